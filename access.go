@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// Roles held by users in the users table
+const (
+	RolePatient = "Patient"
+	RoleDoctor  = "Doctor"
+	RoleAdmin   = "Admin"
+)
+
+// Access declares who may call a route
+type Access struct {
+	// Public routes can be called without a session
+	Public bool
+	// Roles may call the route; any logged in user may when empty
+	Roles []string
+	// Owner names the route variable holding the UUID of the user the
+	// resource belongs to, who may call the route whatever their role.
+	// Patient accounts share the UUID of their patient entry.
+	Owner string
+	// Enroll routes stay open to users whose role requires two-factor
+	// authentication before they have enabled it
+	Enroll bool
+	// Scope lets API keys granted it call the route; routes without one
+	// refuse API keys
+	Scope string
+}
+
+var (
+	public   = Access{Public: true}
+	loggedIn = Access{}
+	doctors  = Access{Roles: []string{RoleDoctor}}
+	admins   = Access{Roles: []string{RoleAdmin}}
+	// enrolling is for logged in users setting up two-factor authentication
+	enrolling = Access{Enroll: true}
+)
+
+// doctorsOrOwner lets doctors and the user named by the route variable in
+func doctorsOrOwner(variable string) Access {
+	return Access{Roles: []string{RoleDoctor}, Owner: variable}
+}
+
+// adminsOrOwner lets admins and the user named by the route variable in, for
+// the lists of a doctor that other doctors may not read
+func adminsOrOwner(variable string) Access {
+	return Access{Roles: []string{RoleAdmin}, Owner: variable}
+}
+
+// withScope returns a also open to API keys granted scope
+func (a Access) withScope(scope string) Access {
+	a.Scope = scope
+	return a
+}
+
+// allows reports whether p may call a route with the given route variables
+func (a Access) allows(p Principal, vars map[string]string) bool {
+	if a.Public {
+		return true
+	}
+	if p.APIKey {
+		return a.Scope != "" && (APIKey{Scopes: p.Scopes}).hasScope(a.Scope)
+	}
+	if a.Owner != "" && vars[a.Owner] == p.UserUUID.String() {
+		return true
+	}
+	if len(a.Roles) == 0 {
+		return true
+	}
+	for _, role := range a.Roles {
+		if p.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize serves inner only to callers allowed by access, answering
+// 403 Forbidden otherwise. Callers whose role requires two-factor
+// authentication and who logged in without it may only call Enroll routes.
+// It must run after Authenticate.
+func (s *Server) Authorize(inner http.Handler, name string, access Access) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, found := principalFrom(r.Context())
+		if !access.allows(principal, mux.Vars(r)) {
+			requestLogger(r).Info("Access denied", "route", name, "role", principal.Role)
+			s.writeStatus(w, r, http.StatusForbidden, "Forbidden")
+			return
+		}
+		if found && !access.Public && !access.Enroll && !principal.TwoFactor &&
+			s.requiresTwoFactor(principal.Role) {
+			requestLogger(r).Info("Access denied without two-factor authentication", "route", name,
+				"role", principal.Role)
+			s.writeStatus(w, r, http.StatusForbidden,
+				"Two-factor authentication must be enabled for your role")
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// canReadPatient reports whether the caller of r may read the records of the
+// patient, for handlers whose route does not name the patient. API keys were
+// checked for the scope of the route already.
+func canReadPatient(r *http.Request, patientUUID gocql.UUID) bool {
+	principal, _ := principalFrom(r.Context())
+	return principal.Role == RoleDoctor || principal.APIKey || principal.UserUUID == patientUUID
+}
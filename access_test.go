@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func TestRouteAccess(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewServer(store)
+	own, other := gocql.TimeUUID(), gocql.TimeUUID()
+	patient := UserAccount{UserUUID: own, Role: RolePatient, Name: "Kelly Lai"}
+	for _, uuid := range []gocql.UUID{own, other} {
+		store.CreatePatient(Patient{PatientUUID: uuid, Name: "Kelly Lai"})
+		store.CreateDocument(Document{DocumentUUID: uuid, PatientUUID: uuid, Filename: "scan.pdf"})
+	}
+
+	tests := []struct {
+		user         UserAccount
+		method, path string
+		body         string
+		code         int
+	}{
+		{patient, "GET", "/patients/patientuuid/" + own.String(), "", http.StatusOK},
+		{patient, "GET", "/patients/patientuuid/" + other.String(), "", http.StatusForbidden},
+		{patient, "GET", "/prescriptions/patientuuid/" + own.String(), "", http.StatusOK},
+		{patient, "GET", "/prescriptions/patientuuid/" + other.String(), "", http.StatusForbidden},
+		{patient, "GET", "/documents/patientuuid/" + own.String(), "", http.StatusOK},
+		{patient, "GET", "/documents/patientuuid/" + other.String(), "", http.StatusForbidden},
+		{patient, "GET", "/documents/documentuuid/" + own.String(), "", http.StatusOK},
+		{patient, "GET", "/documents/documentuuid/" + other.String(), "", http.StatusForbidden},
+		{patient, "GET", "/patients/all", "", http.StatusForbidden},
+		{patient, "GET", "/doctors", "", http.StatusOK},
+		{patient, "POST", "/prescription", `[{"patientUUID": "` + own.String() + `", "drug": "x"}]`, http.StatusForbidden},
+		{patient, "POST", "/completedappointments", `{"patientUUID": "` + own.String() + `"}`, http.StatusForbidden},
+		{testUser, "POST", "/prescription", `[{"patientUUID": "` + own.String() + `", "doctorUUID": "` +
+			testUser.UserUUID.String() + `", "drug": "x"}]`, http.StatusCreated},
+		{testUser, "POST", "/prescription", `[{"patientUUID": "` + own.String() + `", "drug": "y"}]`, http.StatusCreated},
+		{testUser, "POST", "/prescription", `[{"patientUUID": "` + other.String() + `", "doctorUUID": "` +
+			other.String() + `", "drug": "x"}]`, http.StatusForbidden},
+		{testUser, "GET", "/patients/patientuuid/" + other.String(), "", http.StatusOK},
+		{testUser, "POST", "/doctors", `{"name": "Greg House"}`, http.StatusForbidden},
+		{testAdmin, "POST", "/doctors", `{"name": "Greg House"}`, http.StatusCreated},
+		{testAdmin, "GET", "/patients/patientuuid/" + own.String(), "", http.StatusForbidden},
+		{testUser, "GET", "/status", "", http.StatusForbidden},
+		{testUser, "GET", "/appointments/doctoruuid/" + testUser.UserUUID.String(), "", http.StatusNotFound},
+		{testUser, "GET", "/appointments/doctoruuid/" + other.String(), "", http.StatusForbidden},
+		{testUser, "GET", "/patients/doctoruuid/" + other.String(), "", http.StatusForbidden},
+		{testUser, "GET", "/notifications/doctoruuid/" + other.String(), "", http.StatusForbidden},
+		{testAdmin, "GET", "/appointments/doctoruuid/" + other.String(), "", http.StatusNotFound},
+		{testAdmin, "GET", "/users/useruuid/" + testUser.UserUUID.String(), "", http.StatusNotFound},
+		{testAdmin, "POST", "/users", `{"username": "root2", "password": "correct horse", "role": "Admin"}`, http.StatusCreated},
+	}
+	for _, test := range tests {
+		rec := serveServer(s, test.user, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if rec.Code != test.code {
+			t.Errorf("%s %s %s: got %d, want %d", test.user.Role, test.method, test.path, rec.Code, test.code)
+		}
+	}
+
+	// doctors prescribe in their own name
+	prescriptions, err := store.PrescriptionsByPatient(own)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prescriptions) != 2 {
+		t.Errorf("got %d prescriptions, want 2", len(prescriptions))
+	}
+	for _, p := range prescriptions {
+		if p.DoctorUUID != testUser.UserUUID {
+			t.Errorf("prescription of %s by %s, want %s", p.Drug, p.DoctorUUID, testUser.UserUUID)
+		}
+	}
+	if prescriptions, _ := store.PrescriptionsByPatient(other); len(prescriptions) != 0 {
+		t.Errorf("prescription in the name of another doctor was created: %+v", prescriptions)
+	}
+
+	// admin accounts cannot be self registered
+	rec := serveAs(s, nil, httptest.NewRequest("POST", "/users",
+		strings.NewReader(`{"username": "root", "password": "correct horse", "role": "admin"}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("anonymous admin sign up: got %d, want 403", rec.Code)
+	}
+}
+
+func TestSignUpRoles(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreatePatient(Patient{PatientUUID: gocql.TimeUUID(), Name: "No Number"})
+	store.CreatePatient(Patient{PatientUUID: gocql.TimeUUID(), Name: "Kelly Lai", MedicalNumber: "42"})
+	s := NewServer(store)
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"username": "nina", "password": "correct horse", "role": "Nurse"}`, http.StatusBadRequest},
+		{`{"username": "nina", "password": "correct horse"}`, http.StatusBadRequest},
+		{`{"username": "nina", "password": "correct horse", "role": "patient"}`, http.StatusUnauthorized},
+		{`{"username": "kelly", "password": "correct horse", "role": "patient", "verificationKey": "42"}`, http.StatusCreated},
+	}
+	for _, test := range tests {
+		rec := serveAs(s, nil, httptest.NewRequest("POST", "/users", strings.NewReader(test.body)))
+		if rec.Code != test.code {
+			t.Errorf("sign up with %s: got %d, want %d", test.body, rec.Code, test.code)
+		}
+	}
+	if user, err := store.GetUserByUsername("kelly"); err != nil || user.Role != RolePatient || user.Name != "Kelly Lai" {
+		t.Errorf("got user %+v, %v, want the patient Kelly Lai", user, err)
+	}
+}
+
+func TestDocumentUploadDoctorsOnly(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("patientUUID", testUser.UserUUID.String())
+	part, _ := form.CreateFormFile("file", "scan.pdf")
+	part.Write([]byte("%PDF"))
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/documents", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := serveServer(NewServer(NewMemoryStore()), UserAccount{UserUUID: testUser.UserUUID,
+		Role: RolePatient}, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("patient upload: got %d, want 403", rec.Code)
+	}
+}
+
+func TestAddUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emr.db")
+	env := testEnv(map[string]string{"EMR_STORAGE": "sqlite", "EMR_SQLITE_PATH": path})
+	var out bytes.Buffer
+	if err := runAddUser([]string{"-username", "root", "-name", "Site Admin"}, env,
+		strings.NewReader("s3cret passphrase\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if err := runAddUser([]string{"-username", "root"}, env, strings.NewReader("other passphrase\n"), &out); err == nil {
+		t.Error("expected an error adding an existing user")
+	}
+
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	user, err := store.GetUserByUsername("root")
+	if err != nil || user.Role != RoleAdmin || checkPassword(user, "s3cret passphrase") != nil {
+		t.Errorf("admin not created with its password: %+v %v", user, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// PatientAccess is a request of staff concerning the records of a patient,
+// as shown to that patient. Unlike the audit event it comes from, it leaves
+// out where the request came from.
+type PatientAccess struct {
+	OccurredAt time.Time  `json:"occurredAt"`
+	ActorUUID  gocql.UUID `json:"actorUUID"`
+	ActorRole  string     `json:"actorRole"`
+	// ActorName is empty when the actor no longer exists
+	ActorName    string     `json:"actorName"`
+	Action       string     `json:"action"`
+	ResourceType string     `json:"resourceType"`
+	ResourceUUID gocql.UUID `json:"resourceUUID"`
+	Outcome      string     `json:"outcome"`
+}
+
+// PatientAccessPage is a page of accesses, newest first. Next is the before
+// value of the following page, zero on the last one.
+type PatientAccessPage struct {
+	Accesses []PatientAccess `json:"accesses"`
+	Next     int64           `json:"next,omitempty"`
+}
+
+// actorName returns the name of the staff member or API key of an audit
+// event: that of their doctor entry, else of their account
+func (s *Server) actorName(e AuditEvent) (string, error) {
+	if e.ActorRole == ActorRoleAPIKey {
+		apiKey, err := s.APIKeys.GetAPIKey(e.ActorUUID)
+		if err == ErrNotFound {
+			return "", nil
+		}
+		return apiKey.Name, err
+	}
+	doctor, err := s.Doctors.GetDoctor(e.ActorUUID)
+	if err == nil {
+		return doctor.Name, nil
+	}
+	if err != ErrNotFound {
+		return "", err
+	}
+	// admins have no doctor entry
+	user, err := s.Users.GetUserByUUID(e.ActorUUID)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	return user.Name, err
+}
+
+/*
+Returns the requests of doctors, admins and API keys concerning the records
+of a patient, refused ones included, newest first and paged with before and
+limit
+Method: GET
+Endpoint: /patients/patientuuid/{patientuuid}/accesses?before={seq}&limit={limit}
+*/
+func (s *Server) PatientAccessesGet(w http.ResponseWriter, r *http.Request) {
+	patientUUID, err := gocql.ParseUUID(mux.Vars(r)["patientuuid"])
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
+	}
+	q := AuditQuery{PatientUUID: patientUUID, StaffOnly: true}
+	if !s.auditQuery(w, r, &q) {
+		return
+	}
+	events, err := s.AuditTrail.AuditEvents(q)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	page := PatientAccessPage{Accesses: []PatientAccess{},
+		Next: newAuditPage(events, q.Limit).Next}
+	names := map[gocql.UUID]string{}
+	for _, e := range events {
+		name, found := names[e.ActorUUID]
+		if !found {
+			if name, err = s.actorName(e); err != nil {
+				s.internalError(w, r, err)
+				return
+			}
+			names[e.ActorUUID] = name
+		}
+		page.Accesses = append(page.Accesses, PatientAccess{OccurredAt: e.OccurredAt,
+			ActorUUID: e.ActorUUID, ActorRole: e.ActorRole, ActorName: name, Action: e.Action,
+			ResourceType: e.ResourceType, ResourceUUID: e.ResourceUUID, Outcome: e.Outcome})
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Println(err)
+	}
+}
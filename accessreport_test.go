@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+// patientAccesses returns the accesses to the records of kelly listed to her
+func patientAccesses(t *testing.T, s *Server, query string) PatientAccessPage {
+	req := httptest.NewRequest("GET", "/patients/patientuuid/"+testUser.UserUUID.String()+"/accesses"+query, nil)
+	rec := serveServer(s, UserAccount{UserUUID: testUser.UserUUID, Role: RolePatient}, req)
+	var page PatientAccessPage
+	if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&page) != nil {
+		t.Fatalf("GET %s: got %d, want 200 with accesses: %s", req.URL, rec.Code, rec.Body)
+	}
+	return page
+}
+
+func TestPatientAccesses(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	cookie := login(t, s)
+	kelly := "/patients/patientuuid/" + testUser.UserUUID.String()
+	doctor := UserAccount{UserUUID: testAdmin.UserUUID, Role: RoleDoctor}
+	s.Doctors.CreateDoctor(Doctor{DoctorUUID: doctor.UserUUID, Name: "Dr. Ines Park"})
+
+	// her own and anonymous requests are no staff accesses
+	serveAs(s, cookie, httptest.NewRequest("GET", kelly, nil))
+	serveAs(s, nil, httptest.NewRequest("GET", kelly, nil))
+	// nor are those of self-registered accounts of other roles
+	for _, role := range []string{"Nurse", "patient"} {
+		serveServer(s, UserAccount{UserUUID: gocql.TimeUUID(), Role: role}, httptest.NewRequest("GET", kelly, nil))
+	}
+	if got := patientAccesses(t, s, "").Accesses; len(got) != 0 {
+		t.Fatalf("got accesses %+v, want none", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		serveServer(s, doctor, httptest.NewRequest("GET", kelly, nil))
+	}
+	serveServer(s, doctor, httptest.NewRequest("GET", "/documents/patientuuid/"+testUser.UserUUID.String(), nil))
+	serveServer(s, doctor, httptest.NewRequest("GET", "/patients/patientuuid/"+testAdmin.UserUUID.String(), nil))
+	page := patientAccesses(t, s, "?limit=3")
+	if len(page.Accesses) != 3 || page.Next == 0 {
+		t.Fatalf("got page %+v, want 3 accesses and more", page)
+	}
+	a := page.Accesses[0]
+	if a.Action != "DocumentListGetByPatient" || a.ActorUUID != doctor.UserUUID || a.ActorRole != RoleDoctor ||
+		a.ActorName != "Dr. Ines Park" || a.Outcome != OutcomeSuccess {
+		t.Errorf("unexpected access %+v", a)
+	}
+	if rest := patientAccesses(t, s, "?limit=3&before="+strconv.FormatInt(page.Next, 10)); len(rest.Accesses) != 1 || rest.Next != 0 {
+		t.Errorf("got last page %+v, want 1 access", rest)
+	}
+
+	other := "/patients/patientuuid/" + doctor.UserUUID.String() + "/accesses"
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", other, nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("accesses of another patient: got %d, want 403", rec.Code)
+	}
+	if rec := serveServer(s, doctor, httptest.NewRequest("GET", kelly+"/accesses", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("accesses read by a doctor: got %d, want 403", rec.Code)
+	}
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("GET", kelly+"/accesses", nil)); rec.Code != http.StatusOK {
+		t.Errorf("accesses read by an admin: got %d, want 200", rec.Code)
+	}
+}
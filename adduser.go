@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+// runAddUser implements the adduser subcommand, which creates a user of any
+// role directly in the configured store, e.g. the first Admin. The password
+// is read from the first line of in.
+//
+//	go-rest adduser -username admin -name "Site Admin" [-role Admin] [config flags] < password
+func runAddUser(args []string, lookupEnv func(string) (string, bool), in io.Reader, out io.Writer) error {
+	c := DefaultConfig()
+	fs := c.flagSet("go-rest adduser")
+	username := fs.String("username", "", "username of the new user")
+	name := fs.String("name", "", "display name of the new user")
+	role := fs.String("role", RoleAdmin, "role of the new user")
+	email := fs.String("email", "", "email address receiving password reset links")
+	if err := c.load(fs, args, lookupEnv); err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("adduser: -username is required")
+	}
+	if c.Storage == "memory" {
+		return errors.New("adduser: memory storage does not persist users")
+	}
+
+	password, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if password = strings.TrimRight(password, "\r\n"); password == "" {
+		return errors.New("adduser: expected the password on standard input")
+	}
+
+	var breached BreachedPasswords
+	if c.Password.BreachedList != "" {
+		if breached, err = LoadBreachedPasswords(c.Password.BreachedList); err != nil {
+			return err
+		}
+	}
+	if problem := passwordProblem(c.Password, breached, *username, password); problem != "" {
+		return errors.New("adduser: " + problem)
+	}
+
+	store, err := OpenStore(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	userUUID, err := gocql.RandomUUID()
+	if err != nil {
+		return err
+	}
+	salt, saltedHash, err := hashPassword(c.Password, password)
+	if err != nil {
+		return err
+	}
+	err = store.CreateUser(UserAccount{Username: *username, Salt: salt, SaltedHash: saltedHash,
+		UserUUID: userUUID, Role: *role, Name: *name, Email: *email})
+	if err == ErrExists {
+		return fmt.Errorf("adduser: user %s already exists", *username)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Created %s user %s (%s)\n", *role, *username, userUUID)
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// apiKeyPrefix starts every API key, making leaked keys easy to scan for
+const apiKeyPrefix = "emrk_"
+
+// apiKeyTouchInterval is how often the last use of a key is written, so
+// busy clients do not cause a write per request
+const apiKeyTouchInterval = time.Minute
+
+// apiKeyScopes are the scopes an API key may be granted. A route accepts
+// API keys only if it declares one of them.
+var apiKeyScopes = []string{
+	"appointments:read", "appointments:write",
+	"documents:read", "documents:write",
+	"doctors:read",
+	"metrics:read",
+	"notifications:read", "notifications:write",
+	"patients:read", "patients:write",
+	"prescriptions:read", "prescriptions:write",
+}
+
+// APIKey is an apiKeys table entry, the credential of a machine client such
+// as a lab system. Only the SHA-256 of its secret is stored.
+type APIKey struct {
+	KeyUUID    gocql.UUID `json:"keyUUID"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	SecretHash string     `json:"-"`
+	CreatedBy  gocql.UUID `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// NewAPIKey is returned once, when the key is created
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// valid reports whether the key may be used at now
+func (k APIKey) valid(now time.Time) bool {
+	return k.RevokedAt == nil && now.Before(k.ExpiresAt)
+}
+
+func (k APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAPIKey splits a key of the form emrk_<keyUUID>_<secret>
+func parseAPIKey(key string) (gocql.UUID, string, bool) {
+	rest, found := strings.CutPrefix(key, apiKeyPrefix)
+	if !found {
+		return gocql.UUID{}, "", false
+	}
+	id, secret, found := strings.Cut(rest, "_")
+	if !found || secret == "" {
+		return gocql.UUID{}, "", false
+	}
+	keyUUID, err := gocql.ParseUUID(id)
+	if err != nil {
+		return gocql.UUID{}, "", false
+	}
+	return keyUUID, secret, true
+}
+
+// apiKeyHeader returns the key of an "Authorization: ApiKey" header
+func apiKeyHeader(r *http.Request) (string, bool) {
+	scheme, key, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "ApiKey") {
+		return "", false
+	}
+	return strings.TrimSpace(key), true
+}
+
+// authenticateAPIKey serves inner to the client of a valid API key. Like
+// bearer tokens, invalid keys are refused even on optional routes.
+func (s *Server) authenticateAPIKey(inner http.Handler, w http.ResponseWriter, r *http.Request, key string) {
+	refuse := func(reason string) {
+		requestLogger(r).Info("Invalid API key", "reason", reason)
+		w.Header().Set("WWW-Authenticate", "ApiKey")
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid, expired or revoked API key")
+	}
+	keyUUID, secret, ok := parseAPIKey(key)
+	if !ok {
+		refuse("malformed")
+		return
+	}
+	apiKey, err := s.APIKeys.GetAPIKey(keyUUID)
+	if err == ErrNotFound {
+		refuse("unknown")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(apiKey.SecretHash)) != 1 {
+		refuse("wrong secret")
+		return
+	}
+	now := time.Now()
+	if !apiKey.valid(now) {
+		refuse("expired or revoked")
+		return
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.APIKeys.TouchAPIKey(keyUUID, now); err != nil {
+			requestLogger(r).Error("Unable to record API key use", "error", err)
+		}
+	}
+	inner.ServeHTTP(w, withPrincipal(r, Principal{UserUUID: apiKey.KeyUUID, Name: apiKey.Name,
+		APIKey: true, Scopes: apiKey.Scopes}))
+}
+
+// apiKeyRequest is the body of POST /apikeys
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresAt defaults to the longest lifetime allowed
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+/*
+Creates an API key with the given name, scopes and optional expiry. The key
+is only returned in this response.
+Method: POST
+Endpoint: /apikeys
+*/
+func (s *Server) APIKeyCreate(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.badRequest(w, r, "Invalid JSON in request body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		s.badRequest(w, r, "An API key needs a name")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		s.badRequest(w, r, "An API key needs at least one scope")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !(APIKey{Scopes: apiKeyScopes}).hasScope(scope) {
+			s.badRequest(w, r, "Unknown scope "+scope)
+			return
+		}
+	}
+	now := time.Now()
+	expiresAt := now.Add(s.APIKeyMaxTTL)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) || req.ExpiresAt.After(expiresAt) {
+			s.badRequest(w, r, "Expiry must be in the future and within "+s.APIKeyMaxTTL.String())
+			return
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	apiKey := APIKey{KeyUUID: gocql.TimeUUID(), Name: req.Name, Scopes: req.Scopes,
+		SecretHash: hashToken(secret), CreatedBy: principal.UserUUID, CreatedAt: now,
+		ExpiresAt: expiresAt}
+	if err := s.APIKeys.CreateAPIKey(apiKey); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	auditLog(r, "apikey.created", "API key created", "keyUUID", apiKey.KeyUUID, "name", apiKey.Name,
+		"scopes", strings.Join(apiKey.Scopes, " "), "createdBy", principal.UserUUID,
+		"expiresAt", apiKey.ExpiresAt)
+	s.writeSecretJSON(w, r, http.StatusCreated, NewAPIKey{APIKey: apiKey,
+		Key: apiKeyPrefix + apiKey.KeyUUID.String() + "_" + secret})
+}
+
+/*
+Returns every API key, revoked and expired ones included, without their
+secrets
+Method: GET
+Endpoint: /apikeys
+*/
+func (s *Server) APIKeyListGet(w http.ResponseWriter, r *http.Request) {
+	keyList, err := s.APIKeys.ListAPIKeys()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(keyList); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+Revokes an API key, refusing it from the next request on
+Method: DELETE
+Endpoint: /apikeys/keyuuid/{keyuuid}
+*/
+func (s *Server) APIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	keyUUID, err := gocql.ParseUUID(mux.Vars(r)["keyuuid"])
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
+	}
+	err = s.APIKeys.RevokeAPIKey(keyUUID, time.Now())
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	auditLog(r, "apikey.revoked", "API key revoked", "keyUUID", keyUUID, "revokedBy", principal.UserUUID)
+	s.writeStatus(w, r, http.StatusOK, "API key revoked")
+}
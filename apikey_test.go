@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createAPIKey has an admin create a key with the given JSON request body
+func createAPIKey(t *testing.T, s *Server, body string) NewAPIKey {
+	rec := serveServer(s, testAdmin, httptest.NewRequest("POST", "/apikeys", strings.NewReader(body)))
+	var key NewAPIKey
+	if rec.Code != http.StatusCreated || json.NewDecoder(rec.Body).Decode(&key) != nil {
+		t.Fatalf("create API key: got %d, want 201: %s", rec.Code, rec.Body)
+	}
+	return key
+}
+
+// serveAPIKey sends req through the router of s with key
+func serveAPIKey(s *Server, key string, req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Authorization", "ApiKey "+key)
+	return serveAs(s, nil, req)
+}
+
+func TestAPIKey(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	body := `{"name": "Lab system", "scopes": ["appointments:write", "documents:read"]}`
+	if rec := serveServer(s, testUser, httptest.NewRequest("POST", "/apikeys", strings.NewReader(body))); rec.Code != http.StatusForbidden {
+		t.Errorf("create by a doctor: got %d, want 403", rec.Code)
+	}
+	key := createAPIKey(t, s, body)
+	if !strings.HasPrefix(key.Key, apiKeyPrefix) || key.LastUsedAt != nil {
+		t.Errorf("unexpected new key %+v", key)
+	}
+	if time.Until(key.ExpiresAt) < s.APIKeyMaxTTL-time.Minute {
+		t.Errorf("got expiry %v, want the longest lifetime", key.ExpiresAt)
+	}
+
+	appointment := `{"patientUUID": "` + testUser.UserUUID.String() + `", "dateVisited": 1000}`
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/completedappointments", appointment, http.StatusCreated},
+		{"POST", "/futureappointments", appointment, http.StatusCreated},
+		{"GET", "/documents/patientuuid/" + testUser.UserUUID.String(), "", http.StatusOK},
+		{"GET", "/appointments/patientuuid/" + testUser.UserUUID.String(), "", http.StatusForbidden},
+		{"POST", "/prescription", `[]`, http.StatusForbidden},
+		{"GET", "/apikeys", "", http.StatusForbidden},
+		{"GET", "/", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		rec := serveAPIKey(s, key.Key, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if rec.Code != test.code {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.path, rec.Code, test.code)
+		}
+	}
+	if rec := serveAPIKey(s, key.Key+"x", httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: got %d, want 401", rec.Code)
+	}
+
+	rec := serveServer(s, testAdmin, httptest.NewRequest("GET", "/apikeys", nil))
+	var keyList []APIKey
+	if err := json.NewDecoder(rec.Body).Decode(&keyList); err != nil {
+		t.Fatal(err)
+	}
+	if len(keyList) != 1 || keyList[0].LastUsedAt == nil || strings.Contains(rec.Body.String(), key.Key) {
+		t.Errorf("got key list %+v, want the key with its last use", keyList)
+	}
+
+	revoke := "/apikeys/keyuuid/" + key.KeyUUID.String()
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("DELETE", revoke, nil)); rec.Code != http.StatusOK {
+		t.Fatalf("revoke: got %d, want 200", rec.Code)
+	}
+	if rec := serveAPIKey(s, key.Key, httptest.NewRequest("POST", "/completedappointments", strings.NewReader(appointment))); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: got %d, want 401", rec.Code)
+	}
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	tests := []string{
+		`{"name": "Kiosk", "scopes": ["appointments:write"], "expiresAt": "2001-01-01T00:00:00Z"}`,
+		`{"name": "Kiosk", "scopes": ["appointments:write"], "expiresAt": "` +
+			time.Now().Add(s.APIKeyMaxTTL+time.Hour).Format(time.RFC3339) + `"}`,
+		`{"name": "Kiosk", "scopes": ["users:write"]}`,
+		`{"name": "Kiosk", "scopes": []}`,
+		`{"scopes": ["appointments:write"]}`,
+	}
+	for _, body := range tests {
+		if rec := serveServer(s, testAdmin, httptest.NewRequest("POST", "/apikeys", strings.NewReader(body))); rec.Code != http.StatusBadRequest {
+			t.Errorf("create with %s: got %d, want 400", body, rec.Code)
+		}
+	}
+
+	key := createAPIKey(t, s, `{"name": "Kiosk", "scopes": ["doctors:read"], "expiresAt": "`+
+		time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`)
+	stored, err := s.APIKeys.GetAPIKey(key.KeyUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := s.APIKeys.CreateAPIKey(stored); err != nil {
+		t.Fatal(err)
+	}
+	if rec := serveAPIKey(s, key.Key, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired key: got %d, want 401", rec.Code)
+	}
+}
+
+func TestRouteScopes(t *testing.T) {
+	for _, route := range newRoutes(NewServer(NewMemoryStore())) {
+		if scope := route.Access.Scope; scope != "" && !(APIKey{Scopes: apiKeyScopes}).hasScope(scope) {
+			t.Errorf("route %s has unknown scope %s", route.Name, scope)
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// Outcomes of audited requests
+const (
+	OutcomeSuccess = "success"
+	// OutcomeDenied is for requests refused with 401 or 403
+	OutcomeDenied  = "denied"
+	OutcomeFailure = "failure"
+)
+
+// auditAppendAttempts bounds the retries of an append racing with another
+// instance for the same sequence number
+const auditAppendAttempts = 5
+
+// auditPageSize and auditMaxPageSize are the default and largest number of
+// events returned by one query
+const (
+	auditPageSize    = 100
+	auditMaxPageSize = 1000
+)
+
+// ActorRoleAPIKey is the actor role of requests made with an API key
+const ActorRoleAPIKey = "APIKey"
+
+// staffRoles are the actor roles of clinic staff and their systems
+var staffRoles = []string{RoleDoctor, RoleAdmin, ActorRoleAPIKey}
+
+// unaudited are the routes left out of the audit trail, the probes and
+// scrapes called every few seconds that touch no records
+var unaudited = map[string]bool{"Healthz": true, "Readyz": true, "Metrics": true}
+
+// auditResourceVars maps the route variables naming a resource to its type
+var auditResourceVars = map[string]string{
+	"patientuuid":     "patient",
+	"appointmentuuid": "appointment",
+	"documentuuid":    "document",
+	"doctoruuid":      "doctor",
+	"useruuid":        "user",
+	"keyuuid":         "apikey",
+}
+
+// AuditEvent is an auditEvents table entry, recording one request. Events
+// form a hash chain: each holds the hash of the one before it, so that
+// editing or removing an event breaks the chain from there on.
+type AuditEvent struct {
+	Seq        int64     `json:"seq"`
+	OccurredAt time.Time `json:"occurredAt"`
+	// ActorUUID is the user or API key making the request, zero when
+	// anonymous
+	ActorUUID gocql.UUID `json:"actorUUID"`
+	ActorRole string     `json:"actorRole"`
+	// Action is the name of the route called
+	Action       string     `json:"action"`
+	ResourceType string     `json:"resourceType"`
+	ResourceUUID gocql.UUID `json:"resourceUUID"`
+	// PatientUUID is the patient whose records were concerned, zero when none
+	PatientUUID gocql.UUID `json:"patientUUID"`
+	Outcome     string     `json:"outcome"`
+	Status      int        `json:"status"`
+	SourceIP    string     `json:"sourceIP"`
+	RequestID   string     `json:"requestID"`
+	PrevHash    string     `json:"prevHash"`
+	Hash        string     `json:"hash"`
+}
+
+// auditEventColumns are the columns of the auditEvents table in both
+// stores, in the order of AuditEvent
+const auditEventColumns = `seq, occurredAt, actorUUID, actorRole, action, resourceType,
+	resourceUUID, patientUUID, outcome, status, sourceIP, requestID, prevHash, hash`
+
+// chainHash returns the SHA-256 of e with its hash left out, covering the
+// hash of the previous event
+func (e AuditEvent) chainHash() string {
+	e.Hash = ""
+	e.OccurredAt = e.OccurredAt.UTC()
+	b, _ := json.Marshal(e)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditQuery selects audit events, zero fields matching any event
+type AuditQuery struct {
+	PatientUUID gocql.UUID
+	ActorUUID   gocql.UUID
+	// From is inclusive, To exclusive
+	From, To time.Time
+	// BeforeSeq returns the events older than this one, for the next page
+	BeforeSeq int64
+	Limit     int
+	// StaffOnly selects the requests of staffRoles only
+	StaffOnly bool
+}
+
+// matches reports whether e is selected by q, ignoring its limit
+func (q AuditQuery) matches(e AuditEvent) bool {
+	var zero gocql.UUID
+	return (q.PatientUUID == zero || e.PatientUUID == q.PatientUUID) &&
+		(q.ActorUUID == zero || e.ActorUUID == q.ActorUUID) &&
+		(q.From.IsZero() || !e.OccurredAt.Before(q.From)) &&
+		(q.To.IsZero() || e.OccurredAt.Before(q.To)) &&
+		(q.BeforeSeq == 0 || e.Seq < q.BeforeSeq) &&
+		(!q.StaffOnly || isStaffRole(e.ActorRole))
+}
+
+func isStaffRole(role string) bool {
+	for _, staffRole := range staffRoles {
+		if role == staffRole {
+			return true
+		}
+	}
+	return false
+}
+
+// auditRecord collects what the handlers know about the request being
+// audited
+type auditRecord struct {
+	actorRole    string
+	resourceType string
+	resourceUUID gocql.UUID
+	patientUUIDs []gocql.UUID
+}
+
+type auditRecordKey struct{}
+
+func auditRecordFrom(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return rec
+}
+
+// auditResource records the resource a request acted on, for routes whose
+// variables do not name it
+func auditResource(r *http.Request, resourceType string, resourceUUID gocql.UUID) {
+	if rec := auditRecordFrom(r.Context()); rec != nil {
+		rec.resourceType, rec.resourceUUID = resourceType, resourceUUID
+	}
+}
+
+// auditPatients records the patients whose records a request concerned, for
+// routes whose variables do not name them. A request concerning several
+// patients is recorded as one event per patient.
+func auditPatients(r *http.Request, patientUUIDs ...gocql.UUID) {
+	rec := auditRecordFrom(r.Context())
+	if rec == nil {
+		return
+	}
+	var zero gocql.UUID
+next:
+	for _, patientUUID := range patientUUIDs {
+		for _, recorded := range rec.patientUUIDs {
+			if patientUUID == recorded {
+				continue next
+			}
+		}
+		if patientUUID != zero {
+			rec.patientUUIDs = append(rec.patientUUIDs, patientUUID)
+		}
+	}
+}
+
+// setAuditActor records the role of the authenticated caller of r
+func setAuditActor(r *http.Request, p Principal) {
+	if rec := auditRecordFrom(r.Context()); rec != nil {
+		rec.actorRole = p.Role
+		if p.APIKey {
+			rec.actorRole = ActorRoleAPIKey
+		}
+	}
+}
+
+// sourceIP returns the client IP of r
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Audit appends an event to the audit trail for every request served by
+// inner, once it has been answered. It must run outside Authenticate, so
+// that refused requests are recorded too, and inside Logger.
+func (s *Server) Audit(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &auditRecord{}
+		status := &statusRecorder{ResponseWriter: w}
+		inner.ServeHTTP(status, r.WithContext(context.WithValue(r.Context(), auditRecordKey{}, rec)))
+
+		e := AuditEvent{OccurredAt: time.Now().UTC().Truncate(time.Millisecond),
+			ActorRole: rec.actorRole, Action: name, ResourceType: rec.resourceType,
+			ResourceUUID: rec.resourceUUID, Status: status.status, SourceIP: sourceIP(r)}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			e.RequestID = info.ID
+			e.ActorUUID, _ = gocql.ParseUUID(info.UserID)
+		}
+		for variable, value := range mux.Vars(r) {
+			resourceType, found := auditResourceVars[variable]
+			resourceUUID, err := gocql.ParseUUID(value)
+			if !found || err != nil || e.ResourceType != "" {
+				continue
+			}
+			e.ResourceType, e.ResourceUUID = resourceType, resourceUUID
+		}
+		patients := rec.patientUUIDs
+		if patientUUID, err := gocql.ParseUUID(mux.Vars(r)["patientuuid"]); err == nil && len(patients) == 0 {
+			patients = []gocql.UUID{patientUUID}
+		}
+		switch {
+		case e.Status == 0:
+			e.Status = http.StatusOK
+			e.Outcome = OutcomeSuccess
+		case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden:
+			e.Outcome = OutcomeDenied
+		case e.Status >= http.StatusBadRequest:
+			e.Outcome = OutcomeFailure
+		default:
+			e.Outcome = OutcomeSuccess
+		}
+
+		events := []AuditEvent{e}
+		if len(patients) > 0 {
+			events = events[:0]
+			for _, patientUUID := range patients {
+				e.PatientUUID = patientUUID
+				events = append(events, e)
+			}
+		}
+		if err := s.appendAudit(events...); err != nil {
+			// the response is gone, the event is kept in the log at least
+			requestLogger(r).Error("Unable to append to the audit trail", "error", err,
+				"action", e.Action, "actorID", e.ActorUUID, "patientUUIDs", patients,
+				"outcome", e.Outcome)
+		}
+	})
+}
+
+// appendAudit chains events to the newest event and appends them at once
+func (s *Server) appendAudit(events ...AuditEvent) error {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		if s.auditHead == nil {
+			last, err := s.AuditTrail.LastAuditEvent()
+			if err != nil && err != ErrNotFound {
+				return err
+			}
+			s.auditHead = &last
+		}
+		chained := s.chainAudit(events)
+		err := s.AuditTrail.AppendAuditEvents(chained)
+		if err == nil {
+			s.auditHead = &chained[len(chained)-1]
+			return nil
+		}
+		// the head is stale, or unknown after a failed append
+		s.auditHead = nil
+		if err != ErrExists || attempt == auditAppendAttempts {
+			return err
+		}
+	}
+}
+
+// chainAudit returns events chained after the newest event, which is kept
+// between appends and read again when another instance appended first. The
+// caller holds auditMu.
+func (s *Server) chainAudit(events []AuditEvent) []AuditEvent {
+	chained := make([]AuditEvent, len(events))
+	last := *s.auditHead
+	for i, e := range events {
+		e.Seq, e.PrevHash = last.Seq+1, last.Hash
+		// times never decrease along the chain, whatever the clocks of
+		// other instances, so that stores can stop reading at a date
+		if e.OccurredAt.Before(last.OccurredAt) {
+			e.OccurredAt = last.OccurredAt
+		}
+		e.Hash = e.chainHash()
+		chained[i], last = e, e
+	}
+	return chained
+}
+
+// parseAuditTime reads a from or to query value, an RFC 3339 time or a
+// date. A date as the end of a range includes that day.
+func parseAuditTime(value string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// auditQuery reads the paging parameters of r, before and limit, into q.
+// It answers the request itself and returns false when they are invalid.
+func (s *Server) auditQuery(w http.ResponseWriter, r *http.Request, q *AuditQuery) bool {
+	query := r.URL.Query()
+	q.Limit = auditPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > auditMaxPageSize {
+			s.badRequest(w, r, "limit must be between 1 and "+strconv.Itoa(auditMaxPageSize))
+			return false
+		}
+		q.Limit = limit
+	}
+	if value := query.Get("before"); value != "" {
+		before, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || before < 1 {
+			s.badRequest(w, r, "Invalid before")
+			return false
+		}
+		q.BeforeSeq = before
+	}
+	return true
+}
+
+// AuditPage is a page of audit events, newest first. Next is the before
+// value of the following page, zero on the last one.
+type AuditPage struct {
+	Events []AuditEvent `json:"events"`
+	Next   int64        `json:"next,omitempty"`
+}
+
+// newAuditPage pages events, queried with limit
+func newAuditPage(events []AuditEvent, limit int) AuditPage {
+	page := AuditPage{Events: events}
+	if len(events) == limit {
+		page.Next = events[len(events)-1].Seq
+	}
+	return page
+}
+
+/*
+Returns the audit events of a patient, of an actor and within a date range,
+each filter being optional, newest first and paged with before and limit
+Method: GET
+Endpoint: /audit?patientUUID={patientUUID}&actorUUID={actorUUID}&from={from}&to={to}&before={seq}&limit={limit}
+*/
+func (s *Server) AuditEventsGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var q AuditQuery
+	var err error
+	if value := query.Get("patientUUID"); value != "" {
+		if q.PatientUUID, err = gocql.ParseUUID(value); err != nil {
+			s.badRequest(w, r, "Invalid patientUUID")
+			return
+		}
+	}
+	if value := query.Get("actorUUID"); value != "" {
+		if q.ActorUUID, err = gocql.ParseUUID(value); err != nil {
+			s.badRequest(w, r, "Invalid actorUUID")
+			return
+		}
+	}
+	if value := query.Get("from"); value != "" {
+		if q.From, err = parseAuditTime(value, false); err != nil {
+			s.badRequest(w, r, "Invalid from, expected e.g. 2024-01-31 or 2024-01-31T09:30:00Z")
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if q.To, err = parseAuditTime(value, true); err != nil {
+			s.badRequest(w, r, "Invalid to, expected e.g. 2024-01-31 or 2024-01-31T09:30:00Z")
+			return
+		}
+	}
+	if !s.auditQuery(w, r, &q) {
+		return
+	}
+
+	events, err := s.AuditTrail.AuditEvents(q)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(newAuditPage(events, q.Limit)); err != nil {
+		log.Println(err)
+	}
+}
+
+// AuditVerification is the result of checking the audit trail. BrokenAt is
+// the newest event whose hash or link to the one before it is wrong.
+type AuditVerification struct {
+	Valid    bool  `json:"valid"`
+	Events   int64 `json:"events"`
+	BrokenAt int64 `json:"brokenAt,omitempty"`
+}
+
+// verifyAuditTrail checks the hash chain from the newest event back to the
+// first
+func (s *Server) verifyAuditTrail() (AuditVerification, error) {
+	result := AuditVerification{Valid: true}
+	var newer *AuditEvent
+	q := AuditQuery{Limit: auditMaxPageSize}
+	for {
+		events, err := s.AuditTrail.AuditEvents(q)
+		if err != nil {
+			return AuditVerification{}, err
+		}
+		for i := range events {
+			e := &events[i]
+			result.Events++
+			if e.Hash != e.chainHash() {
+				return AuditVerification{Events: result.Events, BrokenAt: e.Seq}, nil
+			}
+			if newer != nil && (newer.Seq != e.Seq+1 || newer.PrevHash != e.Hash) {
+				return AuditVerification{Events: result.Events, BrokenAt: newer.Seq}, nil
+			}
+			newer = e
+		}
+		if len(events) < q.Limit {
+			break
+		}
+		q.BeforeSeq = events[len(events)-1].Seq
+	}
+	// the first event starts the chain
+	if newer != nil && (newer.Seq != 1 || newer.PrevHash != "") {
+		return AuditVerification{Events: result.Events, BrokenAt: newer.Seq}, nil
+	}
+	return result, nil
+}
+
+/*
+Checks that no audit event was changed or removed, by following the hash
+chain from the newest event back to the first
+Method: GET
+Endpoint: /audit/verify
+*/
+func (s *Server) AuditVerify(w http.ResponseWriter, r *http.Request) {
+	result, err := s.verifyAuditTrail()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if !result.Valid {
+		auditLog(r, "audit.chain_broken", "Audit trail hash chain broken", "brokenAt", result.BrokenAt)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(err)
+	}
+}
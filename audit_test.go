@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// auditPage returns the audit events listed to an admin at path
+func auditPage(t *testing.T, s *Server, path string) AuditPage {
+	rec := serveServer(s, testAdmin, httptest.NewRequest("GET", path, nil))
+	var page AuditPage
+	if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&page) != nil {
+		t.Fatalf("GET %s: got %d, want 200 with events: %s", path, rec.Code, rec.Body)
+	}
+	return page
+}
+
+func TestAuditTrail(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	s := NewServer(store)
+	cookie := login(t, s)
+	kelly := testUser.UserUUID.String()
+	other := gocql.TimeUUID()
+	store.CreatePatient(Patient{PatientUUID: other, Name: "Joey Kapow"})
+
+	if rec := serveServer(s, testUser, httptest.NewRequest("GET", "/patients/patientuuid/"+kelly, nil)); rec.Code != http.StatusOK {
+		t.Fatalf("patient read by a doctor: got %d, want 200", rec.Code)
+	}
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", "/patients/patientuuid/"+other.String(), nil)); rec.Code != http.StatusForbidden {
+		t.Fatalf("read of another patient: got %d, want 403", rec.Code)
+	}
+	if rec := serveServer(s, testUser, httptest.NewRequest("GET", "/audit", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("audit query by a doctor: got %d, want 403", rec.Code)
+	}
+
+	events := auditPage(t, s, "/audit?patientUUID="+other.String()).Events
+	if len(events) != 1 {
+		t.Fatalf("got events %+v, want the refused read", events)
+	}
+	e := events[0]
+	if e.Action != "PatientGet" || e.ActorUUID != testUser.UserUUID || e.ActorRole != RolePatient ||
+		e.ResourceType != "patient" || e.ResourceUUID != other || e.Outcome != OutcomeDenied ||
+		e.Status != http.StatusForbidden || e.SourceIP != "192.0.2.1" || e.RequestID == "" {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	events = auditPage(t, s, "/audit?actorUUID="+kelly).Events
+	if len(events) < 3 || events[0].Action != "AuditEventsGet" || events[0].Outcome != OutcomeDenied {
+		t.Errorf("got events %+v of the doctor, newest first", events)
+	}
+	found := false
+	for _, e := range events {
+		if e.Action == "PatientGet" && e.PatientUUID == testUser.UserUUID && e.Outcome == OutcomeSuccess {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("got events %+v, want the read by the doctor", events)
+	}
+
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format("2006-01-02")
+	today := time.Now().UTC().Format("2006-01-02")
+	if got := auditPage(t, s, "/audit?from="+tomorrow).Events; len(got) != 0 {
+		t.Errorf("events from tomorrow: got %d, want none", len(got))
+	}
+	all := auditPage(t, s, "/audit?from="+today+"&to="+today).Events
+	if len(all) < 5 {
+		t.Errorf("events of today: got %d, want all", len(all))
+	}
+	page := auditPage(t, s, "/audit?limit=2")
+	next := auditPage(t, s, "/audit?limit=2&before="+strconv.FormatInt(page.Next, 10))
+	if len(page.Events) != 2 || len(next.Events) != 2 || next.Events[0].Seq != page.Events[1].Seq-1 {
+		t.Errorf("got pages %+v and %+v", page, next)
+	}
+	for _, path := range []string{"/audit?limit=0", "/audit?from=yesterday", "/audit?actorUUID=kelly"} {
+		if rec := serveServer(s, testAdmin, httptest.NewRequest("GET", path, nil)); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: got %d, want 400", path, rec.Code)
+		}
+	}
+
+	// the table is append-only
+	if _, err := store.db.Exec(`UPDATE auditEvents SET outcome = 'success' WHERE seq = ?`, e.Seq); err == nil {
+		t.Error("update of an audit event succeeded")
+	}
+	if _, err := store.db.Exec(`DELETE FROM auditEvents`); err == nil {
+		t.Error("delete of audit events succeeded")
+	}
+}
+
+func TestAuditVerify(t *testing.T) {
+	store := NewMemoryStore()
+	s := NewServer(store)
+	for i := 0; i < 3; i++ {
+		serveServer(s, testUser, httptest.NewRequest("GET", "/doctors", nil))
+	}
+	verify := func() AuditVerification {
+		rec := serveServer(s, testAdmin, httptest.NewRequest("GET", "/audit/verify", nil))
+		var result AuditVerification
+		if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&result) != nil {
+			t.Fatalf("verify: got %d, want 200", rec.Code)
+		}
+		return result
+	}
+	if result := verify(); !result.Valid || result.Events != 3 {
+		t.Errorf("got %+v, want a valid chain of 3 events", result)
+	}
+
+	store.auditEvents[1].Outcome = OutcomeDenied
+	if result := verify(); result.Valid || result.BrokenAt != 2 {
+		t.Errorf("got %+v after editing event 2, want it broken there", result)
+	}
+	store.auditEvents[1].Outcome = OutcomeSuccess
+	store.auditEvents = append(store.auditEvents[:1], store.auditEvents[2:]...)
+	if result := verify(); result.Valid {
+		t.Errorf("got %+v after removing an event, want a broken chain", result)
+	}
+}
+
+func TestAuditTimesNeverDecrease(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, at := range []time.Time{now, now.Add(-time.Minute)} {
+		if err := s.appendAudit(AuditEvent{OccurredAt: at, Action: "Index"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	events, err := s.AuditTrail.AuditEvents(AuditQuery{Limit: 2})
+	if err != nil || len(events) != 2 || !events[0].OccurredAt.Equal(now) {
+		t.Errorf("got events %+v, %v, want both at %v", events, err, now)
+	}
+	if result, err := s.verifyAuditTrail(); err != nil || !result.Valid {
+		t.Errorf("got %+v, %v, want a valid chain", result, err)
+	}
+}
+
+// countingAuditStore counts the reads of the newest event and the appends
+type countingAuditStore struct {
+	AuditStore
+	lastReads, appends int
+}
+
+func (c *countingAuditStore) LastAuditEvent() (AuditEvent, error) {
+	c.lastReads++
+	return c.AuditStore.LastAuditEvent()
+}
+
+func (c *countingAuditStore) AppendAuditEvents(events []AuditEvent) error {
+	c.appends++
+	return c.AuditStore.AppendAuditEvents(events)
+}
+
+func TestAuditHead(t *testing.T) {
+	store := NewMemoryStore()
+	trail := &countingAuditStore{AuditStore: store}
+	s := NewServer(store)
+	s.AuditTrail = trail
+	for _, path := range []string{"/doctors", "/doctors", "/healthz", "/readyz", "/metrics"} {
+		serveServer(s, testUser, httptest.NewRequest("GET", path, nil))
+	}
+	if len(store.auditEvents) != 2 || trail.lastReads != 1 {
+		t.Errorf("got %d events and %d head reads, want 2 without the probes and scrapes and 1",
+			len(store.auditEvents), trail.lastReads)
+	}
+
+	// another instance appends first
+	serveServer(NewServer(store), testUser, httptest.NewRequest("GET", "/doctors", nil))
+	serveServer(s, testUser, httptest.NewRequest("GET", "/doctors", nil))
+	if len(store.auditEvents) != 4 || trail.lastReads != 2 {
+		t.Errorf("got %d events and %d head reads, want 4 and 2", len(store.auditEvents), trail.lastReads)
+	}
+	if result, err := s.verifyAuditTrail(); err != nil || !result.Valid {
+		t.Errorf("got %+v, %v, want a valid chain", result, err)
+	}
+}
+
+func TestAuditPatientLists(t *testing.T) {
+	store := NewMemoryStore()
+	trail := &countingAuditStore{AuditStore: store}
+	s := NewServer(store)
+	s.AuditTrail = trail
+	kelly, joey := gocql.TimeUUID(), gocql.TimeUUID()
+	store.CreatePatient(Patient{PatientUUID: kelly, Name: "Kelly Lai"})
+	store.CreatePatient(Patient{PatientUUID: joey, Name: "Joey Kapow"})
+	if rec := serveServer(s, testUser, httptest.NewRequest("GET", "/patients/all", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("patient list: got %d, want 200", rec.Code)
+	}
+	for _, patientUUID := range []gocql.UUID{kelly, joey} {
+		events, err := store.AuditEvents(AuditQuery{PatientUUID: patientUUID, Limit: 10})
+		if err != nil || len(events) != 1 || events[0].Action != "PatientListGet" {
+			t.Errorf("got events %+v, %v of patient %s, want the list", events, err, patientUUID)
+		}
+	}
+	if len(store.auditEvents) != 2 || store.auditEvents[0].RequestID != store.auditEvents[1].RequestID {
+		t.Errorf("got events %+v, want one per patient of the request", store.auditEvents)
+	}
+	if trail.appends != 1 {
+		t.Errorf("got %d appends, want the events of the request appended at once", trail.appends)
+	}
+	if result, err := s.verifyAuditTrail(); err != nil || !result.Valid {
+		t.Errorf("got %+v, %v, want a valid chain", result, err)
+	}
+}
+
+func TestAuditAppendAllOrNone(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	if err := store.AppendAuditEvents([]AuditEvent{{Seq: 1}, {Seq: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendAuditEvents([]AuditEvent{{Seq: 3}, {Seq: 2}}); err != ErrExists {
+		t.Errorf("append over event 2: got %v, want ErrExists", err)
+	}
+	if last, err := store.LastAuditEvent(); err != nil || last.Seq != 2 {
+		t.Errorf("got newest event %+v, %v, want event 2", last, err)
+	}
+}
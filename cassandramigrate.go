@@ -0,0 +1,432 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// cassandraMigrations are applied in order by the migrate subcommand and
+// recorded in schema_migrations. Statements are separated by semicolons and
+// should be idempotent, as Cassandra cannot roll back a partly applied
+// migration. Never edit a released migration, append a new one instead.
+var cassandraMigrations = []string{
+	// 0001: the schema previously created by cqlsh-setup.cql
+	`CREATE TABLE IF NOT EXISTS patients (
+		patientUUID uuid,
+		dateOfBirth int,
+		gender text,
+		name text,
+		medicalNumber text,
+		bloodType text,
+		emergencyContact text,
+		phone text,
+		address text,
+		notes text,
+		PRIMARY KEY (patientUUID)
+	);
+	CREATE INDEX IF NOT EXISTS patientsMedicalNumber ON patients (medicalNumber);
+
+	CREATE TABLE IF NOT EXISTS completedAppointments (
+		appointmentUUID uuid,
+		patientUUID uuid,
+		doctorUUID uuid,
+		dateVisited int,
+		breathingRate int,
+		heartRate int,
+		bloodOxygenLevel int,
+		bloodPressure int,
+		notes text,
+		PRIMARY KEY (appointmentUUID)
+	);
+	CREATE INDEX IF NOT EXISTS completedAppointmentPatientUUID ON completedAppointments (patientUUID);
+	CREATE INDEX IF NOT EXISTS completedAppointmentDoctorUUID ON completedAppointments (doctorUUID);
+	CREATE INDEX IF NOT EXISTS completedAppointmentDateVisited ON completedAppointments (dateVisited);
+
+	CREATE TABLE IF NOT EXISTS futureAppointments (
+		appointmentUUID uuid,
+		patientUUID uuid,
+		doctorUUID uuid,
+		dateScheduled int,
+		notes text,
+		PRIMARY KEY (appointmentUUID)
+	);
+	CREATE INDEX IF NOT EXISTS futureAppointmentPatientUUID ON futureAppointments (patientUUID);
+	CREATE INDEX IF NOT EXISTS futureAppointmentDoctorUUID ON futureAppointments (doctorUUID);
+	CREATE INDEX IF NOT EXISTS futureAppointmentDateScheduled ON futureAppointments (dateScheduled);
+
+	CREATE TABLE IF NOT EXISTS doctors (
+		doctorUUID uuid,
+		name text,
+		phone text,
+		primaryFacility text,
+		primarySpecialty text,
+		gender text,
+		PRIMARY KEY (doctorUUID)
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		username text,
+		salt blob,
+		saltedHash blob,
+		userUUID uuid,
+		role text,
+		name text,
+		PRIMARY KEY (username)
+	);
+	CREATE INDEX IF NOT EXISTS usersUserUUID ON users (userUUID);
+
+	CREATE TABLE IF NOT EXISTS prescriptions (
+		patientUUID uuid,
+		prescriptionUUID uuid,
+		doctorUUID uuid,
+		doctorName text,
+		drug text,
+		startDate int,
+		endDate int,
+		instructions text,
+		PRIMARY KEY (patientUUID, endDate, prescriptionUUID)
+	);
+
+	CREATE TABLE IF NOT EXISTS notifications (
+		dateCreated int,
+		message text,
+		notificationuuid uuid,
+		receiverUUID uuid,
+		senderName text,
+		senderUUID uuid,
+		PRIMARY KEY (receiverUUID, dateCreated, notificationuuid)
+	) WITH CLUSTERING ORDER BY (dateCreated DESC);
+
+	CREATE TABLE IF NOT EXISTS documents (
+		documentUUID uuid,
+		patientUUID uuid,
+		filename text,
+		content blob,
+		dateUploaded int,
+		PRIMARY KEY (documentUUID)
+	);
+	CREATE INDEX IF NOT EXISTS documentsPatientUUID ON documents (patientUUID);`,
+
+	// 0002: written by the readiness check of each service instance
+	`CREATE TABLE IF NOT EXISTS healthChecks (
+		instance text,
+		checkedAt timestamp,
+		PRIMARY KEY (instance)
+	);`,
+
+	// 0003: server-side login sessions, keyed by the SHA-256 of their token
+	// and expired by TTL
+	`CREATE TABLE IF NOT EXISTS sessions (
+		tokenHash text,
+		userUUID uuid,
+		role text,
+		name text,
+		createdAt timestamp,
+		expiresAt timestamp,
+		rotated boolean,
+		PRIMARY KEY (tokenHash)
+	);
+	CREATE INDEX IF NOT EXISTS sessionsUserUUID ON sessions (userUUID);`,
+
+	// 0004: refresh tokens of bearer token clients, shaped like sessions
+	`CREATE TABLE IF NOT EXISTS refreshTokens (
+		tokenHash text,
+		userUUID uuid,
+		role text,
+		name text,
+		createdAt timestamp,
+		expiresAt timestamp,
+		rotated boolean,
+		PRIMARY KEY (tokenHash)
+	);
+	CREATE INDEX IF NOT EXISTS refreshTokensUserUUID ON refreshTokens (userUUID);`,
+
+	// 0005: failed logins per account and client IP, expired by TTL
+	`CREATE TABLE IF NOT EXISTS loginAttempts (
+		attemptKey text,
+		failures int,
+		lastFailure timestamp,
+		lockedUntil timestamp,
+		expiresAt timestamp,
+		PRIMARY KEY (attemptKey)
+	);`,
+
+	// 0006 and 0007: whether a session or refresh token passed a second
+	// factor. Each ALTER is a migration of its own, as it cannot be repeated.
+	`ALTER TABLE sessions ADD twoFactor boolean;`,
+	`ALTER TABLE refreshTokens ADD twoFactor boolean;`,
+
+	// 0008: TOTP enrollments, their hashed recovery codes, and the logins
+	// waiting for a TOTP code, shaped like sessions
+	`CREATE TABLE IF NOT EXISTS twoFactor (
+		userUUID uuid,
+		secret text,
+		enabled boolean,
+		lastCounter bigint,
+		PRIMARY KEY (userUUID)
+	);
+	CREATE TABLE IF NOT EXISTS recoveryCodes (
+		userUUID uuid,
+		codeID int,
+		salt blob,
+		saltedHash blob,
+		PRIMARY KEY (userUUID, codeID)
+	);
+	CREATE TABLE IF NOT EXISTS loginChallenges (
+		tokenHash text,
+		userUUID uuid,
+		role text,
+		name text,
+		createdAt timestamp,
+		expiresAt timestamp,
+		rotated boolean,
+		twoFactor boolean,
+		PRIMARY KEY (tokenHash)
+	);`,
+
+	// 0009: email address of users, for password resets
+	`ALTER TABLE users ADD email text;`,
+
+	// 0010: emailed password reset tokens, shaped like sessions
+	`CREATE TABLE IF NOT EXISTS passwordResets (
+		tokenHash text,
+		userUUID uuid,
+		role text,
+		name text,
+		createdAt timestamp,
+		expiresAt timestamp,
+		rotated boolean,
+		twoFactor boolean,
+		PRIMARY KEY (tokenHash)
+	);
+	CREATE INDEX IF NOT EXISTS passwordResetsUserUUID ON passwordResets (userUUID);`,
+
+	// 0011: invitation codes of doctors, shaped like sessions with the
+	// doctorUUID as userUUID
+	`CREATE TABLE IF NOT EXISTS doctorInvites (
+		tokenHash text,
+		userUUID uuid,
+		role text,
+		name text,
+		createdAt timestamp,
+		expiresAt timestamp,
+		rotated boolean,
+		twoFactor boolean,
+		PRIMARY KEY (tokenHash)
+	);`,
+
+	// 0012: users signing in through OpenID Connect providers
+	`CREATE TABLE IF NOT EXISTS oidcIdentities (
+		issuer text,
+		subject text,
+		userUUID uuid,
+		PRIMARY KEY ((issuer, subject))
+	);`,
+
+	// 0013: API keys of machine clients
+	`CREATE TABLE IF NOT EXISTS apiKeys (
+		keyUUID uuid,
+		name text,
+		scopes set<text>,
+		secretHash text,
+		createdBy uuid,
+		createdAt timestamp,
+		expiresAt timestamp,
+		lastUsedAt timestamp,
+		revokedAt timestamp,
+		PRIMARY KEY (keyUUID)
+	);`,
+
+	// 0014: accounts disabled by an admin
+	`ALTER TABLE users ADD disabled boolean;`,
+
+	// 0015: hash-chained audit trail of every request. auditHead points at
+	// a recent event, appends follow the chain from there.
+	`CREATE TABLE IF NOT EXISTS auditEvents (
+		seq bigint,
+		occurredAt timestamp,
+		actorUUID uuid,
+		actorRole text,
+		action text,
+		resourceType text,
+		resourceUUID uuid,
+		patientUUID uuid,
+		outcome text,
+		status int,
+		sourceIP text,
+		requestID text,
+		prevHash text,
+		hash text,
+		PRIMARY KEY (seq)
+	);
+	CREATE INDEX IF NOT EXISTS auditEventsPatientUUID ON auditEvents (patientUUID);
+	CREATE INDEX IF NOT EXISTS auditEventsActorUUID ON auditEvents (actorUUID);
+
+	CREATE TABLE IF NOT EXISTS auditHead (
+		id int,
+		seq bigint,
+		PRIMARY KEY (id)
+	);`,
+
+	// 0016: views of auditEvents by day, patient and actor, newest first so
+	// that queries page without sorting or secondary indexes, and the day of
+	// the first event, where daily queries stop
+	`CREATE TABLE IF NOT EXISTS auditEventsByDay (
+		day date,
+		seq bigint,
+		occurredAt timestamp,
+		actorUUID uuid,
+		actorRole text,
+		action text,
+		resourceType text,
+		resourceUUID uuid,
+		patientUUID uuid,
+		outcome text,
+		status int,
+		sourceIP text,
+		requestID text,
+		prevHash text,
+		hash text,
+		PRIMARY KEY ((day), seq)
+	) WITH CLUSTERING ORDER BY (seq DESC);
+
+	CREATE TABLE IF NOT EXISTS auditEventsByPatient (
+		seq bigint,
+		occurredAt timestamp,
+		actorUUID uuid,
+		actorRole text,
+		action text,
+		resourceType text,
+		resourceUUID uuid,
+		patientUUID uuid,
+		outcome text,
+		status int,
+		sourceIP text,
+		requestID text,
+		prevHash text,
+		hash text,
+		PRIMARY KEY ((patientUUID), seq)
+	) WITH CLUSTERING ORDER BY (seq DESC);
+
+	CREATE TABLE IF NOT EXISTS auditEventsByActor (
+		seq bigint,
+		occurredAt timestamp,
+		actorUUID uuid,
+		actorRole text,
+		action text,
+		resourceType text,
+		resourceUUID uuid,
+		patientUUID uuid,
+		outcome text,
+		status int,
+		sourceIP text,
+		requestID text,
+		prevHash text,
+		hash text,
+		PRIMARY KEY ((actorUUID), seq)
+	) WITH CLUSTERING ORDER BY (seq DESC);
+
+	DROP INDEX IF EXISTS auditEventsPatientUUID;
+	DROP INDEX IF EXISTS auditEventsActorUUID;
+	ALTER TABLE auditHead ADD since date;`,
+
+	// 0017: the hash and time of the newest event in auditHead, which orders
+	// appends from now on. A head of before lags behind and has neither; the
+	// first append brings it up to date and writes the views of the events.
+	`ALTER TABLE auditHead ADD (hash text, occurredAt timestamp);`,
+}
+
+// CassandraMigrator applies cassandraMigrations to the configured keyspace,
+// creating the keyspace first if needed
+type CassandraMigrator struct {
+	cfg CassandraConfig
+	// admin is not bound to a keyspace, session is opened on the keyspace
+	// once it exists
+	admin   *gocql.Session
+	session *gocql.Session
+}
+
+// NewCassandraMigrator connects to the cluster described by cfg
+func NewCassandraMigrator(cfg CassandraConfig) (*CassandraMigrator, error) {
+	adminCfg := cfg
+	adminCfg.Keyspace = ""
+	admin, err := NewCassandraSession(adminCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &CassandraMigrator{cfg: cfg, admin: admin}, nil
+}
+
+func (c *CassandraMigrator) Close() {
+	if c.session != nil {
+		c.session.Close()
+	}
+	c.admin.Close()
+}
+
+func (c *CassandraMigrator) Migrations() []string {
+	return cassandraMigrations
+}
+
+func (c *CassandraMigrator) AppliedMigrations() (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+	var table string
+	err := c.admin.Query(`SELECT table_name FROM system_schema.tables
+		WHERE keyspace_name = ? AND table_name = 'schema_migrations'`,
+		strings.ToLower(c.cfg.Keyspace)).Scan(&table)
+	if err == gocql.ErrNotFound {
+		return applied, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the keyspace name is validated by Config.Validate and safe to inline
+	iter := c.admin.Query("SELECT version, appliedAt FROM " + c.cfg.Keyspace +
+		".schema_migrations").Iter()
+	var version int
+	var appliedAt time.Time
+	for iter.Scan(&version, &appliedAt) {
+		applied[version] = appliedAt
+	}
+	return applied, iter.Close()
+}
+
+func (c *CassandraMigrator) ApplyMigration(version int) error {
+	if err := c.admin.Query("CREATE KEYSPACE IF NOT EXISTS " + c.cfg.Keyspace +
+		" WITH replication = " + c.cfg.Replication).Exec(); err != nil {
+		return err
+	}
+	if err := c.admin.Query("CREATE TABLE IF NOT EXISTS " + c.cfg.Keyspace +
+		".schema_migrations (version int PRIMARY KEY, appliedAt timestamp)").Exec(); err != nil {
+		return err
+	}
+	if c.session == nil {
+		session, err := NewCassandraSession(c.cfg)
+		if err != nil {
+			return err
+		}
+		c.session = session
+	}
+
+	for _, statement := range splitCQL(cassandraMigrations[version-1]) {
+		if err := c.session.Query(statement).Exec(); err != nil {
+			return err
+		}
+	}
+	return c.session.Query(`INSERT INTO schema_migrations (version, appliedAt) VALUES (?, ?)`,
+		version, time.Now()).Exec()
+}
+
+// splitCQL splits a migration into its semicolon separated statements
+func splitCQL(cql string) []string {
+	var statements []string
+	for _, statement := range strings.Split(cql, ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
@@ -0,0 +1,1078 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraConfig describes how to connect to the Cassandra cluster
+type CassandraConfig struct {
+	Hosts    []string `yaml:"hosts" toml:"hosts"`
+	Keyspace string   `yaml:"keyspace" toml:"keyspace"`
+	// Replication is the CQL replication map used when migrate creates the
+	// keyspace
+	Replication string `yaml:"replication" toml:"replication"`
+	// Username and Password enable password authentication when set
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	// Consistency is used for writes, ReadConsistency for reads
+	Consistency     string        `yaml:"consistency" toml:"consistency"`
+	ReadConsistency string        `yaml:"readConsistency" toml:"readConsistency"`
+	Timeout         time.Duration `yaml:"timeout" toml:"timeout"`
+	ConnectTimeout  time.Duration `yaml:"connectTimeout" toml:"connectTimeout"`
+	// NumConns is the number of pooled connections per host
+	NumConns int `yaml:"numConns" toml:"numConns"`
+	// RetryAttempts is how many times a failed query is retried with
+	// exponential backoff between RetryMinBackoff and RetryMaxBackoff
+	RetryAttempts   int           `yaml:"retryAttempts" toml:"retryAttempts"`
+	RetryMinBackoff time.Duration `yaml:"retryMinBackoff" toml:"retryMinBackoff"`
+	RetryMaxBackoff time.Duration `yaml:"retryMaxBackoff" toml:"retryMaxBackoff"`
+	// ReconnectInterval is how often hosts marked down are retried;
+	// ConnectAttempts bounds the retries while creating the session
+	ReconnectInterval time.Duration `yaml:"reconnectInterval" toml:"reconnectInterval"`
+	ConnectAttempts   int           `yaml:"connectAttempts" toml:"connectAttempts"`
+}
+
+// DefaultCassandraConfig matches the previous hardcoded local setup
+func DefaultCassandraConfig() CassandraConfig {
+	return CassandraConfig{
+		Hosts:             []string{"127.0.0.1"},
+		Keyspace:          "emr",
+		Replication:       "{'class': 'SimpleStrategy', 'replication_factor': '1'}",
+		Consistency:       "QUORUM",
+		ReadConsistency:   "ONE",
+		Timeout:           2 * time.Second,
+		ConnectTimeout:    5 * time.Second,
+		NumConns:          2,
+		RetryAttempts:     3,
+		RetryMinBackoff:   100 * time.Millisecond,
+		RetryMaxBackoff:   2 * time.Second,
+		ReconnectInterval: 10 * time.Second,
+		ConnectAttempts:   5,
+	}
+}
+
+// NewCassandraSession creates the session shared by every request. It retries
+// with exponential backoff while the cluster is unreachable and returns an
+// error once cfg.ConnectAttempts is exhausted.
+func NewCassandraSession(cfg CassandraConfig) (*gocql.Session, error) {
+	consistency, err := gocql.ParseConsistencyWrapper(cfg.Consistency)
+	if err != nil {
+		return nil, err
+	}
+
+	// connect to the cluster of nodes
+	cluster := gocql.NewCluster(cfg.Hosts...)
+	cluster.Keyspace = cfg.Keyspace
+	cluster.Consistency = consistency
+	cluster.Timeout = cfg.Timeout
+	cluster.ConnectTimeout = cfg.ConnectTimeout
+	if cfg.Username != "" {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: cfg.Username, Password: cfg.Password}
+	}
+	cluster.NumConns = cfg.NumConns
+	cluster.QueryObserver = queryObserver{}
+	cluster.RetryPolicy = &gocql.ExponentialBackoffRetryPolicy{
+		NumRetries: cfg.RetryAttempts, Min: cfg.RetryMinBackoff, Max: cfg.RetryMaxBackoff}
+	cluster.ReconnectInterval = cfg.ReconnectInterval
+	cluster.ReconnectionPolicy = &gocql.ExponentialReconnectionPolicy{
+		MaxRetries: cfg.ConnectAttempts, InitialInterval: time.Second,
+		MaxInterval: cfg.ReconnectInterval}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		session, err := cluster.CreateSession()
+		if err == nil {
+			return session, nil
+		}
+		if attempt >= cfg.ConnectAttempts {
+			return nil, fmt.Errorf("unable to connect to Cassandra at %v: %v", cfg.Hosts, err)
+		}
+		log.Printf("Unable to connect to Cassandra (attempt %d of %d), retrying in %s: %v",
+			attempt, cfg.ConnectAttempts, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > cfg.ReconnectInterval {
+			backoff = cfg.ReconnectInterval
+		}
+	}
+}
+
+// CassandraStore implements Store on top of the emr keyspace
+type CassandraStore struct {
+	session         *gocql.Session
+	readConsistency gocql.Consistency
+}
+
+// NewCassandraStore connects to the cluster described by cfg
+func NewCassandraStore(cfg CassandraConfig) (*CassandraStore, error) {
+	readConsistency, err := gocql.ParseConsistencyWrapper(cfg.ReadConsistency)
+	if err != nil {
+		return nil, err
+	}
+	session, err := NewCassandraSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &CassandraStore{session: session, readConsistency: readConsistency}, nil
+}
+
+func (c *CassandraStore) Close() {
+	c.session.Close()
+}
+
+func (c *CassandraStore) SchemaVersion() (applied, expected int, err error) {
+	if c.session.Closed() {
+		return 0, len(cassandraMigrations), ErrUnavailable
+	}
+	iter := c.session.Query("SELECT version FROM schema_migrations").
+		Consistency(c.readConsistency).Iter()
+	var version int
+	for iter.Scan(&version) {
+		if version > applied {
+			applied = version
+		}
+	}
+	return applied, len(cassandraMigrations), cassandraError(iter.Close())
+}
+
+// CheckWritable writes at the configured consistency, so it fails when too
+// few replicas are up to accept the service's writes
+func (c *CassandraStore) CheckWritable(instance string) error {
+	return cassandraError(c.session.Query(`INSERT INTO healthChecks (instance, checkedAt)
+		VALUES (?, ?)`, instance, time.Now()).Exec())
+}
+
+// cassandraError maps gocql errors onto the store errors handlers understand
+func cassandraError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case gocql.ErrNotFound:
+		return ErrNotFound
+	case gocql.ErrNoConnections, gocql.ErrSessionClosed, gocql.ErrConnectionClosed,
+		gocql.ErrTimeoutNoResponse, gocql.ErrTooManyTimeouts, gocql.ErrUnavailable:
+		return ErrUnavailable
+	}
+
+	switch e := err.(type) {
+	case *gocql.RequestErrUnavailable, *gocql.RequestErrReadTimeout, *gocql.RequestErrWriteTimeout:
+		return ErrUnavailable
+	case net.Error:
+		if e.Timeout() {
+			return ErrUnavailable
+		}
+	}
+	return err
+}
+
+func (c *CassandraStore) CreatePatient(p Patient) error {
+	return cassandraError(c.session.Query(`INSERT INTO patients (patientUuid,
+		address, bloodType, dateOfBirth, emergencyContact, gender,
+		medicalNumber, name, notes, phone )
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.PatientUUID, p.Address, p.BloodType, p.DateOfBirth, p.EmergencyContact,
+		p.Gender, p.MedicalNumber, p.Name, p.Notes, p.Phone).Exec())
+}
+
+func (c *CassandraStore) GetPatient(patientUUID gocql.UUID) (Patient, error) {
+	var p Patient
+	err := c.session.Query("SELECT * FROM patients WHERE patientUUID = ?",
+		patientUUID).Consistency(c.readConsistency).Scan(&p.PatientUUID, &p.Address,
+		&p.BloodType, &p.DateOfBirth, &p.EmergencyContact, &p.Gender, &p.MedicalNumber,
+		&p.Name, &p.Notes, &p.Phone)
+	return p, cassandraError(err)
+}
+
+func (c *CassandraStore) GetPatientByMedicalNumber(medicalNumber string) (Patient, error) {
+	var p Patient
+	err := c.session.Query("SELECT * FROM patients WHERE medicalNumber = ?",
+		medicalNumber).Consistency(c.readConsistency).Scan(&p.PatientUUID, &p.Address,
+		&p.BloodType, &p.DateOfBirth, &p.EmergencyContact, &p.Gender, &p.MedicalNumber,
+		&p.Name, &p.Notes, &p.Phone)
+	return p, cassandraError(err)
+}
+
+func (c *CassandraStore) ListPatients() (Patients, error) {
+	iter := c.session.Query("SELECT * FROM patients").Consistency(c.readConsistency).Iter()
+
+	patientList := make(Patients, 0, iter.NumRows())
+	var p Patient
+	for iter.Scan(&p.PatientUUID, &p.Address, &p.BloodType, &p.DateOfBirth,
+		&p.EmergencyContact, &p.Gender, &p.MedicalNumber, &p.Name, &p.Notes, &p.Phone) {
+		patientList = append(patientList, p)
+	}
+	return patientList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) UpdatePatient(p Patient) error {
+	applied, err := c.session.Query(`UPDATE patients SET address = ?, bloodType = ?, dateOfBirth = ?,
+		emergencyContact = ?, gender = ?, medicalNumber = ?, name = ?, notes = ?, phone = ?
+		WHERE patientUuid = ? IF EXISTS`,
+		p.Address, p.BloodType, p.DateOfBirth, p.EmergencyContact, p.Gender, p.MedicalNumber,
+		p.Name, p.Notes, p.Phone, p.PatientUUID).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !applied {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) CreateFutureAppointment(a FutureAppointment) error {
+	return cassandraError(c.session.Query(`INSERT INTO futureAppointments (appointmentUuid,
+		patientUUID, doctorUUID, dateScheduled, notes) VALUES (?, ?, ?, ?, ?)`,
+		a.AppointmentUUID, a.PatientUUID, a.DoctorUUID, a.DateScheduled, a.Notes).Exec())
+}
+
+func (c *CassandraStore) GetFutureAppointment(appointmentUUID gocql.UUID) (FutureAppointment, error) {
+	var a FutureAppointment
+	err := c.session.Query("SELECT * FROM futureAppointments WHERE appointmentUUID = ?",
+		appointmentUUID).Consistency(c.readConsistency).Scan(&a.AppointmentUUID, &a.DateScheduled,
+		&a.DoctorUUID, &a.Notes, &a.PatientUUID)
+	return a, cassandraError(err)
+}
+
+func (c *CassandraStore) DeleteFutureAppointment(appointmentUUID gocql.UUID) error {
+	deleteSuccess, err := c.session.Query("DELETE FROM futureAppointments WHERE appointmentuuid=? IF EXISTS",
+		appointmentUUID).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !deleteSuccess {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) futureAppointments(query string, args ...interface{}) (FutureAppointments, error) {
+	iter := c.session.Query(query, args...).Consistency(c.readConsistency).Iter()
+
+	appointmentList := make(FutureAppointments, 0, iter.NumRows())
+	var a FutureAppointment
+	for iter.Scan(&a.AppointmentUUID, &a.DateScheduled, &a.DoctorUUID, &a.Notes, &a.PatientUUID) {
+		appointmentList = append(appointmentList, a)
+	}
+	return appointmentList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) FutureAppointmentsByPatient(patientUUID gocql.UUID) (FutureAppointments, error) {
+	return c.futureAppointments("SELECT * FROM futureappointments WHERE patientuuid = ?", patientUUID)
+}
+
+func (c *CassandraStore) FutureAppointmentsByDoctor(doctorUUID gocql.UUID) (FutureAppointments, error) {
+	return c.futureAppointments("SELECT * FROM futureappointments WHERE doctoruuid = ?", doctorUUID)
+}
+
+func (c *CassandraStore) CompleteAppointment(a CompletedAppointment) error {
+	if _, err := c.session.Query(`DELETE FROM futureappointments WHERE appointmentuuid=? IF EXISTS`,
+		a.AppointmentUUID).ScanCAS(); err != nil {
+		return cassandraError(err)
+	}
+
+	// update appointment entry, create entry if does not exist
+	return cassandraError(c.session.Query(`UPDATE completedappointments SET patientUUID = ?,
+		doctorUUID = ?, dateVisited = ?, breathingRate = ?, heartRate = ?, bloodOxygenLevel = ?,
+		bloodPressure = ?, notes = ? WHERE appointmentUuid = ?`, a.PatientUUID,
+		a.DoctorUUID, a.DateVisited, a.BreathingRate, a.HeartRate, a.BloodOxygenLevel,
+		a.BloodPressure, a.Notes, a.AppointmentUUID).Exec())
+}
+
+func (c *CassandraStore) GetCompletedAppointment(appointmentUUID gocql.UUID) (CompletedAppointment, error) {
+	var a CompletedAppointment
+	// match arguments with alphabetical positioning of retrieved columns
+	err := c.session.Query("SELECT * FROM completedAppointments WHERE appointmentUUID = ?",
+		appointmentUUID).Consistency(c.readConsistency).Scan(&a.AppointmentUUID, &a.BloodOxygenLevel,
+		&a.BloodPressure, &a.BreathingRate, &a.DateVisited, &a.DoctorUUID, &a.HeartRate,
+		&a.Notes, &a.PatientUUID)
+	return a, cassandraError(err)
+}
+
+func (c *CassandraStore) completedAppointments(query string, args ...interface{}) (CompletedAppointments, error) {
+	iter := c.session.Query(query, args...).Consistency(c.readConsistency).Iter()
+
+	appointmentList := make(CompletedAppointments, 0, iter.NumRows())
+	var a CompletedAppointment
+	for iter.Scan(&a.AppointmentUUID, &a.BloodOxygenLevel, &a.BloodPressure, &a.BreathingRate,
+		&a.DateVisited, &a.DoctorUUID, &a.HeartRate, &a.Notes, &a.PatientUUID) {
+		appointmentList = append(appointmentList, a)
+	}
+	return appointmentList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) CompletedAppointmentsByPatient(patientUUID gocql.UUID) (CompletedAppointments, error) {
+	return c.completedAppointments("SELECT * FROM completedappointments WHERE patientuuid = ?", patientUUID)
+}
+
+func (c *CassandraStore) CompletedAppointmentsByDoctor(doctorUUID gocql.UUID) (CompletedAppointments, error) {
+	return c.completedAppointments("SELECT * FROM completedappointments WHERE doctoruuid = ?", doctorUUID)
+}
+
+func (c *CassandraStore) CreateDoctor(d Doctor) error {
+	return cassandraError(c.session.Query(`INSERT INTO doctors (doctorUUID,
+		name, phone, primaryFacility, primarySpecialty,
+		gender) VALUES (?, ?, ?, ?, ?, ?)`,
+		d.DoctorUUID, d.Name, d.Phone, d.PrimaryFacility, d.PrimarySpecialty,
+		d.Gender).Exec())
+}
+
+func (c *CassandraStore) GetDoctor(doctorUUID gocql.UUID) (Doctor, error) {
+	var d Doctor
+	err := c.session.Query("SELECT * FROM doctors WHERE doctorUUID = ?",
+		doctorUUID).Consistency(c.readConsistency).Scan(&d.DoctorUUID, &d.Gender,
+		&d.Name, &d.Phone, &d.PrimaryFacility, &d.PrimarySpecialty)
+	return d, cassandraError(err)
+}
+
+func (c *CassandraStore) ListDoctors() ([]Doctor, error) {
+	iter := c.session.Query("SELECT * FROM doctors").Consistency(c.readConsistency).Iter()
+
+	doctorList := make([]Doctor, 0, iter.NumRows())
+	var d Doctor
+	for iter.Scan(&d.DoctorUUID, &d.Gender, &d.Name, &d.Phone, &d.PrimaryFacility,
+		&d.PrimarySpecialty) {
+		doctorList = append(doctorList, d)
+	}
+	return doctorList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) CreateUser(u UserAccount) error {
+	insertSuccess, err := c.session.Query(`INSERT INTO users (username,
+		salt, saltedHash, userUUID, role, name, email, disabled) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		IF NOT EXISTS`, u.Username, u.Salt, u.SaltedHash, u.UserUUID, u.Role, u.Name, u.Email,
+		u.Disabled).ScanCAS(nil, nil, nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !insertSuccess {
+		return ErrExists
+	}
+	return nil
+}
+
+func (c *CassandraStore) GetUserByUsername(username string) (UserAccount, error) {
+	u := UserAccount{Username: username}
+	err := c.session.Query(`SELECT name, role, salt, saltedHash, userUUID, email, disabled
+	FROM users WHERE username = ?`, username).Consistency(c.readConsistency).
+		Scan(&u.Name, &u.Role, &u.Salt, &u.SaltedHash, &u.UserUUID, &u.Email, &u.Disabled)
+	return u, cassandraError(err)
+}
+
+func (c *CassandraStore) GetUserByUUID(userUUID gocql.UUID) (UserAccount, error) {
+	var u UserAccount
+	err := c.session.Query(`SELECT username, name, role, salt, saltedHash, userUUID, email,
+	disabled FROM users WHERE useruuid = ?`, userUUID).Consistency(c.readConsistency).
+		Scan(&u.Username, &u.Name, &u.Role, &u.Salt, &u.SaltedHash, &u.UserUUID, &u.Email,
+			&u.Disabled)
+	return u, cassandraError(err)
+}
+
+func (c *CassandraStore) UpdatePassword(username string, salt, saltedHash []byte) error {
+	updated, err := c.session.Query(`UPDATE users SET salt = ?, saltedHash = ?
+		WHERE username = ? IF EXISTS`, salt, saltedHash, username).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !updated {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) UpdateUser(u UserAccount) error {
+	updated, err := c.session.Query(`UPDATE users SET role = ?, name = ?, email = ?,
+		disabled = ? WHERE username = ? IF EXISTS`, u.Role, u.Name, u.Email, u.Disabled,
+		u.Username).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !updated {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) ListUsers() ([]UserAccount, error) {
+	iter := c.session.Query(`SELECT username, name, role, salt, saltedHash, userUUID, email,
+		disabled FROM users`).Consistency(c.readConsistency).Iter()
+
+	userList := make([]UserAccount, 0, iter.NumRows())
+	var u UserAccount
+	for iter.Scan(&u.Username, &u.Name, &u.Role, &u.Salt, &u.SaltedHash, &u.UserUUID, &u.Email,
+		&u.Disabled) {
+		userList = append(userList, u)
+		u = UserAccount{}
+	}
+	// rows come in token order
+	sort.Slice(userList, func(i, j int) bool {
+		return userList[i].Username < userList[j].Username
+	})
+	return userList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) DeleteUser(username string) error {
+	deleted, err := c.session.Query(`DELETE FROM users WHERE username = ? IF EXISTS`,
+		username).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) CreatePrescription(p Prescription) error {
+	return cassandraError(c.session.Query(`INSERT INTO prescriptions (doctorName, doctorUUID,
+		drug, endDate, instructions, patientUUID, prescriptionUUID, startDate)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, p.DoctorName, p.DoctorUUID, p.Drug, p.EndDate,
+		p.Instructions, p.PatientUUID, p.PrescriptionUUID, p.StartDate).Exec())
+}
+
+func (c *CassandraStore) PrescriptionsByPatient(patientUUID gocql.UUID) (Prescriptions, error) {
+	iter := c.session.Query(`SELECT * FROM prescriptions WHERE patientuuid = ?
+		ORDER BY endDate DESC`, patientUUID).Consistency(c.readConsistency).Iter()
+
+	prescriptionList := make(Prescriptions, 0, iter.NumRows())
+	var p Prescription
+	for iter.Scan(&p.PatientUUID, &p.EndDate, &p.PrescriptionUUID, &p.DoctorName,
+		&p.DoctorUUID, &p.Drug, &p.Instructions, &p.StartDate) {
+		prescriptionList = append(prescriptionList, p)
+	}
+	return prescriptionList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) CreateNotification(n Notification) error {
+	notificationUUID, err := gocql.RandomUUID()
+	if err != nil {
+		return cassandraError(err)
+	}
+	return cassandraError(c.session.Query(`INSERT INTO notifications (receiverUUID, dateCreated, notificationUUID,
+		message, senderName, senderUUID) VALUES (?, ?, ?, ?, ?, ?)`,
+		n.ReceiverUUID, n.DateCreated, notificationUUID, n.Messsage, n.SenderName,
+		n.SenderUUID).Exec())
+}
+
+func (c *CassandraStore) NotificationsByReceiver(receiverUUID gocql.UUID, limit int) (Notifications, error) {
+	iter := c.session.Query(`SELECT receiverUUID, dateCreated, message, senderUUID, senderName FROM
+		notifications WHERE receiverUUID = ? LIMIT ?`, receiverUUID, limit).Consistency(c.readConsistency).Iter()
+
+	notiList := make(Notifications, 0, iter.NumRows())
+	var n Notification
+	for iter.Scan(&n.ReceiverUUID, &n.DateCreated, &n.Messsage, &n.SenderUUID, &n.SenderName) {
+		notiList = append(notiList, n)
+	}
+	return notiList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) CreateDocument(d Document) error {
+	return cassandraError(c.session.Query(`INSERT INTO documents (documentUUID,
+		patientUUID, filename, dateUploaded, content) VALUES (?, ?, ?, ?, ?)`,
+		d.DocumentUUID, d.PatientUUID, d.Filename, d.DateUploaded,
+		[]byte(d.Content)).Exec())
+}
+
+func (c *CassandraStore) GetDocument(documentUUID gocql.UUID) (Document, error) {
+	var d Document
+	var content []byte
+	err := c.session.Query(`SELECT documentUUID, patientUUID, filename, dateUploaded, content
+		FROM documents WHERE documentUUID = ?`, documentUUID).Consistency(c.readConsistency).
+		Scan(&d.DocumentUUID, &d.PatientUUID, &d.Filename, &d.DateUploaded, &content)
+	d.Content = string(content)
+	return d, cassandraError(err)
+}
+
+func (c *CassandraStore) DocumentsByPatient(patientUUID gocql.UUID) ([]Document, error) {
+	iter := c.session.Query(`SELECT documentuuid, dateuploaded, filename, patientuuid FROM documents
+		WHERE patientuuid = ?`, patientUUID).Consistency(c.readConsistency).Iter()
+
+	docuList := make([]Document, 0, iter.NumRows())
+	var d Document
+	for iter.Scan(&d.DocumentUUID, &d.DateUploaded, &d.Filename, &d.PatientUUID) {
+		docuList = append(docuList, d)
+	}
+	return docuList, cassandraError(iter.Close())
+}
+
+// putSession writes a row of table, sessions, refreshTokens,
+// loginChallenges, passwordResets or doctorInvites, with a TTL so that
+// Cassandra removes it once it expires
+func (c *CassandraStore) putSession(table string, s Session) error {
+	ttl := int(time.Until(s.ExpiresAt).Seconds())
+	if ttl < 1 {
+		return nil
+	}
+	return cassandraError(c.session.Query(`INSERT INTO `+table+` (tokenHash, userUUID, role,
+		name, createdAt, expiresAt, rotated, twoFactor) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		USING TTL ?`, s.TokenHash, s.UserUUID, s.Role, s.Name, s.CreatedAt, s.ExpiresAt,
+		s.Rotated, s.TwoFactor, ttl).Exec())
+}
+
+func (c *CassandraStore) getSession(table, tokenHash string) (Session, error) {
+	s := Session{TokenHash: tokenHash}
+	err := c.session.Query(`SELECT userUUID, role, name, createdAt, expiresAt, rotated,
+		twoFactor FROM `+table+` WHERE tokenHash = ?`, tokenHash).Consistency(c.readConsistency).
+		Scan(&s.UserUUID, &s.Role, &s.Name, &s.CreatedAt, &s.ExpiresAt, &s.Rotated, &s.TwoFactor)
+	if err == nil && !time.Now().Before(s.ExpiresAt) {
+		return Session{}, ErrNotFound
+	}
+	return s, cassandraError(err)
+}
+
+func (c *CassandraStore) deleteUserSessions(table string, userUUID gocql.UUID) error {
+	iter := c.session.Query(`SELECT tokenHash FROM `+table+` WHERE userUUID = ?`,
+		userUUID).Iter()
+	var tokenHashes []string
+	var tokenHash string
+	for iter.Scan(&tokenHash) {
+		tokenHashes = append(tokenHashes, tokenHash)
+	}
+	if err := iter.Close(); err != nil {
+		return cassandraError(err)
+	}
+	for _, tokenHash := range tokenHashes {
+		if err := c.session.Query(`DELETE FROM `+table+` WHERE tokenHash = ?`,
+			tokenHash).Exec(); err != nil {
+			return cassandraError(err)
+		}
+	}
+	return nil
+}
+
+func (c *CassandraStore) CreateSession(s Session) error {
+	return c.putSession("sessions", s)
+}
+
+func (c *CassandraStore) GetSession(tokenHash string) (Session, error) {
+	return c.getSession("sessions", tokenHash)
+}
+
+func (c *CassandraStore) DeleteSession(tokenHash string) error {
+	return cassandraError(c.session.Query(`DELETE FROM sessions WHERE tokenHash = ?`,
+		tokenHash).Exec())
+}
+
+func (c *CassandraStore) DeleteUserSessions(userUUID gocql.UUID) error {
+	return c.deleteUserSessions("sessions", userUUID)
+}
+
+func (c *CassandraStore) CreateRefreshToken(t Session) error {
+	return c.putSession("refreshTokens", t)
+}
+
+func (c *CassandraStore) GetRefreshToken(tokenHash string) (Session, error) {
+	return c.getSession("refreshTokens", tokenHash)
+}
+
+func (c *CassandraStore) DeleteRefreshToken(tokenHash string) error {
+	return cassandraError(c.session.Query(`DELETE FROM refreshTokens WHERE tokenHash = ?`,
+		tokenHash).Exec())
+}
+
+func (c *CassandraStore) DeleteUserRefreshTokens(userUUID gocql.UUID) error {
+	return c.deleteUserSessions("refreshTokens", userUUID)
+}
+
+func (c *CassandraStore) GetLoginAttempts(key string) (LoginAttempts, error) {
+	a := LoginAttempts{Key: key}
+	err := c.session.Query(`SELECT failures, lastFailure, lockedUntil, expiresAt
+		FROM loginAttempts WHERE attemptKey = ?`, key).Consistency(c.readConsistency).
+		Scan(&a.Failures, &a.LastFailure, &a.LockedUntil, &a.ExpiresAt)
+	if err == nil && !time.Now().Before(a.ExpiresAt) {
+		return LoginAttempts{}, ErrNotFound
+	}
+	return a, cassandraError(err)
+}
+
+// PutLoginAttempts writes a with a TTL so that Cassandra removes it once it
+// expires
+func (c *CassandraStore) PutLoginAttempts(a LoginAttempts) error {
+	ttl := int(time.Until(a.ExpiresAt).Seconds())
+	if ttl < 1 {
+		return nil
+	}
+	return cassandraError(c.session.Query(`INSERT INTO loginAttempts (attemptKey, failures,
+		lastFailure, lockedUntil, expiresAt) VALUES (?, ?, ?, ?, ?) USING TTL ?`,
+		a.Key, a.Failures, a.LastFailure, a.LockedUntil, a.ExpiresAt, ttl).Exec())
+}
+
+func (c *CassandraStore) DeleteLoginAttempts(key string) error {
+	return cassandraError(c.session.Query(`DELETE FROM loginAttempts WHERE attemptKey = ?`,
+		key).Exec())
+}
+
+func (c *CassandraStore) CreateLoginChallenge(s Session) error {
+	return c.putSession("loginChallenges", s)
+}
+
+func (c *CassandraStore) GetLoginChallenge(tokenHash string) (Session, error) {
+	return c.getSession("loginChallenges", tokenHash)
+}
+
+func (c *CassandraStore) DeleteLoginChallenge(tokenHash string) error {
+	return cassandraError(c.session.Query(`DELETE FROM loginChallenges WHERE tokenHash = ?`,
+		tokenHash).Exec())
+}
+
+func (c *CassandraStore) CreatePasswordReset(t Session) error {
+	return c.putSession("passwordResets", t)
+}
+
+func (c *CassandraStore) GetPasswordReset(tokenHash string) (Session, error) {
+	return c.getSession("passwordResets", tokenHash)
+}
+
+func (c *CassandraStore) DeletePasswordReset(tokenHash string) error {
+	deleted, err := c.session.Query(`DELETE FROM passwordResets WHERE tokenHash = ?
+		IF EXISTS`, tokenHash).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) DeleteUserPasswordResets(userUUID gocql.UUID) error {
+	return c.deleteUserSessions("passwordResets", userUUID)
+}
+
+func (c *CassandraStore) CreateDoctorInvite(i Session) error {
+	return c.putSession("doctorInvites", i)
+}
+
+func (c *CassandraStore) GetDoctorInvite(codeHash string) (Session, error) {
+	return c.getSession("doctorInvites", codeHash)
+}
+
+func (c *CassandraStore) DeleteDoctorInvite(codeHash string) error {
+	deleted, err := c.session.Query(`DELETE FROM doctorInvites WHERE tokenHash = ?
+		IF EXISTS`, codeHash).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) GetOIDCIdentity(issuer, subject string) (gocql.UUID, error) {
+	var userUUID gocql.UUID
+	err := c.session.Query(`SELECT userUUID FROM oidcIdentities WHERE issuer = ?
+		AND subject = ?`, issuer, subject).Consistency(c.readConsistency).Scan(&userUUID)
+	return userUUID, cassandraError(err)
+}
+
+func (c *CassandraStore) PutOIDCIdentity(issuer, subject string, userUUID gocql.UUID) error {
+	return cassandraError(c.session.Query(`INSERT INTO oidcIdentities (issuer, subject,
+		userUUID) VALUES (?, ?, ?)`, issuer, subject, userUUID).Exec())
+}
+
+// apiKeyFromRow fills the unset times of k, read as zero times, with nil
+func apiKeyFromRow(k APIKey, lastUsedAt, revokedAt time.Time) APIKey {
+	if !lastUsedAt.IsZero() {
+		k.LastUsedAt = &lastUsedAt
+	}
+	if !revokedAt.IsZero() {
+		k.RevokedAt = &revokedAt
+	}
+	return k
+}
+
+func (c *CassandraStore) CreateAPIKey(k APIKey) error {
+	return cassandraError(c.session.Query(`INSERT INTO apiKeys (keyUUID, name, scopes,
+		secretHash, createdBy, createdAt, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)`, k.KeyUUID,
+		k.Name, k.Scopes, k.SecretHash, k.CreatedBy, k.CreatedAt, k.ExpiresAt).Exec())
+}
+
+func (c *CassandraStore) GetAPIKey(keyUUID gocql.UUID) (APIKey, error) {
+	k := APIKey{KeyUUID: keyUUID}
+	var lastUsedAt, revokedAt time.Time
+	err := c.session.Query(`SELECT name, scopes, secretHash, createdBy, createdAt, expiresAt,
+		lastUsedAt, revokedAt FROM apiKeys WHERE keyUUID = ?`, keyUUID).
+		Consistency(c.readConsistency).Scan(&k.Name, &k.Scopes, &k.SecretHash, &k.CreatedBy,
+		&k.CreatedAt, &k.ExpiresAt, &lastUsedAt, &revokedAt)
+	if err != nil {
+		return APIKey{}, cassandraError(err)
+	}
+	return apiKeyFromRow(k, lastUsedAt, revokedAt), nil
+}
+
+func (c *CassandraStore) ListAPIKeys() ([]APIKey, error) {
+	iter := c.session.Query(`SELECT keyUUID, name, scopes, secretHash, createdBy, createdAt,
+		expiresAt, lastUsedAt, revokedAt FROM apiKeys`).Consistency(c.readConsistency).Iter()
+
+	keyList := make([]APIKey, 0, iter.NumRows())
+	var k APIKey
+	var lastUsedAt, revokedAt time.Time
+	for iter.Scan(&k.KeyUUID, &k.Name, &k.Scopes, &k.SecretHash, &k.CreatedBy, &k.CreatedAt,
+		&k.ExpiresAt, &lastUsedAt, &revokedAt) {
+		keyList = append(keyList, apiKeyFromRow(k, lastUsedAt, revokedAt))
+		k = APIKey{}
+	}
+	sort.Slice(keyList, func(i, j int) bool {
+		return keyList[i].CreatedAt.Before(keyList[j].CreatedAt)
+	})
+	return keyList, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) TouchAPIKey(keyUUID gocql.UUID, usedAt time.Time) error {
+	return cassandraError(c.session.Query(`UPDATE apiKeys SET lastUsedAt = ? WHERE keyUUID = ?`,
+		usedAt, keyUUID).Exec())
+}
+
+func auditEventDest(e *AuditEvent) []interface{} {
+	return []interface{}{&e.Seq, &e.OccurredAt, &e.ActorUUID, &e.ActorRole, &e.Action,
+		&e.ResourceType, &e.ResourceUUID, &e.PatientUUID, &e.Outcome, &e.Status, &e.SourceIP,
+		&e.RequestID, &e.PrevHash, &e.Hash}
+}
+
+func (c *CassandraStore) getAuditEvent(seq int64) (AuditEvent, error) {
+	var e AuditEvent
+	err := c.session.Query(`SELECT `+auditEventColumns+` FROM auditEvents WHERE seq = ?`, seq).
+		Scan(auditEventDest(&e)...)
+	return e, cassandraError(err)
+}
+
+// LastAuditEvent returns the seq, hash and time of the newest event, kept
+// in auditHead
+func (c *CassandraStore) LastAuditEvent() (AuditEvent, error) {
+	var last AuditEvent
+	err := cassandraError(c.session.Query(`SELECT seq, hash, occurredAt FROM auditHead
+		WHERE id = 0`).Scan(&last.Seq, &last.Hash, &last.OccurredAt))
+	if err == ErrNotFound {
+		// a trail appended before migration 0017 may have no head
+		if _, err := c.getAuditEvent(1); err != nil {
+			return AuditEvent{}, err
+		}
+		return c.upgradeAuditTrail(0)
+	}
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	if last.Hash == "" {
+		return c.upgradeAuditTrail(last.Seq)
+	}
+	return last, nil
+}
+
+// upgradeAuditTrail brings a trail appended before migration 0017 up to
+// date: it writes the views of its events and points auditHead, which may
+// lag behind at headSeq, at the newest event
+func (c *CassandraStore) upgradeAuditTrail(headSeq int64) (AuditEvent, error) {
+	var first, last, e AuditEvent
+	var events []AuditEvent
+	iter := c.session.Query(`SELECT ` + auditEventColumns + ` FROM auditEvents`).Iter()
+	for iter.Scan(auditEventDest(&e)...) {
+		if first.Seq == 0 || e.Seq < first.Seq {
+			first = e
+		}
+		if e.Seq > last.Seq {
+			last = e
+		}
+		if events = append(events, e); len(events) == auditBatchSize {
+			if err := c.writeAuditEvents(events); err != nil {
+				iter.Close()
+				return AuditEvent{}, err
+			}
+			events = events[:0]
+		}
+		e = AuditEvent{}
+	}
+	if err := iter.Close(); err != nil {
+		return AuditEvent{}, cassandraError(err)
+	}
+	if err := c.writeAuditEvents(events); err != nil {
+		return AuditEvent{}, err
+	}
+
+	head := c.session.Query(`UPDATE auditHead SET seq = ?, hash = ?, occurredAt = ?, since = ?
+		WHERE id = 0 IF seq = ?`, last.Seq, last.Hash, last.OccurredAt, auditDay(first.OccurredAt),
+		headSeq)
+	if headSeq == 0 {
+		head = c.session.Query(`INSERT INTO auditHead (id, seq, hash, occurredAt, since)
+			VALUES (0, ?, ?, ?, ?) IF NOT EXISTS`, last.Seq, last.Hash, last.OccurredAt,
+			auditDay(first.OccurredAt))
+	}
+	applied, err := head.MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return AuditEvent{}, cassandraError(err)
+	}
+	if !applied {
+		// another instance upgraded it first
+		return c.LastAuditEvent()
+	}
+	return last, nil
+}
+
+// auditDay returns the auditEventsByDay partition of an event at t
+func auditDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// AppendAuditEvents moves auditHead from the event before the first to the
+// last, which claims the seqs of events, then writes them
+func (c *CassandraStore) AppendAuditEvents(events []AuditEvent) error {
+	first, last := events[0], events[len(events)-1]
+	head := c.session.Query(`UPDATE auditHead SET seq = ?, hash = ?, occurredAt = ? WHERE id = 0
+		IF seq = ? AND hash = ?`, last.Seq, last.Hash, last.OccurredAt, first.Seq-1, first.PrevHash)
+	if first.Seq == 1 {
+		head = c.session.Query(`INSERT INTO auditHead (id, seq, hash, occurredAt, since)
+			VALUES (0, ?, ?, ?, ?) IF NOT EXISTS`, last.Seq, last.Hash, last.OccurredAt,
+			auditDay(first.OccurredAt))
+	}
+	applied, err := head.MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !applied {
+		return ErrExists
+	}
+	return c.writeAuditEvents(events)
+}
+
+// auditBatchSize bounds the events of a batch, whose rows must stay well
+// below the batch size Cassandra refuses, 50 KiB by default
+const auditBatchSize = 25
+
+// writeAuditEvents writes events with their views, in logged batches of up
+// to auditBatchSize events so that each is written whole or not at all. The
+// inserts are idempotent, a failed batch is tried again: the head already
+// points past its events.
+func (c *CassandraStore) writeAuditEvents(events []AuditEvent) error {
+	const placeholders = `?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?`
+	var zero gocql.UUID
+	for len(events) > 0 {
+		n := len(events)
+		if n > auditBatchSize {
+			n = auditBatchSize
+		}
+		batch := c.session.NewBatch(gocql.LoggedBatch)
+		for _, e := range events[:n] {
+			values := []interface{}{e.Seq, e.OccurredAt, e.ActorUUID, e.ActorRole, e.Action,
+				e.ResourceType, e.ResourceUUID, e.PatientUUID, e.Outcome, e.Status, e.SourceIP,
+				e.RequestID, e.PrevHash, e.Hash}
+			batch.Query(`INSERT INTO auditEvents (`+auditEventColumns+`)
+				VALUES (`+placeholders+`)`, values...)
+			batch.Query(`INSERT INTO auditEventsByDay (day, `+auditEventColumns+`)
+				VALUES (?, `+placeholders+`)`, append([]interface{}{auditDay(e.OccurredAt)}, values...)...)
+			if e.PatientUUID != zero {
+				batch.Query(`INSERT INTO auditEventsByPatient (`+auditEventColumns+`)
+					VALUES (`+placeholders+`)`, values...)
+			}
+			if e.ActorUUID != zero {
+				batch.Query(`INSERT INTO auditEventsByActor (`+auditEventColumns+`)
+					VALUES (`+placeholders+`)`, values...)
+			}
+		}
+		var err error
+		for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+			if err = c.session.ExecuteBatch(batch); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return cassandraError(err)
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+// collectAuditEvents appends the events of iter, read newest first, that q
+// selects to events, up to q.Limit. As times never decrease along the
+// chain, it stops at the first event older than q.From; done reports
+// whether older events need not be read.
+func collectAuditEvents(iter *gocql.Iter, q AuditQuery, events []AuditEvent) ([]AuditEvent, bool, error) {
+	done := false
+	var e AuditEvent
+	for len(events) < q.Limit && iter.Scan(auditEventDest(&e)...) {
+		if !q.From.IsZero() && e.OccurredAt.Before(q.From) {
+			done = true
+			break
+		}
+		if q.matches(e) {
+			events = append(events, e)
+		}
+		e = AuditEvent{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, false, cassandraError(err)
+	}
+	return events, done || len(events) == q.Limit, nil
+}
+
+func (c *CassandraStore) AuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	var zero gocql.UUID
+	switch {
+	case q.PatientUUID != zero:
+		return c.partyAuditEvents("auditEventsByPatient", "patientUUID", q.PatientUUID, q,
+			q.ActorUUID != zero)
+	case q.ActorUUID != zero:
+		return c.partyAuditEvents("auditEventsByActor", "actorUUID", q.ActorUUID, q, false)
+	}
+	return c.dailyAuditEvents(q)
+}
+
+// partyAuditEvents reads the events of one patient or actor from its view,
+// a single partition. filtered tells that q selects on more than the CQL
+// query does, which then reads pages until q.Limit events match.
+func (c *CassandraStore) partyAuditEvents(table, column string, partyUUID gocql.UUID, q AuditQuery,
+	filtered bool) ([]AuditEvent, error) {
+	query, args := `SELECT `+auditEventColumns+` FROM `+table+` WHERE `+column+` = ?`,
+		[]interface{}{partyUUID}
+	if q.BeforeSeq != 0 {
+		query, args = query+` AND seq < ?`, append(args, q.BeforeSeq)
+	}
+	if !q.From.IsZero() {
+		query, args = query+` AND occurredAt >= ?`, append(args, q.From)
+	}
+	if !q.To.IsZero() {
+		query, args = query+` AND occurredAt < ?`, append(args, q.To)
+	}
+	if !filtered && !q.StaffOnly {
+		query, args = query+` LIMIT ?`, append(args, q.Limit)
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		// within the partition only
+		query += ` ALLOW FILTERING`
+	}
+	iter := c.session.Query(query, args...).Consistency(c.readConsistency).PageSize(q.Limit).Iter()
+	events, _, err := collectAuditEvents(iter, q, []AuditEvent{})
+	return events, err
+}
+
+// dailyAuditEvents reads the events of every actor and patient from the day
+// view, one day at a time from the newest day the query can select back to
+// q.From or the first event
+func (c *CassandraStore) dailyAuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	var since time.Time
+	err := c.session.Query(`SELECT since FROM auditHead WHERE id = 0`).
+		Consistency(c.readConsistency).Scan(&since)
+	if err := cassandraError(err); err == ErrNotFound || err == nil && since.IsZero() {
+		return []AuditEvent{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !q.From.IsZero() && auditDay(q.From).After(since) {
+		since = auditDay(q.From)
+	}
+
+	// a day ahead, for instances whose clock is ahead of this one
+	day := auditDay(time.Now()).AddDate(0, 0, 1)
+	if !q.To.IsZero() && auditDay(q.To.Add(-time.Millisecond)).Before(day) {
+		day = auditDay(q.To.Add(-time.Millisecond))
+	}
+	if q.BeforeSeq != 0 {
+		before, err := c.getAuditEvent(q.BeforeSeq)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if err == nil && auditDay(before.OccurredAt).Before(day) {
+			day = auditDay(before.OccurredAt)
+		}
+	}
+
+	events := []AuditEvent{}
+	for ; !day.Before(since); day = day.AddDate(0, 0, -1) {
+		query, args := `SELECT `+auditEventColumns+` FROM auditEventsByDay WHERE day = ?`,
+			[]interface{}{day}
+		if q.BeforeSeq != 0 {
+			query, args = query+` AND seq < ?`, append(args, q.BeforeSeq)
+		}
+		iter := c.session.Query(query, args...).Consistency(c.readConsistency).
+			PageSize(q.Limit).Iter()
+		var done bool
+		if events, done, err = collectAuditEvents(iter, q, events); err != nil {
+			return nil, err
+		}
+		if done {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (c *CassandraStore) RevokeAPIKey(keyUUID gocql.UUID, revokedAt time.Time) error {
+	updated, err := c.session.Query(`UPDATE apiKeys SET revokedAt = ? WHERE keyUUID = ?
+		IF EXISTS`, revokedAt, keyUUID).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !updated {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *CassandraStore) GetTwoFactor(userUUID gocql.UUID) (TwoFactor, error) {
+	t := TwoFactor{UserUUID: userUUID}
+	err := c.session.Query(`SELECT secret, enabled, lastCounter FROM twoFactor
+		WHERE userUUID = ?`, userUUID).Consistency(c.readConsistency).
+		Scan(&t.Secret, &t.Enabled, &t.LastCounter)
+	if err != nil {
+		return TwoFactor{}, cassandraError(err)
+	}
+
+	iter := c.session.Query(`SELECT codeID, salt, saltedHash FROM recoveryCodes
+		WHERE userUUID = ?`, userUUID).Consistency(c.readConsistency).Iter()
+	t.RecoveryCodes = make([]RecoveryCode, 0, iter.NumRows())
+	var code RecoveryCode
+	for iter.Scan(&code.ID, &code.Salt, &code.SaltedHash) {
+		t.RecoveryCodes = append(t.RecoveryCodes, code)
+		code = RecoveryCode{}
+	}
+	return t, cassandraError(iter.Close())
+}
+
+func (c *CassandraStore) PutTwoFactor(t TwoFactor) error {
+	return cassandraError(c.session.Query(`INSERT INTO twoFactor (userUUID, secret, enabled,
+		lastCounter) VALUES (?, ?, ?, ?)`, t.UserUUID, t.Secret, t.Enabled,
+		t.LastCounter).Exec())
+}
+
+func (c *CassandraStore) UseTOTPCounter(userUUID gocql.UUID, counter int64) error {
+	updated, err := c.session.Query(`UPDATE twoFactor SET lastCounter = ? WHERE userUUID = ?
+		IF lastCounter < ?`, counter, userUUID, counter).ScanCAS()
+	if err != nil {
+		return cassandraError(err)
+	}
+	if !updated {
+		return ErrExists
+	}
+	return nil
+}
+
+func (c *CassandraStore) PutRecoveryCodes(userUUID gocql.UUID, codes []RecoveryCode) error {
+	// the inserts must be newer than the delete, or its tombstone hides them
+	deleted := time.Now().UnixNano() / int64(time.Microsecond)
+	batch := c.session.NewBatch(gocql.LoggedBatch)
+	batch.Query(`DELETE FROM recoveryCodes USING TIMESTAMP ? WHERE userUUID = ?`,
+		deleted, userUUID)
+	for _, code := range codes {
+		batch.Query(`INSERT INTO recoveryCodes (userUUID, codeID, salt, saltedHash)
+			VALUES (?, ?, ?, ?) USING TIMESTAMP ?`, userUUID, code.ID, code.Salt,
+			code.SaltedHash, deleted+1)
+	}
+	return cassandraError(c.session.ExecuteBatch(batch))
+}
+
+func (c *CassandraStore) DeleteRecoveryCode(userUUID gocql.UUID, codeID int) error {
+	return cassandraError(c.session.Query(`DELETE FROM recoveryCodes WHERE userUUID = ?
+		AND codeID = ?`, userUUID, codeID).Exec())
+}
+
+func (c *CassandraStore) DeleteTwoFactor(userUUID gocql.UUID) error {
+	batch := c.session.NewBatch(gocql.LoggedBatch)
+	batch.Query(`DELETE FROM recoveryCodes WHERE userUUID = ?`, userUUID)
+	batch.Query(`DELETE FROM twoFactor WHERE userUUID = ?`, userUUID)
+	return cassandraError(c.session.ExecuteBatch(batch))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func TestCassandraErrorMapping(t *testing.T) {
+	other := errors.New("syntax error")
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{nil, nil},
+		{gocql.ErrNotFound, ErrNotFound},
+		{gocql.ErrNoConnections, ErrUnavailable},
+		{gocql.ErrTimeoutNoResponse, ErrUnavailable},
+		{&gocql.RequestErrUnavailable{}, ErrUnavailable},
+		{&gocql.RequestErrWriteTimeout{}, ErrUnavailable},
+		{other, other},
+	}
+	for _, c := range cases {
+		if got := cassandraError(c.err); got != c.want {
+			t.Errorf("cassandraError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+// downStore behaves like a cluster with no reachable hosts
+type downStore struct {
+	*MemoryStore
+}
+
+func (downStore) GetPatient(gocql.UUID) (Patient, error) {
+	return Patient{}, ErrUnavailable
+}
+
+func (downStore) CreateDoctor(Doctor) error {
+	return ErrUnavailable
+}
+
+func (downStore) GetCompletedAppointment(gocql.UUID) (CompletedAppointment, error) {
+	return CompletedAppointment{}, ErrUnavailable
+}
+
+func TestStoreUnavailableHandler(t *testing.T) {
+	store := downStore{NewMemoryStore()}
+	patientUUID, _ := gocql.RandomUUID()
+
+	rec := serveStore(store, httptest.NewRequest("GET", "/patients/patientuuid/"+patientUUID.String(), nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	rec = serveServer(NewServer(store), testAdmin,
+		httptest.NewRequest("POST", "/doctors", strings.NewReader(`{"name": "Anoosh Gilliam"}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	rec = serveStore(store, httptest.NewRequest("GET", "/completedappointments/appointmentuuid/"+patientUUID.String(), nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("completed appointment: got %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// patients of a doctor are not skipped as missing while unreachable
+	doctorUUID := testUser.UserUUID
+	store.CompleteAppointment(CompletedAppointment{AppointmentUUID: gocql.TimeUUID(),
+		PatientUUID: patientUUID, DoctorUUID: doctorUUID})
+	rec = serveStore(store, httptest.NewRequest("GET", "/patients/doctoruuid/"+doctorUUID.String(), nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("patients of a doctor: got %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gocql/gocql"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper-cased flag name to form the
+// environment variable for a setting, e.g. -listen-addr is EMR_LISTEN_ADDR
+const envPrefix = "EMR_"
+
+// Config holds every setting of the service. Values are read, lowest
+// precedence first, from the defaults, the config file, EMR_* environment
+// variables and the command line flags.
+type Config struct {
+	ListenAddr string          `yaml:"listenAddr" toml:"listenAddr"`
+	Timeouts   TimeoutConfig   `yaml:"timeouts" toml:"timeouts"`
+	Storage    string          `yaml:"storage" toml:"storage"`
+	SQLitePath string          `yaml:"sqlitePath" toml:"sqlitePath"`
+	Cassandra  CassandraConfig `yaml:"cassandra" toml:"cassandra"`
+	TLS        TLSConfig       `yaml:"tls" toml:"tls"`
+	Session    SessionConfig   `yaml:"session" toml:"session"`
+	JWT        JWTConfig       `yaml:"jwt" toml:"jwt"`
+	Login      LoginConfig     `yaml:"login" toml:"login"`
+	TOTP       TOTPConfig      `yaml:"totp" toml:"totp"`
+	Password   PasswordConfig  `yaml:"password" toml:"password"`
+	Mail       MailConfig      `yaml:"mail" toml:"mail"`
+	OIDC       OIDCConfig      `yaml:"oidc" toml:"oidc"`
+	// InviteTTL is how long an invitation code of a doctor may be used
+	InviteTTL time.Duration `yaml:"inviteTTL" toml:"inviteTTL"`
+	// APIKeyMaxTTL is the longest lifetime of an API key, given to keys
+	// created without an expiry
+	APIKeyMaxTTL time.Duration `yaml:"apiKeyMaxTTL" toml:"apiKeyMaxTTL"`
+	// CORSOrigins lists the origins allowed to call the API, "*" allows any
+	CORSOrigins []string `yaml:"corsOrigins" toml:"corsOrigins"`
+	// MaxUploadSize is the largest accepted document upload in bytes
+	MaxUploadSize int64  `yaml:"maxUploadSize" toml:"maxUploadSize"`
+	LogLevel      string `yaml:"logLevel" toml:"logLevel"`
+	// LogPseudonymKey keys the hashes logged in place of patient
+	// identifiers; a random key is used when empty
+	LogPseudonymKey string `yaml:"logPseudonymKey" toml:"logPseudonymKey"`
+}
+
+// TLSConfig describes HTTPS serving; the server listens on plain HTTP when
+// neither a certificate nor dev mode is configured
+type TLSConfig struct {
+	CertFile string `yaml:"certFile" toml:"certFile"`
+	KeyFile  string `yaml:"keyFile" toml:"keyFile"`
+	// ReloadInterval is how often the certificate files are checked for
+	// changes
+	ReloadInterval time.Duration `yaml:"reloadInterval" toml:"reloadInterval"`
+	// ClientCAFile enables client certificate authentication against the
+	// CAs it holds; ClientAuth is "optional" or "require". Certificates
+	// authenticate the connection only, callers are identified by their
+	// session, token or API key.
+	ClientCAFile string `yaml:"clientCAFile" toml:"clientCAFile"`
+	ClientAuth   string `yaml:"clientAuth" toml:"clientAuth"`
+	// RedirectAddr, when set, is a plain HTTP listener redirecting to HTTPS
+	RedirectAddr string `yaml:"redirectAddr" toml:"redirectAddr"`
+	// Dev generates a CA and a certificate for DevHosts in DevDir instead
+	// of reading CertFile and KeyFile
+	Dev      bool     `yaml:"dev" toml:"dev"`
+	DevDir   string   `yaml:"devDir" toml:"devDir"`
+	DevHosts []string `yaml:"devHosts" toml:"devHosts"`
+}
+
+// Enabled reports whether the server listens on HTTPS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.Dev
+}
+
+// SessionConfig describes the login sessions and their cookie
+type SessionConfig struct {
+	// TTL is how long a session lasts without being rotated
+	TTL time.Duration `yaml:"ttl" toml:"ttl"`
+	// RotateAfter is the age at which a session in use is replaced by a new
+	// one, extending it by TTL
+	RotateAfter time.Duration `yaml:"rotateAfter" toml:"rotateAfter"`
+	// CookieSecure restricts the cookie to HTTPS; browsers make an exception
+	// for localhost
+	CookieSecure bool `yaml:"cookieSecure" toml:"cookieSecure"`
+	// CookieSameSite is "strict" or "lax"
+	CookieSameSite string `yaml:"cookieSameSite" toml:"cookieSameSite"`
+}
+
+// JWTConfig describes the bearer tokens issued to API and mobile clients;
+// they are disabled when KeyDir is empty
+type JWTConfig struct {
+	// KeyDir holds one file per key ID: <kid>.key is an HS256 secret,
+	// <kid>.pem an RSA private key, or public key for verification only
+	KeyDir string `yaml:"keyDir" toml:"keyDir"`
+	// SigningKey is the ID of the key signing new tokens, the others only
+	// verify tokens issued before a rotation
+	SigningKey string        `yaml:"signingKey" toml:"signingKey"`
+	Issuer     string        `yaml:"issuer" toml:"issuer"`
+	AccessTTL  time.Duration `yaml:"accessTTL" toml:"accessTTL"`
+	RefreshTTL time.Duration `yaml:"refreshTTL" toml:"refreshTTL"`
+}
+
+// LoginConfig describes the throttling of failed logins, counted per
+// account and per client IP
+type LoginConfig struct {
+	// MaxFailures locks an account for Lockout once reached
+	MaxFailures int `yaml:"maxFailures" toml:"maxFailures"`
+	// IPMaxFailures locks out a client IP, whatever accounts it tries
+	IPMaxFailures int `yaml:"ipMaxFailures" toml:"ipMaxFailures"`
+	// BaseDelay is the wait imposed after the first failure, doubled after
+	// each further one up to MaxDelay
+	BaseDelay time.Duration `yaml:"baseDelay" toml:"baseDelay"`
+	MaxDelay  time.Duration `yaml:"maxDelay" toml:"maxDelay"`
+	Lockout   time.Duration `yaml:"lockout" toml:"lockout"`
+	// ResetAfter is how long after the last failure the count starts over
+	ResetAfter time.Duration `yaml:"resetAfter" toml:"resetAfter"`
+}
+
+// TOTPConfig describes the TOTP two-factor authentication of logins
+type TOTPConfig struct {
+	// Issuer names the service in authenticator apps
+	Issuer string `yaml:"issuer" toml:"issuer"`
+	// RequiredRoles must enable two-factor authentication; until they do,
+	// their sessions may only enroll
+	RequiredRoles []string `yaml:"requiredRoles" toml:"requiredRoles"`
+	// ChallengeTTL is how long the second login step may take
+	ChallengeTTL time.Duration `yaml:"challengeTTL" toml:"challengeTTL"`
+}
+
+// PasswordConfig describes the password policy, how passwords are hashed,
+// and password resets
+type PasswordConfig struct {
+	// MinLength and MaxLength bound passwords in characters; bcrypt also
+	// limits them to 56 bytes
+	MinLength int `yaml:"minLength" toml:"minLength"`
+	MaxLength int `yaml:"maxLength" toml:"maxLength"`
+	// BreachedList is a file of passwords, or of their SHA-1 hashes, that
+	// may not be chosen
+	BreachedList string `yaml:"breachedList" toml:"breachedList"`
+	// Hash is "bcrypt" or "argon2id". Passwords hashed with another
+	// algorithm or cost are rehashed at the next login.
+	Hash       string `yaml:"hash" toml:"hash"`
+	BcryptCost int    `yaml:"bcryptCost" toml:"bcryptCost"`
+	// Argon2Memory is in KiB
+	Argon2Memory  uint `yaml:"argon2Memory" toml:"argon2Memory"`
+	Argon2Time    uint `yaml:"argon2Time" toml:"argon2Time"`
+	Argon2Threads uint `yaml:"argon2Threads" toml:"argon2Threads"`
+	// ResetTTL is how long an emailed reset token may be used
+	ResetTTL time.Duration `yaml:"resetTTL" toml:"resetTTL"`
+	// ResetURL is the web page completing a reset, linked in the email with
+	// the token appended as ?token=; the bare token is sent when empty
+	ResetURL string `yaml:"resetURL" toml:"resetURL"`
+}
+
+// MailConfig describes how email is sent
+type MailConfig struct {
+	// Sender is "smtp", or "log" and "file" for development, which log the
+	// messages or write them to Dir
+	Sender string `yaml:"sender" toml:"sender"`
+	From   string `yaml:"from" toml:"from"`
+	Dir    string `yaml:"dir" toml:"dir"`
+	// SMTPAddr is the host:port of the relay
+	SMTPAddr     string `yaml:"smtpAddr" toml:"smtpAddr"`
+	SMTPUsername string `yaml:"smtpUsername" toml:"smtpUsername"`
+	SMTPPassword string `yaml:"smtpPassword" toml:"smtpPassword"`
+}
+
+// OIDCConfig describes single sign-on through an OpenID Connect provider;
+// it is disabled when Issuer is empty
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, whose endpoints are discovered at
+	// Issuer/.well-known/openid-configuration
+	Issuer       string `yaml:"issuer" toml:"issuer"`
+	ClientID     string `yaml:"clientID" toml:"clientID"`
+	ClientSecret string `yaml:"clientSecret" toml:"clientSecret"`
+	// RedirectURL is the public URL of /login/oidc/callback, as registered
+	// with the provider
+	RedirectURL string   `yaml:"redirectURL" toml:"redirectURL"`
+	Scopes      []string `yaml:"scopes" toml:"scopes"`
+	// UsernameClaim names the ID token claim used as username when the
+	// user is provisioned
+	UsernameClaim string `yaml:"usernameClaim" toml:"usernameClaim"`
+	// RoleClaim names the claim holding the groups or roles of the user,
+	// a string or a list, and Roles maps its values to Doctor or Admin
+	RoleClaim string            `yaml:"roleClaim" toml:"roleClaim"`
+	Roles     map[string]string `yaml:"roles" toml:"roles"`
+	// PostLoginURL is where the browser is sent once logged in
+	PostLoginURL string `yaml:"postLoginURL" toml:"postLoginURL"`
+}
+
+// TimeoutConfig bounds how long a client may take to send a request and
+// read the response, and how long shutdown waits for in-flight requests
+type TimeoutConfig struct {
+	ReadHeader time.Duration `yaml:"readHeader" toml:"readHeader"`
+	Read       time.Duration `yaml:"read" toml:"read"`
+	Write      time.Duration `yaml:"write" toml:"write"`
+	Idle       time.Duration `yaml:"idle" toml:"idle"`
+	Shutdown   time.Duration `yaml:"shutdown" toml:"shutdown"`
+}
+
+// DefaultConfig matches the previous hardcoded setup
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr: ":8080",
+		Timeouts: TimeoutConfig{
+			ReadHeader: 10 * time.Second,
+			Read:       time.Minute,
+			Write:      time.Minute,
+			Idle:       2 * time.Minute,
+			Shutdown:   30 * time.Second,
+		},
+		Storage:    "cassandra",
+		SQLitePath: "emr.db",
+		Cassandra:  DefaultCassandraConfig(),
+		TLS: TLSConfig{
+			ReloadInterval: 30 * time.Second,
+			ClientAuth:     "optional",
+			DevDir:         "dev-tls",
+			DevHosts:       []string{"localhost", "127.0.0.1", "::1"},
+		},
+		Session: SessionConfig{
+			TTL:            12 * time.Hour,
+			RotateAfter:    15 * time.Minute,
+			CookieSecure:   true,
+			CookieSameSite: "strict",
+		},
+		JWT: JWTConfig{
+			Issuer:     "go-rest",
+			AccessTTL:  15 * time.Minute,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+		Login: LoginConfig{
+			MaxFailures:   5,
+			IPMaxFailures: 50,
+			BaseDelay:     time.Second,
+			MaxDelay:      30 * time.Second,
+			Lockout:       15 * time.Minute,
+			ResetAfter:    time.Hour,
+		},
+		TOTP: TOTPConfig{
+			Issuer:       "EMR",
+			ChallengeTTL: 5 * time.Minute,
+		},
+		Password: PasswordConfig{
+			MinLength:     12,
+			MaxLength:     128,
+			Hash:          "bcrypt",
+			BcryptCost:    bcrypt.DefaultCost,
+			Argon2Memory:  19 * 1024,
+			Argon2Time:    2,
+			Argon2Threads: 1,
+			ResetTTL:      time.Hour,
+		},
+		Mail: MailConfig{
+			Sender: "log",
+			From:   "EMR <emr@localhost>",
+			Dir:    "mail",
+		},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"openid", "profile", "email"},
+			UsernameClaim: "preferred_username",
+			RoleClaim:     "groups",
+			PostLoginURL:  "/",
+		},
+		InviteTTL:     7 * 24 * time.Hour,
+		APIKeyMaxTTL:  365 * 24 * time.Hour,
+		CORSOrigins:   []string{"*"},
+		MaxUploadSize: 32 << 20,
+		LogLevel:      "info",
+	}
+}
+
+// stringList is a comma separated list flag
+type stringList struct {
+	list *[]string
+}
+
+func (s stringList) String() string {
+	if s.list == nil {
+		return ""
+	}
+	return strings.Join(*s.list, ",")
+}
+
+func (s stringList) Set(value string) error {
+	*s.list = nil
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s.list = append(*s.list, v)
+		}
+	}
+	return nil
+}
+
+// stringMap is a comma separated list of key=value pairs flag
+type stringMap struct {
+	m *map[string]string
+}
+
+func (s stringMap) String() string {
+	if s.m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*s.m))
+	for k, v := range *s.m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (s stringMap) Set(value string) error {
+	*s.m = map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("%q is not key=value", pair)
+		}
+		(*s.m)[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return nil
+}
+
+// flagSet binds a flag to every setting of c
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.ListenAddr, "listen-addr", c.ListenAddr, "address to listen on")
+	fs.DurationVar(&c.Timeouts.ReadHeader, "read-header-timeout", c.Timeouts.ReadHeader, "time allowed to read request headers")
+	fs.DurationVar(&c.Timeouts.Read, "read-timeout", c.Timeouts.Read, "time allowed to read a whole request, including uploads")
+	fs.DurationVar(&c.Timeouts.Write, "write-timeout", c.Timeouts.Write, "time allowed to write a response")
+	fs.DurationVar(&c.Timeouts.Idle, "idle-timeout", c.Timeouts.Idle, "time an idle keep-alive connection is kept open")
+	fs.DurationVar(&c.Timeouts.Shutdown, "shutdown-timeout", c.Timeouts.Shutdown, "time allowed for in-flight requests to finish on shutdown")
+	fs.StringVar(&c.Storage, "storage", c.Storage, "storage backend: cassandra, sqlite or memory")
+	fs.StringVar(&c.SQLitePath, "sqlite-path", c.SQLitePath, "database file for the sqlite storage backend")
+	fs.Var(stringList{&c.Cassandra.Hosts}, "cassandra-hosts", "comma separated Cassandra contact points")
+	fs.StringVar(&c.Cassandra.Keyspace, "cassandra-keyspace", c.Cassandra.Keyspace, "Cassandra keyspace")
+	fs.StringVar(&c.Cassandra.Username, "cassandra-username", c.Cassandra.Username, "Cassandra username")
+	fs.StringVar(&c.Cassandra.Password, "cassandra-password", c.Cassandra.Password, "Cassandra password")
+	fs.StringVar(&c.Cassandra.Replication, "cassandra-replication", c.Cassandra.Replication, "replication map used when migrate creates the keyspace")
+	fs.StringVar(&c.Cassandra.Consistency, "cassandra-consistency", c.Cassandra.Consistency, "Cassandra write consistency")
+	fs.StringVar(&c.Cassandra.ReadConsistency, "cassandra-read-consistency", c.Cassandra.ReadConsistency, "Cassandra read consistency")
+	fs.DurationVar(&c.Cassandra.Timeout, "cassandra-timeout", c.Cassandra.Timeout, "Cassandra query timeout")
+	fs.DurationVar(&c.Cassandra.ConnectTimeout, "cassandra-connect-timeout", c.Cassandra.ConnectTimeout, "Cassandra connection timeout")
+	fs.IntVar(&c.Cassandra.NumConns, "cassandra-conns", c.Cassandra.NumConns, "pooled Cassandra connections per host")
+	fs.IntVar(&c.Cassandra.RetryAttempts, "cassandra-retries", c.Cassandra.RetryAttempts, "retries for a failed Cassandra query")
+	fs.DurationVar(&c.Cassandra.ReconnectInterval, "cassandra-reconnect-interval", c.Cassandra.ReconnectInterval, "interval between reconnection attempts to down hosts")
+	fs.IntVar(&c.Cassandra.ConnectAttempts, "cassandra-connect-attempts", c.Cassandra.ConnectAttempts, "attempts to reach the cluster at startup")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile, "PEM certificate file, enables HTTPS")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile, "PEM private key file for -tls-cert")
+	fs.DurationVar(&c.TLS.ReloadInterval, "tls-reload-interval", c.TLS.ReloadInterval, "how often the certificate files are checked for changes")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", c.TLS.ClientCAFile, "PEM CA bundle, enables client certificate authentication of connections")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "client certificates: optional or require")
+	fs.StringVar(&c.TLS.RedirectAddr, "tls-redirect-addr", c.TLS.RedirectAddr, "plain HTTP address redirecting to HTTPS, e.g. :80")
+	fs.BoolVar(&c.TLS.Dev, "tls-dev", c.TLS.Dev, "serve HTTPS with a generated development CA and certificate")
+	fs.StringVar(&c.TLS.DevDir, "tls-dev-dir", c.TLS.DevDir, "directory for the generated development certificates")
+	fs.Var(stringList{&c.TLS.DevHosts}, "tls-dev-hosts", "comma separated DNS names and IPs of the development certificate")
+	fs.DurationVar(&c.Session.TTL, "session-ttl", c.Session.TTL, "how long a login session lasts without being rotated")
+	fs.DurationVar(&c.Session.RotateAfter, "session-rotate-after", c.Session.RotateAfter, "age at which a session in use is replaced by a new one")
+	fs.BoolVar(&c.Session.CookieSecure, "session-cookie-secure", c.Session.CookieSecure, "send the session cookie over HTTPS only")
+	fs.StringVar(&c.Session.CookieSameSite, "session-cookie-samesite", c.Session.CookieSameSite, "SameSite attribute of the session cookie: strict or lax")
+	fs.StringVar(&c.JWT.KeyDir, "jwt-key-dir", c.JWT.KeyDir, "directory of JWT keys, <kid>.key (HS256) or <kid>.pem (RS256); enables bearer tokens")
+	fs.StringVar(&c.JWT.SigningKey, "jwt-signing-key", c.JWT.SigningKey, "ID of the key signing new JWTs")
+	fs.StringVar(&c.JWT.Issuer, "jwt-issuer", c.JWT.Issuer, "issuer of the JWTs")
+	fs.DurationVar(&c.JWT.AccessTTL, "jwt-access-ttl", c.JWT.AccessTTL, "lifetime of JWT access tokens")
+	fs.DurationVar(&c.JWT.RefreshTTL, "jwt-refresh-ttl", c.JWT.RefreshTTL, "lifetime of refresh tokens")
+	fs.IntVar(&c.Login.MaxFailures, "login-max-failures", c.Login.MaxFailures, "failed logins after which an account is locked")
+	fs.IntVar(&c.Login.IPMaxFailures, "login-ip-max-failures", c.Login.IPMaxFailures, "failed logins after which a client IP is locked out")
+	fs.DurationVar(&c.Login.BaseDelay, "login-base-delay", c.Login.BaseDelay, "wait imposed after a failed login, doubled after each further failure")
+	fs.DurationVar(&c.Login.MaxDelay, "login-max-delay", c.Login.MaxDelay, "longest wait imposed between failed logins before lockout")
+	fs.DurationVar(&c.Login.Lockout, "login-lockout", c.Login.Lockout, "how long a locked account or client IP cannot log in")
+	fs.DurationVar(&c.Login.ResetAfter, "login-reset-after", c.Login.ResetAfter, "time after the last failed login at which the count starts over")
+	fs.StringVar(&c.TOTP.Issuer, "totp-issuer", c.TOTP.Issuer, "service name shown in TOTP authenticator apps")
+	fs.Var(stringList{&c.TOTP.RequiredRoles}, "totp-required-roles", "comma separated roles that must enable TOTP two-factor authentication")
+	fs.DurationVar(&c.TOTP.ChallengeTTL, "totp-challenge-ttl", c.TOTP.ChallengeTTL, "time allowed to enter the TOTP code after the password")
+	fs.IntVar(&c.Password.MinLength, "password-min-length", c.Password.MinLength, "shortest password accepted, in characters")
+	fs.IntVar(&c.Password.MaxLength, "password-max-length", c.Password.MaxLength, "longest password accepted, in characters")
+	fs.StringVar(&c.Password.BreachedList, "password-breached-list", c.Password.BreachedList, "file of breached passwords, or of their SHA-1 hashes, that may not be chosen")
+	fs.StringVar(&c.Password.Hash, "password-hash", c.Password.Hash, "password hashing algorithm: bcrypt or argon2id")
+	fs.IntVar(&c.Password.BcryptCost, "password-bcrypt-cost", c.Password.BcryptCost, "bcrypt cost of password hashes")
+	fs.UintVar(&c.Password.Argon2Memory, "password-argon2-memory", c.Password.Argon2Memory, "argon2id memory of password hashes, in KiB")
+	fs.UintVar(&c.Password.Argon2Time, "password-argon2-time", c.Password.Argon2Time, "argon2id iterations of password hashes")
+	fs.UintVar(&c.Password.Argon2Threads, "password-argon2-threads", c.Password.Argon2Threads, "argon2id parallelism of password hashes")
+	fs.DurationVar(&c.Password.ResetTTL, "password-reset-ttl", c.Password.ResetTTL, "how long an emailed password reset token may be used")
+	fs.StringVar(&c.Password.ResetURL, "password-reset-url", c.Password.ResetURL, "web page completing a password reset, linked with ?token= in the email")
+	fs.StringVar(&c.Mail.Sender, "mail-sender", c.Mail.Sender, "how email is sent: smtp, or log and file for development")
+	fs.StringVar(&c.Mail.From, "mail-from", c.Mail.From, "sender address of email")
+	fs.StringVar(&c.Mail.Dir, "mail-dir", c.Mail.Dir, "directory the file mail sender writes messages to")
+	fs.StringVar(&c.Mail.SMTPAddr, "mail-smtp-addr", c.Mail.SMTPAddr, "host:port of the SMTP relay")
+	fs.StringVar(&c.Mail.SMTPUsername, "mail-smtp-username", c.Mail.SMTPUsername, "SMTP username")
+	fs.StringVar(&c.Mail.SMTPPassword, "mail-smtp-password", c.Mail.SMTPPassword, "SMTP password")
+	fs.StringVar(&c.OIDC.Issuer, "oidc-issuer", c.OIDC.Issuer, "URL of the OpenID Connect provider, enables single sign-on")
+	fs.StringVar(&c.OIDC.ClientID, "oidc-client-id", c.OIDC.ClientID, "client ID registered with the OpenID Connect provider")
+	fs.StringVar(&c.OIDC.ClientSecret, "oidc-client-secret", c.OIDC.ClientSecret, "client secret registered with the OpenID Connect provider, empty for a public client")
+	fs.StringVar(&c.OIDC.RedirectURL, "oidc-redirect-url", c.OIDC.RedirectURL, "public URL of /login/oidc/callback registered with the provider")
+	fs.Var(stringList{&c.OIDC.Scopes}, "oidc-scopes", "comma separated scopes requested from the OpenID Connect provider")
+	fs.StringVar(&c.OIDC.UsernameClaim, "oidc-username-claim", c.OIDC.UsernameClaim, "ID token claim used as username of provisioned users")
+	fs.StringVar(&c.OIDC.RoleClaim, "oidc-role-claim", c.OIDC.RoleClaim, "ID token claim holding the groups or roles of the user")
+	fs.Var(stringMap{&c.OIDC.Roles}, "oidc-roles", "comma separated claim values and the role they map to, e.g. emr-doctors=Doctor")
+	fs.StringVar(&c.OIDC.PostLoginURL, "oidc-post-login-url", c.OIDC.PostLoginURL, "where the browser is sent after a single sign-on login")
+	fs.DurationVar(&c.InviteTTL, "invite-ttl", c.InviteTTL, "how long an invitation code of a doctor may be used")
+	fs.DurationVar(&c.APIKeyMaxTTL, "api-key-max-ttl", c.APIKeyMaxTTL, "longest lifetime of an API key, given to keys created without an expiry")
+	fs.Var(stringList{&c.CORSOrigins}, "cors-origins", "comma separated origins allowed by CORS, * allows any")
+	fs.Int64Var(&c.MaxUploadSize, "max-upload-size", c.MaxUploadSize, "largest accepted document upload in bytes")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error")
+	fs.StringVar(&c.LogPseudonymKey, "log-pseudonym-key", c.LogPseudonymKey, "secret keying the hashes logged in place of patient identifiers")
+	return fs
+}
+
+// envName returns the environment variable read for the named flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// LoadConfig builds the configuration from args, the environment looked up
+// through lookupEnv and the file named by -config or EMR_CONFIG, and
+// validates it
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	c := DefaultConfig()
+	err := c.load(c.flagSet("go-rest"), args, lookupEnv)
+	return c, err
+}
+
+// load applies the config file, environment and args to c through the flags
+// of fs, which must have been returned by c.flagSet
+func (c *Config) load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) error {
+	path := fs.String("config", "", "YAML (.yaml, .yml) or TOML (.toml) configuration file")
+
+	// the flags are parsed twice: first to find the config file, then again
+	// after the file and environment so that they take precedence
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	if *path == "" {
+		*path, _ = lookupEnv(envName("config"))
+	}
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return err
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := lookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return envErr
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+// readFile decodes the config file at path over c, rejecting unknown keys
+func (c *Config) readFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(content), c)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("%s: config file must end in .yaml, .yml or .toml", path)
+	}
+	return nil
+}
+
+var keyspaceName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+
+// Validate reports every invalid setting of c in a single error
+func (c Config) Validate() error {
+	var problems []string
+	invalid := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("listen address %q: %v", c.ListenAddr, err)
+	}
+
+	for _, timeout := range []time.Duration{c.Timeouts.ReadHeader, c.Timeouts.Read,
+		c.Timeouts.Write, c.Timeouts.Idle, c.Timeouts.Shutdown} {
+		if timeout <= 0 {
+			invalid("server timeouts must be positive")
+			break
+		}
+	}
+
+	switch c.Storage {
+	case "cassandra":
+		if len(c.Cassandra.Hosts) == 0 {
+			invalid("at least one Cassandra host is required")
+		}
+		if !keyspaceName.MatchString(c.Cassandra.Keyspace) {
+			invalid("Cassandra keyspace %q is not a valid name", c.Cassandra.Keyspace)
+		}
+		if !strings.HasPrefix(strings.TrimSpace(c.Cassandra.Replication), "{") {
+			invalid("Cassandra replication must be a CQL map such as {'class': 'SimpleStrategy', 'replication_factor': '1'}")
+		}
+		if c.Cassandra.Password != "" && c.Cassandra.Username == "" {
+			invalid("Cassandra password given without a username")
+		}
+		for _, consistency := range []string{c.Cassandra.Consistency, c.Cassandra.ReadConsistency} {
+			if _, err := gocql.ParseConsistencyWrapper(consistency); err != nil {
+				invalid("%v", err)
+			}
+		}
+		if c.Cassandra.Timeout <= 0 || c.Cassandra.ConnectTimeout <= 0 {
+			invalid("Cassandra timeouts must be positive")
+		}
+		if c.Cassandra.NumConns < 1 || c.Cassandra.ConnectAttempts < 1 {
+			invalid("Cassandra connections and connect attempts must be at least 1")
+		}
+		if c.Cassandra.RetryAttempts < 0 {
+			invalid("Cassandra retries must not be negative")
+		}
+	case "sqlite":
+		if c.SQLitePath == "" {
+			invalid("SQLite path is required")
+		}
+	case "memory":
+	default:
+		invalid("unknown storage backend %q", c.Storage)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		invalid("TLS certificate and key must be given together")
+	}
+	if c.TLS.Dev && c.TLS.CertFile != "" {
+		invalid("TLS dev mode generates its own certificate, do not give one")
+	}
+	if c.TLS.Dev && (c.TLS.DevDir == "" || len(c.TLS.DevHosts) == 0) {
+		invalid("TLS dev mode needs a directory and at least one host")
+	}
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			invalid("TLS file: %v", err)
+		}
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		invalid("TLS reload interval must be positive")
+	}
+	if c.TLS.ClientAuth != "optional" && c.TLS.ClientAuth != "require" {
+		invalid("TLS client auth must be optional or require, not %q", c.TLS.ClientAuth)
+	}
+	if !c.TLS.Enabled() && (c.TLS.ClientCAFile != "" || c.TLS.RedirectAddr != "") {
+		invalid("TLS client CA and redirect need a certificate or dev mode")
+	}
+	if c.TLS.RedirectAddr != "" {
+		if _, _, err := net.SplitHostPort(c.TLS.RedirectAddr); err != nil {
+			invalid("TLS redirect address %q: %v", c.TLS.RedirectAddr, err)
+		} else if c.TLS.RedirectAddr == c.ListenAddr {
+			invalid("TLS redirect address must differ from the listen address")
+		}
+	}
+
+	if c.Session.TTL <= 0 || c.Session.RotateAfter <= 0 {
+		invalid("session TTL and rotation age must be positive")
+	} else if c.Session.RotateAfter >= c.Session.TTL {
+		invalid("session rotation age must be shorter than the session TTL")
+	}
+	if c.Session.CookieSameSite != "strict" && c.Session.CookieSameSite != "lax" {
+		invalid("session cookie SameSite must be strict or lax, not %q", c.Session.CookieSameSite)
+	}
+
+	if c.JWT.KeyDir != "" {
+		if c.JWT.SigningKey == "" {
+			invalid("JWT signing key ID is required with a key directory")
+		}
+		if c.JWT.AccessTTL <= 0 || c.JWT.RefreshTTL <= c.JWT.AccessTTL {
+			invalid("JWT access TTL must be positive and shorter than the refresh TTL")
+		}
+	}
+
+	if c.Login.MaxFailures < 1 || c.Login.IPMaxFailures < 1 {
+		invalid("login failure limits must be at least 1")
+	}
+	if c.Login.BaseDelay <= 0 || c.Login.MaxDelay < c.Login.BaseDelay {
+		invalid("login base delay must be positive and at most the maximum delay")
+	}
+	if c.Login.Lockout <= 0 || c.Login.ResetAfter < c.Login.Lockout {
+		invalid("login lockout must be positive and at most the reset time")
+	}
+
+	if c.TOTP.Issuer == "" || strings.Contains(c.TOTP.Issuer, ":") {
+		invalid("TOTP issuer must be set and cannot contain a colon")
+	}
+	for _, role := range c.TOTP.RequiredRoles {
+		if role != RolePatient && role != RoleDoctor && role != RoleAdmin {
+			invalid("unknown role %q requiring TOTP", role)
+		}
+	}
+	if c.TOTP.ChallengeTTL <= 0 {
+		invalid("TOTP challenge TTL must be positive")
+	}
+
+	if c.Password.MinLength < 1 || c.Password.MaxLength < c.Password.MinLength {
+		invalid("password minimum length must be at least 1 and at most the maximum length")
+	}
+	if c.Password.BreachedList != "" {
+		if _, err := os.Stat(c.Password.BreachedList); err != nil {
+			invalid("breached password list: %v", err)
+		}
+	}
+	switch c.Password.Hash {
+	case "bcrypt":
+		if c.Password.BcryptCost < bcrypt.MinCost || c.Password.BcryptCost > bcrypt.MaxCost {
+			invalid("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		if c.Password.MinLength > bcryptMaxPassword {
+			invalid("bcrypt cannot hash passwords longer than %d bytes", bcryptMaxPassword)
+		}
+	case "argon2id":
+		if c.Password.Argon2Time < 1 || c.Password.Argon2Threads < 1 || c.Password.Argon2Threads > 255 {
+			invalid("argon2id time must be at least 1 and threads between 1 and 255")
+		}
+		if c.Password.Argon2Memory < 8*c.Password.Argon2Threads {
+			invalid("argon2id memory must be at least 8 KiB per thread")
+		}
+	default:
+		invalid("unknown password hash %q", c.Password.Hash)
+	}
+	if c.Password.ResetTTL <= 0 {
+		invalid("password reset TTL must be positive")
+	}
+	if c.Password.ResetURL != "" {
+		u, err := url.Parse(c.Password.ResetURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.RawQuery != "" || u.Fragment != "" {
+			invalid("password reset URL %q must be an http(s) URL without a query", c.Password.ResetURL)
+		}
+	}
+
+	switch c.Mail.Sender {
+	case "log":
+	case "file":
+		if c.Mail.Dir == "" {
+			invalid("mail directory is required by the file sender")
+		}
+	case "smtp":
+		if _, _, err := net.SplitHostPort(c.Mail.SMTPAddr); err != nil {
+			invalid("SMTP address %q: %v", c.Mail.SMTPAddr, err)
+		}
+	default:
+		invalid("unknown mail sender %q", c.Mail.Sender)
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		invalid("mail sender address %q: %v", c.Mail.From, err)
+	}
+	if c.Mail.SMTPPassword != "" && c.Mail.SMTPUsername == "" {
+		invalid("SMTP password given without a username")
+	}
+
+	if c.OIDC.Issuer != "" {
+		if !oidcURL(c.OIDC.Issuer) {
+			invalid("OIDC issuer %q must be an https URL, or http on localhost", c.OIDC.Issuer)
+		}
+		if c.OIDC.ClientID == "" {
+			invalid("OIDC client ID is required with an issuer")
+		}
+		if u, err := url.Parse(c.OIDC.RedirectURL); err != nil || !oidcURL(c.OIDC.RedirectURL) ||
+			u.RawQuery != "" || u.Fragment != "" {
+			invalid("OIDC redirect URL %q must be an https URL without a query, or http on localhost",
+				c.OIDC.RedirectURL)
+		}
+		openid := false
+		for _, scope := range c.OIDC.Scopes {
+			openid = openid || scope == "openid"
+		}
+		if !openid {
+			invalid("OIDC scopes must include openid")
+		}
+		if c.OIDC.UsernameClaim == "" || c.OIDC.RoleClaim == "" {
+			invalid("OIDC username and role claims are required")
+		}
+		if len(c.OIDC.Roles) == 0 {
+			invalid("OIDC roles must map at least one claim value to a role")
+		}
+		for value, role := range c.OIDC.Roles {
+			if role != RoleDoctor && role != RoleAdmin {
+				invalid("OIDC role of %q must be Doctor or Admin, not %q", value, role)
+			}
+		}
+	}
+
+	if c.InviteTTL <= 0 {
+		invalid("invite TTL must be positive")
+	}
+	if c.APIKeyMaxTTL <= 0 {
+		invalid("API key max TTL must be positive")
+	}
+
+	if len(c.CORSOrigins) == 0 {
+		invalid("at least one CORS origin is required, use * to allow any")
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") {
+			invalid("CORS origin %q must be * or scheme://host[:port]", origin)
+		}
+	}
+
+	if c.MaxUploadSize <= 0 {
+		invalid("max upload size must be positive")
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		invalid("unknown log level %q", c.LogLevel)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// oidcURL reports whether raw is an https URL, or an http URL on localhost
+// for development against a local provider
+func oidcURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return u.Scheme == "https" || u.Scheme == "http"
+	}
+	return u.Scheme == "https"
+}
+
+// String renders c as YAML with secrets masked, for logging at startup
+func (c Config) String() string {
+	if c.Cassandra.Password != "" {
+		c.Cassandra.Password = "********"
+	}
+	if c.LogPseudonymKey != "" {
+		c.LogPseudonymKey = "********"
+	}
+	if c.Mail.SMTPPassword != "" {
+		c.Mail.SMTPPassword = "********"
+	}
+	if c.OIDC.ClientSecret != "" {
+		c.OIDC.ClientSecret = "********"
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEnv returns a lookupEnv func backed by env
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig(nil, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, DefaultConfig()) {
+		t.Errorf("expected defaults, got %+v", cfg)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "emr.yaml", `
+listenAddr: ":9000"
+logLevel: warn
+corsOrigins: ["https://emr.example.com"]
+cassandra:
+  hosts: [10.0.0.1, 10.0.0.2]
+  keyspace: emr_prod
+  timeout: 5s
+`)
+	env := map[string]string{
+		"EMR_CONFIG":          path,
+		"EMR_LISTEN_ADDR":     ":9001",
+		"EMR_LOG_LEVEL":       "debug",
+		"EMR_CASSANDRA_CONNS": "4",
+	}
+	cfg, err := LoadConfig([]string{"-listen-addr", ":9002"}, testEnv(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ListenAddr != ":9002" {
+		t.Errorf("flag should override environment, got %s", cfg.ListenAddr)
+	}
+	if cfg.LogLevel != "debug" || cfg.Cassandra.NumConns != 4 {
+		t.Errorf("environment should override file, got %s and %d",
+			cfg.LogLevel, cfg.Cassandra.NumConns)
+	}
+	if !reflect.DeepEqual(cfg.Cassandra.Hosts, []string{"10.0.0.1", "10.0.0.2"}) ||
+		cfg.Cassandra.Keyspace != "emr_prod" || cfg.Cassandra.Timeout != 5*time.Second ||
+		!reflect.DeepEqual(cfg.CORSOrigins, []string{"https://emr.example.com"}) {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	if cfg.Cassandra.ReadConsistency != "ONE" {
+		t.Errorf("settings missing from the file should keep their default, got %s",
+			cfg.Cassandra.ReadConsistency)
+	}
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := writeConfigFile(t, "emr.toml", `
+storage = "sqlite"
+sqlitePath = "/var/lib/emr/emr.db"
+maxUploadSize = 1048576
+
+[cassandra]
+username = "emr"
+password = "secret"
+`)
+	cfg, err := LoadConfig([]string{"-config", path}, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Storage != "sqlite" || cfg.SQLitePath != "/var/lib/emr/emr.db" ||
+		cfg.MaxUploadSize != 1<<20 || cfg.Cassandra.Username != "emr" {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	if strings.Contains(cfg.String(), "secret") {
+		t.Errorf("printed configuration contains the Cassandra password:\n%s", cfg)
+	}
+}
+
+func TestLoadConfigUnknownSetting(t *testing.T) {
+	path := writeConfigFile(t, "emr.yaml", "listenAdress: \":9000\"\n")
+	if _, err := LoadConfig([]string{"-config", path}, testEnv(nil)); err == nil {
+		t.Error("expected an error for a misspelt setting")
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		args    []string
+		problem string
+	}{
+		{[]string{"-listen-addr", "8080"}, "listen address"},
+		{[]string{"-storage", "mysql"}, "unknown storage backend"},
+		{[]string{"-cassandra-keyspace", "emr-prod"}, "keyspace"},
+		{[]string{"-cassandra-consistency", "MOST"}, "MOST"},
+		{[]string{"-tls-cert", "cert.pem"}, "TLS certificate and key"},
+		{[]string{"-cors-origins", "emr.example.com"}, "CORS origin"},
+		{[]string{"-max-upload-size", "0"}, "upload size"},
+		{[]string{"-log-level", "verbose"}, "log level"},
+		{[]string{"-login-lockout", "2h"}, "login lockout"},
+		{[]string{"-totp-required-roles", "Doctor,Nurse"}, "Nurse"},
+		{[]string{"-mail-sender", "smtp"}, "SMTP address"},
+		{[]string{"-password-hash", "scrypt"}, "password hash"},
+		{[]string{"-password-bcrypt-cost", "40"}, "bcrypt cost"},
+		{[]string{"-password-reset-url", "https://emr.example.com/reset?x=1"}, "password reset URL"},
+		{[]string{"-oidc-issuer", "http://idp.example.com"}, "OIDC issuer"},
+		{[]string{"-oidc-issuer", "https://idp.example.com", "-oidc-roles", "clinicians=Patient"}, "Doctor or Admin"},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(test.args, testEnv(nil))
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%v: expected error about %q, got %v", test.args, test.problem, err)
+		}
+	}
+
+	_, err := LoadConfig(nil, testEnv(map[string]string{"EMR_CASSANDRA_CONNS": "many"}))
+	if err == nil || !strings.Contains(err.Error(), "EMR_CASSANDRA_CONNS") {
+		t.Errorf("expected error naming the environment variable, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeStatus sends a Status JSON body with the given HTTP status code
+func (s *Server) writeStatus(w http.ResponseWriter, r *http.Request, code int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(Status{Code: code, Message: message})
+}
+
+// badRequest sends 400 Bad Request for malformed client input
+func (s *Server) badRequest(w http.ResponseWriter, r *http.Request, message string) {
+	requestLogger(r).Info("Bad request", "reason", message)
+	s.writeStatus(w, r, http.StatusBadRequest, message)
+}
+
+// internalError logs err and sends 503 Service Unavailable if the database
+// cannot be reached, 500 Internal Server Error otherwise
+func (s *Server) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	requestLogger(r).Error("Request failed", "error", err)
+	if err == ErrUnavailable {
+		w.Header().Set("Retry-After", "5")
+		s.writeStatus(w, r, http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+	s.writeStatus(w, r, http.StatusInternalServerError, "Internal Server Error")
+}
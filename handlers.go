@@ -1,82 +1,108 @@
 package main
 
 import (
-	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"net/mail"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gocql/gocql"
-	"golang.org/x/crypto/bcrypt"
 )
 
 func Index(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Welcome!\n")
 }
 
-// Added JSON config file and parser to read from, but removed for demo
-const localDB = "127.0.0.1"
-const sampleKeyspace = "emr"
-
-func PreFlight(w http.ResponseWriter, r *http.Request) {
+func (s *Server) PreFlight(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Length", "0")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
-	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Encoding, Content-Length, Content-Range")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Range, X-Request-ID")
+	s.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Encoding, Content-Length, Content-Range, X-Request-ID")
 
 	w.WriteHeader(http.StatusOK)
 	// json.NewEncoder(w).Encode()
 }
 
-func initializeSession(keyspace string, cassandraNodes ...string) (*gocql.Session, error) {
-	// connect to the cluster of nodes
-	cluster := gocql.NewCluster(cassandraNodes...)
-	cluster.Keyspace = keyspace
-	cluster.Consistency = gocql.Quorum
-	session, err := cluster.CreateSession()
-	if err != nil {
-		panic("Unable to connect to Cassandra")
+// allowOrigin sets Access-Control-Allow-Origin when the request origin is one
+// of the configured CORS origins
+func (s *Server) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			return
+		}
+		if allowed == origin {
+			// browsers only send the session cookie to a named origin
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+// uriUUID parses the trailing UUID of a /{resource}/{key}/{uuid} request URI
+func uriUUID(r *http.Request) (gocql.UUID, error) {
+	URI := strings.Split(r.URL.Path, "/")
+	if len(URI) != 4 {
+		return gocql.UUID{}, errors.New("improper URI")
 	}
-	return session, nil
+	return gocql.ParseUUID(URI[3])
 }
 
 /*
-Validates a user credentials
+Validates a user credentials, starting a session or, when the form sets
+tokens=true, returning a JWT access token and a refresh token. Users with
+two-factor authentication get a token to send to /login/totp with their
+code instead.
 Method: POST
 Endpoint: /login
 */
-func UserAuthenticate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) UserAuthenticate(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
 	}
 
-	username := r.Form["username"][0]
-	password := r.Form["password"][0]
-	var salt []byte
-	var saltedHash []byte
-	// login successful, so make second query to get desired values
-	var userUUID gocql.UUID
-	var role string
-	var name string
+	username := r.Form.Get("username")
+	password := r.Form.Get("password")
+	if username == "" || password == "" {
+		s.badRequest(w, r, "Missing username or password")
+		return
+	}
 
-	if err := session.Query(`SELECT name, role, salt, saltedHash, userUUID FROM users
-	WHERE username = ?`, username).Consistency(gocql.One).
-		Scan(&name, &role, &salt, &saltedHash, &userUUID); err != nil {
+	// failed logins are throttled per account and per client IP
+	if wait, err := s.loginWait(r, username); err != nil {
+		s.internalError(w, r, err)
+		return
+	} else if wait > 0 {
+		s.tooManyLogins(w, r, wait)
+		return
+	}
+
+	user, err := s.Users.GetUserByUsername(username)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
+		// unknown usernames count too, so that they cannot be told apart
+		if err := s.loginFailed(r, username); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
 		// Username doesn't exist, but return ambiguous error to user
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusUnauthorized,
 			Message: "Incorrect username or password"})
@@ -85,13 +111,14 @@ func UserAuthenticate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// compare hash(salt + attempted password) with saltedHash
-	passwordPlaintext := append(salt, password...)
-
-	if err := bcrypt.CompareHashAndPassword(saltedHash,
-		passwordPlaintext); err != nil {
+	if err := checkPassword(user, password); err != nil {
+		if err := s.loginFailed(r, username); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
 		// incorrect password, but return ambiguous error to user
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusUnauthorized,
 			Message: "Incorrect username or password"})
@@ -99,13 +126,50 @@ func UserAuthenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Set-Cookie", "userToken=test; Path=/; HttpOnly")
+	setRequestUser(r, user.UserUUID.String())
+	s.rehashPassword(r, user, password)
+	tf, err := s.TwoFactor.GetTwoFactor(user.UserUUID)
+	if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
+	if err == nil && tf.Enabled {
+		s.startChallenge(w, r, user)
+		return
+	}
+	s.completeLogin(w, r, user, false)
+}
+
+// completeLogin starts a session for user, or issues bearer tokens when the
+// form sets tokens=true, once their credentials have been checked
+func (s *Server) completeLogin(w http.ResponseWriter, r *http.Request, user UserAccount, twoFactor bool) {
+	if user.Disabled {
+		s.accountDisabled(w, r, user)
+		return
+	}
+	// the client IP keeps its count, a valid account must not reset it
+	if err := s.LoginAttempts.DeleteLoginAttempts(accountKey(user.Username)); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if r.Form.Get("tokens") == "true" {
+		if s.Tokens == nil {
+			s.badRequest(w, r, "Bearer tokens are not enabled")
+			return
+		}
+		s.issueTokens(w, r, user, twoFactor)
+		return
+	}
+	if err := s.startSession(w, user, twoFactor); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(User{UserUUID: userUUID, Role: role, Name: name}); err != nil {
-		panic(err)
+	if err := json.NewEncoder(w).Encode(User{UserUUID: user.UserUUID, Role: user.Role,
+		Name: user.Name}); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -114,26 +178,23 @@ Search for a user's basic info
 Method: GET
 Endpoint: /users/useruuid/{useruuid}
 */
-func UserGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) UserGet(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	var userUUID gocql.UUID
-	var role string
-	var name string
-
 	// get the user entry
-	if err := session.Query(`SELECT userUUID, role, name FROM users WHERE useruuid=?`,
-		searchUUID).Consistency(gocql.One).Scan(&userUUID, &role, &name); err != nil {
+	user, err := s.Users.GetUserByUUID(searchUUID)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// user not found
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound,
 			Message: "Not Found"})
@@ -143,14 +204,13 @@ func UserGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// User was found
-	if len(userUUID) > 0 {
-		log.Printf("User was found")
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(User{UserUUID: userUUID, Role: role, Name: name}); err != nil {
-			panic(err)
-		}
+	log.Printf("User was found")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(User{UserUUID: user.UserUUID, Role: user.Role,
+		Name: user.Name}); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -159,29 +219,21 @@ Create a user entry
 Method: POST
 Endpoint: /users
 */
-func UserCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) UserCreate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var a User
 	err := decoder.Decode(&a)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
 
 	// generate new randomly generated UUID
 	userUUID, err := gocql.RandomUUID()
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	// randomly generated 16 bytes salt
-	salt := make([]byte, 16)
-	_, saltErr := rand.Read(salt)
-	if saltErr != nil {
-		log.Fatal(err)
+		s.internalError(w, r, err)
+		return
 	}
 
 	username := a.Username
@@ -190,42 +242,91 @@ func UserCreate(w http.ResponseWriter, r *http.Request) {
 	name := a.Name
 	// some control in the URI for user creation
 	// Patient can only create an account if patient entry exist in system
-	// Doctor requires similar functionality but tied to applicatoin access
-	// Not current implmented for doctors
+	// Doctor needs an invitation code issued by an admin for the doctor entry
 	verificationKey := a.VerificationKey
+	// the email address, optional, receives password reset links
+	email := a.Email
+	if email != "" {
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			s.badRequest(w, r, "Invalid email address, expected e.g. name@example.com")
+			return
+		}
+	}
 
-	if role == "Patient" {
-		var patientuuid gocql.UUID
-		// if created user is a patient check if paitnet exists
-		if err := session.Query(`SELECT patientuuid, name FROM patients where medicalNumber = ?`,
-			verificationKey).Consistency(gocql.One).Scan(&patientuuid, &name); err != nil {
+	// roles are matched ignoring case and stored as spelt in access.go
+	switch {
+	case strings.EqualFold(role, RolePatient):
+		role = RolePatient
+	case strings.EqualFold(role, RoleDoctor):
+		role = RoleDoctor
+	case strings.EqualFold(role, RoleAdmin):
+		role = RoleAdmin
+	default:
+		s.badRequest(w, r, "Role must be Patient, Doctor or Admin")
+		return
+	}
+
+	// only admins may create admin accounts
+	principal, signedIn := principalFrom(r.Context())
+	if role == RoleAdmin && principal.Role != RoleAdmin {
+		s.writeStatus(w, r, http.StatusForbidden, "Only admins may create admin accounts")
+		return
+	}
+	if problem := passwordProblem(s.Password, s.BreachedPasswords, username, password); problem != "" {
+		s.badRequest(w, r, problem)
+		return
+	}
+
+	if role == RolePatient {
+		// if created user is a patient check if paitnet exists. An empty
+		// key is refused, it would match patients without a medical number.
+		patient, err := Patient{}, ErrNotFound
+		if verificationKey != "" {
+			patient, err = s.Patients.GetPatientByMedicalNumber(verificationKey)
+		}
+		if err != nil {
+			if err != ErrNotFound {
+				s.internalError(w, r, err)
+				return
+			}
 			// Patient doesn't exist do not create user entry for this patient
 			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
+			s.allowOrigin(w, r)
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]bool{"validError": true, "patientError": true})
 			log.Println(err)
 			log.Printf("Cannot create patient user entry, patient does not exist")
 			return
 		}
-		userUUID = patientuuid
+		userUUID = patient.PatientUUID
+		name = patient.Name
+	} else if role == RoleDoctor {
+		doctor, ok := s.redeemDoctorInvite(w, r, username, verificationKey)
+		if !ok {
+			return
+		}
+		userUUID = doctor.DoctorUUID
+		name = doctor.Name
 	}
 
-	// store salt and salted hash in DB
-	saltedHash, err := bcrypt.GenerateFromPassword(
-		append(salt, password...), bcrypt.DefaultCost)
+	// store a random salt and the salted hash of the password in DB
+	salt, saltedHash, err := hashPassword(s.Password, password)
 	if err != nil {
-		log.Fatal(err)
+		s.internalError(w, r, err)
+		return
 	}
 
-	log.Printf("Created new user: %s\t%s\t%s\t%s\t",
-		username, role, name, userUUID)
+	requestLogger(r).Info("Created new user", "username", username, "role", role,
+		"name", name, "userID", userUUID)
 
-	if insertSuccess, err := session.Query(`INSERT INTO users (username,
-		salt, saltedHash, userUUID, role, name) VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
-		username, salt, saltedHash, userUUID, role, name).ScanCAS(); err != nil || !insertSuccess {
+	if err := s.Users.CreateUser(UserAccount{Username: username, Salt: salt,
+		SaltedHash: saltedHash, UserUUID: userUUID, Role: role, Name: name, Email: email}); err != nil {
+		if err != ErrExists {
+			s.internalError(w, r, err)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]bool{"validError": true, "createUserError": true})
 		log.Println(err)
@@ -233,13 +334,20 @@ func UserCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Set-Cookie", "userToken=test; Path=/; HttpOnly")
+	// self-signup logs the new user in; an admin creating an account keeps
+	// their own session
+	if !signedIn {
+		setRequestUser(r, userUUID.String())
+		if err := s.startSession(w, UserAccount{UserUUID: userUUID, Role: role, Name: name}, false); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(User{UserUUID: userUUID, Role: role, Name: name}); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
@@ -248,56 +356,37 @@ Create a patient entry
 Method: POST
 Endpoint: /patients
 */
-func PatientCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) PatientCreate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var p Patient
 	err := decoder.Decode(&p)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
 
 	// generate new randomly generated UUID (version 4)
-	patientUUID, err := gocql.RandomUUID()
+	p.PatientUUID, err = gocql.RandomUUID()
 	if err != nil {
-		log.Fatal(err)
+		s.internalError(w, r, err)
+		return
 	}
 
-	address := p.Address
-	bloodType := p.BloodType
-	dateOfBirth := p.DateOfBirth
-	emergencyContact := p.EmergencyContact
-	gender := p.Gender
-	medicalNumber := p.MedicalNumber
-	name := p.Name
-	notes := p.Notes
-	phone := p.Phone
-
-	log.Printf("Created new patient: %s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t",
-		patientUUID, address, bloodType, dateOfBirth, emergencyContact, gender,
-		medicalNumber, name, notes, phone)
+	auditResource(r, "patient", p.PatientUUID)
+	auditPatients(r, p.PatientUUID)
+	requestLogger(r).Info("Created new patient", "patientUUID", p.PatientUUID,
+		"medicalNumber", p.MedicalNumber, "name", p.Name, "notes", p.Notes)
 
 	// insert new patient entry
-	if err := session.Query(`INSERT INTO patients (patientUuid,
-		address, bloodType, dateOfBirth, emergencyContact, gender,
-		medicalNumber, name, notes, phone )
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		patientUUID, address, bloodType, dateOfBirth, emergencyContact,
-		gender, medicalNumber, name, notes, phone).Exec(); err != nil {
-		log.Println(err)
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(Status{Code: http.StatusBadRequest,
-			Message: "Patient Not Created"})
+	if err := s.Patients.CreatePatient(p); err != nil {
+		s.internalError(w, r, err)
+		return
 	}
 
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(Status{Code: http.StatusCreated,
 		Message: "Patient entry successfully created."})
@@ -308,32 +397,20 @@ Search for a patient's info
 Method: GET
 Endpoint: /patients/patientuuid/{patientuuid}
 */
-func PatientGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) PatientGet(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	var patientUUID gocql.UUID
-	var address string
-	var bloodType string
-	var dateOfBirth int
-	var emergencyContact string
-	var gender string
-	var medicalNumber string
-	var name string
-	var notes string
-	var phone string
-
 	// get the patient entry
-	if err := session.Query("SELECT * FROM patients WHERE patientUUID = ?",
-		searchUUID).Consistency(gocql.One).Scan(&patientUUID, &address,
-		&bloodType, &dateOfBirth, &emergencyContact, &gender, &medicalNumber,
-		&name, &notes, &phone); err != nil {
+	patient, err := s.Patients.GetPatient(searchUUID)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// patient was not found
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusNotFound)
@@ -344,58 +421,50 @@ func PatientGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// else, patient was found
-	if len(patientUUID) > 0 {
-		log.Printf("Patient was found")
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(Patient{PatientUUID: patientUUID,
-			Address: address, BloodType: bloodType, DateOfBirth: dateOfBirth,
-			EmergencyContact: emergencyContact, Gender: gender,
-			MedicalNumber: medicalNumber, Name: name, Notes: notes,
-			Phone: phone}); err != nil {
-			panic(err)
-		}
+	log.Printf("Patient was found")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(patient); err != nil {
+		log.Println(err)
 	}
 }
 
+// patientSummary trims a patient entry down to the basic info used in lists
+func patientSummary(p Patient) Patient {
+	return Patient{PatientUUID: p.PatientUUID, DateOfBirth: p.DateOfBirth,
+		Gender: p.Gender, Name: p.Name, Phone: p.Phone}
+}
+
 /*
 Returns a list of all patients in the clinic
 Method: GET
 Endpoint: /patients/all
 */
-func PatientListGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) PatientListGet(w http.ResponseWriter, r *http.Request) {
 	// Get all patients of current clinic
-	iter := session.Query("SELECT * FROM patients").Consistency(gocql.One).Iter()
+	patients, err := s.Patients.ListPatients()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
 
-	patientList := make([]Patient, iter.NumRows())
-	i := 0
-	var patientUUID gocql.UUID
-	var dateOfBirth int
-	var gender string
-	var name string
-	var phone string
+	patientList := make([]Patient, len(patients))
 
 	// patients found
-	if iter.NumRows() > 0 {
+	if len(patients) > 0 {
 		log.Printf("Patients found")
-		for iter.Scan(&patientUUID, nil, nil, &dateOfBirth, nil, &gender, nil,
-			&name, nil, &phone) {
-
-			patientList[i] = Patient{PatientUUID: patientUUID, DateOfBirth: dateOfBirth,
-				Gender: gender, Name: name, Phone: phone}
-			i++
+		for i, p := range patients {
+			patientList[i] = patientSummary(p)
+			auditPatients(r, p.PatientUUID)
 		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(patientList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
@@ -404,42 +473,30 @@ Update a patient entry
 Method: PUT
 Endpoint: /patients
 */
-func PatientUpdate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) PatientUpdate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var p Patient
 	err := decoder.Decode(&p)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
 
-	patientUUID := p.PatientUUID
-	address := p.Address
-	bloodType := p.BloodType
-	dateOfBirth := p.DateOfBirth
-	emergencyContact := p.EmergencyContact
-	gender := p.Gender
-	medicalNumber := p.MedicalNumber
-	name := p.Name
-	notes := p.Notes
-	phone := p.Phone
-
-	log.Printf("Updating patient: %s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t",
-		patientUUID, address, bloodType, dateOfBirth, emergencyContact, gender,
-		medicalNumber, name, notes, phone)
+	auditResource(r, "patient", p.PatientUUID)
+	auditPatients(r, p.PatientUUID)
+	requestLogger(r).Info("Updating patient", "patientUUID", p.PatientUUID,
+		"medicalNumber", p.MedicalNumber, "name", p.Name, "notes", p.Notes)
 
 	// update patient entry
-	if err := session.Query(`UPDATE patients SET address = ?, bloodType = ?, dateOfBirth = ?,
-		emergencyContact = ?, gender = ?, medicalNumber = ?, name = ?, notes = ?, phone = ?
-		WHERE patientUuid = ? IF EXISTS`,
-		address, bloodType, dateOfBirth, emergencyContact, gender, medicalNumber, name, notes,
-		phone, patientUUID).Exec(); err != nil {
+	if err := s.Patients.UpdatePatient(p); err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// patient was not found
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound,
 			Message: "Error Occured: Patient not updated"})
@@ -449,25 +506,63 @@ func PatientUpdate(w http.ResponseWriter, r *http.Request) {
 
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(Status{Code: http.StatusOK,
 		Message: "Patient entry successfully updated."})
 }
 
-func mapPatients(m *map[gocql.UUID]string, patientUUID gocql.UUID, session *gocql.Session) {
-	// note: need to dereference for map
-	if _, found := (*m)[patientUUID]; !found {
-		var name string
+func (s *Server) mapPatients(m map[gocql.UUID]string, patientUUID gocql.UUID) {
+	if _, found := m[patientUUID]; !found {
 		// get patient name
-		if err := session.Query("SELECT name FROM patients WHERE patientUUID = ?",
-			patientUUID).Consistency(gocql.One).Scan(&name); err != nil {
+		patient, err := s.Patients.GetPatient(patientUUID)
+		if err != nil {
 			// patient was not found
-			name = "Undefined Patient"
+			patient.Name = "Undefined Patient"
 		}
 		// cache name to UUID for populating appointment list
-		(*m)[patientUUID] = name
+		m[patientUUID] = patient.Name
+	}
+}
+
+// appointmentList merges scheduled and completed appointments into one list,
+// filling in patient names
+func (s *Server) appointmentList(future FutureAppointments,
+	completed CompletedAppointments) []GenericAppointment {
+	appointmentList := make([]GenericAppointment, 0, len(future)+len(completed))
+	m := make(map[gocql.UUID]string)
+
+	// scheduled appointment(s) found
+	if len(future) > 0 {
+		log.Printf("Scheduled appointments found")
+
+		for _, a := range future {
+			// Search patient table to get patient name, cache patient names
+			// TODO Optimization: create table of appointments by doctor
+			s.mapPatients(m, a.PatientUUID)
+
+			appointmentList = append(appointmentList, GenericAppointment{
+				AppointmentUUID: a.AppointmentUUID, PatientUUID: a.PatientUUID,
+				DoctorUUID: a.DoctorUUID, DateScheduled: a.DateScheduled,
+				DateVisited: 0, Notes: a.Notes, PatientName: m[a.PatientUUID]})
+		}
+	}
+
+	// completed appointment(s) found
+	if len(completed) > 0 {
+		log.Printf("Completed appointments found")
+
+		for _, a := range completed {
+			s.mapPatients(m, a.PatientUUID)
+
+			appointmentList = append(appointmentList, GenericAppointment{
+				AppointmentUUID: a.AppointmentUUID, PatientUUID: a.PatientUUID,
+				DoctorUUID: a.DoctorUUID, DateScheduled: 0, DateVisited: a.DateVisited,
+				Notes: a.Notes, PatientName: m[a.PatientUUID]})
+		}
 	}
+
+	return appointmentList
 }
 
 /*
@@ -475,26 +570,28 @@ Returns a list of scheduled and completed appointments for a specific patient
 Method: GET
 Endpoint: /appointments/patientuuid/{patientuuid}
 */
-func AppointmentGetByPatient(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) AppointmentGetByPatient(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	// Get all future appointments by patient
-	iter := session.Query("SELECT * FROM futureappointments WHERE patientuuid = ?",
-		searchUUID).Consistency(gocql.One).Iter()
+	// Get all future and completed appointments by patient
+	var future FutureAppointments
+	var completed CompletedAppointments
+	future, err = s.Appointments.FutureAppointmentsByPatient(searchUUID)
+	if err == nil {
+		completed, err = s.Appointments.CompletedAppointmentsByPatient(searchUUID)
+	}
 
-	// Get all completed appointments by patient
-	completedIter := session.Query("SELECT * FROM completedappointments WHERE patientuuid = ?",
-		searchUUID).Consistency(gocql.One).Iter()
+	if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
 
 	// no appointments found
-	if iter.NumRows() == 0 && completedIter.NumRows() == 0 {
+	if err != nil || len(future) == 0 && len(completed) == 0 {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound, Message: "Not Found"})
@@ -502,56 +599,13 @@ func AppointmentGetByPatient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	appointmentList := make([]GenericAppointment, iter.NumRows()+completedIter.NumRows())
-	i := 0
-	m := make(map[gocql.UUID]string)
-	var appointmentUUID gocql.UUID
-	var dateVisited int
-	var dateScheduled int
-	var doctorUUID gocql.UUID
-	var notes string
-	var patientUUID gocql.UUID
-	var name string
-
-	// scheduled appointment(s) found
-	if iter.NumRows() > 0 {
-		log.Printf("Scheduled appointments found")
-
-		for iter.Scan(&appointmentUUID, &dateScheduled, &doctorUUID, &notes, &patientUUID) {
-			// Search patient table to get patient name, cache patient names
-			mapPatients(&m, patientUUID, session)
-			name = m[patientUUID]
-
-			appointmentList[i] = GenericAppointment{
-				AppointmentUUID: appointmentUUID, PatientUUID: patientUUID,
-				DoctorUUID: doctorUUID, DateScheduled: dateScheduled,
-				DateVisited: 0, Notes: notes, PatientName: name}
-			i++
-		}
-	}
-
-	// completed appointment(s) found
-	if completedIter.NumRows() > 0 {
-		log.Printf("Completed appointments found")
-
-		for completedIter.Scan(&appointmentUUID, nil, nil, nil, &dateVisited,
-			&doctorUUID, nil, &notes, &patientUUID) {
-			mapPatients(&m, patientUUID, session)
-			name = m[patientUUID]
-
-			appointmentList[i] = GenericAppointment{
-				AppointmentUUID: appointmentUUID, PatientUUID: patientUUID,
-				DoctorUUID: doctorUUID, DateScheduled: 0, DateVisited: dateVisited,
-				Notes: notes, PatientName: name}
-			i++
-		}
-	}
+	appointmentList := s.appointmentList(future, completed)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(appointmentList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
@@ -560,26 +614,28 @@ Returns a list of scheduled and completed appointments for a specific doctor
 Method: GET
 Endpoint: /appointments/doctoruuid/{doctoruuid}
 */
-func AppointmentGetByDoctor(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) AppointmentGetByDoctor(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	// Get all future appointments by doctor
-	iter := session.Query("SELECT * FROM futureappointments WHERE doctoruuid = ?",
-		searchUUID).Consistency(gocql.One).Iter()
+	// Get all future and completed appointments by doctor
+	var future FutureAppointments
+	var completed CompletedAppointments
+	future, err = s.Appointments.FutureAppointmentsByDoctor(searchUUID)
+	if err == nil {
+		completed, err = s.Appointments.CompletedAppointmentsByDoctor(searchUUID)
+	}
 
-	// Get all completed appointments by doctor
-	completedIter := session.Query("SELECT * FROM completedappointments WHERE doctoruuid = ?",
-		searchUUID).Consistency(gocql.One).Iter()
+	if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
 
 	// no appointments found
-	if iter.NumRows() == 0 && completedIter.NumRows() == 0 {
+	if err != nil || len(future) == 0 && len(completed) == 0 {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound, Message: "Not Found"})
@@ -587,57 +643,19 @@ func AppointmentGetByDoctor(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	appointmentList := make([]GenericAppointment, iter.NumRows()+completedIter.NumRows())
-	i := 0
-	m := make(map[gocql.UUID]string)
-	var appointmentUUID gocql.UUID
-	var dateVisited int
-	var dateScheduled int
-	var doctorUUID gocql.UUID
-	var notes string
-	var patientUUID gocql.UUID
-	var name string
-
-	// scheduled appointment(s) found
-	if iter.NumRows() > 0 {
-		log.Printf("Scheduled appointments found")
-
-		for iter.Scan(&appointmentUUID, &dateScheduled, &doctorUUID, &notes, &patientUUID) {
-			// Search patient table to get patient name, cache patient names
-			// TODO Optimization: create table of appointments by doctor
-			mapPatients(&m, patientUUID, session)
-			name = m[patientUUID]
-
-			appointmentList[i] = GenericAppointment{
-				AppointmentUUID: appointmentUUID, PatientUUID: patientUUID,
-				DoctorUUID: doctorUUID, DateScheduled: dateScheduled,
-				DateVisited: 0, Notes: notes, PatientName: name}
-			i++
-		}
+	appointmentList := s.appointmentList(future, completed)
+	for _, a := range future {
+		auditPatients(r, a.PatientUUID)
 	}
-
-	// completed appointment(s) found
-	if completedIter.NumRows() > 0 {
-		log.Printf("Completed appointments found")
-
-		for completedIter.Scan(&appointmentUUID, nil, nil, nil, &dateVisited,
-			&doctorUUID, nil, &notes, &patientUUID) {
-			mapPatients(&m, patientUUID, session)
-			name = m[patientUUID]
-
-			appointmentList[i] = GenericAppointment{
-				AppointmentUUID: appointmentUUID, PatientUUID: patientUUID,
-				DoctorUUID: doctorUUID, DateScheduled: 0, DateVisited: dateVisited,
-				Notes: notes, PatientName: name}
-			i++
-		}
+	for _, a := range completed {
+		auditPatients(r, a.PatientUUID)
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(appointmentList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
@@ -646,26 +664,28 @@ Returns a list of patients seen by a specific doctor
 Method: GET
 Endpoint: /patients/doctoruuid/{doctoruuid}
 */
-func PatientGetByDoctor(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) PatientGetByDoctor(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	// Get all future appointments by doctor
-	iter := session.Query("SELECT * FROM futureappointments WHERE doctoruuid = ?",
-		searchUUID).Consistency(gocql.One).Iter()
+	// Get all future and completed appointments by doctor
+	var future FutureAppointments
+	var completed CompletedAppointments
+	future, err = s.Appointments.FutureAppointmentsByDoctor(searchUUID)
+	if err == nil {
+		completed, err = s.Appointments.CompletedAppointmentsByDoctor(searchUUID)
+	}
 
-	// Get all completed appointments by doctor
-	completedIter := session.Query("SELECT * FROM completedappointments WHERE doctoruuid = ?",
-		searchUUID).Consistency(gocql.One).Iter()
+	if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
 
 	// no appointments found, thus no patients
-	if iter.NumRows() == 0 && completedIter.NumRows() == 0 {
+	if err != nil || len(future) == 0 && len(completed) == 0 {
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound, Message: "Not Found"})
@@ -675,47 +695,45 @@ func PatientGetByDoctor(w http.ResponseWriter, r *http.Request) {
 
 	// make a set of patientUUIDs
 	m := make(map[gocql.UUID]gocql.UUID)
-	var patientUUID gocql.UUID
 
 	// scheduled appointment(s) found
-	if iter.NumRows() > 0 {
+	if len(future) > 0 {
 		log.Printf("Scheduled appointments found")
-		for iter.Scan(nil, nil, nil, nil, &patientUUID) {
-			m[patientUUID] = patientUUID
+		for _, a := range future {
+			m[a.PatientUUID] = a.PatientUUID
 		}
 	}
 
 	// completed appointment(s) found
-	if completedIter.NumRows() > 0 {
+	if len(completed) > 0 {
 		log.Printf("Completed appointments found")
-		for completedIter.Scan(nil, nil, nil, nil, nil, nil, nil, nil, &patientUUID) {
-			m[patientUUID] = patientUUID
+		for _, a := range completed {
+			m[a.PatientUUID] = a.PatientUUID
 		}
 	}
 
 	var patientList []Patient
-	var dateOfBirth int
-	var gender string
-	var name string
-	var phone string
 
 	// get each patient's info and add to list
 	for k := range m {
-		if err := session.Query("SELECT * FROM patients WHERE patientUUID = ?",
-			k).Consistency(gocql.One).Scan(&patientUUID, nil,
-			nil, &dateOfBirth, nil, &gender, nil, &name, nil, &phone); err != nil {
+		patient, err := s.Patients.GetPatient(k)
+		if err == ErrNotFound {
 			log.Printf("Patient does not exist, skipping")
-		} else {
-			patientList = append(patientList, Patient{PatientUUID: patientUUID,
-				DateOfBirth: dateOfBirth, Gender: gender, Name: name, Phone: phone})
+			continue
 		}
+		if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		patientList = append(patientList, patientSummary(patient))
+		auditPatients(r, patient.PatientUUID)
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(patientList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
@@ -724,40 +742,37 @@ Create a future appointment
 Method: POST
 Endpoint: /futureappointments
 */
-func FutureAppointmentCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) FutureAppointmentCreate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var f FutureAppointment
 	err := decoder.Decode(&f)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
 
 	// generate new randomly generated UUID (version 4)
-	appointmentUuid, err := gocql.RandomUUID()
+	f.AppointmentUUID, err = gocql.RandomUUID()
 	if err != nil {
-		log.Fatal(err)
+		s.internalError(w, r, err)
+		return
 	}
-	patientUUID := f.PatientUUID
-	doctorUUID := f.DoctorUUID
-	dateScheduled := f.DateScheduled
-	notes := f.Notes
-	log.Printf("Created future appointment: %s\t%d\t%s\t%s\t%s",
-		appointmentUuid, patientUUID, doctorUUID, dateScheduled, notes)
+	auditResource(r, "appointment", f.AppointmentUUID)
+	auditPatients(r, f.PatientUUID)
+	requestLogger(r).Info("Created future appointment", "appointmentUUID", f.AppointmentUUID,
+		"patientUUID", f.PatientUUID, "doctorUUID", f.DoctorUUID,
+		"dateScheduled", f.DateScheduled, "notes", f.Notes)
 
 	// insert new appointment entry
-	if err := session.Query(`INSERT INTO futureAppointments (appointmentUuid,
-		patientUUID, doctorUUID, dateScheduled, notes) VALUES (?, ?, ?, ?, ?)`,
-		appointmentUuid, patientUUID, doctorUUID, dateScheduled, notes).Exec(); err != nil {
-		log.Fatal(err)
+	if err := s.Appointments.CreateFutureAppointment(f); err != nil {
+		s.internalError(w, r, err)
+		return
 	}
 
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(Status{Code: http.StatusCreated,
 		Message: "Appointment entry successfully created."})
@@ -768,26 +783,20 @@ Search for info on a future appointment
 Method: GET
 Endpoint: /futureappointments/appointmentuuid/{appointmentuuid}
 */
-func FutureAppointmentGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) FutureAppointmentGet(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	var appointmentUUID gocql.UUID
-	var patientUUID gocql.UUID
-	var doctorUUID gocql.UUID
-	var dateScheduled int
-	var notes string
-
 	// get the appointment entry
-	if err := session.Query("SELECT * FROM futureAppointments WHERE appointmentUUID = ?",
-		searchUUID).Consistency(gocql.One).Scan(&appointmentUUID, &dateScheduled,
-		&doctorUUID, &notes, &patientUUID); err != nil {
+	appointment, err := s.Appointments.GetFutureAppointment(searchUUID)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// appointment was not found
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusNotFound)
@@ -796,18 +805,15 @@ func FutureAppointmentGet(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Appointment not found")
 		return
 	}
+	auditPatients(r, appointment.PatientUUID)
 
 	// else, appointment was found
-	if len(appointmentUUID) > 0 {
-		log.Printf("Appointment was found")
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(FutureAppointment{
-			AppointmentUUID: appointmentUUID, PatientUUID: patientUUID,
-			DoctorUUID: doctorUUID, DateScheduled: dateScheduled, Notes: notes}); err != nil {
-			panic(err)
-		}
+	log.Printf("Appointment was found")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(appointment); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -816,47 +822,31 @@ Create a completed appointment
 Method: POST
 Endpoint: /completedappointments
 */
-func CompletedAppointmentCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) CompletedAppointmentCreate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var c CompletedAppointment
 	err := decoder.Decode(&c)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
 
-	appointmentUuid := c.AppointmentUUID
-	patientUUID := c.PatientUUID
-	doctorUUID := c.DoctorUUID
-	dateVisited := c.DateVisited
-	breathingRate := c.BreathingRate
-	heartRate := c.HeartRate
-	bloodOxygenLevel := c.BloodOxygenLevel
-	bloodPressure := c.BloodPressure
-	notes := c.Notes
-
-	// var deleteSuccess bool
-	if _, err := session.Query(`DELETE FROM futureappointments WHERE appointmentuuid=? IF EXISTS`,
-		appointmentUuid).ScanCAS(); err != nil {
-		log.Fatal(err)
-	}
-
-	log.Printf("Updating appointment: %s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%s\t",
-		appointmentUuid, patientUUID, doctorUUID, dateVisited, breathingRate, heartRate,
-		bloodOxygenLevel, bloodPressure, notes)
-
-	// update appointment entry, create entry if does not exist
-	if err := session.Query(`UPDATE completedappointments SET patientUUID = ?,
-		doctorUUID = ?, dateVisited = ?, breathingRate = ?, heartRate = ?, bloodOxygenLevel = ?,
-		bloodPressure = ?, notes = ? WHERE appointmentUuid = ?`, patientUUID,
-		doctorUUID, dateVisited, breathingRate, heartRate, bloodOxygenLevel, bloodPressure, notes,
-		appointmentUuid).Exec(); err != nil {
+	auditResource(r, "appointment", c.AppointmentUUID)
+	auditPatients(r, c.PatientUUID)
+	requestLogger(r).Info("Updating appointment", "appointmentUUID", c.AppointmentUUID,
+		"patientUUID", c.PatientUUID, "doctorUUID", c.DoctorUUID,
+		"dateVisited", c.DateVisited, "notes", c.Notes)
+
+	// remove the scheduled appointment and create or update the completed entry
+	if err := s.Appointments.CompleteAppointment(c); err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// Appointment not created/updated
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound,
 			Message: "Error Occured: Appointment not updated/created"})
@@ -867,7 +857,7 @@ func CompletedAppointmentCreate(w http.ResponseWriter, r *http.Request) {
 
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(Status{Code: http.StatusCreated,
 		Message: "Appointment entry successfully updated/created."})
@@ -878,52 +868,38 @@ Search for info on a completed appointment
 Method: GET
 Endpoint: /completedappointments/appointmentuuid/{appointmentuuid}
 */
-func CompletedAppointmentGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
-	}
-
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	var appointmentUUID gocql.UUID
-	var patientUUID gocql.UUID
-	var doctorUUID gocql.UUID
-	var dateVisited int
-	var breathingRate int
-	var heartRate int
-	var bloodOxygenLevel int
-	var bloodPressure int
-	var notes string
-
-	// get the appointment entry (match arguments with alphabetical positioning of retrieved columns)
-	if err := session.Query("SELECT * FROM completedAppointments WHERE appointmentUUID = ?",
-		searchUUID).Consistency(gocql.One).Scan(&appointmentUUID, &bloodOxygenLevel, &bloodPressure,
-		&breathingRate, &dateVisited, &doctorUUID, &heartRate, &notes, &patientUUID); err != nil {
+func (s *Server) CompletedAppointmentGet(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
+	}
+
+	// get the appointment entry
+	appointment, err := s.Appointments.GetCompletedAppointment(searchUUID)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// appointment was not found
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound,
 			Message: "Not Found"})
 		log.Printf("Appointment not found")
 		return
 	}
+	auditPatients(r, appointment.PatientUUID)
 
 	// else, appointment was found
-	if len(appointmentUUID) > 0 {
-		log.Printf("Appointment was found")
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(CompletedAppointment{AppointmentUUID: appointmentUUID,
-			PatientUUID: patientUUID, DoctorUUID: doctorUUID, DateVisited: dateVisited,
-			BreathingRate: breathingRate, HeartRate: heartRate, BloodOxygenLevel: bloodOxygenLevel,
-			BloodPressure: bloodPressure, Notes: notes}); err != nil {
-			panic(err)
-		}
+	log.Printf("Appointment was found")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(appointment); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -932,36 +908,41 @@ Delete selected appointment
 Method: DELETE
 Endpoint: /futureappointments/appointmentuuid/{appointmentuuid}
 */
-func FutureAppointmentDelete(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) FutureAppointmentDelete(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
+	// the patient is looked up first, for the audit trail
+	if appointment, err := s.Appointments.GetFutureAppointment(searchUUID); err == nil {
+		auditPatients(r, appointment.PatientUUID)
+	}
 
 	// Tries to delete from futureAppointments
-	if deleteSuccess, err := session.Query("DELETE FROM futureAppointments WHERE appointmentuuid=? IF EXISTS",
-		searchUUID).ScanCAS(); err != nil || !deleteSuccess {
-		log.Println(deleteSuccess)
+	err = s.Appointments.DeleteFutureAppointment(searchUUID)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
+		log.Println(err)
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusNotFound)
 		if err := json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound,
 			Message: "Delete target not found"}); err != nil {
-			panic(err)
+			log.Println(err)
 		}
 	} else {
-		log.Println(deleteSuccess)
-		log.Printf("Delete on: %s\t", searchUUID)
+		requestLogger(r).Info("Deleted future appointment", "appointmentUUID", searchUUID)
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		s.allowOrigin(w, r)
 		w.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(w).Encode(Status{Code: http.StatusOK,
 			Message: "Delete Success"}); err != nil {
-			panic(err)
+			log.Println(err)
 		}
 	}
 }
@@ -971,40 +952,28 @@ Create a Doctor entry
 Method: POST
 Endpoint: /doctors
 */
-func DoctorCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) DoctorCreate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var d Doctor
 	err := decoder.Decode(&d)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
 
-	doctorUUID := d.DoctorUUID
-	name := d.Name
-	phoneNumber := d.Phone
-	prFacility := d.PrimaryFacility
-	prSpecialty := d.PrimarySpecialty
-	gender := d.Gender
-
-	log.Printf("Created new doctor: %s\t%s\t%s\t%s\t%s\t%s\t",
-		doctorUUID, name, phoneNumber, prFacility, prSpecialty, gender)
+	requestLogger(r).Info("Created new doctor", "doctorUUID", d.DoctorUUID,
+		"primaryFacility", d.PrimaryFacility, "primarySpecialty", d.PrimarySpecialty)
 
 	// insert new doctor entry
-	if err := session.Query(`INSERT INTO doctors (doctorUUID,
-		name, phone, primaryFacility, primarySpecialty,
-		gender) VALUES (?, ?, ?, ?, ?, ?)`,
-		doctorUUID, name, phoneNumber, prFacility, prSpecialty,
-		gender).Exec(); err != nil {
-		log.Fatal(err)
+	if err := s.Doctors.CreateDoctor(d); err != nil {
+		s.internalError(w, r, err)
+		return
 	}
 
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(Status{Code: http.StatusCreated,
 		Message: "Doctor entry successfully created."})
@@ -1015,27 +984,20 @@ Search for a doctor's info
 Method: GET
 Endpoint: /doctors/doctoruuid/{doctoruuid}
 */
-func DoctorGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) DoctorGet(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	var doctorUUID gocql.UUID
-	var name string
-	var phoneNumber string
-	var primaryFacility string
-	var primarySpecialty string
-	var gender string
-
 	// get the doctor entry
-	if err := session.Query("SELECT * FROM doctors WHERE doctorUUID = ?",
-		searchUUID).Consistency(gocql.One).Scan(&doctorUUID, &gender,
-		&name, &phoneNumber, &primaryFacility, &primarySpecialty); err != nil {
+	doctor, err := s.Doctors.GetDoctor(searchUUID)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// doctor was not found
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusNotFound)
@@ -1046,16 +1008,12 @@ func DoctorGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// else, doctor was found
-	if len(doctorUUID) > 0 {
-		log.Printf("Doctor was found")
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(Doctor{DoctorUUID: doctorUUID,
-			Name: name, Phone: phoneNumber, PrimaryFacility: primaryFacility,
-			PrimarySpecialty: primarySpecialty, Gender: gender}); err != nil {
-			panic(err)
-		}
+	log.Printf("Doctor was found")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(doctor); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -1064,40 +1022,24 @@ Returns a list of all doctors
 Method: GET
 Endpoint: /doctors
 */
-func DoctorListGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) DoctorListGet(w http.ResponseWriter, r *http.Request) {
 	// Get all doctors of current clinic
-	iter := session.Query("SELECT * FROM doctors").Consistency(gocql.One).Iter()
-
-	doctorList := make([]Doctor, iter.NumRows())
-	i := 0
-	var doctorUUID gocql.UUID
-	var name string
-	var phoneNumber string
-	var primaryFacility string
-	var primarySpecialty string
-	var gender string
+	doctorList, err := s.Doctors.ListDoctors()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
 
 	// doctors found
-	if iter.NumRows() > 0 {
-		log.Printf("Scheduled appointments found")
-
-		for iter.Scan(&doctorUUID, &gender, &name, &phoneNumber, &primaryFacility,
-			&primarySpecialty) {
-			doctorList[i] = Doctor{DoctorUUID: doctorUUID,
-				Name: name, Phone: phoneNumber, PrimaryFacility: primaryFacility,
-				PrimarySpecialty: primarySpecialty, Gender: gender}
-			i++
-		}
+	if len(doctorList) > 0 {
+		log.Printf("Doctors found")
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(doctorList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
@@ -1106,51 +1048,30 @@ Returns a list of prescriptions for a specific patient
 Method: GET
 Endpoint: /prescriptions/patientuuid/{patientuuid}
 */
-func PrescriptionsGetByPatient(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) PrescriptionsGetByPatient(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
 	// Get all prescriptions for a patient
-	iter := session.Query(`SELECT * FROM prescriptions WHERE patientuuid = ?
-		ORDER BY endDate DESC`, searchUUID).Consistency(gocql.One).Iter()
-
-	prescriptionList := make(Prescriptions, iter.NumRows())
-	i := 0
-
-	var doctorName string
-	var doctorUUID gocql.UUID
-	var drug string
-	var endDate int
-	var instructions string
-	var patientUUID gocql.UUID
-	var prescriptionUUID gocql.UUID
-	var startDate int
+	prescriptionList, err := s.Prescriptions.PrescriptionsByPatient(searchUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
 
 	// prescriptions found
-	if iter.NumRows() > 0 {
+	if len(prescriptionList) > 0 {
 		log.Printf("prescriptions found")
-
-		for iter.Scan(&patientUUID, &endDate, &prescriptionUUID, &doctorName,
-			&doctorUUID, &drug, &instructions, &startDate) {
-			prescriptionList[i] = Prescription{
-				DoctorName: doctorName, DoctorUUID: doctorUUID, Drug: drug,
-				EndDate: endDate, Instructions: instructions, PatientUUID: patientUUID,
-				PrescriptionUUID: prescriptionUUID, StartDate: startDate}
-			i++
-		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(prescriptionList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
@@ -1159,47 +1080,50 @@ Create a new Prescription
 Method: POST
 Endpoint: /prescription
 */
-func PrescriptionCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) PrescriptionCreate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var prescriptionList Prescriptions
 	err := decoder.Decode(&prescriptionList)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
+	for _, d := range prescriptionList {
+		auditPatients(r, d.PatientUUID)
+	}
+	// doctors prescribe in their own name; API keys name the doctor
+	if principal, _ := principalFrom(r.Context()); principal.Role == RoleDoctor {
+		for i, d := range prescriptionList {
+			if d.DoctorUUID == (gocql.UUID{}) {
+				prescriptionList[i].DoctorUUID = principal.UserUUID
+			} else if d.DoctorUUID != principal.UserUUID {
+				s.writeStatus(w, r, http.StatusForbidden, "Doctors may only prescribe in their own name")
+				return
+			}
+		}
+	}
 	for _, d := range prescriptionList {
 		// generate new randomly generated UUID
-		prescriptionUUID, err := gocql.RandomUUID()
+		d.PrescriptionUUID, err = gocql.RandomUUID()
 		if err != nil {
-			log.Fatal(err)
+			s.internalError(w, r, err)
+			return
 		}
 
-		doctorName := d.DoctorName
-		doctorUUID := d.DoctorUUID
-		drug := d.Drug
-		endDate := d.EndDate
-		instructions := d.Instructions
-		patientUUID := d.PatientUUID
-		startDate := d.StartDate
-
-		log.Printf("Created new prescription: %s\t%s\t%s\t%d\t%s\t%s\t%s\t%d\t",
-			doctorName, doctorUUID, drug, endDate, instructions, patientUUID,
-			prescriptionUUID, startDate)
+		requestLogger(r).Info("Created new prescription", "prescriptionUUID", d.PrescriptionUUID,
+			"patientUUID", d.PatientUUID, "doctorUUID", d.DoctorUUID, "drug", d.Drug,
+			"instructions", d.Instructions)
 
 		// insert new prescription entry
-		if err := session.Query(`INSERT INTO prescriptions (doctorName, doctorUUID,
-			drug, endDate, instructions, patientUUID, prescriptionUUID, startDate)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, doctorName, doctorUUID, drug, endDate,
-			instructions, patientUUID, prescriptionUUID, startDate).Exec(); err != nil {
-			log.Fatal(err)
+		if err := s.Prescriptions.CreatePrescription(d); err != nil {
+			s.internalError(w, r, err)
+			return
 		}
 	}
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(Status{Code: http.StatusCreated,
 		Message: "Prescription entry successfully created."})
@@ -1210,44 +1134,31 @@ Create a new notification for a doctor
 Method: POST
 Endpoint: /notifications
 */
-func NotificationCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
+func (s *Server) NotificationCreate(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	var n Notification
 	err := decoder.Decode(&n)
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
 	}
 	defer r.Body.Close()
 
-	// generate new randomly generated UUID
-	notificationUUID, err := gocql.RandomUUID()
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	// get current unix timestamp
-	dateCreated := int32(time.Now().Unix())
-	message := n.Messsage
-	receiverUUID := n.ReceiverUUID
-	senderName := n.SenderName
-	senderUUID := n.SenderUUID
+	n.DateCreated = int(time.Now().Unix())
 
-	log.Printf("Creating new notification: %d\t%s\t%s\t%s\t%s\t%s\t",
-		dateCreated, message, senderUUID, receiverUUID, senderName, senderUUID)
+	requestLogger(r).Info("Creating new notification", "senderUUID", n.SenderUUID,
+		"receiverUUID", n.ReceiverUUID, "message", n.Messsage)
 
 	// insert new notification entry
-	if err := session.Query(`INSERT INTO notifications (receiverUUID, dateCreated, notificationUUID,
-		message, senderName, senderUUID) VALUES (?, ?, ?, ?, ?, ?)`,
-		receiverUUID, dateCreated, notificationUUID, message, senderName, senderUUID).Exec(); err != nil {
-		log.Fatal(err)
+	if err := s.Notifications.CreateNotification(n); err != nil {
+		s.internalError(w, r, err)
+		return
 	}
 
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(Status{Code: http.StatusCreated,
 		Message: "Notification entry successfully created."})
@@ -1258,95 +1169,97 @@ Returns a list of notifications for a specific doctor
 Method: GET
 Endpoint: /notifications/doctoruuid/{doctoruuid}
 */
-func NotificationsGetByDoctor(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) NotificationsGetByDoctor(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
 	// Get all notifications for a doctor, limit to last 100
-	iter := session.Query(`SELECT receiverUUID, dateCreated, message, senderUUID, senderName FROM
-		notifications WHERE receiverUUID = ? LIMIT 100`, searchUUID).Consistency(gocql.One).Iter()
-
-	notiList := make(Notifications, iter.NumRows())
-	i := 0
-
-	var dateCreated int
-	var message string
-	var receiverUUID gocql.UUID
-	var senderName string
-	var senderUUID gocql.UUID
+	notiList, err := s.Notifications.NotificationsByReceiver(searchUUID, 100)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
 
 	// notifications found
-	if iter.NumRows() > 0 {
+	if len(notiList) > 0 {
 		log.Printf("Notifications found")
-
-		for iter.Scan(&receiverUUID, &dateCreated, &message, &senderUUID, &senderName) {
-			notiList[i] = Notification{
-				DateCreated: dateCreated, Messsage: message,
-				ReceiverUUID: receiverUUID, SenderName: senderName, SenderUUID: senderUUID}
-			i++
-		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(notiList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
 
 /*
-
 Upload a document
 Method: POST
 Endpoint: /document
 */
-func DocumentCreate(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
+func (s *Server) DocumentCreate(w http.ResponseWriter, r *http.Request) {
+	uploadsInFlight.Inc()
+	defer uploadsInFlight.Dec()
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+	var tooLarge *http.MaxBytesError
+	if err := r.ParseMultipartForm(32 << 20); errors.As(err, &tooLarge) {
+		s.writeStatus(w, r, http.StatusRequestEntityTooLarge,
+			"Document exceeds the maximum upload size")
+		return
+	} else if err != nil {
+		s.badRequest(w, r, "Malformed multipart form: "+err.Error())
+		return
+	}
 
 	// generate new randomly generated UUID (version 4)
 	documentUUID, err := gocql.RandomUUID()
 	if err != nil {
-		log.Fatal(err)
+		s.internalError(w, r, err)
+		return
 	}
 
-	patientUUID := r.FormValue("patientUUID")
+	patientUUID, err := gocql.ParseUUID(r.FormValue("patientUUID"))
+	if err != nil {
+		s.badRequest(w, r, "Invalid or missing patientUUID")
+		return
+	}
 	filename := r.FormValue("filename")
 	// get current unix timestamp
-	dateUploaded := int32(time.Now().Unix())
+	dateUploaded := int(time.Now().Unix())
 
 	file, _, err := r.FormFile("file")
 	if err != nil {
-		panic(err)
+		s.badRequest(w, r, "Missing file")
+		return
 	}
 	defer file.Close()
 	binaryContent, err := ioutil.ReadAll(file)
-
 	if err != nil {
-		log.Fatal("error:", err)
+		s.internalError(w, r, err)
+		return
 	}
 
-	log.Printf("Created new document: %s\t%s\t%s\t%d\t",
-		documentUUID, patientUUID, filename, dateUploaded)
+	auditResource(r, "document", documentUUID)
+	auditPatients(r, patientUUID)
+	requestLogger(r).Info("Created new document", "documentUUID", documentUUID,
+		"patientUUID", patientUUID, "filename", filename, "size", len(binaryContent))
 
 	// insert new document entry
-	if err := session.Query(`INSERT INTO documents (documentUUID,
-		patientUUID, filename, dateUploaded, content) VALUES (?, ?, ?, ?, ?)`,
-		documentUUID, patientUUID, filename, dateUploaded,
-		binaryContent).Exec(); err != nil {
-		log.Fatal(err)
+	if err := s.Documents.CreateDocument(Document{DocumentUUID: documentUUID,
+		PatientUUID: patientUUID, Filename: filename, DateUploaded: dateUploaded,
+		Content: string(binaryContent)}); err != nil {
+		s.internalError(w, r, err)
+		return
 	}
 
 	// send success response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusCreated)
 	// returns the created documentuuid on success
 	json.NewEncoder(w).Encode(map[string]gocql.UUID{"documentuuid": documentUUID})
@@ -1357,23 +1270,20 @@ Download a document given its UUID
 Method: GET
 Endpoint: /documents/documentuuid/{documentuuid}
 */
-func DocumentGet(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) DocumentGet(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
-	var documentUUID gocql.UUID
-	var filename string
-	var content []byte
-
 	// download the document
-	if err := session.Query("SELECT content, filename FROM documents WHERE documentUUID = ?",
-		searchUUID).Consistency(gocql.One).Scan(&content, &filename); err != nil {
+	document, err := s.Documents.GetDocument(searchUUID)
+	if err != nil {
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return
+		}
 		// document was not found
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		w.WriteHeader(http.StatusNotFound)
@@ -1383,53 +1293,31 @@ func DocumentGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// else, document was found
-	if len(documentUUID) > 0 {
-		log.Printf("document was found")
-		err := ioutil.WriteFile(filename, content, 0755)
-		// issue with writing file
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound,
-				Message: "Not Found"})
-			return
-		}
-
-		fopen, err := os.Open(filename)
-		defer fopen.Close()
-		// remove file from local storage after sending to client
-		defer os.Remove(filename)
-		if err != nil {
-			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(Status{Code: http.StatusNotFound,
-				Message: "Not Found"})
-			return
-		}
+	auditPatients(r, document.PatientUUID)
+	// patients may only download their own documents
+	if !canReadPatient(r, document.PatientUUID) {
+		s.writeStatus(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
 
-		// determine file content type
-		header := make([]byte, 512)
-		fopen.Read(header)
-		fileType := http.DetectContentType(header)
+	// else, document was found
+	log.Printf("document was found")
 
-		stat, _ := fopen.Stat()
-		fileSize := strconv.FormatInt(stat.Size(), 10)
+	// determine file content type
+	fileType := http.DetectContentType([]byte(document.Content))
+	fileSize := strconv.Itoa(len(document.Content))
 
-		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-		w.Header().Set("Content-Type", fileType)
-		w.Header().Set("Content-Length", fileSize)
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Range")
-		w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Encoding, Content-Length, Content-Range")
+	w.Header().Set("Content-Disposition", "attachment; filename="+document.Filename)
+	w.Header().Set("Content-Type", fileType)
+	w.Header().Set("Content-Length", fileSize)
+	s.allowOrigin(w, r)
+	w.Header().Set("Access-Control-Allow-Headers", "Range")
+	w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Encoding, Content-Length, Content-Range")
 
-		w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusOK)
 
-		// send the file (read 512 bytes from the file already so reset offset)
-		fopen.Seek(0, 0)
-		io.Copy(w, fopen)
-		return
-	}
+	// send the file
+	w.Write([]byte(document.Content))
 }
 
 /*
@@ -1437,48 +1325,32 @@ Returns an index list of documents for a given patient
 Method: GET
 Endpoint: /documents/patientuuid/{patientuuid}
 */
-func DocumentListGetByPatient(w http.ResponseWriter, r *http.Request) {
-	session, _ := initializeSession(sampleKeyspace, localDB)
-	defer session.Close()
-
-	if URI := strings.Split(r.RequestURI, "/"); len(URI) != 4 {
-		panic("Improper URI")
+func (s *Server) DocumentListGetByPatient(w http.ResponseWriter, r *http.Request) {
+	searchUUID, err := uriUUID(r)
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
 	}
 
-	var searchUUID = strings.Split(r.RequestURI, "/")[3]
-
 	// Get all documents metadata of a patient
-	iter := session.Query(`SELECT documentuuid, dateuploaded, filename, patientuuid FROM documents
-		WHERE patientuuid = ?`, searchUUID).Consistency(gocql.One).Iter()
+	var docuList []Document
+	docuList, err = s.Documents.DocumentsByPatient(searchUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
 
 	// no documents found
-	if iter.NumRows() == 0 {
+	if len(docuList) == 0 {
 		log.Printf("No documents found for patient")
-	}
-
-	docuList := make([]Document, iter.NumRows())
-	i := 0
-	var documentUUID gocql.UUID
-	var patientUUID gocql.UUID
-	var filename string
-	var dateUploaded int
-
-	// documents found
-	if iter.NumRows() > 0 {
+	} else {
 		log.Printf("Documents found")
-
-		for iter.Scan(&documentUUID, &dateUploaded, &filename, &patientUUID) {
-			docuList[i] = Document{
-				DocumentUUID: documentUUID, PatientUUID: patientUUID, Filename: filename,
-				DateUploaded: dateUploaded}
-			i++
-		}
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowOrigin(w, r)
 	w.WriteHeader(http.StatusOK)
 	if err := json.NewEncoder(w).Encode(docuList); err != nil {
-		panic(err)
+		log.Println(err)
 	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// version is the release of the build, set with
+// -ldflags "-X main.version=1.2.0"
+var version = "dev"
+
+// revision returns the VCS revision the binary was built from, if known
+func revision() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return ""
+}
+
+// HealthCheck is the outcome of one readiness check
+type HealthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// ServiceStatus is the detailed state of the service reported by /status
+type ServiceStatus struct {
+	Version               string        `json:"version"`
+	Revision              string        `json:"revision,omitempty"`
+	GoVersion             string        `json:"goVersion"`
+	StartedAt             int           `json:"startedAt"`
+	Uptime                string        `json:"uptime"`
+	Ready                 bool          `json:"ready"`
+	SchemaVersion         int           `json:"schemaVersion"`
+	ExpectedSchemaVersion int           `json:"expectedSchemaVersion"`
+	Checks                []HealthCheck `json:"checks"`
+}
+
+// checkHealth runs the readiness checks against the store: the database
+// answers, its schema is the one this build expects and it accepts writes
+func (s *Server) checkHealth() (checks []HealthCheck, applied, expected int) {
+	run := func(name string, check func() error) bool {
+		start := time.Now()
+		err := check()
+		result := HealthCheck{Name: name, OK: err == nil, Duration: time.Since(start).String()}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		checks = append(checks, result)
+		return err == nil
+	}
+
+	reachable := run("database", func() (err error) {
+		applied, expected, err = s.Health.SchemaVersion()
+		return err
+	})
+	run("schema", func() error {
+		if !reachable {
+			return fmt.Errorf("schema version unknown")
+		}
+		if applied != expected {
+			return fmt.Errorf("schema version %04d, expected %04d, run the migrate subcommand", applied, expected)
+		}
+		return nil
+	})
+	run("storage", func() error {
+		instance, _ := os.Hostname()
+		return s.Health.CheckWritable(instance)
+	})
+	return checks, applied, expected
+}
+
+/*
+Reports that the process is alive, without touching the database
+Method: GET
+Endpoint: /healthz
+*/
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	s.writeStatus(w, r, http.StatusOK, "OK")
+}
+
+/*
+Reports whether the service can serve requests: the database is reachable,
+its schema is up to date and it accepts writes
+Method: GET
+Endpoint: /readyz
+*/
+func (s *Server) Readyz(w http.ResponseWriter, r *http.Request) {
+	checks, _, _ := s.checkHealth()
+	var failed []string
+	for _, check := range checks {
+		if !check.OK {
+			failed = append(failed, check.Name)
+		}
+	}
+	if len(failed) > 0 {
+		requestLogger(r).Warn("Not ready", "checks", checks)
+		s.writeStatus(w, r, http.StatusServiceUnavailable, "Not ready: "+strings.Join(failed, ", "))
+		return
+	}
+	s.writeStatus(w, r, http.StatusOK, "Ready")
+}
+
+/*
+Retrieves the build, uptime and readiness checks of the service
+Method: GET
+Endpoint: /status
+*/
+func (s *Server) ServiceStatus(w http.ResponseWriter, r *http.Request) {
+	checks, applied, expected := s.checkHealth()
+	status := ServiceStatus{
+		Version:               version,
+		Revision:              revision(),
+		GoVersion:             runtime.Version(),
+		StartedAt:             int(s.Started.Unix()),
+		Uptime:                time.Since(s.Started).Round(time.Second).String(),
+		Ready:                 true,
+		SchemaVersion:         applied,
+		ExpectedSchemaVersion: expected,
+		Checks:                checks,
+	}
+	for _, check := range checks {
+		status.Ready = status.Ready && check.OK
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Println(err)
+	}
+}
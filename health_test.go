@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	rec := serveAs(NewServer(NewMemoryStore()), nil, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("memory store not ready: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// a database migrated by an older release is not ready
+	store, err := openSQLite(filepath.Join(t.TempDir(), "emr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.ApplyMigration(1); err != nil {
+		t.Fatal(err)
+	}
+	rec = serveAs(NewServer(store), nil, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "schema") {
+		t.Errorf("expected 503 for an outdated schema, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// the process stays alive while the database is not ready
+	rec = serveAs(NewServer(store), nil, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("healthz returned %d", rec.Code)
+	}
+
+	if err := MigrateUp(store, false, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	rec = serveAs(NewServer(store), nil, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("migrated database not ready: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// closedHealth reports on a database that has been closed
+type closedHealth struct{}
+
+func (closedHealth) SchemaVersion() (int, int, error) {
+	return 0, 0, errors.New("sql: database is closed")
+}
+
+func (closedHealth) CheckWritable(string) error {
+	return errors.New("sql: database is closed")
+}
+
+func TestServiceStatus(t *testing.T) {
+	server := NewServer(NewMemoryStore())
+	server.Health = closedHealth{}
+
+	// a closed database fails every check
+	rec := serveServer(server, testAdmin, httptest.NewRequest("GET", "/status", nil))
+	var status ServiceStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || status.Ready || status.Version != version || status.StartedAt == 0 {
+		t.Errorf("unexpected status %d %+v", rec.Code, status)
+	}
+	for _, check := range status.Checks {
+		if check.OK || check.Error == "" {
+			t.Errorf("check %s passed on a closed database", check.Name)
+		}
+	}
+}
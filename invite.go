@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// DoctorInvite is returned to the admin issuing an invitation code, to
+// hand to the doctor out of band
+type DoctorInvite struct {
+	DoctorUUID string    `json:"doctorUUID"`
+	InviteCode string    `json:"inviteCode"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// newInviteCode returns a random code of 100 bits, grouped as
+// xxxxx-xxxxx-xxxxx-xxxxx
+func newInviteCode() (string, error) {
+	raw := make([]byte, 13)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(raw)[:20])
+	return code[:5] + "-" + code[5:10] + "-" + code[10:15] + "-" + code[15:], nil
+}
+
+// inviteCodeHash is the doctorInvites key of code, which may be typed
+// without the dashes and in any case
+func inviteCodeHash(code string) string {
+	return hashToken(normalizeRecoveryCode(code))
+}
+
+/*
+Issues a single-use invitation code for the doctor to create their user
+account with, which expires after the configured TTL
+Method: POST
+Endpoint: /doctors/doctoruuid/{doctoruuid}/invites
+*/
+func (s *Server) DoctorInviteCreate(w http.ResponseWriter, r *http.Request) {
+	doctorUUID, err := gocql.ParseUUID(mux.Vars(r)["doctoruuid"])
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
+	}
+	doctor, err := s.Doctors.GetDoctor(doctorUUID)
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	code, err := newInviteCode()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	now := time.Now()
+	invite := Session{TokenHash: inviteCodeHash(code), UserUUID: doctor.DoctorUUID,
+		Role: RoleDoctor, Name: doctor.Name, CreatedAt: now, ExpiresAt: now.Add(s.InviteTTL)}
+	if err := s.DoctorInvites.CreateDoctorInvite(invite); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	auditLog(r, "doctor.invited", "Doctor invitation code issued", "doctorUUID", doctorUUID,
+		"invitedBy", principal.UserUUID, "expiresAt", invite.ExpiresAt)
+	s.writeSecretJSON(w, r, http.StatusCreated, DoctorInvite{DoctorUUID: doctorUUID.String(),
+		InviteCode: code, ExpiresAt: invite.ExpiresAt})
+}
+
+// redeemDoctorInvite consumes the invitation code of a doctor signing up as
+// username, returning the doctor it was issued for. It answers the request
+// itself and returns false if the code is not valid.
+func (s *Server) redeemDoctorInvite(w http.ResponseWriter, r *http.Request, username, code string) (Doctor, bool) {
+	invalid := func() (Doctor, bool) {
+		// same shape as the patientError of patients without a record
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		s.allowOrigin(w, r)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]bool{"validError": true, "inviteError": true})
+		log.Printf("Cannot create doctor user entry, invalid or expired invitation code")
+		return Doctor{}, false
+	}
+	invite, err := s.DoctorInvites.GetDoctorInvite(inviteCodeHash(code))
+	if err == ErrNotFound {
+		return invalid()
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return Doctor{}, false
+	}
+	doctor, err := s.Doctors.GetDoctor(invite.UserUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return Doctor{}, false
+	}
+
+	// the code stays usable if the account cannot be created
+	_, accountErr := s.Users.GetUserByUUID(doctor.DoctorUUID)
+	_, usernameErr := s.Users.GetUserByUsername(username)
+	for _, err := range []error{accountErr, usernameErr} {
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			s.allowOrigin(w, r)
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]bool{"validError": true, "createUserError": true})
+			log.Printf("Cannot create doctor user entry, the doctor or username has one already")
+			return Doctor{}, false
+		}
+		if err != ErrNotFound {
+			s.internalError(w, r, err)
+			return Doctor{}, false
+		}
+	}
+	// only the request that deletes the code redeems it
+	err = s.DoctorInvites.DeleteDoctorInvite(invite.TokenHash)
+	if err == ErrNotFound {
+		return invalid()
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return Doctor{}, false
+	}
+	auditLog(r, "doctor.registered", "Doctor invitation code redeemed",
+		"doctorUUID", doctor.DoctorUUID, "username", username)
+	return doctor, true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// signUpDoctor posts a Doctor account for username with the invitation code
+func signUpDoctor(s *Server, username, code string) *httptest.ResponseRecorder {
+	return serveAs(s, nil, httptest.NewRequest("POST", "/users", strings.NewReader(
+		`{"username": "`+username+`", "password": "correct horse", "role": "doctor", "name": "Mallory",
+		"verificationKey": "`+code+`"}`)))
+}
+
+func TestDoctorInvite(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	doctor := Doctor{DoctorUUID: gocql.TimeUUID(), Name: "Anoosh Gilliam"}
+	if err := s.Doctors.CreateDoctor(doctor); err != nil {
+		t.Fatal(err)
+	}
+	invites := "/doctors/doctoruuid/" + doctor.DoctorUUID.String() + "/invites"
+
+	if rec := serveServer(s, testUser, httptest.NewRequest("POST", invites, nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("invite by a doctor: got %d, want 403", rec.Code)
+	}
+	unknown := "/doctors/doctoruuid/" + gocql.TimeUUID().String() + "/invites"
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("POST", unknown, nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("invite for an unknown doctor: got %d, want 404", rec.Code)
+	}
+	rec := serveServer(s, testAdmin, httptest.NewRequest("POST", invites, nil))
+	var invite DoctorInvite
+	if rec.Code != http.StatusCreated || json.NewDecoder(rec.Body).Decode(&invite) != nil {
+		t.Fatalf("invite by an admin: got %d, want 201 with a code", rec.Code)
+	}
+
+	if rec := signUpDoctor(s, "mallory", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("doctor sign up without a code: got %d, want 401", rec.Code)
+	}
+	if rec := signUpDoctor(s, "mallory", "aaaaa-bbbbb-ccccc-ddddd"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("doctor sign up with a wrong code: got %d, want 401", rec.Code)
+	}
+
+	// the account is linked to the doctor entry, whatever name it gives
+	code := strings.ToUpper(strings.Replace(invite.InviteCode, "-", "", -1))
+	rec = signUpDoctor(s, "anoosh", code)
+	var user User
+	if rec.Code != http.StatusCreated || json.NewDecoder(rec.Body).Decode(&user) != nil {
+		t.Fatalf("doctor sign up: got %d, want 201: %s", rec.Code, rec.Body)
+	}
+	if user.UserUUID != doctor.DoctorUUID || user.Name != doctor.Name || user.Role != RoleDoctor {
+		t.Errorf("got user %+v, want the doctor entry %+v", user, doctor)
+	}
+	if rec := signUpDoctor(s, "mallory", invite.InviteCode); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused code: got %d, want 401", rec.Code)
+	}
+
+	// a new code cannot create a second account for the doctor
+	rec = serveServer(s, testAdmin, httptest.NewRequest("POST", invites, nil))
+	json.NewDecoder(rec.Body).Decode(&invite)
+	if rec := signUpDoctor(s, "mallory", invite.InviteCode); rec.Code != http.StatusUnauthorized {
+		t.Errorf("second account for the doctor: got %d, want 401", rec.Code)
+	}
+}
+
+// racedInvites has each invitation code redeemed by another request right
+// after it is read
+type racedInvites struct{ DoctorInviteStore }
+
+func (r racedInvites) GetDoctorInvite(codeHash string) (Session, error) {
+	invite, err := r.DoctorInviteStore.GetDoctorInvite(codeHash)
+	if err == nil {
+		err = r.DoctorInviteStore.DeleteDoctorInvite(codeHash)
+	}
+	return invite, err
+}
+
+func TestDoctorInviteRaced(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	doctor := Doctor{DoctorUUID: gocql.TimeUUID(), Name: "Anoosh Gilliam"}
+	if err := s.Doctors.CreateDoctor(doctor); err != nil {
+		t.Fatal(err)
+	}
+	rec := serveServer(s, testAdmin, httptest.NewRequest("POST",
+		"/doctors/doctoruuid/"+doctor.DoctorUUID.String()+"/invites", nil))
+	var invite DoctorInvite
+	if err := json.NewDecoder(rec.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+
+	s.DoctorInvites = racedInvites{s.DoctorInvites}
+	if rec := signUpDoctor(s, "mallory", invite.InviteCode); rec.Code != http.StatusUnauthorized {
+		t.Errorf("code redeemed by another request: got %d, want 401", rec.Code)
+	}
+	if _, err := s.Users.GetUserByUsername("mallory"); err != ErrNotFound {
+		t.Errorf("got %v looking up the account, want none created", err)
+	}
+}
+
+func TestDoctorInviteExpiry(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	doctor := Doctor{DoctorUUID: gocql.TimeUUID(), Name: "Anoosh Gilliam"}
+	if err := s.Doctors.CreateDoctor(doctor); err != nil {
+		t.Fatal(err)
+	}
+	s.InviteTTL = time.Second
+	rec := serveServer(s, testAdmin, httptest.NewRequest("POST",
+		"/doctors/doctoruuid/"+doctor.DoctorUUID.String()+"/invites", nil))
+	var invite DoctorInvite
+	if err := json.NewDecoder(rec.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := s.DoctorInvites.GetDoctorInvite(inviteCodeHash(invite.InviteCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := s.DoctorInvites.CreateDoctorInvite(expired); err != nil {
+		t.Fatal(err)
+	}
+	if rec := signUpDoctor(s, "anoosh", invite.InviteCode); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired code: got %d, want 401", rec.Code)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyIDPattern limits JWT key IDs to safe file names
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// jwtKey is one key of the JWT key set
+type jwtKey struct {
+	method jwt.SigningMethod
+	// sign is nil for keys that only verify tokens
+	sign   interface{}
+	verify interface{}
+}
+
+// TokenIssuer signs and verifies the JWT access tokens of bearer clients
+type TokenIssuer struct {
+	cfg  JWTConfig
+	keys map[string]jwtKey
+}
+
+// accessClaims are the claims of an access token, whose subject is the
+// user UUID
+type accessClaims struct {
+	Role string `json:"role"`
+	Name string `json:"name,omitempty"`
+	// AMR lists the authentication methods of the login, as in OpenID
+	// Connect: "pwd", and "otp" after a TOTP code
+	AMR []string `json:"amr,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// NewTokenIssuer loads the keys in cfg.KeyDir, named after their key ID
+func NewTokenIssuer(cfg JWTConfig) (*TokenIssuer, error) {
+	files, err := ioutil.ReadDir(cfg.KeyDir)
+	if err != nil {
+		return nil, err
+	}
+	t := &TokenIssuer{cfg: cfg, keys: map[string]jwtKey{}}
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".key" && ext != ".pem") {
+			continue
+		}
+		kid := strings.TrimSuffix(file.Name(), ext)
+		if !keyIDPattern.MatchString(kid) {
+			return nil, fmt.Errorf("JWT key %s: invalid key ID", file.Name())
+		}
+		content, err := ioutil.ReadFile(filepath.Join(cfg.KeyDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseJWTKey(ext, content)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %s: %v", file.Name(), err)
+		}
+		if _, found := t.keys[kid]; found {
+			return nil, fmt.Errorf("JWT key %s: duplicate key ID", file.Name())
+		}
+		t.keys[kid] = key
+	}
+	if t.keys[cfg.SigningKey].sign == nil {
+		return nil, fmt.Errorf("JWT signing key %q not found in %s", cfg.SigningKey, cfg.KeyDir)
+	}
+	return t, nil
+}
+
+// parseJWTKey reads an HS256 secret (.key) or an RSA key (.pem)
+func parseJWTKey(ext string, content []byte) (jwtKey, error) {
+	if ext == ".key" {
+		secret := bytes.TrimSpace(content)
+		if len(secret) < 32 {
+			return jwtKey{}, errors.New("HS256 secrets must be at least 32 bytes")
+		}
+		return jwtKey{method: jwt.SigningMethodHS256, sign: secret, verify: secret}, nil
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return jwtKey{}, errors.New("no PEM block found")
+	}
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		rsaPublic, ok := public.(*rsa.PublicKey)
+		if !ok || rsaPublic.N.BitLen() < 2048 {
+			return jwtKey{}, errors.New("public key must be RSA of at least 2048 bits")
+		}
+		return jwtKey{method: jwt.SigningMethodRS256, verify: rsaPublic}, nil
+	default:
+		return jwtKey{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return jwtKey{}, err
+	}
+	rsaPrivate, ok := private.(*rsa.PrivateKey)
+	if !ok || rsaPrivate.N.BitLen() < 2048 {
+		return jwtKey{}, errors.New("private key must be RSA of at least 2048 bits")
+	}
+	return jwtKey{method: jwt.SigningMethodRS256, sign: rsaPrivate, verify: &rsaPrivate.PublicKey}, nil
+}
+
+// Issue returns a signed access token for user and its expiry
+func (t *TokenIssuer) Issue(user UserAccount, twoFactor bool) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(t.cfg.AccessTTL)
+	key := t.keys[t.cfg.SigningKey]
+	amr := []string{"pwd"}
+	if twoFactor {
+		amr = append(amr, "otp")
+	}
+	token := jwt.NewWithClaims(key.method, accessClaims{
+		Role: user.Role,
+		Name: user.Name,
+		AMR:  amr,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    t.cfg.Issuer,
+			Subject:   user.UserUUID.String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	})
+	token.Header["kid"] = t.cfg.SigningKey
+	signed, err := token.SignedString(key.sign)
+	return signed, expires, err
+}
+
+// Verify checks the signature, issuer and expiry of an access token and
+// returns the user it was issued to
+func (t *TokenIssuer) Verify(tokenString string) (Principal, error) {
+	var claims accessClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, found := t.keys[kid]
+		if !found {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		// the key decides the algorithm, never the token
+		if token.Method != key.method {
+			return nil, fmt.Errorf("key %q does not sign %s tokens", kid, token.Method.Alg())
+		}
+		return key.verify, nil
+	}, jwt.WithIssuer(t.cfg.Issuer), jwt.WithExpirationRequired(),
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}))
+	if err != nil {
+		return Principal{}, err
+	}
+	userUUID, err := gocql.ParseUUID(claims.Subject)
+	if err != nil {
+		return Principal{}, fmt.Errorf("invalid subject: %v", err)
+	}
+	principal := Principal{UserUUID: userUUID, Role: claims.Role, Name: claims.Name}
+	for _, method := range claims.AMR {
+		principal.TwoFactor = principal.TwoFactor || method == "otp"
+	}
+	return principal, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// TokenResponse is the body returned to bearer token clients by /login and
+// /token/refresh
+type TokenResponse struct {
+	User
+	AccessToken string `json:"accessToken"`
+	TokenType   string `json:"tokenType"`
+	// ExpiresIn is the lifetime of the access token in seconds
+	ExpiresIn    int    `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// issueTokens sends user a new access token and refresh token
+func (s *Server) issueTokens(w http.ResponseWriter, r *http.Request, user UserAccount, twoFactor bool) {
+	accessToken, expires, err := s.Tokens.Issue(user, twoFactor)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	refresh, refreshToken, err := newToken(user, s.Tokens.cfg.RefreshTTL)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	refresh.TwoFactor = twoFactor
+	if err := s.RefreshTokens.CreateRefreshToken(refresh); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	s.writeSecretJSON(w, r, http.StatusOK, TokenResponse{
+		User:         User{UserUUID: user.UserUUID, Role: user.Role, Name: user.Name},
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(expires).Seconds()),
+		RefreshToken: refreshToken,
+	})
+}
+
+/*
+Exchanges a refresh token for a new access token and refresh token. Each
+refresh token can be used once; using one again revokes all the refresh
+tokens of the user, as it has likely been stolen.
+Method: POST
+Endpoint: /token/refresh
+*/
+func (s *Server) TokenRefresh(w http.ResponseWriter, r *http.Request) {
+	if s.Tokens == nil {
+		s.writeStatus(w, r, http.StatusNotFound, "Bearer tokens are not enabled")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	refreshToken := r.Form.Get("refreshToken")
+	if refreshToken == "" {
+		s.badRequest(w, r, "Missing refreshToken")
+		return
+	}
+
+	refresh, err := s.RefreshTokens.GetRefreshToken(hashToken(refreshToken))
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	setRequestUser(r, refresh.UserUUID.String())
+
+	if refresh.Rotated {
+		requestLogger(r).Warn("Refresh token reused, revoking all refresh tokens",
+			"userID", refresh.UserUUID)
+		if err := s.RefreshTokens.DeleteUserRefreshTokens(refresh.UserUUID); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+
+	// the used token is kept until it expires to detect its reuse
+	refresh.Rotated = true
+	if err := s.RefreshTokens.CreateRefreshToken(refresh); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	s.issueTokens(w, r, UserAccount{UserUUID: refresh.UserUUID, Role: refresh.Role,
+		Name: refresh.Name}, refresh.TwoFactor)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeJWTKeys creates an HS256 secret "hs" and an RSA key "rs" in a new
+// key directory, returning it with the RSA key
+func writeJWTKeys(t *testing.T) (string, *rsa.PrivateKey) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hs.key"),
+		[]byte("0123456789abcdef0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "rs.pem"), pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, key
+}
+
+func testJWTConfig(dir, signingKey string) JWTConfig {
+	cfg := DefaultConfig().JWT
+	cfg.KeyDir = dir
+	cfg.SigningKey = signingKey
+	return cfg
+}
+
+func TestJWTIssueVerify(t *testing.T) {
+	dir, _ := writeJWTKeys(t)
+	for _, kid := range []string{"hs", "rs"} {
+		tokens, err := NewTokenIssuer(testJWTConfig(dir, kid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _, err := tokens.Issue(testUser, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		principal, err := tokens.Verify(token)
+		if err != nil {
+			t.Errorf("%s: %v", kid, err)
+		}
+		if principal.UserUUID != testUser.UserUUID || principal.Role != testUser.Role {
+			t.Errorf("%s: got principal %+v, want %s", kid, principal, testUser.UserUUID)
+		}
+		if _, err := tokens.Verify(token + "x"); err == nil {
+			t.Errorf("%s: tampered token verified", kid)
+		}
+	}
+
+	if _, err := NewTokenIssuer(testJWTConfig(dir, "missing")); err == nil {
+		t.Error("missing signing key accepted")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "short.key"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTokenIssuer(testJWTConfig(dir, "hs")); err == nil {
+		t.Error("short HS256 secret accepted")
+	}
+}
+
+func TestJWTRejectsForgedTokens(t *testing.T) {
+	dir, key := writeJWTKeys(t)
+	tokens, err := NewTokenIssuer(testJWTConfig(dir, "rs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := accessClaims{Role: RoleAdmin, RegisteredClaims: jwt.RegisteredClaims{
+		Issuer:    tokens.cfg.Issuer,
+		Subject:   testUser.UserUUID.String(),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}}
+	sign := func(method jwt.SigningMethod, kid string, claims accessClaims, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	if _, err := tokens.Verify(sign(jwt.SigningMethodRS256, "rs", claims, key)); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	// an HS256 token keyed with the RSA public key must not pass as RS256
+	public := x509.MarshalPKCS1PublicKey(&key.PublicKey)
+	if _, err := tokens.Verify(sign(jwt.SigningMethodHS256, "rs", claims, public)); err == nil {
+		t.Error("HS256 token verified with an RSA key")
+	}
+	if _, err := tokens.Verify(sign(jwt.SigningMethodRS256, "unknown", claims, key)); err == nil {
+		t.Error("token with an unknown key ID verified")
+	}
+	expired := claims
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	if _, err := tokens.Verify(sign(jwt.SigningMethodRS256, "rs", expired, key)); err == nil {
+		t.Error("expired token verified")
+	}
+	other := claims
+	other.Issuer = "someone-else"
+	if _, err := tokens.Verify(sign(jwt.SigningMethodRS256, "rs", other, key)); err == nil {
+		t.Error("token of another issuer verified")
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	dir, _ := writeJWTKeys(t)
+	old, err := NewTokenIssuer(testJWTConfig(dir, "hs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := old.Issue(testUser, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tokens of the previous key verify until it is removed
+	rotated, err := NewTokenIssuer(testJWTConfig(dir, "rs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.Verify(token); err != nil {
+		t.Errorf("token of the previous key rejected: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "hs.key")); err != nil {
+		t.Fatal(err)
+	}
+	if rotated, err = NewTokenIssuer(testJWTConfig(dir, "rs")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.Verify(token); err == nil {
+		t.Error("token of a removed key verified")
+	}
+}
+
+// refresh posts refreshToken to /token/refresh
+func refresh(s *Server, refreshToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/token/refresh",
+		strings.NewReader(url.Values{"refreshToken": {refreshToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveAs(s, nil, req)
+}
+
+func decodeTokens(t *testing.T, rec *httptest.ResponseRecorder) TokenResponse {
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var tokens TokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestTokenRefresh(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "emr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	s := NewServer(store)
+	dir, _ := writeJWTKeys(t)
+	if s.Tokens, err = NewTokenIssuer(testJWTConfig(dir, "rs")); err != nil {
+		t.Fatal(err)
+	}
+	login(t, s)
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{
+		"username": {"kelly"}, "password": {"correct horse"}, "tokens": {"true"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	first := decodeTokens(t, serveAs(s, nil, req))
+	if first.TokenType != "Bearer" || first.Role != RolePatient || first.RefreshToken == "" {
+		t.Fatalf("unexpected token response %+v", first)
+	}
+
+	bearer := func(accessToken string, req *http.Request) int {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		return serveAs(s, nil, req).Code
+	}
+	if code := bearer(first.AccessToken, httptest.NewRequest("GET", "/doctors", nil)); code != http.StatusOK {
+		t.Errorf("bearer request: got %d, want 200", code)
+	}
+	if code := bearer(first.AccessToken, httptest.NewRequest("POST", "/doctors", nil)); code != http.StatusForbidden {
+		t.Errorf("bearer request by a patient to an admin route: got %d, want 403", code)
+	}
+	if code := bearer("forged", httptest.NewRequest("GET", "/doctors", nil)); code != http.StatusUnauthorized {
+		t.Errorf("forged bearer token: got %d, want 401", code)
+	}
+
+	second := decodeTokens(t, refresh(s, first.RefreshToken))
+	if second.RefreshToken == first.RefreshToken {
+		t.Error("refresh token was not rotated")
+	}
+	if code := bearer(second.AccessToken, httptest.NewRequest("GET", "/doctors", nil)); code != http.StatusOK {
+		t.Errorf("refreshed bearer request: got %d, want 200", code)
+	}
+
+	// reusing a refresh token revokes every refresh token of the user
+	if rec := refresh(s, first.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token: got %d, want 401", rec.Code)
+	}
+	if rec := refresh(s, second.RefreshToken); rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token after reuse: got %d, want 401", rec.Code)
+	}
+
+	// access tokens of an account given another role are refused before they expire
+	if _, err := store.db.Exec(`UPDATE users SET role = ? WHERE username = 'kelly'`, RoleDoctor); err != nil {
+		t.Fatal(err)
+	}
+	if code := bearer(second.AccessToken, httptest.NewRequest("GET", "/doctors", nil)); code != http.StatusUnauthorized {
+		t.Errorf("bearer request after a role change: got %d, want 401", code)
+	}
+
+	// and so are those of a disabled account
+	if _, err := store.db.Exec(`UPDATE users SET role = ?, disabled = 1 WHERE username = 'kelly'`, RolePatient); err != nil {
+		t.Fatal(err)
+	}
+	if code := bearer(second.AccessToken, httptest.NewRequest("GET", "/doctors", nil)); code != http.StatusUnauthorized {
+		t.Errorf("bearer request of a disabled user: got %d, want 401", code)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewHTTPServers returns the http.Server for handler with the configured
+// listen address, timeouts and TLS, followed by the HTTP to HTTPS redirect
+// server when one is configured. The timeouts keep slow clients from holding
+// connections open.
+func NewHTTPServers(cfg Config, handler http.Handler) ([]*http.Server, error) {
+	tlsConfig, err := NewTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	servers := []*http.Server{{
+		Addr:              cfg.ListenAddr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+		ReadTimeout:       cfg.Timeouts.Read,
+		WriteTimeout:      cfg.Timeouts.Write,
+		IdleTimeout:       cfg.Timeouts.Idle,
+	}}
+
+	if cfg.TLS.RedirectAddr != "" {
+		servers = append(servers, &http.Server{
+			Addr:              cfg.TLS.RedirectAddr,
+			Handler:           RedirectToHTTPS(cfg.ListenAddr),
+			ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+			ReadTimeout:       cfg.Timeouts.ReadHeader,
+			WriteTimeout:      cfg.Timeouts.ReadHeader,
+			IdleTimeout:       cfg.Timeouts.Idle,
+		})
+	}
+	return servers, nil
+}
+
+// Serve runs servers, over HTTPS for those with a TLSConfig, until one fails
+// or a signal arrives on stop. It then stops accepting connections and waits
+// up to shutdownTimeout for in-flight requests before closing the rest.
+func Serve(servers []*http.Server, shutdownTimeout time.Duration, stop <-chan os.Signal) error {
+	errc := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				errc <- srv.ListenAndServeTLS("", "")
+			} else {
+				errc <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+
+	var err error
+	running := len(servers)
+	select {
+	case err = <-errc:
+		running--
+	case sig := <-stop:
+		log.Printf("Received %s, draining connections for up to %s", sig, shutdownTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown deadline exceeded, closing remaining connections: %v", err)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	for ; running > 0; running-- {
+		if serveErr := <-errc; err == nil && serveErr != http.ErrServerClosed {
+			err = serveErr
+		}
+	}
+	return err
+}
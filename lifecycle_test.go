@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing is listening on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServeDrainsOnSignal(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = freeAddr(t)
+	servers, err := NewHTTPServers(cfg, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() { served <- Serve(servers, 5*time.Second, stop) }()
+
+	// retry until the listener is up
+	body := make(chan string, 1)
+	go func() {
+		for {
+			resp, err := http.Get("http://" + cfg.ListenAddr)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			content, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			body <- string(content)
+			return
+		}
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned before the in-flight request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request was cut off, got %q", got)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+}
+
+func TestServeShutdownDeadline(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = freeAddr(t)
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	servers, err := NewHTTPServers(cfg, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { served <- Serve(servers, 50*time.Millisecond, stop) }()
+
+	go func() {
+		for {
+			if resp, err := http.Get("http://" + cfg.ListenAddr); err == nil {
+				resp.Body.Close()
+				return
+			}
+			select {
+			case <-started:
+				return
+			default:
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}()
+
+	<-started
+	stop <- syscall.SIGINT
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not give up on a stuck request after the shutdown deadline")
+	}
+}
+
+func TestServeListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cfg := DefaultConfig()
+	cfg.ListenAddr = l.Addr().String()
+	servers, err := NewHTTPServers(cfg, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Serve(servers, time.Second, nil); err == nil {
+		t.Error("expected an error listening on a used address")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// LoginAttempts counts the recent failed logins of an account or client IP
+type LoginAttempts struct {
+	// Key is "account:<username>" or "ip:<address>"
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	// LockedUntil is set once Failures reaches the limit
+	LockedUntil time.Time
+	// ExpiresAt is when the failures are forgotten
+	ExpiresAt time.Time
+}
+
+// accountKey is the LoginAttempts key of the account username
+func accountKey(username string) string {
+	return "account:" + username
+}
+
+// clientIPKey is the LoginAttempts key of the client IP of r
+func clientIPKey(r *http.Request) string {
+	return "ip:" + sourceIP(r)
+}
+
+// retryAt returns when the next login may be attempted: BaseDelay after the
+// first failure, doubling up to MaxDelay, or when the lockout ends
+func (a LoginAttempts) retryAt(cfg LoginConfig) time.Time {
+	delay := cfg.BaseDelay
+	for i := 1; i < a.Failures && delay < cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > cfg.MaxDelay {
+		delay = cfg.MaxDelay
+	}
+	retry := a.LastFailure.Add(delay)
+	if a.LockedUntil.After(retry) {
+		return a.LockedUntil
+	}
+	return retry
+}
+
+// loginLimits returns the keys a login as username from r is counted
+// under, with the number of failures at which each is locked
+func (s *Server) loginLimits(r *http.Request, username string) map[string]int {
+	return map[string]int{
+		accountKey(username): s.Login.MaxFailures,
+		clientIPKey(r):       s.Login.IPMaxFailures,
+	}
+}
+
+// loginWait returns how long the caller of r must wait before logging in as
+// username, zero if it may try now
+func (s *Server) loginWait(r *http.Request, username string) (time.Duration, error) {
+	var wait time.Duration
+	for key := range s.loginLimits(r, username) {
+		a, err := s.LoginAttempts.GetLoginAttempts(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if d := time.Until(a.retryAt(s.Login)); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// loginFailed counts a failed login as username from r, locking the account
+// or client IP once it reaches its limit. Concurrent failures may be counted
+// once, which only delays the lockout by an attempt.
+func (s *Server) loginFailed(r *http.Request, username string) error {
+	now := time.Now()
+	for key, limit := range s.loginLimits(r, username) {
+		a, err := s.LoginAttempts.GetLoginAttempts(key)
+		if err == ErrNotFound {
+			a = LoginAttempts{Key: key}
+		} else if err != nil {
+			return err
+		}
+		a.Failures++
+		a.LastFailure = now
+		a.ExpiresAt = now.Add(s.Login.ResetAfter)
+		if a.Failures >= limit {
+			a.LockedUntil = now.Add(s.Login.Lockout)
+			scope, _, _ := strings.Cut(key, ":")
+			auditLog(r, "login.locked", "Login locked after failed attempts", "scope", scope,
+				"username", username, "remoteAddr", r.RemoteAddr, "failures", a.Failures,
+				"lockedUntil", a.LockedUntil)
+		}
+		if err := s.LoginAttempts.PutLoginAttempts(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tooManyLogins answers a login attempted before wait has elapsed
+func (s *Server) tooManyLogins(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	requestLogger(r).Info("Login throttled", "remoteAddr", r.RemoteAddr, "wait", wait.String())
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	s.writeStatus(w, r, http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+}
+
+/*
+Unlocks a user account locked after failed logins
+Method: DELETE
+Endpoint: /users/useruuid/{useruuid}/lockout
+*/
+func (s *Server) UserUnlock(w http.ResponseWriter, r *http.Request) {
+	userUUID, err := gocql.ParseUUID(mux.Vars(r)["useruuid"])
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
+	}
+	user, err := s.Users.GetUserByUUID(userUUID)
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusNotFound, "Not Found")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.LoginAttempts.DeleteLoginAttempts(accountKey(user.Username)); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	auditLog(r, "login.unlocked", "Account unlocked", "username", user.Username,
+		"unlockedBy", principal.UserUUID)
+	s.writeStatus(w, r, http.StatusOK, "Account unlocked")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	cfg := LoginConfig{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	last := time.Now()
+	tests := []struct {
+		attempts LoginAttempts
+		want     time.Duration
+	}{
+		{LoginAttempts{Failures: 1, LastFailure: last}, time.Second},
+		{LoginAttempts{Failures: 2, LastFailure: last}, 2 * time.Second},
+		{LoginAttempts{Failures: 3, LastFailure: last}, 4 * time.Second},
+		{LoginAttempts{Failures: 4, LastFailure: last}, 5 * time.Second},
+		{LoginAttempts{Failures: 1000, LastFailure: last}, 5 * time.Second},
+		{LoginAttempts{Failures: 4, LastFailure: last, LockedUntil: last.Add(time.Hour)}, time.Hour},
+	}
+	for _, test := range tests {
+		if got := test.attempts.retryAt(cfg).Sub(last); got != test.want {
+			t.Errorf("%d failures: retry after %v, want %v", test.attempts.Failures, got, test.want)
+		}
+	}
+}
+
+// postLogin logs in through the router of s from the httptest client IP
+func postLogin(s *Server, username, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/login",
+		strings.NewReader(url.Values{"username": {username}, "password": {password}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveAs(s, nil, req)
+}
+
+// elapse moves the failed logins counted under key d into the past
+func elapse(t *testing.T, s *Server, key string, d time.Duration) {
+	a, err := s.LoginAttempts.GetLoginAttempts(key)
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	a.LastFailure = a.LastFailure.Add(-d)
+	if !a.LockedUntil.IsZero() {
+		a.LockedUntil = a.LockedUntil.Add(-d)
+	}
+	if err := s.LoginAttempts.PutLoginAttempts(a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStoreLoginLockout(t *testing.T, store Store) {
+	s := NewServer(store)
+	s.Login = LoginConfig{MaxFailures: 3, IPMaxFailures: 5, BaseDelay: time.Second,
+		MaxDelay: 4 * time.Second, Lockout: time.Minute, ResetAfter: time.Hour}
+	login(t, s)
+	account, clientIP := accountKey("kelly"), "ip:192.0.2.1"
+	wait := func(d time.Duration) {
+		elapse(t, s, account, d)
+		elapse(t, s, clientIP, d)
+	}
+
+	if rec := postLogin(s, "kelly", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: got %d, want 401", rec.Code)
+	}
+	rec := postLogin(s, "kelly", "correct horse")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("login right after a failure: got %d, want 429 with Retry-After", rec.Code)
+	}
+
+	// the third failure locks the account past the backoff delays
+	wait(time.Second)
+	postLogin(s, "kelly", "wrong")
+	wait(2 * time.Second)
+	postLogin(s, "kelly", "wrong")
+	wait(10 * time.Second)
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("login to a locked account: got %d, want 429", rec.Code)
+	}
+
+	unlock := httptest.NewRequest("DELETE", "/users/useruuid/"+testUser.UserUUID.String()+"/lockout", nil)
+	if rec := serveServer(s, testUser, unlock); rec.Code != http.StatusForbidden {
+		t.Errorf("unlock by a patient: got %d, want 403", rec.Code)
+	}
+	unlock = httptest.NewRequest("DELETE", "/users/useruuid/"+testUser.UserUUID.String()+"/lockout", nil)
+	if rec := serveServer(s, testAdmin, unlock); rec.Code != http.StatusOK {
+		t.Errorf("unlock by an admin: got %d, want 200", rec.Code)
+	}
+	elapse(t, s, clientIP, 10*time.Second)
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusOK {
+		t.Errorf("login after unlock: got %d, want 200", rec.Code)
+	}
+
+	// unknown usernames count against the client IP, locking out other accounts
+	postLogin(s, "nobody", "guess")
+	elapse(t, s, clientIP, 10*time.Second)
+	postLogin(s, "someone", "guess")
+	elapse(t, s, clientIP, 10*time.Second)
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("login from a locked out IP: got %d, want 429", rec.Code)
+	}
+}
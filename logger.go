@@ -1,23 +1,155 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"regexp"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
+// logLevels maps the accepted log levels to their slog level
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel is the configured verbosity, request lines are logged at info
+var logLevel = new(slog.LevelVar)
+
+// logOutput is where the JSON log lines are written
+var logOutput io.Writer = os.Stderr
+
+// SetupLogging sends the service logs, including those of the log package,
+// to out as JSON lines with sensitive fields redacted
+func SetupLogging(out io.Writer, level string, pseudonymKey []byte) {
+	logOutput = out
+	logLevel.Set(logLevels[level])
+	slog.SetDefault(slog.New(NewRedactHandler(
+		slog.NewJSONHandler(out, &slog.HandlerOptions{Level: logLevel}), pseudonymKey)))
+}
+
+// FlushLogs writes out anything the log output still buffers, call it
+// before the process exits
+func FlushLogs() {
+	if f, ok := logOutput.(interface{ Sync() error }); ok {
+		f.Sync()
+	}
+}
+
+// requestInfo describes the request being served, for its log lines
+type requestInfo struct {
+	ID string
+	// UserID is set once the request is authenticated
+	UserID string
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the requestInfo stored by Logger, if any
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setRequestUser records the user making r in its request log line
+func setRequestUser(r *http.Request, userID string) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.UserID = userID
+	}
+}
+
+// requestLogger returns a logger tagging each line with the request ID of r
+func requestLogger(r *http.Request) *slog.Logger {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return slog.Default().With("requestID", info.ID)
+	}
+	return slog.Default()
+}
+
+// auditLog logs a security event, such as an account lockout, naming it
+// under "audit" so that these lines can be collected apart
+func auditLog(r *http.Request, event, msg string, args ...any) {
+	requestLogger(r).Warn(msg, append([]any{"audit", event}, args...)...)
+}
+
+// requestIDPattern limits propagated X-Request-ID values to safe tokens
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the caller's X-Request-ID if it is well formed, a new
+// random ID otherwise
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); requestIDPattern.MatchString(id) {
+		return id
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// statusRecorder remembers the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// Logger assigns the request an ID, echoed in the X-Request-ID response
+// header, and logs one line per request once it has been served. The path
+// is logged as its route template so that no identifiers end up in the log.
 func Logger(inner http.Handler, name string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		info := &requestInfo{ID: requestID(r)}
+		w.Header().Set("X-Request-ID", info.ID)
+		rec := &statusRecorder{ResponseWriter: w}
 
-		inner.ServeHTTP(w, r)
+		// logged on the way out even if the response is aborted by a panic
+		defer func() {
+			path := "unknown"
+			if route := mux.CurrentRoute(r); route != nil {
+				path, _ = route.GetPathTemplate()
+			}
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			slog.Info("request",
+				"requestID", info.ID,
+				"method", r.Method,
+				"route", name,
+				"path", path,
+				"status", rec.status,
+				"size", rec.size,
+				"duration", time.Since(start).String(),
+				"remoteAddr", r.RemoteAddr,
+				"userID", info.UserID,
+			)
+		}()
 
-		log.Printf(
-			"%s\t%s\t%s\t%s",
-			r.Method,
-			r.RequestURI,
-			name,
-			time.Since(start),
-		)
+		inner.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
 	})
 }
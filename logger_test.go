@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+// captureLogs sends the JSON logs to a buffer for the rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger, writer, flags := slog.Default(), log.Writer(), log.Flags()
+	SetupLogging(&buf, "debug", []byte("test key"))
+	t.Cleanup(func() {
+		slog.SetDefault(logger)
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+// logLines decodes the JSON log lines written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("log line is not JSON: %s", scanner.Text())
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestLoggerRequestLine(t *testing.T) {
+	buf := captureLogs(t)
+	store := NewMemoryStore()
+	serveStore(store, httptest.NewRequest("POST", "/patients", strings.NewReader(`{"name": "Kelly Lai",
+		"medicalNumber": "1234567890", "notes": "Accompanied by guide dog"}`)))
+	patients, _ := store.ListPatients()
+
+	req := httptest.NewRequest("GET", "/patients/patientuuid/"+patients[0].PatientUUID.String(), nil)
+	req.Header.Set("X-Request-ID", "lb-7f3a")
+	rec := serveStore(store, req)
+	if rec.Header().Get("X-Request-ID") != "lb-7f3a" {
+		t.Errorf("request ID not propagated, got %q", rec.Header().Get("X-Request-ID"))
+	}
+
+	output := buf.String()
+	for _, phi := range []string{"Kelly Lai", "1234567890", "guide dog", patients[0].PatientUUID.String()} {
+		if strings.Contains(output, phi) {
+			t.Errorf("log output contains patient data %q:\n%s", phi, output)
+		}
+	}
+
+	var request map[string]interface{}
+	for _, line := range logLines(t, buf) {
+		if line["msg"] == "request" && line["requestID"] == "lb-7f3a" {
+			request = line
+		}
+	}
+	if request == nil {
+		t.Fatalf("no request line for lb-7f3a in:\n%s", output)
+	}
+	if request["route"] != "PatientGet" || request["path"] != "/patients/patientuuid/{patientuuid}" ||
+		request["status"] != float64(http.StatusOK) || request["size"].(float64) <= 0 {
+		t.Errorf("unexpected request line %v", request)
+	}
+}
+
+func TestLoggerGeneratesRequestID(t *testing.T) {
+	captureLogs(t)
+	for _, id := range []string{"", "has spaces", strings.Repeat("x", 200)} {
+		req := httptest.NewRequest("GET", "/doctors", nil)
+		req.Header.Set("X-Request-ID", id)
+		rec := serveStore(NewMemoryStore(), req)
+		if got := rec.Header().Get("X-Request-ID"); got == id || !requestIDPattern.MatchString(got) {
+			t.Errorf("X-Request-ID %q: expected a new ID, got %q", id, got)
+		}
+	}
+}
+
+func TestRedactHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewRedactHandler(slog.NewJSONHandler(&buf, nil), []byte("key"))
+	logger := slog.New(h).With("patientUUID", "a2b5e1b4-5b1d-4b5e-9c53-7d6b2f0b8f4e")
+	logger.Info("test", slog.Group("patient", "Name", "Kelly Lai", "gender", "F"), "doctorUUID", "d1")
+
+	line := logLines(t, &buf)[0]
+	if line["patientUUID"] != h.Pseudonym("a2b5e1b4-5b1d-4b5e-9c53-7d6b2f0b8f4e") {
+		t.Errorf("patient UUID not pseudonymised: %v", line["patientUUID"])
+	}
+	patient := line["patient"].(map[string]interface{})
+	if patient["Name"] != redactedValue || patient["gender"] != redactedValue {
+		t.Errorf("grouped patient fields not redacted: %v", patient)
+	}
+	if line["doctorUUID"] != "d1" {
+		t.Errorf("non patient field changed: %v", line["doctorUUID"])
+	}
+
+	kelly := gocql.TimeUUID()
+	logger.Error("audit", "actorID", kelly, "patientUUIDs", []gocql.UUID{kelly})
+	line = logLines(t, &buf)[0]
+	if line["actorID"] != h.Pseudonym(kelly.String()) {
+		t.Errorf("actor not pseudonymised: %v", line["actorID"])
+	}
+	if list, ok := line["patientUUIDs"].([]interface{}); !ok || len(list) != 1 || list[0] != h.Pseudonym(kelly.String()) {
+		t.Errorf("patient UUIDs not pseudonymised: %v", line["patientUUIDs"])
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail is an email sent by the service
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email
+type Mailer interface {
+	Send(m Mail) error
+}
+
+// NewMailer returns the sender selected by cfg.Sender
+func NewMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Sender {
+	case "log":
+		return LogMailer{}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+			return nil, err
+		}
+		return FileMailer{Dir: cfg.Dir, From: cfg.From}, nil
+	case "smtp":
+		return SMTPMailer{Addr: cfg.SMTPAddr, From: cfg.From, Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword}, nil
+	}
+	return nil, fmt.Errorf("unknown mail sender %q", cfg.Sender)
+}
+
+// message renders m as a plain text RFC 5322 message from from
+func (m Mail) message(from string) ([]byte, error) {
+	for _, header := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("mail header contains a line break")
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	return b.Bytes(), nil
+}
+
+// LogMailer logs messages instead of sending them, for development. The
+// log lines hold the whole message, reset links included.
+type LogMailer struct{}
+
+func (LogMailer) Send(m Mail) error {
+	slog.Info("Mail not sent, logged for development", "to", m.To, "subject", m.Subject,
+		"body", m.Body)
+	return nil
+}
+
+// FileMailer writes each message to a new .eml file in Dir, for development
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (f FileMailer) Send(m Mail) error {
+	msg, err := m.message(f.From)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix) + ".eml"
+	return os.WriteFile(filepath.Join(f.Dir, name), msg, 0600)
+}
+
+// SMTPMailer sends messages through an SMTP relay, with STARTTLS when the
+// relay offers it and PLAIN authentication when Username is set
+type SMTPMailer struct {
+	// Addr is the host:port of the relay
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s SMTPMailer) Send(m Mail) error {
+	msg, err := m.message(s.From)
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, from.Address, []string{m.To}, msg)
+}
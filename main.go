@@ -1,16 +1,86 @@
 package main
 
 import (
+	"flag"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	router := NewRouter()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.LookupEnv, os.Stdout); err != nil && err != flag.ErrHelp {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "adduser" {
+		if err := runAddUser(os.Args[2:], os.LookupEnv, os.Stdin, os.Stdout); err != nil && err != flag.ErrHelp {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// Https cert and key generation and usage -> removed for demo
-	// generateCertKeyPEM()
-	// log.Fatal( http.ListenAndServeTLS(":8080", "cert.pem", "key.pem", router))
-	
-	log.Fatal(http.ListenAndServe(":8080", router))
+	cfg, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	SetupLogging(os.Stderr, cfg.LogLevel, []byte(cfg.LogPseudonymKey))
+	log.Printf("Effective configuration:\n%s", cfg)
+
+	store, err := OpenStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := NewServer(store)
+	server.AllowedOrigins = cfg.CORSOrigins
+	server.MaxUploadSize = cfg.MaxUploadSize
+	server.Session = cfg.Session
+	server.Login = cfg.Login
+	server.TOTP = cfg.TOTP
+	server.Password = cfg.Password
+	server.InviteTTL = cfg.InviteTTL
+	server.APIKeyMaxTTL = cfg.APIKeyMaxTTL
+	if cfg.Password.BreachedList != "" {
+		if server.BreachedPasswords, err = LoadBreachedPasswords(cfg.Password.BreachedList); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if server.Mail, err = NewMailer(cfg.Mail); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.OIDC.Issuer != "" {
+		server.OIDC = NewOIDCProvider(cfg.OIDC)
+	}
+	if cfg.JWT.KeyDir != "" {
+		if server.Tokens, err = NewTokenIssuer(cfg.JWT); err != nil {
+			log.Fatal(err)
+		}
+	}
+	servers, err := NewHTTPServers(cfg, NewRouter(server))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	for _, srv := range servers {
+		log.Printf("Listening on %s (TLS %t)", srv.Addr, srv.TLSConfig != nil)
+	}
+	err = Serve(servers, cfg.Timeouts.Shutdown, stop)
+	// the store is closed only once no request can use it any more
+	store.Close()
+	if err != nil {
+		log.Print(err)
+		FlushLogs()
+		os.Exit(1)
+	}
+	log.Printf("Server stopped")
+	FlushLogs()
 }
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// uuidSet is the set of primary keys stored under one secondary index value
+type uuidSet map[gocql.UUID]struct{}
+
+func (s uuidSet) add(key gocql.UUID) {
+	s[key] = struct{}{}
+}
+
+// sortedKeys returns the keys in s in a stable order
+func (s uuidSet) sortedKeys() []gocql.UUID {
+	keys := make([]gocql.UUID, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sortUUIDs(keys)
+	return keys
+}
+
+func sortUUIDs(keys []gocql.UUID) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+}
+
+// uuidIndex is a secondary index on a UUID column
+type uuidIndex map[gocql.UUID]uuidSet
+
+func (idx uuidIndex) add(value, key gocql.UUID) {
+	if idx[value] == nil {
+		idx[value] = uuidSet{}
+	}
+	idx[value].add(key)
+}
+
+func (idx uuidIndex) remove(value, key gocql.UUID) {
+	delete(idx[value], key)
+	if len(idx[value]) == 0 {
+		delete(idx, value)
+	}
+}
+
+// textIndex is a secondary index on a text column
+type textIndex map[string]uuidSet
+
+func (idx textIndex) add(value string, key gocql.UUID) {
+	if idx[value] == nil {
+		idx[value] = uuidSet{}
+	}
+	idx[value].add(key)
+}
+
+func (idx textIndex) remove(value string, key gocql.UUID) {
+	delete(idx[value], key)
+	if len(idx[value]) == 0 {
+		delete(idx, value)
+	}
+}
+
+// MemoryStore implements Store in process memory. It mirrors the tables and
+// secondary indexes of the Cassandra schema and is meant for tests and local
+// development; nothing is persisted.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	patients              map[gocql.UUID]Patient
+	patientsMedicalNumber textIndex
+	futureAppointments    map[gocql.UUID]FutureAppointment
+	futureByPatient       uuidIndex
+	futureByDoctor        uuidIndex
+	completedAppointments map[gocql.UUID]CompletedAppointment
+	completedByPatient    uuidIndex
+	completedByDoctor     uuidIndex
+	doctors               map[gocql.UUID]Doctor
+	users                 map[string]UserAccount
+	usersUserUUID         map[gocql.UUID]string
+	prescriptions         map[gocql.UUID]Prescriptions
+	notifications         map[gocql.UUID]Notifications
+	documents             map[gocql.UUID]Document
+	documentsPatientUUID  uuidIndex
+	sessions              map[string]Session
+	refreshTokens         map[string]Session
+	loginAttempts         map[string]LoginAttempts
+	loginChallenges       map[string]Session
+	twoFactor             map[gocql.UUID]TwoFactor
+	passwordResets        map[string]Session
+	doctorInvites         map[string]Session
+	oidcIdentities        map[[2]string]gocql.UUID
+	apiKeys               map[gocql.UUID]APIKey
+	// auditEvents are ordered by Seq
+	auditEvents []AuditEvent
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		patients:              make(map[gocql.UUID]Patient),
+		patientsMedicalNumber: textIndex{},
+		futureAppointments:    make(map[gocql.UUID]FutureAppointment),
+		futureByPatient:       uuidIndex{},
+		futureByDoctor:        uuidIndex{},
+		completedAppointments: make(map[gocql.UUID]CompletedAppointment),
+		completedByPatient:    uuidIndex{},
+		completedByDoctor:     uuidIndex{},
+		doctors:               make(map[gocql.UUID]Doctor),
+		users:                 make(map[string]UserAccount),
+		usersUserUUID:         make(map[gocql.UUID]string),
+		prescriptions:         make(map[gocql.UUID]Prescriptions),
+		notifications:         make(map[gocql.UUID]Notifications),
+		documents:             make(map[gocql.UUID]Document),
+		documentsPatientUUID:  uuidIndex{},
+		sessions:              make(map[string]Session),
+		refreshTokens:         make(map[string]Session),
+		loginAttempts:         make(map[string]LoginAttempts),
+		loginChallenges:       make(map[string]Session),
+		twoFactor:             make(map[gocql.UUID]TwoFactor),
+		passwordResets:        make(map[string]Session),
+		doctorInvites:         make(map[string]Session),
+		oidcIdentities:        make(map[[2]string]gocql.UUID),
+		apiKeys:               make(map[gocql.UUID]APIKey),
+	}
+}
+
+func (m *MemoryStore) Close() {}
+
+// SchemaVersion reports no migrations, the memory store has no schema
+func (m *MemoryStore) SchemaVersion() (applied, expected int, err error) {
+	return 0, 0, nil
+}
+
+func (m *MemoryStore) CheckWritable(instance string) error {
+	return nil
+}
+
+// putPatient inserts or overwrites a patient, keeping the index current
+func (m *MemoryStore) putPatient(p Patient) {
+	if old, found := m.patients[p.PatientUUID]; found {
+		m.patientsMedicalNumber.remove(old.MedicalNumber, old.PatientUUID)
+	}
+	m.patients[p.PatientUUID] = p
+	m.patientsMedicalNumber.add(p.MedicalNumber, p.PatientUUID)
+}
+
+func (m *MemoryStore) CreatePatient(p Patient) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.putPatient(p)
+	return nil
+}
+
+func (m *MemoryStore) GetPatient(patientUUID gocql.UUID) (Patient, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, found := m.patients[patientUUID]
+	if !found {
+		return Patient{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (m *MemoryStore) GetPatientByMedicalNumber(medicalNumber string) (Patient, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := m.patientsMedicalNumber[medicalNumber].sortedKeys()
+	if len(keys) == 0 {
+		return Patient{}, ErrNotFound
+	}
+	return m.patients[keys[0]], nil
+}
+
+func (m *MemoryStore) ListPatients() (Patients, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	patientList := make(Patients, 0, len(m.patients))
+	for _, p := range m.patients {
+		patientList = append(patientList, p)
+	}
+	sort.Slice(patientList, func(i, j int) bool {
+		return patientList[i].PatientUUID.String() < patientList[j].PatientUUID.String()
+	})
+	return patientList, nil
+}
+
+func (m *MemoryStore) UpdatePatient(p Patient) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.patients[p.PatientUUID]; !found {
+		return ErrNotFound
+	}
+	m.putPatient(p)
+	return nil
+}
+
+func (m *MemoryStore) CreateFutureAppointment(a FutureAppointment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteFutureAppointment(a.AppointmentUUID)
+	m.futureAppointments[a.AppointmentUUID] = a
+	m.futureByPatient.add(a.PatientUUID, a.AppointmentUUID)
+	m.futureByDoctor.add(a.DoctorUUID, a.AppointmentUUID)
+	return nil
+}
+
+func (m *MemoryStore) GetFutureAppointment(appointmentUUID gocql.UUID) (FutureAppointment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, found := m.futureAppointments[appointmentUUID]
+	if !found {
+		return FutureAppointment{}, ErrNotFound
+	}
+	return a, nil
+}
+
+// deleteFutureAppointment reports whether an appointment was removed
+func (m *MemoryStore) deleteFutureAppointment(appointmentUUID gocql.UUID) bool {
+	a, found := m.futureAppointments[appointmentUUID]
+	if !found {
+		return false
+	}
+	delete(m.futureAppointments, appointmentUUID)
+	m.futureByPatient.remove(a.PatientUUID, appointmentUUID)
+	m.futureByDoctor.remove(a.DoctorUUID, appointmentUUID)
+	return true
+}
+
+func (m *MemoryStore) DeleteFutureAppointment(appointmentUUID gocql.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.deleteFutureAppointment(appointmentUUID) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MemoryStore) futureAppointmentsIn(keys uuidSet) FutureAppointments {
+	appointmentList := make(FutureAppointments, 0, len(keys))
+	for _, k := range keys.sortedKeys() {
+		appointmentList = append(appointmentList, m.futureAppointments[k])
+	}
+	return appointmentList
+}
+
+func (m *MemoryStore) FutureAppointmentsByPatient(patientUUID gocql.UUID) (FutureAppointments, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.futureAppointmentsIn(m.futureByPatient[patientUUID]), nil
+}
+
+func (m *MemoryStore) FutureAppointmentsByDoctor(doctorUUID gocql.UUID) (FutureAppointments, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.futureAppointmentsIn(m.futureByDoctor[doctorUUID]), nil
+}
+
+func (m *MemoryStore) CompleteAppointment(a CompletedAppointment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteFutureAppointment(a.AppointmentUUID)
+
+	if old, found := m.completedAppointments[a.AppointmentUUID]; found {
+		m.completedByPatient.remove(old.PatientUUID, old.AppointmentUUID)
+		m.completedByDoctor.remove(old.DoctorUUID, old.AppointmentUUID)
+	}
+	m.completedAppointments[a.AppointmentUUID] = a
+	m.completedByPatient.add(a.PatientUUID, a.AppointmentUUID)
+	m.completedByDoctor.add(a.DoctorUUID, a.AppointmentUUID)
+	return nil
+}
+
+func (m *MemoryStore) GetCompletedAppointment(appointmentUUID gocql.UUID) (CompletedAppointment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, found := m.completedAppointments[appointmentUUID]
+	if !found {
+		return CompletedAppointment{}, ErrNotFound
+	}
+	return a, nil
+}
+
+func (m *MemoryStore) completedAppointmentsIn(keys uuidSet) CompletedAppointments {
+	appointmentList := make(CompletedAppointments, 0, len(keys))
+	for _, k := range keys.sortedKeys() {
+		appointmentList = append(appointmentList, m.completedAppointments[k])
+	}
+	return appointmentList
+}
+
+func (m *MemoryStore) CompletedAppointmentsByPatient(patientUUID gocql.UUID) (CompletedAppointments, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.completedAppointmentsIn(m.completedByPatient[patientUUID]), nil
+}
+
+func (m *MemoryStore) CompletedAppointmentsByDoctor(doctorUUID gocql.UUID) (CompletedAppointments, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.completedAppointmentsIn(m.completedByDoctor[doctorUUID]), nil
+}
+
+func (m *MemoryStore) CreateDoctor(d Doctor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.doctors[d.DoctorUUID] = d
+	return nil
+}
+
+func (m *MemoryStore) GetDoctor(doctorUUID gocql.UUID) (Doctor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	d, found := m.doctors[doctorUUID]
+	if !found {
+		return Doctor{}, ErrNotFound
+	}
+	return d, nil
+}
+
+func (m *MemoryStore) ListDoctors() ([]Doctor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	doctorList := make([]Doctor, 0, len(m.doctors))
+	for _, d := range m.doctors {
+		doctorList = append(doctorList, d)
+	}
+	sort.Slice(doctorList, func(i, j int) bool {
+		return doctorList[i].DoctorUUID.String() < doctorList[j].DoctorUUID.String()
+	})
+	return doctorList, nil
+}
+
+func (m *MemoryStore) CreateUser(u UserAccount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.users[u.Username]; found {
+		return ErrExists
+	}
+	m.users[u.Username] = u
+	m.usersUserUUID[u.UserUUID] = u.Username
+	return nil
+}
+
+func (m *MemoryStore) GetUserByUsername(username string) (UserAccount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, found := m.users[username]
+	if !found {
+		return UserAccount{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (m *MemoryStore) GetUserByUUID(userUUID gocql.UUID) (UserAccount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	username, found := m.usersUserUUID[userUUID]
+	if !found {
+		return UserAccount{}, ErrNotFound
+	}
+	return m.users[username], nil
+}
+
+func (m *MemoryStore) UpdatePassword(username string, salt, saltedHash []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, found := m.users[username]
+	if !found {
+		return ErrNotFound
+	}
+	u.Salt, u.SaltedHash = salt, saltedHash
+	m.users[username] = u
+	return nil
+}
+
+func (m *MemoryStore) UpdateUser(u UserAccount) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, found := m.users[u.Username]
+	if !found {
+		return ErrNotFound
+	}
+	existing.Role, existing.Name, existing.Email = u.Role, u.Name, u.Email
+	existing.Disabled = u.Disabled
+	m.users[u.Username] = existing
+	return nil
+}
+
+func (m *MemoryStore) ListUsers() ([]UserAccount, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	userList := make([]UserAccount, 0, len(m.users))
+	for _, u := range m.users {
+		userList = append(userList, u)
+	}
+	sort.Slice(userList, func(i, j int) bool {
+		return userList[i].Username < userList[j].Username
+	})
+	return userList, nil
+}
+
+func (m *MemoryStore) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, found := m.users[username]
+	if !found {
+		return ErrNotFound
+	}
+	delete(m.users, username)
+	delete(m.usersUserUUID, u.UserUUID)
+	return nil
+}
+
+func (m *MemoryStore) CreatePrescription(p Prescription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the primary key is (patientUUID, endDate, prescriptionUUID)
+	prescriptionList := m.prescriptions[p.PatientUUID]
+	for i, existing := range prescriptionList {
+		if existing.EndDate == p.EndDate && existing.PrescriptionUUID == p.PrescriptionUUID {
+			prescriptionList[i] = p
+			return nil
+		}
+	}
+	m.prescriptions[p.PatientUUID] = append(prescriptionList, p)
+	return nil
+}
+
+func (m *MemoryStore) PrescriptionsByPatient(patientUUID gocql.UUID) (Prescriptions, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	prescriptionList := append(Prescriptions{}, m.prescriptions[patientUUID]...)
+	sort.SliceStable(prescriptionList, func(i, j int) bool {
+		return prescriptionList[i].EndDate > prescriptionList[j].EndDate
+	})
+	return prescriptionList, nil
+}
+
+func (m *MemoryStore) CreateNotification(n Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.notifications[n.ReceiverUUID] = append(m.notifications[n.ReceiverUUID], n)
+	return nil
+}
+
+func (m *MemoryStore) NotificationsByReceiver(receiverUUID gocql.UUID, limit int) (Notifications, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// clustering order is dateCreated DESC
+	notiList := append(Notifications{}, m.notifications[receiverUUID]...)
+	sort.SliceStable(notiList, func(i, j int) bool {
+		return notiList[i].DateCreated > notiList[j].DateCreated
+	})
+	if len(notiList) > limit {
+		notiList = notiList[:limit]
+	}
+	return notiList, nil
+}
+
+func (m *MemoryStore) CreateDocument(d Document) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if old, found := m.documents[d.DocumentUUID]; found {
+		m.documentsPatientUUID.remove(old.PatientUUID, old.DocumentUUID)
+	}
+	m.documents[d.DocumentUUID] = d
+	m.documentsPatientUUID.add(d.PatientUUID, d.DocumentUUID)
+	return nil
+}
+
+func (m *MemoryStore) GetDocument(documentUUID gocql.UUID) (Document, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	d, found := m.documents[documentUUID]
+	if !found {
+		return Document{}, ErrNotFound
+	}
+	return d, nil
+}
+
+func (m *MemoryStore) DocumentsByPatient(patientUUID gocql.UUID) ([]Document, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := m.documentsPatientUUID[patientUUID].sortedKeys()
+	docuList := make([]Document, 0, len(keys))
+	for _, k := range keys {
+		d := m.documents[k]
+		d.Content = ""
+		docuList = append(docuList, d)
+	}
+	return docuList, nil
+}
+
+func (m *MemoryStore) CreateSession(s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[s.TokenHash] = s
+	return nil
+}
+
+// getSession returns the unexpired entry of table for tokenHash
+func (m *MemoryStore) getSession(table map[string]Session, tokenHash string) (Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, found := table[tokenHash]
+	if !found || !time.Now().Before(s.ExpiresAt) {
+		return Session{}, ErrNotFound
+	}
+	return s, nil
+}
+
+func (m *MemoryStore) deleteUserSessions(table map[string]Session, userUUID gocql.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for tokenHash, s := range table {
+		if s.UserUUID == userUUID {
+			delete(table, tokenHash)
+		}
+	}
+}
+
+func (m *MemoryStore) GetSession(tokenHash string) (Session, error) {
+	return m.getSession(m.sessions, tokenHash)
+}
+
+func (m *MemoryStore) DeleteSession(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, tokenHash)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserSessions(userUUID gocql.UUID) error {
+	m.deleteUserSessions(m.sessions, userUUID)
+	return nil
+}
+
+func (m *MemoryStore) CreateRefreshToken(t Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.refreshTokens[t.TokenHash] = t
+	return nil
+}
+
+func (m *MemoryStore) GetRefreshToken(tokenHash string) (Session, error) {
+	return m.getSession(m.refreshTokens, tokenHash)
+}
+
+func (m *MemoryStore) DeleteRefreshToken(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.refreshTokens, tokenHash)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserRefreshTokens(userUUID gocql.UUID) error {
+	m.deleteUserSessions(m.refreshTokens, userUUID)
+	return nil
+}
+
+func (m *MemoryStore) GetLoginAttempts(key string) (LoginAttempts, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, found := m.loginAttempts[key]
+	if !found || !time.Now().Before(a.ExpiresAt) {
+		return LoginAttempts{}, ErrNotFound
+	}
+	return a, nil
+}
+
+func (m *MemoryStore) PutLoginAttempts(a LoginAttempts) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.loginAttempts[a.Key] = a
+	return nil
+}
+
+func (m *MemoryStore) DeleteLoginAttempts(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginAttempts, key)
+	return nil
+}
+
+func (m *MemoryStore) CreateLoginChallenge(c Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.loginChallenges[c.TokenHash] = c
+	return nil
+}
+
+func (m *MemoryStore) GetLoginChallenge(tokenHash string) (Session, error) {
+	return m.getSession(m.loginChallenges, tokenHash)
+}
+
+func (m *MemoryStore) DeleteLoginChallenge(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginChallenges, tokenHash)
+	return nil
+}
+
+func (m *MemoryStore) CreatePasswordReset(t Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.passwordResets[t.TokenHash] = t
+	return nil
+}
+
+func (m *MemoryStore) GetPasswordReset(tokenHash string) (Session, error) {
+	return m.getSession(m.passwordResets, tokenHash)
+}
+
+func (m *MemoryStore) DeletePasswordReset(tokenHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.passwordResets[tokenHash]; !found {
+		return ErrNotFound
+	}
+	delete(m.passwordResets, tokenHash)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUserPasswordResets(userUUID gocql.UUID) error {
+	m.deleteUserSessions(m.passwordResets, userUUID)
+	return nil
+}
+
+func (m *MemoryStore) CreateDoctorInvite(i Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.doctorInvites[i.TokenHash] = i
+	return nil
+}
+
+func (m *MemoryStore) GetDoctorInvite(codeHash string) (Session, error) {
+	return m.getSession(m.doctorInvites, codeHash)
+}
+
+func (m *MemoryStore) DeleteDoctorInvite(codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.doctorInvites[codeHash]; !found {
+		return ErrNotFound
+	}
+	delete(m.doctorInvites, codeHash)
+	return nil
+}
+
+func (m *MemoryStore) GetOIDCIdentity(issuer, subject string) (gocql.UUID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	userUUID, found := m.oidcIdentities[[2]string{issuer, subject}]
+	if !found {
+		return gocql.UUID{}, ErrNotFound
+	}
+	return userUUID, nil
+}
+
+func (m *MemoryStore) PutOIDCIdentity(issuer, subject string, userUUID gocql.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.oidcIdentities[[2]string{issuer, subject}] = userUUID
+	return nil
+}
+
+func (m *MemoryStore) CreateAPIKey(k APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.apiKeys[k.KeyUUID] = k
+	return nil
+}
+
+func (m *MemoryStore) GetAPIKey(keyUUID gocql.UUID) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, found := m.apiKeys[keyUUID]
+	if !found {
+		return APIKey{}, ErrNotFound
+	}
+	return k, nil
+}
+
+func (m *MemoryStore) ListAPIKeys() ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keyList := make([]APIKey, 0, len(m.apiKeys))
+	for _, k := range m.apiKeys {
+		keyList = append(keyList, k)
+	}
+	sort.Slice(keyList, func(i, j int) bool {
+		return keyList[i].CreatedAt.Before(keyList[j].CreatedAt)
+	})
+	return keyList, nil
+}
+
+func (m *MemoryStore) TouchAPIKey(keyUUID gocql.UUID, usedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if k, found := m.apiKeys[keyUUID]; found {
+		k.LastUsedAt = &usedAt
+		m.apiKeys[keyUUID] = k
+	}
+	return nil
+}
+
+func (m *MemoryStore) LastAuditEvent() (AuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.auditEvents) == 0 {
+		return AuditEvent{}, ErrNotFound
+	}
+	return m.auditEvents[len(m.auditEvents)-1], nil
+}
+
+func (m *MemoryStore) AppendAuditEvents(events []AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if events[0].Seq <= int64(len(m.auditEvents)) {
+		return ErrExists
+	}
+	m.auditEvents = append(m.auditEvents, events...)
+	return nil
+}
+
+func (m *MemoryStore) AuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := []AuditEvent{}
+	for i := len(m.auditEvents) - 1; i >= 0 && len(events) < q.Limit; i-- {
+		if q.matches(m.auditEvents[i]) {
+			events = append(events, m.auditEvents[i])
+		}
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) RevokeAPIKey(keyUUID gocql.UUID, revokedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, found := m.apiKeys[keyUUID]
+	if !found {
+		return ErrNotFound
+	}
+	k.RevokedAt = &revokedAt
+	m.apiKeys[keyUUID] = k
+	return nil
+}
+
+func (m *MemoryStore) GetTwoFactor(userUUID gocql.UUID) (TwoFactor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, found := m.twoFactor[userUUID]
+	if !found {
+		return TwoFactor{}, ErrNotFound
+	}
+	t.RecoveryCodes = append([]RecoveryCode(nil), t.RecoveryCodes...)
+	return t, nil
+}
+
+func (m *MemoryStore) PutTwoFactor(t TwoFactor) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t.RecoveryCodes = m.twoFactor[t.UserUUID].RecoveryCodes
+	m.twoFactor[t.UserUUID] = t
+	return nil
+}
+
+func (m *MemoryStore) UseTOTPCounter(userUUID gocql.UUID, counter int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, found := m.twoFactor[userUUID]
+	if !found || t.LastCounter >= counter {
+		return ErrExists
+	}
+	t.LastCounter = counter
+	m.twoFactor[userUUID] = t
+	return nil
+}
+
+func (m *MemoryStore) PutRecoveryCodes(userUUID gocql.UUID, codes []RecoveryCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, found := m.twoFactor[userUUID]
+	if !found {
+		return ErrNotFound
+	}
+	t.RecoveryCodes = append([]RecoveryCode(nil), codes...)
+	m.twoFactor[userUUID] = t
+	return nil
+}
+
+func (m *MemoryStore) DeleteRecoveryCode(userUUID gocql.UUID, codeID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.twoFactor[userUUID]
+	codes := []RecoveryCode{}
+	for _, code := range t.RecoveryCodes {
+		if code.ID != codeID {
+			codes = append(codes, code)
+		}
+	}
+	t.RecoveryCodes = codes
+	m.twoFactor[userUUID] = t
+	return nil
+}
+
+func (m *MemoryStore) DeleteTwoFactor(userUUID gocql.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.twoFactor, userUUID)
+	return nil
+}
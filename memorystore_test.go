@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestMemoryStorePatientLifecycle(t *testing.T) {
+	testStorePatientLifecycle(t, NewMemoryStore())
+}
+
+func TestMemoryStoreAppointmentsByDoctor(t *testing.T) {
+	testStoreAppointmentsByDoctor(t, NewMemoryStore())
+}
+
+func TestMemoryStoreUserCreateAndLogin(t *testing.T) {
+	testStoreUserCreateAndLogin(t, NewMemoryStore())
+}
+
+func TestMemoryStoreDocuments(t *testing.T) {
+	testStoreDocuments(t, NewMemoryStore())
+}
+
+func TestMemoryStoreLoginLockout(t *testing.T) {
+	testStoreLoginLockout(t, NewMemoryStore())
+}
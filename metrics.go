@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "emr_http_requests_total",
+		Help: "HTTP requests served, by route name and status code.",
+	}, []string{"route", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "emr_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	cassandraQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "emr_cassandra_query_duration_seconds",
+		Help:    "Latency of Cassandra query attempts, by operation and table.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "table"})
+
+	cassandraQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "emr_cassandra_query_errors_total",
+		Help: "Cassandra query attempts that failed, by operation and table.",
+	}, []string{"operation", "table"})
+
+	uploadsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "emr_document_uploads_in_flight",
+		Help: "Document uploads currently being received or stored.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration,
+		cassandraQueryDuration, cassandraQueryErrors, uploadsInFlight)
+}
+
+// MetricsHandler serves the registered metrics in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Metrics counts the requests served by inner and their latency under the
+// route name, so that paths holding identifiers do not multiply the series
+func Metrics(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+
+		// recorded on the way out even if the response is aborted by a panic
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			httpRequests.WithLabelValues(name, strconv.Itoa(rec.status)).Inc()
+			httpRequestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		}()
+
+		inner.ServeHTTP(rec, r)
+	})
+}
+
+// queryObserver records the latency and errors of every Cassandra query
+// attempt made by a session
+type queryObserver struct{}
+
+func (queryObserver) ObserveQuery(ctx context.Context, q gocql.ObservedQuery) {
+	operation, table := cqlOperation(q.Statement)
+	cassandraQueryDuration.WithLabelValues(operation, table).Observe(q.End.Sub(q.Start).Seconds())
+	if q.Err != nil {
+		cassandraQueryErrors.WithLabelValues(operation, table).Inc()
+	}
+}
+
+// cqlOperation returns the lower cased verb of a CQL statement and the table
+// it reads or writes, if any
+func cqlOperation(stmt string) (operation, table string) {
+	fields := strings.Fields(strings.ToLower(stmt))
+	if len(fields) == 0 {
+		return "", ""
+	}
+	operation = fields[0]
+	for i, field := range fields[:len(fields)-1] {
+		if (operation == "update" && i == 0) || field == "from" || field == "into" {
+			table = fields[i+1]
+			break
+		}
+	}
+	// drop a keyspace qualifier and a column list
+	if i := strings.IndexAny(table, "(;"); i >= 0 {
+		table = table[:i]
+	}
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		table = table[i+1:]
+	}
+	return operation, table
+}
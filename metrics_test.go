@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsByRouteName(t *testing.T) {
+	store := NewMemoryStore()
+	serveStore(store, httptest.NewRequest("GET", "/patients/patientuuid/not-a-uuid", nil))
+	serveStore(store, httptest.NewRequest("GET", "/doctors", nil))
+
+	if rec := serveAs(NewServer(store), nil, httptest.NewRequest("GET", "/metrics", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous metrics: got %d, want 401", rec.Code)
+	}
+	if rec := serveStore(store, httptest.NewRequest("GET", "/metrics", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("metrics read by a doctor: got %d, want 403", rec.Code)
+	}
+	rec := serveServer(NewServer(store), testAdmin, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, series := range []string{
+		`emr_http_requests_total{code="400",route="PatientGet"}`,
+		`emr_http_requests_total{code="200",route="DoctorListGet"}`,
+		`emr_http_request_duration_seconds_count{route="PatientGet"}`,
+		`emr_document_uploads_in_flight 0`,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("metrics do not contain %s", series)
+		}
+	}
+	if strings.Contains(body, "not-a-uuid") {
+		t.Error("request path leaked into metric labels")
+	}
+
+	s := NewServer(store)
+	key := createAPIKey(t, s, `{"name": "Prometheus", "scopes": ["metrics:read"]}`)
+	if rec := serveAPIKey(s, key.Key, httptest.NewRequest("GET", "/metrics", nil)); rec.Code != http.StatusOK {
+		t.Errorf("scrape with an API key: got %d, want 200", rec.Code)
+	}
+}
+
+func TestCQLOperation(t *testing.T) {
+	tests := []struct {
+		stmt, operation, table string
+	}{
+		{"SELECT * FROM patients WHERE patientUUID = ?", "select", "patients"},
+		{"INSERT INTO futureAppointments (appointmentUuid,\n\tpatientUuid) VALUES (?, ?)", "insert", "futureappointments"},
+		{"UPDATE completedappointments SET notes = ? WHERE appointmentUUID = ?", "update", "completedappointments"},
+		{"DELETE FROM emr.futureAppointments WHERE appointmentuuid=? IF EXISTS", "delete", "futureappointments"},
+		{"INSERT INTO schema_migrations(version, appliedAt) VALUES (?, ?)", "insert", "schema_migrations"},
+		{"CREATE INDEX IF NOT EXISTS ON users (userUUID)", "create", ""},
+	}
+	for _, test := range tests {
+		operation, table := cqlOperation(test.stmt)
+		if operation != test.operation || table != test.table {
+			t.Errorf("%q: got %s %s, want %s %s", test.stmt, operation, table, test.operation, test.table)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Migrator is a storage backend whose schema is evolved by numbered up
+// migrations recorded in a schema_migrations table. Version n is
+// Migrations()[n-1]; released migrations are never edited, only appended.
+type Migrator interface {
+	Migrations() []string
+	// AppliedMigrations returns when each applied version was applied, it
+	// does not create anything when the schema does not exist yet
+	AppliedMigrations() (map[int]time.Time, error)
+	// ApplyMigration runs migration version and records it as applied
+	ApplyMigration(version int) error
+	Close()
+}
+
+// PendingMigrations returns the versions of m not applied yet, oldest first
+func PendingMigrations(m Migrator) ([]int, error) {
+	applied, err := m.AppliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var pending []int
+	for version := 1; version <= len(m.Migrations()); version++ {
+		if _, ok := applied[version]; !ok {
+			pending = append(pending, version)
+		}
+	}
+	return pending, nil
+}
+
+// MigrateUp applies every pending migration of m in order, reporting each
+// through logf. With dryRun the migrations are only reported.
+func MigrateUp(m Migrator, dryRun bool, logf func(format string, v ...interface{})) error {
+	pending, err := PendingMigrations(m)
+	if err != nil {
+		return err
+	}
+	for _, version := range pending {
+		if dryRun {
+			logf("Would apply migration %04d:\n%s", version, m.Migrations()[version-1])
+			continue
+		}
+		if err := m.ApplyMigration(version); err != nil {
+			return fmt.Errorf("migration %04d: %v", version, err)
+		}
+		logf("Applied migration %04d", version)
+	}
+	if len(pending) == 0 {
+		logf("Schema is up to date at version %04d", len(m.Migrations()))
+	}
+	return nil
+}
+
+// PrintMigrationStatus writes one line per known migration of m to out
+func PrintMigrationStatus(m Migrator, out io.Writer) error {
+	applied, err := m.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	for version := 1; version <= len(m.Migrations()); version++ {
+		if appliedAt, ok := applied[version]; ok {
+			fmt.Fprintf(out, "%04d\tapplied\t%s\n", version, appliedAt.UTC().Format(time.RFC3339))
+		} else {
+			fmt.Fprintf(out, "%04d\tpending\n", version)
+		}
+	}
+	return nil
+}
+
+// runMigrate implements the migrate subcommand:
+//
+//	go-rest migrate [up|status] [-dry-run] [configuration flags]
+func runMigrate(args []string, lookupEnv func(string) (string, bool), out io.Writer) error {
+	action := "up"
+	if len(args) > 0 && (args[0] == "up" || args[0] == "status") {
+		action, args = args[0], args[1:]
+	}
+
+	c := DefaultConfig()
+	fs := c.flagSet("go-rest migrate")
+	dryRun := fs.Bool("dry-run", false, "print the pending migrations without applying them")
+	if err := c.load(fs, args, lookupEnv); err != nil {
+		return err
+	}
+
+	var m Migrator
+	switch c.Storage {
+	case "cassandra":
+		cassandraMigrator, err := NewCassandraMigrator(c.Cassandra)
+		if err != nil {
+			return err
+		}
+		m = cassandraMigrator
+	case "sqlite":
+		sqlStore, err := openSQLite(c.SQLitePath)
+		if err != nil {
+			return err
+		}
+		m = sqlStore
+	default:
+		return fmt.Errorf("%s storage has no schema to migrate", c.Storage)
+	}
+	defer m.Close()
+
+	if action == "status" {
+		return PrintMigrationStatus(m, out)
+	}
+	return MigrateUp(m, *dryRun, func(format string, v ...interface{}) {
+		fmt.Fprintf(out, format+"\n", v...)
+	})
+}
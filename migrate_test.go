@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emr.db")
+	env := testEnv(map[string]string{"EMR_STORAGE": "sqlite", "EMR_SQLITE_PATH": path})
+	migrate := func(args ...string) string {
+		var out bytes.Buffer
+		if err := runMigrate(args, env, &out); err != nil {
+			t.Fatalf("migrate %v: %v", args, err)
+		}
+		return out.String()
+	}
+
+	if out := migrate("status"); !strings.Contains(out, "0001\tpending") {
+		t.Errorf("expected 0001 pending on a new database, got:\n%s", out)
+	}
+	if out := migrate("-dry-run"); !strings.Contains(out, "Would apply migration 0001") ||
+		!strings.Contains(out, "CREATE TABLE patients") {
+		t.Errorf("expected the dry run to print migration 0001, got:\n%s", out)
+	}
+	if out := migrate("status"); !strings.Contains(out, "0001\tpending") {
+		t.Errorf("dry run must not apply migrations, got:\n%s", out)
+	}
+
+	if out := migrate("up"); !strings.Contains(out, "Applied migration 0001") {
+		t.Errorf("expected migration 0001 to be applied, got:\n%s", out)
+	}
+	if out := migrate("status"); !strings.Contains(out, "0001\tapplied") {
+		t.Errorf("expected 0001 applied, got:\n%s", out)
+	}
+	if out := migrate(); !strings.Contains(out, "up to date") {
+		t.Errorf("expected nothing left to apply, got:\n%s", out)
+	}
+
+	// the store opens the migrated database without reapplying anything
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+}
+
+func TestMigrateMemory(t *testing.T) {
+	err := runMigrate([]string{"-storage", "memory"}, testEnv(nil), &bytes.Buffer{})
+	if err == nil {
+		t.Error("expected an error migrating the memory backend")
+	}
+}
+
+func TestSplitCQL(t *testing.T) {
+	statements := splitCQL(cassandraMigrations[0])
+	if len(statements) != 17 {
+		t.Fatalf("expected 17 statements in migration 0001, got %d", len(statements))
+	}
+	for _, statement := range statements {
+		if !strings.HasPrefix(statement, "CREATE TABLE IF NOT EXISTS ") &&
+			!strings.HasPrefix(statement, "CREATE INDEX IF NOT EXISTS ") {
+			t.Errorf("statement is not idempotent: %s", statement)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// oidcFlowCookie carries the state, nonce and PKCE verifier of a single
+// sign-on login from the redirect to the provider to the callback
+const oidcFlowCookie = "oidc"
+
+// oidcFlowTTL is how long a user may take to log in at the provider
+const oidcFlowTTL = 10 * time.Minute
+
+// oidcKeyRefresh is the least time between two downloads of the provider
+// keys, which are downloaded again when a token names an unknown key
+const oidcKeyRefresh = time.Minute
+
+// errOIDCRole is returned for ID tokens whose claims map to no role, or to
+// more than one
+var errOIDCRole = errors.New("no single role mapped")
+
+// OIDCProvider signs users in through an OpenID Connect provider with the
+// authorization code flow and PKCE. The provider endpoints and keys are
+// fetched on first use, so that the service starts while it is down.
+type OIDCProvider struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *oidcMetadata
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// oidcMetadata is the part of the provider configuration document used
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// jsonWebKey is a key of the provider key set; only RSA keys are used, ID
+// tokens must be signed with RS256
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// OIDCIdentity is the user described by a verified ID token
+type OIDCIdentity struct {
+	Subject  string
+	Username string
+	Name     string
+	// Email is only set when the provider verified it
+	Email string
+	Role  string
+	// TwoFactor is set when the amr claim reports a second factor
+	TwoFactor bool
+}
+
+// NewOIDCProvider returns a client of the provider described by cfg
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// getJSON decodes the JSON document at url into v
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the provider metadata, fetching it on first use
+func (p *OIDCProvider) discover() (oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+	var m oidcMetadata
+	err := p.getJSON(strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &m)
+	if err != nil {
+		return oidcMetadata{}, err
+	}
+	if m.Issuer != p.cfg.Issuer {
+		return oidcMetadata{}, fmt.Errorf("provider issuer %q does not match %q", m.Issuer, p.cfg.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return oidcMetadata{}, errors.New("provider configuration lacks an endpoint")
+	}
+	p.metadata = &m
+	return m, nil
+}
+
+// key returns the provider key kid, downloading the key set again when it
+// is unknown
+func (p *OIDCProvider) key(kid string) (*rsa.PublicKey, error) {
+	m, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeyRefresh {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(m.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = map[string]*rsa.PublicKey{}
+	p.keysFetched = time.Now()
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.rsaKey()
+		if err != nil {
+			return nil, fmt.Errorf("provider key %q: %v", k.Kid, err)
+		}
+		p.keys[k.Kid] = key
+	}
+	if key, found := p.keys[kid]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// rsaKey decodes the modulus and exponent of k
+func (k jsonWebKey) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent")
+	}
+	exponent := 0
+	for _, b := range e {
+		exponent = exponent<<8 | int(b)
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+	if key.N.BitLen() < 2048 || exponent < 3 {
+		return nil, errors.New("RSA keys must be of at least 2048 bits")
+	}
+	return key, nil
+}
+
+// pkceChallenge is the S256 code challenge of verifier, as in RFC 7636
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the provider page the browser is sent to for login
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	m, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(m.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code for the ID token of the user and
+// returns the identity it describes once verified against nonce
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (OIDCIdentity, error) {
+	m, err := p.discover()
+	if err != nil {
+		return OIDCIdentity{}, err
+	}
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code},
+		"redirect_uri": {p.cfg.RedirectURL}, "code_verifier": {verifier}}
+	if p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OIDCIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		// client_secret_basic, form encoded as in RFC 6749 section 2.3.1
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return OIDCIdentity{}, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return OIDCIdentity{}, fmt.Errorf("token endpoint: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return OIDCIdentity{}, fmt.Errorf("token endpoint: %s: %s %s", resp.Status, body.Error,
+			body.ErrorDescription)
+	}
+	return p.verify(body.IDToken, nonce)
+}
+
+// verify checks the signature, issuer, audience, expiry and nonce of an ID
+// token and maps its claims to a user
+func (p *OIDCProvider) verify(idToken, nonce string) (OIDCIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(kid)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}), jwt.WithIssuer(p.cfg.Issuer),
+		jwt.WithAudience(p.cfg.ClientID), jwt.WithExpirationRequired(), jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute))
+	if err != nil {
+		return OIDCIdentity{}, err
+	}
+	if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return OIDCIdentity{}, errors.New("ID token nonce does not match")
+	}
+	// a token for several audiences must have been issued to this client
+	if azp, found := claims["azp"]; found && azp != p.cfg.ClientID {
+		return OIDCIdentity{}, fmt.Errorf("ID token issued to %v", azp)
+	}
+	return p.identity(claims)
+}
+
+// identity maps the claims of a verified ID token to a user, whose role is
+// the one the role claim values map to
+func (p *OIDCProvider) identity(claims jwt.MapClaims) (OIDCIdentity, error) {
+	var id OIDCIdentity
+	id.Subject, _ = claims["sub"].(string)
+	id.Username, _ = claims[p.cfg.UsernameClaim].(string)
+	if id.Subject == "" || id.Username == "" {
+		return OIDCIdentity{}, fmt.Errorf("ID token lacks the sub or %s claim", p.cfg.UsernameClaim)
+	}
+	if id.Name, _ = claims["name"].(string); id.Name == "" {
+		id.Name = id.Username
+	}
+	if verified, _ := claims["email_verified"].(bool); verified {
+		id.Email, _ = claims["email"].(string)
+	}
+
+	var values []interface{}
+	switch v := claims[p.cfg.RoleClaim].(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	for _, v := range values {
+		value, _ := v.(string)
+		role, found := p.cfg.Roles[value]
+		if !found {
+			continue
+		}
+		if id.Role != "" && id.Role != role {
+			return OIDCIdentity{}, fmt.Errorf("%w: %s maps to %s and %s", errOIDCRole,
+				p.cfg.RoleClaim, id.Role, role)
+		}
+		id.Role = role
+	}
+	if id.Role == "" {
+		return OIDCIdentity{}, fmt.Errorf("%w: %s holds %v", errOIDCRole, p.cfg.RoleClaim, values)
+	}
+
+	// authentication method references of RFC 8176 implying a second factor
+	amr, _ := claims["amr"].([]interface{})
+	for _, method := range amr {
+		switch method {
+		case "mfa", "otp", "hwk", "sc":
+			id.TwoFactor = true
+		}
+	}
+	return id, nil
+}
+
+// setFlowCookie sends the state, nonce and verifier of a login in progress,
+// or deletes the cookie when value is empty
+func (s *Server) setFlowCookie(w http.ResponseWriter, value string) {
+	maxAge := int(oidcFlowTTL.Seconds())
+	if value == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcFlowCookie,
+		Value:    value,
+		Path:     "/login/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.Session.CookieSecure,
+		// sent along the redirect back from the provider, a cross-site
+		// navigation
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+/*
+Starts a single sign-on login, redirecting the browser to the OpenID Connect
+provider
+Method: GET
+Endpoint: /login/oidc
+*/
+func (s *Server) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		s.writeStatus(w, r, http.StatusNotFound, "Single sign-on is not enabled")
+		return
+	}
+	var flow [3]string
+	for i := range flow {
+		token, err := randomToken()
+		if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		flow[i] = token
+	}
+	state, nonce, verifier := flow[0], flow[1], flow[2]
+
+	authURL, err := s.OIDC.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		requestLogger(r).Error("Cannot reach the OpenID Connect provider", "error", err)
+		s.writeStatus(w, r, http.StatusBadGateway, "Identity provider unavailable")
+		return
+	}
+	s.setFlowCookie(w, strings.Join(flow[:], "."))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+/*
+Completes a single sign-on login when the OpenID Connect provider sends the
+browser back, provisioning the user at their first login, and redirects to
+the configured page with the session cookie. Users who enabled TOTP get the
+challenge of /login instead.
+Method: GET
+Endpoint: /login/oidc/callback
+*/
+func (s *Server) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		s.writeStatus(w, r, http.StatusNotFound, "Single sign-on is not enabled")
+		return
+	}
+	var flow []string
+	if cookie, err := r.Cookie(oidcFlowCookie); err == nil {
+		flow = strings.Split(cookie.Value, ".")
+	}
+	// the state, nonce and verifier are used once
+	s.setFlowCookie(w, "")
+	query := r.URL.Query()
+	if len(flow) != 3 || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow[0])) != 1 {
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid or expired single sign-on state")
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		requestLogger(r).Warn("Single sign-on refused by the provider", "error", e,
+			"description", query.Get("error_description"))
+		s.writeStatus(w, r, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		s.badRequest(w, r, "Missing code")
+		return
+	}
+
+	identity, err := s.OIDC.Exchange(r.Context(), code, flow[2], flow[1])
+	if errors.Is(err, errOIDCRole) {
+		requestLogger(r).Warn("Single sign-on without a role", "error", err)
+		s.writeStatus(w, r, http.StatusForbidden, "No role is mapped to this account")
+		return
+	}
+	if err != nil {
+		requestLogger(r).Warn("Single sign-on failed", "error", err)
+		s.writeStatus(w, r, http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+	user, ok := s.oidcUser(w, r, identity)
+	if !ok {
+		return
+	}
+	setRequestUser(r, user.UserUUID.String())
+	if user.Disabled {
+		s.accountDisabled(w, r, user)
+		return
+	}
+	// users who enabled TOTP here are asked for it as at a password login
+	tf, err := s.TwoFactor.GetTwoFactor(user.UserUUID)
+	if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
+	if err == nil && tf.Enabled {
+		s.startChallenge(w, r, user)
+		return
+	}
+	if err := s.startSession(w, user, identity.TwoFactor); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, s.OIDC.cfg.PostLoginURL, http.StatusSeeOther)
+}
+
+// oidcUser returns the local user of identity, provisioning it at the first
+// login and updating its role, name and email at later ones. It answers the
+// request itself and returns false on failure.
+func (s *Server) oidcUser(w http.ResponseWriter, r *http.Request, id OIDCIdentity) (UserAccount, bool) {
+	issuer := s.OIDC.cfg.Issuer
+	var user UserAccount
+	userUUID, err := s.OIDCIdentities.GetOIDCIdentity(issuer, id.Subject)
+	if err == nil {
+		user, err = s.Users.GetUserByUUID(userUUID)
+	}
+	switch {
+	case err == ErrNotFound:
+		// provisioned users have no password, they only log in through the
+		// provider
+		user = UserAccount{Username: id.Username, UserUUID: gocql.TimeUUID(), Role: id.Role,
+			Name: id.Name, Email: id.Email}
+		if err := s.Users.CreateUser(user); err == ErrExists {
+			requestLogger(r).Warn("Single sign-on username taken by another user",
+				"username", id.Username)
+			s.writeStatus(w, r, http.StatusConflict, "The username of this account is taken by another user")
+			return UserAccount{}, false
+		} else if err != nil {
+			s.internalError(w, r, err)
+			return UserAccount{}, false
+		}
+		if err := s.OIDCIdentities.PutOIDCIdentity(issuer, id.Subject, user.UserUUID); err != nil {
+			s.internalError(w, r, err)
+			return UserAccount{}, false
+		}
+		auditLog(r, "user.provisioned", "User provisioned from single sign-on",
+			"userID", user.UserUUID, "username", user.Username, "role", user.Role)
+	case err != nil:
+		s.internalError(w, r, err)
+		return UserAccount{}, false
+	case user.Role != id.Role || user.Name != id.Name || user.Email != id.Email:
+		previous := user.Role
+		user.Role, user.Name, user.Email = id.Role, id.Name, id.Email
+		if err := s.Users.UpdateUser(user); err != nil {
+			s.internalError(w, r, err)
+			return UserAccount{}, false
+		}
+		// sessions and refresh tokens of the previous role are revoked
+		if previous != id.Role {
+			if err := s.signOutUser(user.UserUUID); err != nil {
+				s.internalError(w, r, err)
+				return UserAccount{}, false
+			}
+			auditLog(r, "user.role_changed", "Role of a single sign-on user changed by the provider",
+				"userID", user.UserUUID, "from", previous, "to", id.Role)
+		}
+	}
+
+	// doctors have a doctor entry of their user UUID, as when invited
+	if user.Role == RoleDoctor {
+		_, err := s.Doctors.GetDoctor(user.UserUUID)
+		if err == ErrNotFound {
+			err = s.Doctors.CreateDoctor(Doctor{DoctorUUID: user.UserUUID, Name: user.Name})
+		}
+		if err != nil {
+			s.internalError(w, r, err)
+			return UserAccount{}, false
+		}
+	}
+	return user, true
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636 appendix B
+	if got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("got code challenge %s", got)
+	}
+}
+
+// mockIdP is an OpenID Connect provider for the client "emr", issuing ID
+// tokens with the claims passed to authorize
+type mockIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]mockGrant
+}
+
+// mockGrant is an authorization code waiting to be redeemed
+type mockGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcMetadata{Issuer: idp.URL, AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint: idp.URL + "/token", JWKSURI: idp.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{Kty: "RSA", Use: "sig", Kid: "idp-1",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()), E: base64.RawURLEncoding.EncodeToString(e)}}})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// config returns the settings of a client of idp
+func (idp *mockIdP) config() OIDCConfig {
+	cfg := DefaultConfig().OIDC
+	cfg.Issuer = idp.URL
+	cfg.ClientID = "emr"
+	cfg.ClientSecret = "idp secret"
+	cfg.RedirectURL = "https://emr.example.com/login/oidc/callback"
+	cfg.Roles = map[string]string{"clinicians": RoleDoctor, "it": RoleAdmin}
+	cfg.PostLoginURL = "/app"
+	return cfg
+}
+
+// authorize stands for the user logging in at the provider page authURL,
+// returning the code and state the browser is sent back with. The ID token
+// gets the standard claims unless claims sets them.
+func (idp *mockIdP) authorize(authURL string, claims jwt.MapClaims) (string, string) {
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("response_type") != "code" || q.Get("client_id") != "emr" ||
+		q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+		idp.t.Errorf("unexpected authorization request %s", authURL)
+	}
+	now := time.Now()
+	standard := jwt.MapClaims{"iss": idp.URL, "aud": "emr", "iat": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(), "nonce": q.Get("nonce")}
+	for name, value := range standard {
+		if _, found := claims[name]; !found {
+			claims[name] = value
+		}
+	}
+	code, _ := randomToken()
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.grants[code] = mockGrant{challenge: q.Get("code_challenge"), claims: claims}
+	return code, q.Get("state")
+}
+
+// token redeems authorization codes once, for the client that presents the
+// PKCE verifier
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	idp.mu.Lock()
+	grant, found := idp.grants[r.Form.Get("code")]
+	delete(idp.grants, r.Form.Get("code"))
+	idp.mu.Unlock()
+
+	clientID, secret, _ := r.BasicAuth()
+	if !found || clientID != "emr" || secret != url.QueryEscape("idp secret") ||
+		r.Form.Get("grant_type") != "authorization_code" ||
+		r.Form.Get("redirect_uri") != "https://emr.example.com/login/oidc/callback" ||
+		pkceChallenge(r.Form.Get("code_verifier")) != grant.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+	token.Header["kid"] = "idp-1"
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		idp.t.Error(err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "token_type": "Bearer",
+		"id_token": idToken})
+}
+
+// ssoLogin runs a single sign-on login of s at idp as the user of claims,
+// returning the callback response
+func ssoLogin(t *testing.T, s *Server, idp *mockIdP, claims jwt.MapClaims) *httptest.ResponseRecorder {
+	rec := serveAs(s, nil, httptest.NewRequest("GET", "/login/oidc", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: got %d, want 302: %s", rec.Code, rec.Body)
+	}
+	flow := rec.Result().Cookies()[0]
+	code, state := idp.authorize(rec.Header().Get("Location"), claims)
+	callback := "/login/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode()
+	return serveAs(s, flow, httptest.NewRequest("GET", callback, nil))
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	s := NewServer(newTestSQLiteStore(t))
+	s.OIDC = NewOIDCProvider(idp.config())
+	claims := func(groups ...string) jwt.MapClaims {
+		return jwt.MapClaims{"sub": "248289761001", "preferred_username": "jane.doe", "name": "Jane Doe",
+			"email": "jane@example.com", "email_verified": true, "groups": groups}
+	}
+
+	// the first login provisions a doctor with a doctor entry
+	rec := ssoLogin(t, s, idp, claims("staff", "clinicians"))
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/app" {
+		t.Fatalf("callback: got %d to %q, want 303 to /app: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			session = c
+		}
+	}
+	if session == nil {
+		t.Fatal("callback returned no session cookie")
+	}
+	if rec := serveAs(s, session, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusOK {
+		t.Errorf("request in the session: got %d, want 200", rec.Code)
+	}
+	user, err := s.Users.GetUserByUsername("jane.doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != RoleDoctor || user.Name != "Jane Doe" || user.Email != "jane@example.com" ||
+		len(user.SaltedHash) != 0 {
+		t.Errorf("unexpected provisioned user %+v", user)
+	}
+	if doctor, err := s.Doctors.GetDoctor(user.UserUUID); err != nil || doctor.Name != "Jane Doe" {
+		t.Errorf("got doctor entry %+v, %v", doctor, err)
+	}
+	if rec := postLogin(s, "jane.doe", "correct horse"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("password login of a provisioned user: got %d, want 401", rec.Code)
+	}
+
+	// later logins follow the role given by the provider
+	if rec := ssoLogin(t, s, idp, claims("it")); rec.Code != http.StatusSeeOther {
+		t.Fatalf("second login: got %d, want 303: %s", rec.Code, rec.Body)
+	}
+	again, err := s.Users.GetUserByUsername("jane.doe")
+	if err != nil || again.UserUUID != user.UserUUID || again.Role != RoleAdmin {
+		t.Errorf("got user %+v after the role change, %v", again, err)
+	}
+	if rec := serveAs(s, session, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session of the previous role: got %d, want 401", rec.Code)
+	}
+	if rec := ssoLogin(t, s, idp, claims("staff")); rec.Code != http.StatusForbidden {
+		t.Errorf("login without a mapped group: got %d, want 403", rec.Code)
+	}
+	if rec := ssoLogin(t, s, idp, claims("it", "clinicians")); rec.Code != http.StatusForbidden {
+		t.Errorf("login with groups of two roles: got %d, want 403", rec.Code)
+	}
+
+	// another subject cannot take over an existing username
+	other := claims("it")
+	other["sub"] = "7"
+	if rec := ssoLogin(t, s, idp, other); rec.Code != http.StatusConflict {
+		t.Errorf("login of another subject with the same username: got %d, want 409", rec.Code)
+	}
+}
+
+func TestOIDCLoginTwoFactor(t *testing.T) {
+	idp := newMockIdP(t)
+	s := NewServer(NewMemoryStore())
+	s.OIDC = NewOIDCProvider(idp.config())
+	s.TOTP.RequiredRoles = []string{RoleDoctor}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "248289761001", "preferred_username": "jane.doe", "name": "Jane Doe",
+			"groups": []string{"clinicians"}}
+	}
+	sessionOf := func(rec *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == sessionCookie {
+				return c
+			}
+		}
+		return nil
+	}
+
+	// without a second factor from the provider nor TOTP, a required role
+	// only reaches the enroll routes
+	rec := ssoLogin(t, s, idp, claims())
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("callback: got %d, want 303: %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(s, sessionOf(rec), httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("request before enrolling: got %d, want 403", rec.Code)
+	}
+
+	// users who enabled TOTP are asked for it rather than given a session
+	user, err := s.Users.GetUserByUsername("jane.doe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := "JBSWY3DPEHPK3PXP"
+	if err := s.TwoFactor.PutTwoFactor(TwoFactor{UserUUID: user.UserUUID, Secret: secret, Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	rec = ssoLogin(t, s, idp, claims())
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("callback of an enrolled user: got %d, want 202: %s", rec.Code, rec.Body)
+	}
+	if session := sessionOf(rec); session != nil {
+		t.Errorf("callback of an enrolled user returned a session cookie")
+	}
+	var challenge TwoFactorChallenge
+	if err := json.NewDecoder(rec.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	// the code gives a session counting as two-factor
+	code, _ := totp.GenerateCode(secret, time.Now())
+	rec = postForm(s, nil, "/login/totp", url.Values{"twoFactorToken": {challenge.TwoFactorToken}, "code": {code}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second login step: got %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if rec := serveAs(s, sessionOf(rec), httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusOK {
+		t.Errorf("request after the second login step: got %d, want 200", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejects(t *testing.T) {
+	idp := newMockIdP(t)
+	s := NewServer(NewMemoryStore())
+	s.OIDC = NewOIDCProvider(idp.config())
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "248289761001", "preferred_username": "jane.doe", "groups": "it"}
+	}
+	if rec := ssoLogin(t, s, idp, claims()); rec.Code != http.StatusSeeOther {
+		t.Fatalf("login: got %d, want 303: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"nonce", jwt.MapClaims{"nonce": "replayed"}},
+		{"audience", jwt.MapClaims{"aud": "other-client"}},
+		{"issuer", jwt.MapClaims{"iss": "https://idp.example.com"}},
+		{"expiry", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}},
+		{"authorized party", jwt.MapClaims{"aud": []string{"emr", "other-client"}, "azp": "other-client"}},
+	}
+	for _, test := range tests {
+		c := claims()
+		for name, value := range test.claims {
+			c[name] = value
+		}
+		if rec := ssoLogin(t, s, idp, c); rec.Code != http.StatusUnauthorized {
+			t.Errorf("wrong %s: got %d, want 401", test.name, rec.Code)
+		}
+	}
+
+	// the state, verifier and code come from the same login
+	start := serveAs(s, nil, httptest.NewRequest("GET", "/login/oidc", nil))
+	flow := start.Result().Cookies()[0]
+	code, state := idp.authorize(start.Header().Get("Location"), claims())
+	callback := func(cookie *http.Cookie, code, state string) int {
+		path := "/login/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode()
+		return serveAs(s, cookie, httptest.NewRequest("GET", path, nil)).Code
+	}
+	if got := callback(nil, code, state); got != http.StatusUnauthorized {
+		t.Errorf("callback without the flow cookie: got %d, want 401", got)
+	}
+	if got := callback(flow, code, "forged"); got != http.StatusUnauthorized {
+		t.Errorf("callback with another state: got %d, want 401", got)
+	}
+	if got := callback(flow, code, state); got != http.StatusSeeOther {
+		t.Fatalf("callback: got %d, want 303", got)
+	}
+	if got := callback(flow, code, state); got != http.StatusUnauthorized {
+		t.Errorf("reused code: got %d, want 401", got)
+	}
+	code, state = idp.authorize(start.Header().Get("Location"), claims())
+	parts := strings.Split(flow.Value, ".")
+	tampered := &http.Cookie{Name: flow.Name, Value: parts[0] + "." + parts[1] + ".forged"}
+	if got := callback(tampered, code, state); got != http.StatusUnauthorized {
+		t.Errorf("callback with another PKCE verifier: got %d, want 401", got)
+	}
+
+	if rec := serveAs(NewServer(NewMemoryStore()), nil, httptest.NewRequest("GET", "/login/oidc", nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("login without single sign-on: got %d, want 404", rec.Code)
+	}
+}
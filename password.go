@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordSaltSize is the length of the random salt of each password hash
+const passwordSaltSize = 16
+
+// bcryptMaxPassword is the longest password in bytes bcrypt can hash after
+// the salt, it ignores anything past 72 bytes
+const bcryptMaxPassword = 72 - passwordSaltSize
+
+// argon2idFormat is the PHC string of an argon2id hash: version, memory in
+// KiB, iterations, threads, salt and key
+const argon2idFormat = "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s"
+
+// argon2idKeySize is the length of argon2id keys
+const argon2idKeySize = 32
+
+var errPasswordMismatch = errors.New("password does not match")
+
+// hashPassword returns a random salt and the hash of password with the
+// algorithm and cost of cfg, as stored in the users table. bcrypt hashes
+// salt+password; argon2id hashes are PHC strings holding the salt and their
+// parameters.
+func hashPassword(cfg PasswordConfig, password string) (salt, saltedHash []byte, err error) {
+	salt = make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Hash == "argon2id" {
+		key := argon2.IDKey([]byte(password), salt, uint32(cfg.Argon2Time),
+			uint32(cfg.Argon2Memory), uint8(cfg.Argon2Threads), argon2idKeySize)
+		return salt, []byte(fmt.Sprintf(argon2idFormat, argon2.Version, cfg.Argon2Memory,
+			cfg.Argon2Time, cfg.Argon2Threads, base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key))), nil
+	}
+	saltedHash, err = bcrypt.GenerateFromPassword(append(salt, password...), cfg.BcryptCost)
+	return salt, saltedHash, err
+}
+
+// argon2idHash is a parsed argon2id PHC string
+type argon2idHash struct {
+	version, memory, time, threads uint
+	salt, key                      []byte
+}
+
+func parseArgon2id(saltedHash []byte) (argon2idHash, error) {
+	var h argon2idHash
+	var salt, key string
+	// the base64 fields end at the next $, which Sscanf does not stop at
+	_, err := fmt.Sscanf(strings.Replace(string(saltedHash), "$", " ", -1),
+		strings.Replace(argon2idFormat, "$", " ", -1), &h.version, &h.memory, &h.time,
+		&h.threads, &salt, &key)
+	if err != nil {
+		return h, fmt.Errorf("malformed argon2id hash: %v", err)
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(salt); err != nil {
+		return h, err
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(key)
+	return h, err
+}
+
+// checkPassword returns nil if password matches the stored credentials of u
+func checkPassword(u UserAccount, password string) error {
+	return checkSaltedHash(u.Salt, u.SaltedHash, password)
+}
+
+// checkSaltedHash returns nil if secret is the one salt and saltedHash were
+// made from by hashPassword, whatever the algorithm
+func checkSaltedHash(salt, saltedHash []byte, secret string) error {
+	if !strings.HasPrefix(string(saltedHash), "$argon2id$") {
+		return bcrypt.CompareHashAndPassword(saltedHash, append(salt, secret...))
+	}
+	h, err := parseArgon2id(saltedHash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(secret), h.salt, uint32(h.time), uint32(h.memory),
+		uint8(h.threads), uint32(len(h.key)))
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return errPasswordMismatch
+	}
+	return nil
+}
+
+// needsRehash reports whether saltedHash was made with another algorithm or
+// cost than cfg sets
+func needsRehash(cfg PasswordConfig, saltedHash []byte) bool {
+	if cfg.Hash == "argon2id" {
+		h, err := parseArgon2id(saltedHash)
+		return err != nil || h.version != argon2.Version || h.memory != cfg.Argon2Memory ||
+			h.time != cfg.Argon2Time || h.threads != cfg.Argon2Threads
+	}
+	cost, err := bcrypt.Cost(saltedHash)
+	return err != nil || cost != cfg.BcryptCost
+}
+
+// rehashPassword stores a new hash of the password of user, just checked,
+// when theirs was made with outdated parameters. Failures are only logged,
+// the next login tries again.
+func (s *Server) rehashPassword(r *http.Request, user UserAccount, password string) {
+	if !needsRehash(s.Password, user.SaltedHash) {
+		return
+	}
+	salt, saltedHash, err := hashPassword(s.Password, password)
+	if err == nil {
+		err = s.Users.UpdatePassword(user.Username, salt, saltedHash)
+	}
+	if err != nil {
+		requestLogger(r).Warn("Cannot rehash password", "error", err)
+		return
+	}
+	requestLogger(r).Info("Password rehashed", "algorithm", s.Password.Hash)
+}
+
+// BreachedPasswords is a set of the uppercase hex SHA-1 hashes of passwords
+// known from breaches, which may not be chosen
+type BreachedPasswords map[string]bool
+
+var sha1Line = regexp.MustCompile(`^[0-9A-Fa-f]{40}(:[0-9]+)?$`)
+
+// LoadBreachedPasswords reads the file at path, holding one password per
+// line or, as in the Pwned Passwords downloads, one SHA-1 hash optionally
+// followed by :count. The whole list is kept in memory.
+func LoadBreachedPasswords(path string) (BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := BreachedPasswords{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+		case sha1Line.MatchString(line):
+			breached[strings.ToUpper(line[:40])] = true
+		default:
+			breached[sha1Hex(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return breached, nil
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// passwordProblem returns why username may not choose password, to show to
+// the user, or "" if they may
+func passwordProblem(cfg PasswordConfig, breached BreachedPasswords, username, password string) string {
+	length := utf8.RuneCountInString(password)
+	switch {
+	case length < cfg.MinLength:
+		return fmt.Sprintf("Password must be at least %d characters long", cfg.MinLength)
+	case length > cfg.MaxLength:
+		return fmt.Sprintf("Password must be at most %d characters long", cfg.MaxLength)
+	case cfg.Hash == "bcrypt" && len(password) > bcryptMaxPassword:
+		return fmt.Sprintf("Password must be at most %d bytes long", bcryptMaxPassword)
+	case username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)):
+		return "Password must not contain the username"
+	case breached[sha1Hex(password)]:
+		return "Password appears in a list of breached passwords, choose another one"
+	}
+	return ""
+}
+
+// replacePassword stores password for user and signs them out everywhere,
+// revoking their sessions, refresh tokens and pending password resets
+func (s *Server) replacePassword(user UserAccount, password string) error {
+	salt, saltedHash, err := hashPassword(s.Password, password)
+	if err != nil {
+		return err
+	}
+	if err := s.Users.UpdatePassword(user.Username, salt, saltedHash); err != nil {
+		return err
+	}
+	return s.signOutUser(user.UserUUID)
+}
+
+/*
+Changes the password of the caller, who must give their current one. Their
+other sessions and refresh tokens are revoked; the caller gets a new session,
+or new bearer tokens when it used one.
+Method: POST
+Endpoint: /password
+*/
+func (s *Server) PasswordChange(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	oldPassword := r.Form.Get("oldPassword")
+	newPassword := r.Form.Get("newPassword")
+	if oldPassword == "" || newPassword == "" {
+		s.badRequest(w, r, "Missing oldPassword or newPassword")
+		return
+	}
+
+	principal, _ := principalFrom(r.Context())
+	user, err := s.Users.GetUserByUUID(principal.UserUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	// guessing the current password is throttled like logins
+	if wait, err := s.loginWait(r, user.Username); err != nil {
+		s.internalError(w, r, err)
+		return
+	} else if wait > 0 {
+		s.tooManyLogins(w, r, wait)
+		return
+	}
+	if err := checkPassword(user, oldPassword); err != nil {
+		if err := s.loginFailed(r, user.Username); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		s.writeStatus(w, r, http.StatusForbidden, "Incorrect password")
+		return
+	}
+	if problem := passwordProblem(s.Password, s.BreachedPasswords, user.Username, newPassword); problem != "" {
+		s.badRequest(w, r, problem)
+		return
+	}
+
+	if err := s.replacePassword(user, newPassword); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	auditLog(r, "password.changed", "Password changed", "username", user.Username)
+	if _, ok := bearerToken(r); ok {
+		s.issueTokens(w, r, user, principal.TwoFactor)
+		return
+	}
+	if err := s.startSession(w, user, principal.TwoFactor); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	s.writeStatus(w, r, http.StatusOK, "Password changed")
+}
+
+// passwordResetMail is the email sending token to user
+func (s *Server) passwordResetMail(user UserAccount, token string) Mail {
+	instructions := "enter this reset token in the app:\n\n" + token
+	if s.Password.ResetURL != "" {
+		instructions = "open this link:\n\n" + s.Password.ResetURL + "?token=" + token
+	}
+	return Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nA password reset was requested for your account %s. "+
+			"To choose a new password within %d minutes, %s\n\nIf you did not request it, "+
+			"ignore this email: your password is unchanged.\n", user.Name, user.Username,
+			int(s.Password.ResetTTL.Minutes()), instructions),
+	}
+}
+
+/*
+Emails a single-use password reset token to the user, if they have an email
+address. The answer is the same for unknown users, so that accounts cannot be
+discovered.
+Method: POST
+Endpoint: /password/reset
+*/
+func (s *Server) PasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	username := r.Form.Get("username")
+	if username == "" {
+		s.badRequest(w, r, "Missing username")
+		return
+	}
+
+	user, err := s.Users.GetUserByUsername(username)
+	if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
+	// users provisioned by single sign-on have no password to reset
+	if err == nil && user.Email != "" && len(user.SaltedHash) > 0 {
+		setRequestUser(r, user.UserUUID.String())
+		reset, token, err := newToken(user, s.Password.ResetTTL)
+		if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		if err := s.PasswordResets.CreatePasswordReset(reset); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		// a failure is only logged, answering differently would reveal
+		// that the account exists
+		if err := s.Mail.Send(s.passwordResetMail(user, token)); err != nil {
+			requestLogger(r).Error("Cannot send password reset email", "error", err)
+		} else {
+			auditLog(r, "password.reset_requested", "Password reset requested",
+				"username", username, "remoteAddr", r.RemoteAddr)
+		}
+	} else {
+		requestLogger(r).Info("Password reset requested for an account without email or password",
+			"username", username)
+	}
+	s.writeStatus(w, r, http.StatusAccepted,
+		"If the account has an email address, a reset link has been sent to it")
+}
+
+/*
+Sets a new password from an emailed reset token, which can be used once. The
+account is unlocked and signed out everywhere.
+Method: POST
+Endpoint: /password/reset/confirm
+*/
+func (s *Server) PasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	token := r.Form.Get("token")
+	newPassword := r.Form.Get("newPassword")
+	if token == "" || newPassword == "" {
+		s.badRequest(w, r, "Missing token or newPassword")
+		return
+	}
+
+	reset, err := s.PasswordResets.GetPasswordReset(hashToken(token))
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	setRequestUser(r, reset.UserUUID.String())
+	user, err := s.Users.GetUserByUUID(reset.UserUUID)
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	// the token stays usable with another password
+	if problem := passwordProblem(s.Password, s.BreachedPasswords, user.Username, newPassword); problem != "" {
+		s.badRequest(w, r, problem)
+		return
+	}
+	// consumed before the password changes, only by the request that
+	// deletes it, so that it cannot be raced
+	err = s.PasswordResets.DeletePasswordReset(reset.TokenHash)
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid or expired reset token")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	if err := s.replacePassword(user, newPassword); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.LoginAttempts.DeleteLoginAttempts(accountKey(user.Username)); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	auditLog(r, "password.reset", "Password reset", "username", user.Username,
+		"remoteAddr", r.RemoteAddr)
+	s.writeStatus(w, r, http.StatusOK, "Password reset, log in with the new password")
+}
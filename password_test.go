@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMailer records the messages sent instead of sending them
+type testMailer struct {
+	sent []Mail
+}
+
+func (m *testMailer) Send(mail Mail) error {
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+func TestPasswordChange(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	cookie := login(t, s)
+	other := login(t, s)
+
+	change := func(oldPassword string) *httptest.ResponseRecorder {
+		return postForm(s, cookie, "/password", url.Values{"oldPassword": {oldPassword},
+			"newPassword": {"new passphrase"}})
+	}
+	if rec := change("wrong"); rec.Code != http.StatusForbidden {
+		t.Fatalf("change with a wrong password: got %d, want 403", rec.Code)
+	}
+	elapse(t, s, accountKey("kelly"), time.Minute)
+	elapse(t, s, "ip:192.0.2.1", time.Minute)
+	rec := change("correct horse")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("change: got %d, want 200: %s", rec.Code, rec.Body)
+	}
+
+	// the caller continues in a new session, other sessions are revoked
+	var renewed *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			renewed = c
+		}
+	}
+	if renewed == nil {
+		t.Fatal("no new session cookie after the change")
+	}
+	if rec := serveAs(s, renewed, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusOK {
+		t.Errorf("request in the new session: got %d, want 200", rec.Code)
+	}
+	if rec := serveAs(s, other, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("request in another session: got %d, want 401", rec.Code)
+	}
+	if rec := postLogin(s, "kelly", "new passphrase"); rec.Code != http.StatusOK {
+		t.Errorf("login with the new password: got %d, want 200", rec.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	mailer := &testMailer{}
+	s.Mail = mailer
+	s.Password.ResetURL = "https://emr.example.com/reset-password"
+
+	create := func(email string) int {
+		return serveServer(s, testAdmin, httptest.NewRequest("POST", "/users", strings.NewReader(
+			`{"username": "logan", "password": "correct horse", "role": "Admin", "name": "Logan", "email": "`+
+				email+`"}`))).Code
+	}
+	if code := create("Logan <logan@example.com>"); code != http.StatusBadRequest {
+		t.Errorf("create with a display name in the email: got %d, want 400", code)
+	}
+	if code := create("logan@example.com"); code != http.StatusCreated {
+		t.Fatalf("create: got %d, want 201", code)
+	}
+
+	request := func(username string) int {
+		return postForm(s, nil, "/password/reset", url.Values{"username": {username}}).Code
+	}
+	if code := request("nobody"); code != http.StatusAccepted || len(mailer.sent) != 0 {
+		t.Fatalf("reset of an unknown user: got %d and %d emails, want 202 and none", code, len(mailer.sent))
+	}
+	if code := request("logan"); code != http.StatusAccepted || len(mailer.sent) != 1 {
+		t.Fatalf("reset: got %d and %d emails, want 202 and one", code, len(mailer.sent))
+	}
+	mail := mailer.sent[0]
+	_, link, found := strings.Cut(mail.Body, s.Password.ResetURL+"?token=")
+	if mail.To != "logan@example.com" || !found {
+		t.Fatalf("unexpected reset email %+v", mail)
+	}
+	token := strings.Fields(link)[0]
+
+	confirm := func(token string) int {
+		return postForm(s, nil, "/password/reset/confirm", url.Values{"token": {token},
+			"newPassword": {"new passphrase"}}).Code
+	}
+	if code := confirm("forged"); code != http.StatusUnauthorized {
+		t.Errorf("forged reset token: got %d, want 401", code)
+	}
+	if code := confirm(token); code != http.StatusOK {
+		t.Fatalf("confirm: got %d, want 200", code)
+	}
+	if code := confirm(token); code != http.StatusUnauthorized {
+		t.Errorf("reused reset token: got %d, want 401", code)
+	}
+	if rec := postLogin(s, "logan", "new passphrase"); rec.Code != http.StatusOK {
+		t.Errorf("login with the new password: got %d, want 200", rec.Code)
+	}
+
+	// a token used by another request between its read and its deletion
+	// sets no password
+	request("logan")
+	_, link, _ = strings.Cut(mailer.sent[1].Body, s.Password.ResetURL+"?token=")
+	s.PasswordResets = racedResets{s.PasswordResets}
+	if code := confirm(strings.Fields(link)[0]); code != http.StatusUnauthorized {
+		t.Errorf("raced reset token: got %d, want 401", code)
+	}
+}
+
+// racedResets has each reset token used by another request right after it
+// is read
+type racedResets struct{ PasswordResetStore }
+
+func (r racedResets) GetPasswordReset(tokenHash string) (Session, error) {
+	reset, err := r.PasswordResetStore.GetPasswordReset(tokenHash)
+	if err == nil {
+		err = r.PasswordResetStore.DeletePasswordReset(tokenHash)
+	}
+	return reset, err
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := FileMailer{Dir: dir, From: "EMR <emr@example.com>"}
+	if err := mailer.Send(Mail{To: "kelly@example.com", Subject: "Réinitialisation",
+		Body: "Hello\nKelly"}); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("got %d messages, want 1", len(files))
+	}
+	msg, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: kelly@example.com\r\n", "Subject: =?utf-8?q?R=C3=A9initialisation?=\r\n",
+		"\r\n\r\nHello\r\nKelly"} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+
+	if err := mailer.Send(Mail{To: "kelly@example.com\r\nBcc: eve@example.com"}); err == nil {
+		t.Error("header injection accepted")
+	}
+}
+
+func TestPasswordHashing(t *testing.T) {
+	cheapBcrypt := DefaultConfig().Password
+	cheapBcrypt.BcryptCost = 4
+	cheapArgon2 := cheapBcrypt
+	cheapArgon2.Hash, cheapArgon2.Argon2Memory, cheapArgon2.Argon2Time = "argon2id", 64, 1
+	for _, cfg := range []PasswordConfig{cheapBcrypt, cheapArgon2} {
+		salt, saltedHash, err := hashPassword(cfg, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkSaltedHash(salt, saltedHash, "correct horse"); err != nil {
+			t.Errorf("%s: right password rejected: %v", cfg.Hash, err)
+		}
+		if checkSaltedHash(salt, saltedHash, "correct horsE") == nil {
+			t.Errorf("%s: wrong password accepted", cfg.Hash)
+		}
+		if needsRehash(cfg, saltedHash) {
+			t.Errorf("%s: rehash needed with the same parameters", cfg.Hash)
+		}
+	}
+
+	_, bcryptHash, _ := hashPassword(cheapBcrypt, "correct horse")
+	_, argon2Hash, _ := hashPassword(cheapArgon2, "correct horse")
+	costlier := cheapBcrypt
+	costlier.BcryptCost = 5
+	moreMemory := cheapArgon2
+	moreMemory.Argon2Memory = 128
+	if !needsRehash(costlier, bcryptHash) || !needsRehash(cheapArgon2, bcryptHash) ||
+		!needsRehash(moreMemory, argon2Hash) || !needsRehash(cheapBcrypt, argon2Hash) {
+		t.Error("rehash not needed after changing the algorithm or its parameters")
+	}
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	login(t, s)
+	s.Password.Hash, s.Password.Argon2Memory, s.Password.Argon2Time = "argon2id", 64, 1
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusOK {
+		t.Fatalf("login: got %d, want 200", rec.Code)
+	}
+	user, err := s.Users.GetUserByUsername("kelly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(user.SaltedHash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("password not rehashed with argon2id: %s", user.SaltedHash)
+	}
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusOK {
+		t.Errorf("login after the rehash: got %d, want 200", rec.Code)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte("password1234\r\n\n"+
+		"DB12F1F2B5A3B0CDB6AB9E2EC1B1E2C0B7C8E5D2:42\n"+ // not a hash of any test password
+		sha1Hex("letmein12345")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	breached, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breached) != 3 {
+		t.Errorf("got %d breached passwords, want 3", len(breached))
+	}
+
+	cfg := DefaultConfig().Password
+	tests := []struct {
+		password string
+		problem  string
+	}{
+		{"", "at least 12 characters"},
+		{"short", "at least 12 characters"},
+		{"ünïcödé-ok!", "at least 12 characters"},
+		{"ünïcödé-ok!!", ""},
+		{strings.Repeat("x", 57), "at most 56 bytes"},
+		{"my name is Kelly!", "username"},
+		{"password1234", "breached"},
+		{"letmein12345", "breached"},
+		{"correct horse", ""},
+	}
+	for _, test := range tests {
+		problem := passwordProblem(cfg, breached, "kelly", test.password)
+		if (test.problem == "") != (problem == "") || !strings.Contains(problem, test.problem) {
+			t.Errorf("%q: got problem %q, want %q", test.password, problem, test.problem)
+		}
+	}
+
+	s := NewServer(NewMemoryStore())
+	rec := serveServer(s, testAdmin, httptest.NewRequest("POST", "/users", strings.NewReader(
+		`{"username": "logan", "password": "logan", "role": "Doctor"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("create with a weak password: got %d, want 400", rec.Code)
+	}
+}
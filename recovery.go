@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recoverer turns a panic in inner into a 500 Internal Server Error response
+// so that one bad request cannot take the server down
+func Recoverer(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// reuse the recorder of Logger to know if the response has started
+		rec, ok := w.(*statusRecorder)
+		if !ok {
+			rec = &statusRecorder{ResponseWriter: w}
+		}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// deliberate abort of the response, let net/http handle it
+				panic(err)
+			}
+
+			requestLogger(r).Error("Panic serving request", "route", name,
+				"panic", fmt.Sprint(err), "stack", string(debug.Stack()))
+			if rec.status != 0 {
+				// too late for an error response, drop the connection instead
+				panic(http.ErrAbortHandler)
+			}
+			rec.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			rec.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(rec).Encode(Status{Code: http.StatusInternalServerError,
+				Message: "Internal Server Error"})
+		}()
+
+		inner.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecovererAnswers500(t *testing.T) {
+	handler := Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var form map[string][]string
+		w.Write([]byte(form["username"][0]))
+	}), "Panics")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	var status Status
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusInternalServerError || status.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 with a Status body, got %d %+v", rec.Code, status)
+	}
+}
+
+func TestMalformedInputAnswers400(t *testing.T) {
+	store := NewMemoryStore()
+	tests := []struct {
+		method, target, contentType, body string
+	}{
+		{"POST", "/patients", "application/json", `{"name": `},
+		{"PUT", "/patients", "application/json", `[]`},
+		{"POST", "/users", "application/json", `not json`},
+		{"POST", "/doctors", "application/json", ``},
+		{"POST", "/futureappointments", "application/json", `{"patientUUID": "nope"}`},
+		{"POST", "/prescription", "application/json", `{}`},
+		{"GET", "/patients/patientuuid/not-a-uuid", "", ``},
+		{"DELETE", "/futureappointments/appointmentuuid/1234", "", ``},
+		{"POST", "/login", "application/x-www-form-urlencoded", `username=kelly`},
+		{"POST", "/documents", "multipart/form-data; boundary=x", `--x--`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.target, strings.NewReader(test.body))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		user := testUser
+		if test.target == "/doctors" {
+			user = testAdmin
+		}
+		rec := serveServer(NewServer(store), user, req)
+
+		var status Status
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Errorf("%s %s: response is not a Status: %v", test.method, test.target, err)
+			continue
+		}
+		if rec.Code != http.StatusBadRequest || status.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected 400, got %d %+v", test.method, test.target, rec.Code, status)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+)
+
+// redactedValue replaces free text and clinical values in log output
+const redactedValue = "[REDACTED]"
+
+// redactedKeys are log attribute keys, lower case, whose values are
+// patient data and are never logged
+var redactedKeys = map[string]bool{
+	"name": true, "patientname": true, "address": true, "phone": true,
+	"emergencycontact": true, "dateofbirth": true, "gender": true,
+	"bloodtype": true, "notes": true, "instructions": true, "message": true,
+	"drug": true, "filename": true, "breathingrate": true, "heartrate": true,
+	"bloodoxygenlevel": true, "bloodpressure": true, "password": true,
+	"salt": true, "saltedhash": true, "verificationkey": true, "email": true,
+}
+
+// pseudonymKeys are log attribute keys, lower case, whose values, or each
+// value of a list, identify a patient. They are logged as a keyed hash so
+// that lines about the same patient can be correlated without revealing who
+// it is.
+var pseudonymKeys = map[string]bool{
+	"patientuuid": true, "patientuuids": true, "medicalnumber": true, "username": true,
+	"userid": true, "actorid": true,
+}
+
+// RedactHandler is a slog.Handler removing patient data from log attributes
+// before passing them on
+type RedactHandler struct {
+	inner slog.Handler
+	key   []byte
+}
+
+// NewRedactHandler wraps inner; pseudonyms are keyed with key, or with a
+// random key, making them unlinkable across restarts, when key is empty
+func NewRedactHandler(inner slog.Handler, key []byte) *RedactHandler {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	return &RedactHandler{inner: inner, key: key}
+}
+
+// Pseudonym returns the value logged in place of the identifier value
+func (h *RedactHandler) Pseudonym(value string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(value))
+	return "p:" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (h *RedactHandler) redact(a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		attrs := a.Value.Group()
+		redacted := make([]any, len(attrs))
+		for i, attr := range attrs {
+			redacted[i] = h.redact(attr)
+		}
+		return slog.Group(a.Key, redacted...)
+	case redactedKeys[key]:
+		return slog.String(a.Key, redactedValue)
+	case pseudonymKeys[key]:
+		value := a.Value.Resolve().Any()
+		if list := reflect.ValueOf(value); list.Kind() == reflect.Slice {
+			pseudonyms := make([]string, list.Len())
+			for i := range pseudonyms {
+				pseudonyms[i] = h.pseudonymize(list.Index(i).Interface())
+			}
+			return slog.Any(a.Key, pseudonyms)
+		}
+		return slog.String(a.Key, h.pseudonymize(value))
+	}
+	return a
+}
+
+// pseudonymize returns the pseudonym of an identifier, leaving empty and
+// zero UUID values as they are
+func (h *RedactHandler) pseudonymize(value any) string {
+	s := fmt.Sprint(value)
+	if s == "" || s == "00000000-0000-0000-0000-000000000000" {
+		return s
+	}
+	return h.Pseudonym(s)
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.inner.Handle(ctx, redacted)
+}
+
+func (h *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact(a)
+	}
+	return &RedactHandler{inner: h.inner.WithAttrs(redacted), key: h.key}
+}
+
+func (h *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{inner: h.inner.WithGroup(name), key: h.key}
+}
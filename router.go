@@ -6,17 +6,24 @@ import (
 	"github.com/gorilla/mux"
 )
 
-func NewRouter() *mux.Router {
+func NewRouter(s *Server) *mux.Router {
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.
 		Methods("OPTIONS").
-		Handler(http.HandlerFunc(PreFlight))
+		Handler(Recoverer(http.HandlerFunc(s.PreFlight), "PreFlight"))
 
-	for _, route := range routes {
+	for _, route := range newRoutes(s) {
 		var handler http.Handler
 
 		handler = route.HandlerFunc
+		handler = s.Authorize(handler, route.Name, route.Access)
+		handler = s.Authenticate(handler, route.Access.Public)
+		handler = Recoverer(handler, route.Name)
+		if !unaudited[route.Name] {
+			handler = s.Audit(handler, route.Name)
+		}
+		handler = Metrics(handler, route.Name)
 		handler = Logger(handler, route.Name)
 
 		router.
@@ -7,165 +7,413 @@ type Route struct {
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	// Access declares who may call the route
+	Access Access
 }
 
 type Routes []Route
 
-var routes = Routes{
-	Route{
-		"Index",
-		"GET",
-		"/",
-		Index,
-	},
-	Route{
-		"UserAuthenticate",
-		"POST",
-		"/login",
-		UserAuthenticate,
-	},
-	Route{
-		"UserGet",
-		"GET",
-		"/users/useruuid/{useruuid}",
-		UserGet,
-	},
-	Route{
-		"UserCreate",
-		"POST",
-		"/users",
-		UserCreate,
-	},
-	Route{
-		"PatientCreate",
-		"POST",
-		"/patients",
-		PatientCreate,
-	},
-	Route{
-		"PatientGet",
-		"GET",
-		"/patients/patientuuid/{patientuuid}",
-		PatientGet,
-	},
-	Route{
-		"PatientListGet",
-		"GET",
-		"/patients/all",
-		PatientListGet,
-	},
-	Route{
-		"PatientGetByDoctor",
-		"GET",
-		"/patients/doctoruuid/{doctoruuid}",
-		PatientGetByDoctor,
-	},
-	Route{
-		"FutureAppointmentDelete",
-		"DELETE",
-		"/futureappointments/appointmentuuid/{appointmentuuid}",
-		FutureAppointmentDelete,
-	},
-	Route{
-		"FutureAppointmentCreate",
-		"POST",
-		"/futureappointments",
-		FutureAppointmentCreate,
-	},
-	Route{
-		"FutureAppointmentGet",
-		"GET",
-		"/futureappointments/appointmentuuid/{appointmentuuid}",
-		FutureAppointmentGet,
-	},
-	Route{
-		"CompletedAppointmentCreate",
-		"POST",
-		"/completedappointments",
-		CompletedAppointmentCreate,
-	},
-	Route{
-		"CompletedAppointmentGet",
-		"GET",
-		"/completedappointments/appointmentuuid/{appointmentuuid}",
-		CompletedAppointmentGet,
-	},
-	Route{
-		"AppointmentGetByDoctor",
-		"GET",
-		"/appointments/doctoruuid/{doctoruuid}",
-		AppointmentGetByDoctor,
-	},
-	Route{
-		"DoctorCreate",
-		"POST",
-		"/doctors",
-		DoctorCreate,
-	},
-	Route{
-		"DoctorGet",
-		"GET",
-		"/doctors/doctoruuid/{doctoruuid}",
-		DoctorGet,
-	},
-	Route{
-		"DoctorListGet",
-		"GET",
-		"/doctors",
-		DoctorListGet,
-	},
-	Route{
-		"PrescriptionCreate",
-		"POST",
-		"/prescription",
-		PrescriptionCreate,
-	},
-	Route{
-		"PrescriptionsGetByPatient",
-		"GET",
-		"/prescriptions/patientuuid/{patientuuid}",
-		PrescriptionsGetByPatient,
-	},
-	Route{
-		"AppointmentGetByPatient",
-		"GET",
-		"/appointments/patientuuid/{patientuuid}",
-		AppointmentGetByPatient,
-	},
-	Route{
-		"PatientUpdate",
-		"PUT",
-		"/patients",
-		PatientUpdate,
-	},
-	Route{
-		"NotificationCreate",
-		"POST",
-		"/notifications",
-		NotificationCreate,
-	},
-	Route{
-		"NotificationsGetByDoctor",
-		"GET",
-		"/notifications/doctoruuid/{doctoruuid}",
-		NotificationsGetByDoctor,
-	},
-	Route{
-		"DocumentCreate",
-		"POST",
-		"/documents",
-		DocumentCreate,
-	},
-	Route{
-		"DocumentGet",
-		"GET",
-		"/documents/documentuuid/{documentuuid}",
-		DocumentGet,
-	},
-	Route{
-		"DocumentListGetByPatient",
-		"GET",
-		"/documents/patientuuid/{patientuuid}",
-		DocumentListGetByPatient,
-	},
+// newRoutes returns the API routes served by s
+func newRoutes(s *Server) Routes {
+	return Routes{
+		Route{
+			"Index",
+			"GET",
+			"/",
+			Index,
+			loggedIn,
+		},
+		Route{
+			"Healthz",
+			"GET",
+			"/healthz",
+			s.Healthz,
+			public,
+		},
+		Route{
+			"Readyz",
+			"GET",
+			"/readyz",
+			s.Readyz,
+			public,
+		},
+		Route{
+			"Metrics",
+			"GET",
+			"/metrics",
+			MetricsHandler().ServeHTTP,
+			admins.withScope("metrics:read"),
+		},
+		Route{
+			"ServiceStatus",
+			"GET",
+			"/status",
+			s.ServiceStatus,
+			admins,
+		},
+		Route{
+			"UserAuthenticate",
+			"POST",
+			"/login",
+			s.UserAuthenticate,
+			public,
+		},
+		Route{
+			"UserAuthenticateTOTP",
+			"POST",
+			"/login/totp",
+			s.UserAuthenticateTOTP,
+			public,
+		},
+		Route{
+			"OIDCLogin",
+			"GET",
+			"/login/oidc",
+			s.OIDCLogin,
+			public,
+		},
+		Route{
+			"OIDCCallback",
+			"GET",
+			"/login/oidc/callback",
+			s.OIDCCallback,
+			public,
+		},
+		Route{
+			"TokenRefresh",
+			"POST",
+			"/token/refresh",
+			s.TokenRefresh,
+			public,
+		},
+		Route{
+			"PasswordResetRequest",
+			"POST",
+			"/password/reset",
+			s.PasswordResetRequest,
+			public,
+		},
+		Route{
+			"PasswordResetConfirm",
+			"POST",
+			"/password/reset/confirm",
+			s.PasswordResetConfirm,
+			public,
+		},
+		Route{
+			"PasswordChange",
+			"POST",
+			"/password",
+			s.PasswordChange,
+			loggedIn,
+		},
+		Route{
+			"UserLogout",
+			"POST",
+			"/logout",
+			s.UserLogout,
+			enrolling,
+		},
+		Route{
+			"SessionsRevoke",
+			"DELETE",
+			"/sessions",
+			s.SessionsRevoke,
+			enrolling,
+		},
+		Route{
+			"TOTPEnroll",
+			"POST",
+			"/2fa/totp",
+			s.TOTPEnroll,
+			enrolling,
+		},
+		Route{
+			"TOTPConfirm",
+			"POST",
+			"/2fa/totp/confirm",
+			s.TOTPConfirm,
+			enrolling,
+		},
+		Route{
+			"TOTPDisable",
+			"POST",
+			"/2fa/totp/disable",
+			s.TOTPDisable,
+			loggedIn,
+		},
+		Route{
+			"RecoveryCodesRegenerate",
+			"POST",
+			"/2fa/recovery-codes",
+			s.RecoveryCodesRegenerate,
+			loggedIn,
+		},
+		Route{
+			"UserUnlock",
+			"DELETE",
+			"/users/useruuid/{useruuid}/lockout",
+			s.UserUnlock,
+			admins,
+		},
+		Route{
+			"UserTwoFactorReset",
+			"DELETE",
+			"/users/useruuid/{useruuid}/2fa",
+			s.UserTwoFactorReset,
+			admins,
+		},
+		Route{
+			"APIKeyCreate",
+			"POST",
+			"/apikeys",
+			s.APIKeyCreate,
+			admins,
+		},
+		Route{
+			"APIKeyListGet",
+			"GET",
+			"/apikeys",
+			s.APIKeyListGet,
+			admins,
+		},
+		Route{
+			"APIKeyRevoke",
+			"DELETE",
+			"/apikeys/keyuuid/{keyuuid}",
+			s.APIKeyRevoke,
+			admins,
+		},
+		Route{
+			"UserGet",
+			"GET",
+			"/users/useruuid/{useruuid}",
+			s.UserGet,
+			Access{Roles: []string{RoleDoctor, RoleAdmin}, Owner: "useruuid"},
+		},
+		Route{
+			"UserListGet",
+			"GET",
+			"/users",
+			s.UserListGet,
+			admins,
+		},
+		Route{
+			"UserUpdate",
+			"PATCH",
+			"/users/useruuid/{useruuid}",
+			s.UserUpdate,
+			admins,
+		},
+		Route{
+			"UserDelete",
+			"DELETE",
+			"/users/useruuid/{useruuid}",
+			s.UserDelete,
+			admins,
+		},
+		Route{
+			"UserDisable",
+			"PUT",
+			"/users/useruuid/{useruuid}/disabled",
+			s.UserDisable,
+			admins,
+		},
+		Route{
+			"UserEnable",
+			"DELETE",
+			"/users/useruuid/{useruuid}/disabled",
+			s.UserEnable,
+			admins,
+		},
+		Route{
+			"AuditEventsGet",
+			"GET",
+			"/audit",
+			s.AuditEventsGet,
+			admins,
+		},
+		Route{
+			"AuditVerify",
+			"GET",
+			"/audit/verify",
+			s.AuditVerify,
+			admins,
+		},
+		Route{
+			"UserCreate",
+			"POST",
+			"/users",
+			s.UserCreate,
+			public,
+		},
+		Route{
+			"PatientCreate",
+			"POST",
+			"/patients",
+			s.PatientCreate,
+			doctors.withScope("patients:write"),
+		},
+		Route{
+			"PatientGet",
+			"GET",
+			"/patients/patientuuid/{patientuuid}",
+			s.PatientGet,
+			doctorsOrOwner("patientuuid").withScope("patients:read"),
+		},
+		Route{
+			"PatientListGet",
+			"GET",
+			"/patients/all",
+			s.PatientListGet,
+			doctors.withScope("patients:read"),
+		},
+		Route{
+			"PatientGetByDoctor",
+			"GET",
+			"/patients/doctoruuid/{doctoruuid}",
+			s.PatientGetByDoctor,
+			adminsOrOwner("doctoruuid").withScope("patients:read"),
+		},
+		Route{
+			"FutureAppointmentDelete",
+			"DELETE",
+			"/futureappointments/appointmentuuid/{appointmentuuid}",
+			s.FutureAppointmentDelete,
+			doctors.withScope("appointments:write"),
+		},
+		Route{
+			"FutureAppointmentCreate",
+			"POST",
+			"/futureappointments",
+			s.FutureAppointmentCreate,
+			doctors.withScope("appointments:write"),
+		},
+		Route{
+			"FutureAppointmentGet",
+			"GET",
+			"/futureappointments/appointmentuuid/{appointmentuuid}",
+			s.FutureAppointmentGet,
+			doctors.withScope("appointments:read"),
+		},
+		Route{
+			"CompletedAppointmentCreate",
+			"POST",
+			"/completedappointments",
+			s.CompletedAppointmentCreate,
+			doctors.withScope("appointments:write"),
+		},
+		Route{
+			"CompletedAppointmentGet",
+			"GET",
+			"/completedappointments/appointmentuuid/{appointmentuuid}",
+			s.CompletedAppointmentGet,
+			doctors.withScope("appointments:read"),
+		},
+		Route{
+			"AppointmentGetByDoctor",
+			"GET",
+			"/appointments/doctoruuid/{doctoruuid}",
+			s.AppointmentGetByDoctor,
+			adminsOrOwner("doctoruuid").withScope("appointments:read"),
+		},
+		Route{
+			"DoctorCreate",
+			"POST",
+			"/doctors",
+			s.DoctorCreate,
+			admins,
+		},
+		Route{
+			"DoctorInviteCreate",
+			"POST",
+			"/doctors/doctoruuid/{doctoruuid}/invites",
+			s.DoctorInviteCreate,
+			admins,
+		},
+		Route{
+			"DoctorGet",
+			"GET",
+			"/doctors/doctoruuid/{doctoruuid}",
+			s.DoctorGet,
+			loggedIn.withScope("doctors:read"),
+		},
+		Route{
+			"DoctorListGet",
+			"GET",
+			"/doctors",
+			s.DoctorListGet,
+			loggedIn.withScope("doctors:read"),
+		},
+		Route{
+			"PrescriptionCreate",
+			"POST",
+			"/prescription",
+			s.PrescriptionCreate,
+			doctors.withScope("prescriptions:write"),
+		},
+		Route{
+			"PrescriptionsGetByPatient",
+			"GET",
+			"/prescriptions/patientuuid/{patientuuid}",
+			s.PrescriptionsGetByPatient,
+			doctorsOrOwner("patientuuid").withScope("prescriptions:read"),
+		},
+		Route{
+			"AppointmentGetByPatient",
+			"GET",
+			"/appointments/patientuuid/{patientuuid}",
+			s.AppointmentGetByPatient,
+			doctorsOrOwner("patientuuid").withScope("appointments:read"),
+		},
+		Route{
+			"PatientUpdate",
+			"PUT",
+			"/patients",
+			s.PatientUpdate,
+			doctors.withScope("patients:write"),
+		},
+		Route{
+			"PatientAccessesGet",
+			"GET",
+			"/patients/patientuuid/{patientuuid}/accesses",
+			s.PatientAccessesGet,
+			Access{Roles: []string{RoleAdmin}, Owner: "patientuuid"},
+		},
+		Route{
+			"NotificationCreate",
+			"POST",
+			"/notifications",
+			s.NotificationCreate,
+			doctors.withScope("notifications:write"),
+		},
+		Route{
+			"NotificationsGetByDoctor",
+			"GET",
+			"/notifications/doctoruuid/{doctoruuid}",
+			s.NotificationsGetByDoctor,
+			adminsOrOwner("doctoruuid").withScope("notifications:read"),
+		},
+		Route{
+			"DocumentCreate",
+			"POST",
+			"/documents",
+			s.DocumentCreate,
+			doctors.withScope("documents:write"),
+		},
+		Route{
+			"DocumentGet",
+			"GET",
+			"/documents/documentuuid/{documentuuid}",
+			s.DocumentGet,
+			Access{Roles: []string{RoleDoctor, RolePatient}}.withScope("documents:read"),
+		},
+		Route{
+			"DocumentListGetByPatient",
+			"GET",
+			"/documents/patientuuid/{patientuuid}",
+			s.DocumentListGetByPatient,
+			doctorsOrOwner("patientuuid").withScope("documents:read"),
+		},
+	}
 }
@@ -13,6 +13,21 @@ import (
 
 var testDB string = "emr"
 
+// CASSDB is the Cassandra node holding the test keyspace
+const CASSDB = "127.0.0.1"
+
+// testServer returns a Server whose handlers run against the test keyspace
+func testServer() *Server {
+	cfg := DefaultCassandraConfig()
+	cfg.Hosts = []string{CASSDB}
+	cfg.Keyspace = testDB
+	store, err := NewCassandraStore(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return NewServer(store)
+}
+
 func TestIndexHandler(t *testing.T) {
 	// Create the request
 	req, err := http.NewRequest("GET", "/index", nil)
@@ -70,7 +85,7 @@ func TestPatientCreateHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(PatientCreate)
+	handler := http.HandlerFunc(testServer().PatientCreate)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -135,7 +150,7 @@ func TestPatientGetHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(PatientGet)
+	handler := http.HandlerFunc(testServer().PatientGet)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -171,12 +186,20 @@ func TestUserCreateHandler(t *testing.T) {
 	// Get current count of patients
 	numUsersBefore := session.Query("SELECT * FROM users").Iter().NumRows()
 
+	// Patient accounts need a patient entry of the medical number
+	server := testServer()
+	if err := server.Patients.CreatePatient(Patient{PatientUUID: gocql.TimeUUID(), Name: "Tester",
+		MedicalNumber: "tester-0001"}); err != nil {
+		t.Fatal(err)
+	}
+
 	// Make the reader using the json string
 	jsonStringReader := strings.NewReader(`{
 																				  "username": "tester@test.net",
-																				  "password": "test",
+																				  "password": "test password",
 																				  "role": "patient",
-																				  "name": "Tester"
+																				  "name": "Tester",
+																				  "verificationKey": "tester-0001"
 																				}`)
 
 	// Create the request with json as body
@@ -189,7 +212,7 @@ func TestUserCreateHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(UserCreate)
+	handler := http.HandlerFunc(server.UserCreate)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -242,7 +265,7 @@ func TestUserGetHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(UserGet)
+	handler := http.HandlerFunc(testServer().UserGet)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -298,7 +321,7 @@ func TestDoctorCreateHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(DoctorCreate)
+	handler := http.HandlerFunc(testServer().DoctorCreate)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -357,7 +380,7 @@ func TestDoctorGetHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(DoctorGet)
+	handler := http.HandlerFunc(testServer().DoctorGet)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -453,7 +476,7 @@ func TestDoctorListGetHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(DoctorListGet)
+	handler := http.HandlerFunc(testServer().DoctorListGet)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -588,7 +611,7 @@ func TestPrescriptionCreate(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(PrescriptionCreate)
+	handler := http.HandlerFunc(testServer().PrescriptionCreate)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -654,7 +677,7 @@ func TestFutureAppointmentCreateHandler(t *testing.T) {
 	}
 
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(FutureAppointmentCreate)
+	handler := http.HandlerFunc(testServer().FutureAppointmentCreate)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -747,7 +770,7 @@ func TestFutureAppointmentGetHandler(t *testing.T) {
 	req.RequestURI = endpoint
 
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(FutureAppointmentGet)
+	handler := http.HandlerFunc(testServer().FutureAppointmentGet)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -828,7 +851,7 @@ func TestCompletedAppointmentCreateHandler(t *testing.T) {
 	}
 
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(CompletedAppointmentCreate)
+	handler := http.HandlerFunc(testServer().CompletedAppointmentCreate)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -930,7 +953,7 @@ func TestCompletedAppointmentGetHandler(t *testing.T) {
 	req.RequestURI = endpoint
 
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(CompletedAppointmentGet)
+	handler := http.HandlerFunc(testServer().CompletedAppointmentGet)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -1063,7 +1086,7 @@ func TestAppointmentGetByDoctorHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(AppointmentGetByDoctor)
+	handler := http.HandlerFunc(testServer().AppointmentGetByDoctor)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -1206,7 +1229,7 @@ func TestAppointmentGetByPatientHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(AppointmentGetByPatient)
+	handler := http.HandlerFunc(testServer().AppointmentGetByPatient)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -1330,7 +1353,7 @@ func TestPatientGetByDoctorHandler(t *testing.T) {
 	req.RequestURI = endpoint
 
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(PatientGetByDoctor)
+	handler := http.HandlerFunc(testServer().PatientGetByDoctor)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -1443,7 +1466,7 @@ func TestDeleteFutureAppointmentHandler(t *testing.T) {
 	req.RequestURI = endpoint
 
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(FutureAppointmentDelete)
+	handler := http.HandlerFunc(testServer().FutureAppointmentDelete)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -1570,7 +1593,7 @@ func TestPrescriptionGetByPatient(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(PrescriptionsGetByPatient)
+	handler := http.HandlerFunc(testServer().PrescriptionsGetByPatient)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
@@ -1689,7 +1712,7 @@ func TestPatientUpdateHandler(t *testing.T) {
 	req.RequestURI = endpoint
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(PatientUpdate)
+	handler := http.HandlerFunc(testServer().PatientUpdate)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -1809,7 +1832,7 @@ func TestNotificationCreateHandler(t *testing.T) {
 	req.RequestURI = endpoint
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(NotificationCreate)
+	handler := http.HandlerFunc(testServer().NotificationCreate)
 	handler.ServeHTTP(rec, req)
 
 	status := rec.Code
@@ -1884,7 +1907,7 @@ func TestNotificationsGetByDoctorHandler(t *testing.T) {
 
 	// Create a response recorder to record the response
 	rec := httptest.NewRecorder()
-	handler := http.HandlerFunc(NotificationsGetByDoctor)
+	handler := http.HandlerFunc(testServer().NotificationsGetByDoctor)
 	handler.ServeHTTP(rec, req)
 
 	// Get the status code of the page and check if it is OK
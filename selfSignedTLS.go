@@ -1,81 +1,141 @@
 package main
 
 import (
-    "crypto/rand"
-    "crypto/rsa"
-    "crypto/x509"
-    "crypto/x509/pkix"
-    "encoding/pem"
-    "log"
-    "math/big"
-    "net"
-    "time"
-    "errors"
-    "os"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
 )
 
-// helper function to create a cert template with a serial number and other required fields
-func CertTemplate() (*x509.Certificate, error) {
-    // generate a random serial number (a real cert authority would have some logic behind this)
-    serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-    serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-    if err != nil {
-        return nil, errors.New("failed to generate serial number: " + err.Error())
-    }
+// file names written by GenerateDevCertificates in the dev TLS directory
+const (
+	devCAFile    = "ca.pem"
+	devCAKeyFile = "ca-key.pem"
+	devCertFile  = "cert.pem"
+	devKeyFile   = "key.pem"
+)
 
-    tmpl := x509.Certificate{
-        SerialNumber:          serialNumber,
-        Subject:               pkix.Name{Organization: []string{"Yhat, Inc."}},
-        SignatureAlgorithm:    x509.SHA256WithRSA,
-        NotBefore:             time.Now(),
-        NotAfter:              time.Now().Add(time.Hour), // valid for an hour
-        BasicConstraintsValid: true,
-    }
-    return &tmpl, nil
-}
+// CertTemplate returns a certificate template with a random serial number,
+// valid from now for the given duration
+func CertTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	// generate a random serial number (a real cert authority would have some logic behind this)
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, errors.New("failed to generate serial number: " + err.Error())
+	}
 
-func CreateCert(template, parent *x509.Certificate, pub interface{}, parentPriv interface{}) ( err error) {
-	
-	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, pub, parentPriv)
-   
-    certOut, err := os.Create("cert.pem")
-    if err != nil {
-     log.Fatalf("failed to open cert.pem for writing: %s", err)
-    }
-    pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-    certOut.Close()
-    return
+	return &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"go-rest development"}, CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validFor),
+		BasicConstraintsValid: true,
+	}, nil
 }
 
-func generateCertKeyPEM(){
-    // generate a new private key-pair
-    rootKey, err := rsa.GenerateKey(rand.Reader, 2048)
-    if err != nil {
-        log.Fatalf("generating random key: %v", err)
-    }
+// GenerateDevCertificates writes a development CA and a server certificate
+// signed by it for hosts (DNS names or IP addresses) into dir, returning the
+// certificate and key files to serve. An existing, unexpired CA in dir is
+// reused so that it only needs to be trusted once; the server certificate is
+// issued again on every call.
+func GenerateDevCertificates(dir string, hosts []string) (certFile, keyFile string, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	ca, err := tls.LoadX509KeyPair(filepath.Join(dir, devCAFile), filepath.Join(dir, devCAKeyFile))
+	if err == nil {
+		ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	}
+	if err != nil || time.Now().After(ca.Leaf.NotAfter.Add(-24*time.Hour)) {
+		if ca, err = generateDevCA(dir); err != nil {
+			return "", "", err
+		}
+		log.Printf("Generated development CA %s, add it to your trust store to avoid certificate warnings",
+			filepath.Join(dir, devCAFile))
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	tmpl, err := CertTemplate(hosts[0], 30*24*time.Hour)
+	if err != nil {
+		return "", "", err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
 
-    rootCertTmpl, err := CertTemplate()
-    if err != nil {
-        log.Fatalf("creating cert template: %v", err)
-    }
+	certFile, keyFile = filepath.Join(dir, devCertFile), filepath.Join(dir, devKeyFile)
+	if err := writeCertKeyPEM(certFile, keyFile, tmpl, ca.Leaf, key, ca.PrivateKey); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// generateDevCA writes a new CA certificate and key into dir
+func generateDevCA(dir string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl, err := CertTemplate("go-rest development CA", 365*24*time.Hour)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// describe what the certificate will be used for
+	tmpl.IsCA = true
+	tmpl.MaxPathLenZero = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 
-    // describe what the certificate will be used for
-    rootCertTmpl.IsCA = true
-    rootCertTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
-    rootCertTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
-    rootCertTmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	certFile, keyFile := filepath.Join(dir, devCAFile), filepath.Join(dir, devCAKeyFile)
+	if err := writeCertKeyPEM(certFile, keyFile, tmpl, tmpl, key, key); err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return ca, err
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	return ca, err
+}
 
-    //Create roote certificate and write to cert.pem file
-    if CreateCert(rootCertTmpl, rootCertTmpl, &rootKey.PublicKey, rootKey) != nil {
-        log.Fatalf("error creating cert: %v", err)
-    }
+// writeCertKeyPEM signs template with parentKey and writes the certificate
+// and key as PEM, the key readable by the owner only
+func writeCertKeyPEM(certFile, keyFile string, template, parent *x509.Certificate,
+	key *ecdsa.PrivateKey, parentKey interface{}) error {
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
 
-    keyOut, err := os.OpenFile("key.pem", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-    if err != nil {
-        log.Print("failed to open key.pem for writing:", err)
-        return
-    }
-    // pem.Encode(keyOut, pemBlockForKey(rootKey))
-    pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rootKey), })
-    keyOut.Close()
-}
\ No newline at end of file
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(
+		&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(
+		&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+}
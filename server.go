@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Server holds the dependencies shared by the request handlers
+type Server struct {
+	Patients      PatientStore
+	Appointments  AppointmentStore
+	Doctors       DoctorStore
+	Users         UserStore
+	Prescriptions PrescriptionStore
+	Notifications NotificationStore
+	Documents     DocumentStore
+	Sessions      SessionStore
+	Health        HealthStore
+	RefreshTokens RefreshTokenStore
+	LoginAttempts LoginAttemptStore
+	// LoginChallenges and TwoFactor hold the TOTP second login step
+	LoginChallenges LoginChallengeStore
+	TwoFactor       TwoFactorStore
+	PasswordResets  PasswordResetStore
+	DoctorInvites   DoctorInviteStore
+	OIDCIdentities  OIDCIdentityStore
+	APIKeys         APIKeyStore
+	// AuditTrail records every request, appended through Audit
+	AuditTrail AuditStore
+	auditMu    sync.Mutex
+	// auditHead is the newest event known to this instance, read from
+	// AuditTrail when nil
+	auditHead *AuditEvent
+
+	// AllowedOrigins are the CORS origins answered, "*" allows any
+	AllowedOrigins []string
+	// MaxUploadSize is the largest accepted document upload in bytes
+	MaxUploadSize int64
+	// Session configures login sessions and their cookie
+	Session SessionConfig
+	// Login configures the throttling of failed logins
+	Login LoginConfig
+	// TOTP configures two-factor authentication
+	TOTP TOTPConfig
+	// Password configures the password policy, hashing and resets
+	Password PasswordConfig
+	// BreachedPasswords may not be chosen as passwords
+	BreachedPasswords BreachedPasswords
+	// Mail sends the password reset emails
+	Mail Mailer
+	// InviteTTL is how long an invitation code of a doctor may be used
+	InviteTTL time.Duration
+	// APIKeyMaxTTL is the longest lifetime of an API key
+	APIKeyMaxTTL time.Duration
+	// OIDC signs users in through an OpenID Connect provider, nil when
+	// single sign-on is not enabled
+	OIDC *OIDCProvider
+	// Tokens issues the JWT access tokens of bearer clients, nil when they
+	// are not enabled
+	Tokens *TokenIssuer
+	// Started is when the service started, reported by /status
+	Started time.Time
+}
+
+// NewServer returns a Server backed entirely by store, using the default
+// CORS, upload, session, login, TOTP, password, invite and API key
+// settings, logging email instead of sending it
+func NewServer(store Store) *Server {
+	defaults := DefaultConfig()
+	return &Server{
+		Patients:        store,
+		Appointments:    store,
+		Doctors:         store,
+		Users:           store,
+		Prescriptions:   store,
+		Notifications:   store,
+		Documents:       store,
+		Sessions:        store,
+		Health:          store,
+		RefreshTokens:   store,
+		LoginAttempts:   store,
+		LoginChallenges: store,
+		TwoFactor:       store,
+		PasswordResets:  store,
+		DoctorInvites:   store,
+		OIDCIdentities:  store,
+		APIKeys:         store,
+		AuditTrail:      store,
+
+		AllowedOrigins: defaults.CORSOrigins,
+		MaxUploadSize:  defaults.MaxUploadSize,
+		Session:        defaults.Session,
+		Login:          defaults.Login,
+		TOTP:           defaults.TOTP,
+		Password:       defaults.Password,
+		Mail:           LogMailer{},
+		InviteTTL:      defaults.InviteTTL,
+		APIKeyMaxTTL:   defaults.APIKeyMaxTTL,
+		Started:        time.Now(),
+	}
+}
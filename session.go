@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// sessionCookie is the cookie holding the session token
+const sessionCookie = "session"
+
+// rotationGrace is how long a rotated session stays valid, for requests the
+// client sent before it received the new cookie
+const rotationGrace = time.Minute
+
+// Session is a sessions table entry. Only the SHA-256 of the token handed to
+// the client is stored, so the table cannot be used to impersonate users.
+type Session struct {
+	TokenHash string
+	UserUUID  gocql.UUID
+	Role      string
+	Name      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// Rotated is set once the session has been replaced by a new one
+	Rotated bool
+	// TwoFactor is set when the login passed a second factor
+	TwoFactor bool
+}
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserUUID gocql.UUID
+	Role     string
+	Name     string
+	// SessionTokenHash identifies the session used, if any
+	SessionTokenHash string
+	// TwoFactor is set when the login passed a second factor
+	TwoFactor bool
+	// APIKey is set for machine clients, UserUUID then being the key's
+	// UUID and Scopes what it was granted
+	APIKey bool
+	Scopes []string
+}
+
+type principalKey struct{}
+
+// principalFrom returns the caller stored by Authenticate
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// withPrincipal returns r carrying p as its authenticated caller
+func withPrincipal(r *http.Request, p Principal) *http.Request {
+	setRequestUser(r, p.UserUUID.String())
+	setAuditActor(r, p)
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// hashToken returns the stored form of a session token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns 256 random bits, base64url encoded
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// newToken returns a random token for user lasting ttl, with the entry to
+// store for it
+func newToken(user UserAccount, ttl time.Duration) (Session, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	now := time.Now()
+	return Session{TokenHash: hashToken(token), UserUUID: user.UserUUID, Role: user.Role,
+		Name: user.Name, CreatedAt: now, ExpiresAt: now.Add(ttl)}, token, nil
+}
+
+// newSession creates a session for user lasting the configured TTL and
+// returns it with its token
+func (s *Server) newSession(user UserAccount, twoFactor bool) (Session, string, error) {
+	session, token, err := newToken(user, s.Session.TTL)
+	if err != nil {
+		return Session{}, "", err
+	}
+	session.TwoFactor = twoFactor
+	if err := s.Sessions.CreateSession(session); err != nil {
+		return Session{}, "", err
+	}
+	return session, token, nil
+}
+
+// startSession logs user in, sending the new session token in a cookie
+func (s *Server) startSession(w http.ResponseWriter, user UserAccount, twoFactor bool) error {
+	session, token, err := s.newSession(user, twoFactor)
+	if err != nil {
+		return err
+	}
+	s.setSessionCookie(w, token, session.ExpiresAt)
+	return nil
+}
+
+func (s *Server) setSessionCookie(w http.ResponseWriter, token string, expires time.Time) {
+	sameSite := http.SameSiteStrictMode
+	if s.Session.CookieSameSite == "lax" {
+		sameSite = http.SameSiteLaxMode
+	}
+	maxAge := int(time.Until(expires).Seconds())
+	if token == "" {
+		// tells the browser to delete the cookie
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.Session.CookieSecure,
+		SameSite: sameSite,
+	})
+}
+
+// Authenticate serves inner only to callers with a valid API key, bearer
+// token or session cookie, answering 401 Unauthorized otherwise, unless optional is
+// set in which case callers without credentials are served anonymously.
+// Sessions older than RotateAfter are replaced by a new one sent back in the
+// cookie; the old token keeps working for rotationGrace.
+func (s *Server) Authenticate(inner http.Handler, optional bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, ok := apiKeyHeader(r); ok {
+			s.authenticateAPIKey(inner, w, r, key)
+			return
+		}
+		if token, ok := bearerToken(r); ok {
+			s.authenticateBearer(inner, w, r, token)
+			return
+		}
+
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil || cookie.Value == "" {
+			if optional {
+				inner.ServeHTTP(w, r)
+				return
+			}
+			s.writeStatus(w, r, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		session, err := s.Sessions.GetSession(hashToken(cookie.Value))
+		if err == ErrNotFound {
+			s.setSessionCookie(w, "", time.Time{})
+			if optional {
+				inner.ServeHTTP(w, r)
+				return
+			}
+			s.writeStatus(w, r, http.StatusUnauthorized, "Session expired or revoked")
+			return
+		}
+		if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+
+		if !session.Rotated && time.Since(session.CreatedAt) >= s.Session.RotateAfter {
+			if session, err = s.rotateSession(w, session); err != nil {
+				requestLogger(r).Error("Unable to rotate session", "error", err)
+			}
+		}
+
+		inner.ServeHTTP(w, withPrincipal(r, Principal{UserUUID: session.UserUUID,
+			Role: session.Role, Name: session.Name, SessionTokenHash: session.TokenHash,
+			TwoFactor: session.TwoFactor}))
+	})
+}
+
+// authenticateBearer serves inner to the caller of a valid access token.
+// Invalid tokens are refused even on optional routes, as the client
+// expects to be authenticated.
+func (s *Server) authenticateBearer(inner http.Handler, w http.ResponseWriter, r *http.Request, token string) {
+	if s.Tokens == nil {
+		s.writeStatus(w, r, http.StatusUnauthorized, "Bearer tokens are not enabled")
+		return
+	}
+	refuse := func(reason interface{}) {
+		requestLogger(r).Info("Invalid bearer token", "error", reason)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		s.writeStatus(w, r, http.StatusUnauthorized, "Invalid or expired bearer token")
+	}
+	principal, err := s.Tokens.Verify(token)
+	if err != nil {
+		refuse(err)
+		return
+	}
+	// tokens are self-contained, the account is checked so that disabling,
+	// deleting or changing the role of a user takes effect before they expire
+	user, err := s.Users.GetUserByUUID(principal.UserUUID)
+	if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
+	if err == ErrNotFound || user.Disabled || user.Role != principal.Role {
+		refuse("account deleted, disabled or of another role")
+		return
+	}
+	inner.ServeHTTP(w, withPrincipal(r, principal))
+}
+
+// rotateSession replaces old by a new session, returning the one to use for
+// the current request
+func (s *Server) rotateSession(w http.ResponseWriter, old Session) (Session, error) {
+	session, token, err := s.newSession(UserAccount{UserUUID: old.UserUUID, Role: old.Role,
+		Name: old.Name}, old.TwoFactor)
+	if err != nil {
+		return old, err
+	}
+	old.Rotated = true
+	if grace := time.Now().Add(rotationGrace); grace.Before(old.ExpiresAt) {
+		old.ExpiresAt = grace
+	}
+	if err := s.Sessions.CreateSession(old); err != nil {
+		// the old session is still fully valid, forget the new one
+		s.Sessions.DeleteSession(session.TokenHash)
+		return old, err
+	}
+	s.setSessionCookie(w, token, session.ExpiresAt)
+	return session, nil
+}
+
+// signOutUser revokes every session, refresh token and pending password
+// reset of the user. Access tokens already issued stay valid until they
+// expire.
+func (s *Server) signOutUser(userUUID gocql.UUID) error {
+	if err := s.Sessions.DeleteUserSessions(userUUID); err != nil {
+		return err
+	}
+	if err := s.RefreshTokens.DeleteUserRefreshTokens(userUUID); err != nil {
+		return err
+	}
+	return s.PasswordResets.DeleteUserPasswordResets(userUUID)
+}
+
+/*
+Ends the session of the caller. Bearer clients pass their refreshToken in
+the form to revoke it.
+Method: POST
+Endpoint: /logout
+*/
+func (s *Server) UserLogout(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFrom(r.Context())
+	if err := s.Sessions.DeleteSession(principal.SessionTokenHash); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if refreshToken := r.FormValue("refreshToken"); refreshToken != "" {
+		if err := s.RefreshTokens.DeleteRefreshToken(hashToken(refreshToken)); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+	}
+	requestLogger(r).Info("Logged out", "userID", principal.UserUUID)
+	s.setSessionCookie(w, "", time.Time{})
+	s.writeStatus(w, r, http.StatusOK, "Logged out")
+}
+
+/*
+Revokes every session and refresh token of the caller, logging them out on
+all devices. Access tokens already issued stay valid until they expire.
+Method: DELETE
+Endpoint: /sessions
+*/
+func (s *Server) SessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFrom(r.Context())
+	if err := s.Sessions.DeleteUserSessions(principal.UserUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.RefreshTokens.DeleteUserRefreshTokens(principal.UserUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	requestLogger(r).Info("Revoked all sessions", "userID", principal.UserUUID)
+	s.setSessionCookie(w, "", time.Time{})
+	s.writeStatus(w, r, http.StatusOK, "All sessions revoked")
+}
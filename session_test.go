@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// login signs up a patient user and logs in, returning the session cookie
+func login(t *testing.T, s *Server) *http.Cookie {
+	s.Patients.CreatePatient(Patient{PatientUUID: testUser.UserUUID, Name: "Kelly Lai", MedicalNumber: "42"})
+	serveServer(s, testUser, httptest.NewRequest("POST", "/users", strings.NewReader(
+		`{"username": "kelly", "password": "correct horse", "role": "Patient", "verificationKey": "42"}`)))
+
+	req := httptest.NewRequest("POST", "/login",
+		strings.NewReader(url.Values{"username": {"kelly"}, "password": {"correct horse"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	NewRouter(s).ServeHTTP(rec, req)
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	t.Fatalf("login returned no session cookie: %d %v", rec.Code, rec.Header())
+	return nil
+}
+
+// serveAs sends req through the router of s with the session cookie
+func serveAs(s *Server, cookie *http.Cookie, req *http.Request) *httptest.ResponseRecorder {
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	NewRouter(s).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSessionAuthentication(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "emr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	s := NewServer(store)
+	cookie := login(t, s)
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("session cookie is missing security attributes: %+v", cookie)
+	}
+
+	if rec := serveAs(s, nil, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("request without a session: got %d, want 401", rec.Code)
+	}
+	forged := &http.Cookie{Name: sessionCookie, Value: "test"}
+	if rec := serveAs(s, forged, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("request with a forged session: got %d, want 401", rec.Code)
+	}
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusOK {
+		t.Errorf("request with a session: got %d, want 200", rec.Code)
+	}
+
+	// preflight requests carry no cookies
+	if rec := serveAs(s, nil, httptest.NewRequest("OPTIONS", "/doctors", nil)); rec.Code != http.StatusOK {
+		t.Errorf("preflight: got %d, want 200", rec.Code)
+	}
+
+	if rec := serveAs(s, cookie, httptest.NewRequest("POST", "/logout", nil)); rec.Code != http.StatusOK {
+		t.Errorf("logout: got %d, want 200", rec.Code)
+	}
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("request after logout: got %d, want 401", rec.Code)
+	}
+}
+
+func TestUserCreateSession(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	_, token, err := s.newSession(testAdmin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &http.Cookie{Name: sessionCookie, Value: token}
+
+	rec := serveAs(s, admin, httptest.NewRequest("POST", "/users", strings.NewReader(
+		`{"username": "root2", "password": "correct horse", "role": "Admin"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("admin creating an account: got %d, want 201: %s", rec.Code, rec.Body)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("admin creating an account got session cookies %v", cookies)
+	}
+	if rec := serveAs(s, admin, httptest.NewRequest("GET", "/apikeys", nil)); rec.Code != http.StatusOK {
+		t.Errorf("admin session after creating an account: got %d, want 200", rec.Code)
+	}
+
+	// self-signup logs the new user in
+	s.Patients.CreatePatient(Patient{PatientUUID: testUser.UserUUID, Name: "Kelly Lai", MedicalNumber: "42"})
+	rec = serveAs(s, nil, httptest.NewRequest("POST", "/users", strings.NewReader(
+		`{"username": "kelly", "password": "correct horse", "role": "Patient", "verificationKey": "42"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("self-signup: got %d, want 201: %s", rec.Code, rec.Body)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Errorf("self-signup got cookies %v, want a session cookie", cookies)
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	s.Session.RotateAfter = time.Nanosecond
+	cookie := login(t, s)
+
+	rec := serveAs(s, cookie, httptest.NewRequest("GET", "/doctors", nil))
+	var rotated *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookie {
+			rotated = c
+		}
+	}
+	if rec.Code != http.StatusOK || rotated == nil || rotated.Value == cookie.Value {
+		t.Fatalf("expected the session to be rotated, got %d %v", rec.Code, rec.Header())
+	}
+
+	// the old token keeps working for a grace period, without rotating again
+	rec = serveAs(s, cookie, httptest.NewRequest("GET", "/doctors", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Set-Cookie") != "" {
+		t.Errorf("old session during grace period: got %d %v", rec.Code, rec.Header())
+	}
+	old, err := s.Sessions.GetSession(hashToken(cookie.Value))
+	if err != nil || time.Until(old.ExpiresAt) > rotationGrace {
+		t.Errorf("old session not cut short: %+v %v", old, err)
+	}
+
+	// revoking all sessions logs out the rotated one too
+	if rec := serveAs(s, rotated, httptest.NewRequest("DELETE", "/sessions", nil)); rec.Code != http.StatusOK {
+		t.Errorf("revoke sessions: got %d", rec.Code)
+	}
+	for _, c := range []*http.Cookie{cookie, rotated} {
+		if rec := serveAs(s, c, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+			t.Errorf("request after revocation: got %d, want 401", rec.Code)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateSession(Session{TokenHash: hashToken("expired"), UserUUID: testUser.UserUUID,
+		CreatedAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(-time.Second)})
+	rec := serveAs(NewServer(store), &http.Cookie{Name: sessionCookie, Value: "expired"},
+		httptest.NewRequest("GET", "/doctors", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired session: got %d, want 401", rec.Code)
+	}
+}
+
+func TestAllowOriginCredentials(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	login(t, s)
+	for _, test := range []struct {
+		allowed     []string
+		origin      string
+		credentials string
+	}{
+		{[]string{"https://emr.example.com"}, "https://emr.example.com", "true"},
+		{[]string{"https://emr.example.com"}, "https://evil.example.com", ""},
+		{[]string{"*"}, "https://evil.example.com", ""},
+	} {
+		s.AllowedOrigins = test.allowed
+		req := httptest.NewRequest("POST", "/login",
+			strings.NewReader(url.Values{"username": {"kelly"}, "password": {"correct horse"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", test.origin)
+		rec := serveAs(s, nil, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("login: got %d, want 200", rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != test.credentials {
+			t.Errorf("%v with origin %s: got credentials %q, want %q",
+				test.allowed, test.origin, got, test.credentials)
+		}
+	}
+}
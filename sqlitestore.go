@@ -0,0 +1,1156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations are applied in order and recorded in schema_migrations.
+// Never edit a released migration, append a new one instead.
+var sqliteMigrations = []string{
+	// 0001: tables and indexes equivalent to the Cassandra migration 0001
+	`CREATE TABLE patients (
+		patientUUID TEXT PRIMARY KEY,
+		dateOfBirth INTEGER NOT NULL DEFAULT 0,
+		gender TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		medicalNumber TEXT NOT NULL DEFAULT '',
+		bloodType TEXT NOT NULL DEFAULT '',
+		emergencyContact TEXT NOT NULL DEFAULT '',
+		phone TEXT NOT NULL DEFAULT '',
+		address TEXT NOT NULL DEFAULT '',
+		notes TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX patientsMedicalNumber ON patients (medicalNumber);
+
+	CREATE TABLE completedAppointments (
+		appointmentUUID TEXT PRIMARY KEY,
+		patientUUID TEXT NOT NULL,
+		doctorUUID TEXT NOT NULL,
+		dateVisited INTEGER NOT NULL DEFAULT 0,
+		breathingRate INTEGER NOT NULL DEFAULT 0,
+		heartRate INTEGER NOT NULL DEFAULT 0,
+		bloodOxygenLevel INTEGER NOT NULL DEFAULT 0,
+		bloodPressure INTEGER NOT NULL DEFAULT 0,
+		notes TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX completedAppointmentPatientUUID ON completedAppointments (patientUUID);
+	CREATE INDEX completedAppointmentDoctorUUID ON completedAppointments (doctorUUID);
+	CREATE INDEX completedAppointmentDateVisited ON completedAppointments (dateVisited);
+
+	CREATE TABLE futureAppointments (
+		appointmentUUID TEXT PRIMARY KEY,
+		patientUUID TEXT NOT NULL,
+		doctorUUID TEXT NOT NULL,
+		dateScheduled INTEGER NOT NULL DEFAULT 0,
+		notes TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX futureAppointmentPatientUUID ON futureAppointments (patientUUID);
+	CREATE INDEX futureAppointmentDoctorUUID ON futureAppointments (doctorUUID);
+	CREATE INDEX futureAppointmentDateScheduled ON futureAppointments (dateScheduled);
+
+	CREATE TABLE doctors (
+		doctorUUID TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		phone TEXT NOT NULL DEFAULT '',
+		primaryFacility TEXT NOT NULL DEFAULT '',
+		primarySpecialty TEXT NOT NULL DEFAULT '',
+		gender TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE users (
+		username TEXT PRIMARY KEY,
+		salt BLOB,
+		saltedHash BLOB,
+		userUUID TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX usersUserUUID ON users (userUUID);
+
+	CREATE TABLE prescriptions (
+		patientUUID TEXT NOT NULL,
+		prescriptionUUID TEXT NOT NULL,
+		doctorUUID TEXT NOT NULL,
+		doctorName TEXT NOT NULL DEFAULT '',
+		drug TEXT NOT NULL DEFAULT '',
+		startDate INTEGER NOT NULL DEFAULT 0,
+		endDate INTEGER NOT NULL DEFAULT 0,
+		instructions TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (patientUUID, endDate, prescriptionUUID)
+	);
+
+	CREATE TABLE notifications (
+		dateCreated INTEGER NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		notificationUUID TEXT NOT NULL,
+		receiverUUID TEXT NOT NULL,
+		senderName TEXT NOT NULL DEFAULT '',
+		senderUUID TEXT NOT NULL,
+		PRIMARY KEY (receiverUUID, dateCreated, notificationUUID)
+	);
+
+	CREATE TABLE documents (
+		documentUUID TEXT PRIMARY KEY,
+		patientUUID TEXT NOT NULL,
+		filename TEXT NOT NULL DEFAULT '',
+		content BLOB,
+		dateUploaded INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX documentsPatientUUID ON documents (patientUUID);`,
+
+	// 0002: written by the readiness check of each service instance
+	`CREATE TABLE healthChecks (
+		instance TEXT PRIMARY KEY,
+		checkedAt INTEGER NOT NULL
+	);`,
+
+	// 0003: server-side login sessions, keyed by the SHA-256 of their token
+	`CREATE TABLE sessions (
+		tokenHash TEXT PRIMARY KEY,
+		userUUID TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		createdAt INTEGER NOT NULL,
+		expiresAt INTEGER NOT NULL,
+		rotated INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX sessionsUserUUID ON sessions (userUUID);`,
+
+	// 0004: refresh tokens of bearer token clients, shaped like sessions
+	`CREATE TABLE refreshTokens (
+		tokenHash TEXT PRIMARY KEY,
+		userUUID TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		createdAt INTEGER NOT NULL,
+		expiresAt INTEGER NOT NULL,
+		rotated INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX refreshTokensUserUUID ON refreshTokens (userUUID);`,
+
+	// 0005: failed logins per account and client IP
+	`CREATE TABLE loginAttempts (
+		attemptKey TEXT PRIMARY KEY,
+		failures INTEGER NOT NULL,
+		lastFailure INTEGER NOT NULL,
+		lockedUntil INTEGER NOT NULL,
+		expiresAt INTEGER NOT NULL
+	);`,
+
+	// 0006 and 0007: whether a session or refresh token passed a second
+	// factor, one migration per table as in Cassandra
+	`ALTER TABLE sessions ADD COLUMN twoFactor INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE refreshTokens ADD COLUMN twoFactor INTEGER NOT NULL DEFAULT 0;`,
+
+	// 0008: TOTP enrollments, their hashed recovery codes, and the logins
+	// waiting for a TOTP code, shaped like sessions
+	`CREATE TABLE twoFactor (
+		userUUID TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled INTEGER NOT NULL DEFAULT 0,
+		lastCounter INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE recoveryCodes (
+		userUUID TEXT NOT NULL,
+		codeID INTEGER NOT NULL,
+		salt BLOB,
+		saltedHash BLOB,
+		PRIMARY KEY (userUUID, codeID)
+	);
+	CREATE TABLE loginChallenges (
+		tokenHash TEXT PRIMARY KEY,
+		userUUID TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		createdAt INTEGER NOT NULL,
+		expiresAt INTEGER NOT NULL,
+		rotated INTEGER NOT NULL DEFAULT 0,
+		twoFactor INTEGER NOT NULL DEFAULT 0
+	);`,
+
+	// 0009: email address of users, for password resets
+	`ALTER TABLE users ADD COLUMN email TEXT NOT NULL DEFAULT '';`,
+
+	// 0010: emailed password reset tokens, shaped like sessions
+	`CREATE TABLE passwordResets (
+		tokenHash TEXT PRIMARY KEY,
+		userUUID TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		createdAt INTEGER NOT NULL,
+		expiresAt INTEGER NOT NULL,
+		rotated INTEGER NOT NULL DEFAULT 0,
+		twoFactor INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX passwordResetsUserUUID ON passwordResets (userUUID);`,
+
+	// 0011: invitation codes of doctors, shaped like sessions with the
+	// doctorUUID as userUUID
+	`CREATE TABLE doctorInvites (
+		tokenHash TEXT PRIMARY KEY,
+		userUUID TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		createdAt INTEGER NOT NULL,
+		expiresAt INTEGER NOT NULL,
+		rotated INTEGER NOT NULL DEFAULT 0,
+		twoFactor INTEGER NOT NULL DEFAULT 0
+	);`,
+
+	// 0012: users signing in through OpenID Connect providers
+	`CREATE TABLE oidcIdentities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		userUUID TEXT NOT NULL,
+		PRIMARY KEY (issuer, subject)
+	);`,
+
+	// 0013: API keys of machine clients, times in Unix seconds with 0 for
+	// unset
+	`CREATE TABLE apiKeys (
+		keyUUID TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		secretHash TEXT NOT NULL,
+		createdBy TEXT NOT NULL,
+		createdAt INTEGER NOT NULL,
+		expiresAt INTEGER NOT NULL,
+		lastUsedAt INTEGER NOT NULL DEFAULT 0,
+		revokedAt INTEGER NOT NULL DEFAULT 0
+	);`,
+
+	// 0014: accounts disabled by an admin
+	`ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0;`,
+
+	// 0015: hash-chained audit trail of every request, occurredAt in Unix
+	// milliseconds; the triggers keep it append-only
+	`CREATE TABLE auditEvents (
+		seq INTEGER PRIMARY KEY,
+		occurredAt INTEGER NOT NULL,
+		actorUUID TEXT NOT NULL,
+		actorRole TEXT NOT NULL,
+		action TEXT NOT NULL,
+		resourceType TEXT NOT NULL,
+		resourceUUID TEXT NOT NULL,
+		patientUUID TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		sourceIP TEXT NOT NULL,
+		requestID TEXT NOT NULL,
+		prevHash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	);
+	CREATE INDEX auditEventsPatientUUID ON auditEvents (patientUUID, seq);
+	CREATE INDEX auditEventsActorUUID ON auditEvents (actorUUID, seq);
+	CREATE TRIGGER auditEventsNoUpdate BEFORE UPDATE ON auditEvents
+	BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END;
+	CREATE TRIGGER auditEventsNoDelete BEFORE DELETE ON auditEvents
+	BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END;`,
+
+	// 0016: audit events by time, for queries by date range only
+	`CREATE INDEX auditEventsOccurredAt ON auditEvents (occurredAt);`,
+
+	// 0017: nothing, appends are ordered by the seq primary key here, not by
+	// the Cassandra auditHead
+	`SELECT 1;`,
+}
+
+// SQLStore implements Store on an embedded SQLite database file
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (creating if needed) the database at path and brings
+// its schema up to date
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	s, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := MigrateUp(s, false, log.Printf); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openSQLite opens the database at path without touching its schema
+func openSQLite(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, serialise access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Migrations() []string {
+	return sqliteMigrations
+}
+
+func (s *SQLStore) AppliedMigrations() (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+	var tables int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&tables); err != nil || tables == 0 {
+		return applied, err
+	}
+
+	rows, err := s.db.Query(`SELECT version, appliedAt FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(appliedAt, 0)
+	}
+	return applied, rows.Err()
+}
+
+// ApplyMigration runs the migration and records it in a single transaction
+func (s *SQLStore) ApplyMigration(version int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		appliedAt INTEGER NOT NULL)`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(sqliteMigrations[version-1]); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, appliedAt) VALUES (?, ?)`,
+		version, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) Close() {
+	s.db.Close()
+}
+
+func (s *SQLStore) SchemaVersion() (applied, expected int, err error) {
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied)
+	return applied, len(sqliteMigrations), err
+}
+
+func (s *SQLStore) CheckWritable(instance string) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO healthChecks (instance, checkedAt) VALUES (?, ?)`,
+		instance, time.Now().Unix())
+	return err
+}
+
+// uuidCol scans a TEXT column into a gocql.UUID
+type uuidCol struct {
+	u *gocql.UUID
+}
+
+func (c uuidCol) Scan(src interface{}) error {
+	var text string
+	switch v := src.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into UUID", src)
+	}
+	u, err := gocql.ParseUUID(text)
+	if err != nil {
+		return err
+	}
+	*c.u = u
+	return nil
+}
+
+// sqlNotFound maps a missing row to ErrNotFound
+func sqlNotFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// affected returns ErrNotFound if res changed no rows
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const patientColumns = `patientUUID, address, bloodType, dateOfBirth, emergencyContact,
+	gender, medicalNumber, name, notes, phone`
+
+func scanPatient(row interface{ Scan(...interface{}) error }, p *Patient) error {
+	return row.Scan(uuidCol{&p.PatientUUID}, &p.Address, &p.BloodType, &p.DateOfBirth,
+		&p.EmergencyContact, &p.Gender, &p.MedicalNumber, &p.Name, &p.Notes, &p.Phone)
+}
+
+func (s *SQLStore) CreatePatient(p Patient) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO patients (`+patientColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.PatientUUID.String(), p.Address, p.BloodType, p.DateOfBirth, p.EmergencyContact,
+		p.Gender, p.MedicalNumber, p.Name, p.Notes, p.Phone)
+	return err
+}
+
+func (s *SQLStore) GetPatient(patientUUID gocql.UUID) (Patient, error) {
+	var p Patient
+	err := scanPatient(s.db.QueryRow(`SELECT `+patientColumns+` FROM patients
+		WHERE patientUUID = ?`, patientUUID.String()), &p)
+	return p, sqlNotFound(err)
+}
+
+func (s *SQLStore) GetPatientByMedicalNumber(medicalNumber string) (Patient, error) {
+	var p Patient
+	err := scanPatient(s.db.QueryRow(`SELECT `+patientColumns+` FROM patients
+		WHERE medicalNumber = ? ORDER BY patientUUID LIMIT 1`, medicalNumber), &p)
+	return p, sqlNotFound(err)
+}
+
+func (s *SQLStore) ListPatients() (Patients, error) {
+	rows, err := s.db.Query(`SELECT ` + patientColumns + ` FROM patients ORDER BY patientUUID`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	patientList := Patients{}
+	for rows.Next() {
+		var p Patient
+		if err := scanPatient(rows, &p); err != nil {
+			return nil, err
+		}
+		patientList = append(patientList, p)
+	}
+	return patientList, rows.Err()
+}
+
+func (s *SQLStore) UpdatePatient(p Patient) error {
+	return affected(s.db.Exec(`UPDATE patients SET address = ?, bloodType = ?, dateOfBirth = ?,
+		emergencyContact = ?, gender = ?, medicalNumber = ?, name = ?, notes = ?, phone = ?
+		WHERE patientUUID = ?`,
+		p.Address, p.BloodType, p.DateOfBirth, p.EmergencyContact, p.Gender, p.MedicalNumber,
+		p.Name, p.Notes, p.Phone, p.PatientUUID.String()))
+}
+
+const futureAppointmentColumns = `appointmentUUID, patientUUID, doctorUUID, dateScheduled, notes`
+
+func scanFutureAppointment(row interface{ Scan(...interface{}) error }, a *FutureAppointment) error {
+	return row.Scan(uuidCol{&a.AppointmentUUID}, uuidCol{&a.PatientUUID},
+		uuidCol{&a.DoctorUUID}, &a.DateScheduled, &a.Notes)
+}
+
+func (s *SQLStore) CreateFutureAppointment(a FutureAppointment) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO futureAppointments (`+futureAppointmentColumns+`)
+		VALUES (?, ?, ?, ?, ?)`, a.AppointmentUUID.String(), a.PatientUUID.String(),
+		a.DoctorUUID.String(), a.DateScheduled, a.Notes)
+	return err
+}
+
+func (s *SQLStore) GetFutureAppointment(appointmentUUID gocql.UUID) (FutureAppointment, error) {
+	var a FutureAppointment
+	err := scanFutureAppointment(s.db.QueryRow(`SELECT `+futureAppointmentColumns+`
+		FROM futureAppointments WHERE appointmentUUID = ?`, appointmentUUID.String()), &a)
+	return a, sqlNotFound(err)
+}
+
+func (s *SQLStore) DeleteFutureAppointment(appointmentUUID gocql.UUID) error {
+	return affected(s.db.Exec(`DELETE FROM futureAppointments WHERE appointmentUUID = ?`,
+		appointmentUUID.String()))
+}
+
+func (s *SQLStore) futureAppointments(where string, arg string) (FutureAppointments, error) {
+	rows, err := s.db.Query(`SELECT `+futureAppointmentColumns+` FROM futureAppointments
+		WHERE `+where+` = ? ORDER BY appointmentUUID`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appointmentList := FutureAppointments{}
+	for rows.Next() {
+		var a FutureAppointment
+		if err := scanFutureAppointment(rows, &a); err != nil {
+			return nil, err
+		}
+		appointmentList = append(appointmentList, a)
+	}
+	return appointmentList, rows.Err()
+}
+
+func (s *SQLStore) FutureAppointmentsByPatient(patientUUID gocql.UUID) (FutureAppointments, error) {
+	return s.futureAppointments("patientUUID", patientUUID.String())
+}
+
+func (s *SQLStore) FutureAppointmentsByDoctor(doctorUUID gocql.UUID) (FutureAppointments, error) {
+	return s.futureAppointments("doctorUUID", doctorUUID.String())
+}
+
+const completedAppointmentColumns = `appointmentUUID, patientUUID, doctorUUID, dateVisited,
+	breathingRate, heartRate, bloodOxygenLevel, bloodPressure, notes`
+
+func scanCompletedAppointment(row interface{ Scan(...interface{}) error }, a *CompletedAppointment) error {
+	return row.Scan(uuidCol{&a.AppointmentUUID}, uuidCol{&a.PatientUUID},
+		uuidCol{&a.DoctorUUID}, &a.DateVisited, &a.BreathingRate, &a.HeartRate,
+		&a.BloodOxygenLevel, &a.BloodPressure, &a.Notes)
+}
+
+func (s *SQLStore) CompleteAppointment(a CompletedAppointment) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM futureAppointments WHERE appointmentUUID = ?`,
+		a.AppointmentUUID.String()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// update appointment entry, create entry if does not exist
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO completedAppointments (`+completedAppointmentColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, a.AppointmentUUID.String(), a.PatientUUID.String(),
+		a.DoctorUUID.String(), a.DateVisited, a.BreathingRate, a.HeartRate, a.BloodOxygenLevel,
+		a.BloodPressure, a.Notes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetCompletedAppointment(appointmentUUID gocql.UUID) (CompletedAppointment, error) {
+	var a CompletedAppointment
+	err := scanCompletedAppointment(s.db.QueryRow(`SELECT `+completedAppointmentColumns+`
+		FROM completedAppointments WHERE appointmentUUID = ?`, appointmentUUID.String()), &a)
+	return a, sqlNotFound(err)
+}
+
+func (s *SQLStore) completedAppointments(where string, arg string) (CompletedAppointments, error) {
+	rows, err := s.db.Query(`SELECT `+completedAppointmentColumns+` FROM completedAppointments
+		WHERE `+where+` = ? ORDER BY appointmentUUID`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appointmentList := CompletedAppointments{}
+	for rows.Next() {
+		var a CompletedAppointment
+		if err := scanCompletedAppointment(rows, &a); err != nil {
+			return nil, err
+		}
+		appointmentList = append(appointmentList, a)
+	}
+	return appointmentList, rows.Err()
+}
+
+func (s *SQLStore) CompletedAppointmentsByPatient(patientUUID gocql.UUID) (CompletedAppointments, error) {
+	return s.completedAppointments("patientUUID", patientUUID.String())
+}
+
+func (s *SQLStore) CompletedAppointmentsByDoctor(doctorUUID gocql.UUID) (CompletedAppointments, error) {
+	return s.completedAppointments("doctorUUID", doctorUUID.String())
+}
+
+const doctorColumns = `doctorUUID, name, phone, primaryFacility, primarySpecialty, gender`
+
+func scanDoctor(row interface{ Scan(...interface{}) error }, d *Doctor) error {
+	return row.Scan(uuidCol{&d.DoctorUUID}, &d.Name, &d.Phone, &d.PrimaryFacility,
+		&d.PrimarySpecialty, &d.Gender)
+}
+
+func (s *SQLStore) CreateDoctor(d Doctor) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO doctors (`+doctorColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?)`, d.DoctorUUID.String(), d.Name, d.Phone,
+		d.PrimaryFacility, d.PrimarySpecialty, d.Gender)
+	return err
+}
+
+func (s *SQLStore) GetDoctor(doctorUUID gocql.UUID) (Doctor, error) {
+	var d Doctor
+	err := scanDoctor(s.db.QueryRow(`SELECT `+doctorColumns+` FROM doctors
+		WHERE doctorUUID = ?`, doctorUUID.String()), &d)
+	return d, sqlNotFound(err)
+}
+
+func (s *SQLStore) ListDoctors() ([]Doctor, error) {
+	rows, err := s.db.Query(`SELECT ` + doctorColumns + ` FROM doctors ORDER BY doctorUUID`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	doctorList := []Doctor{}
+	for rows.Next() {
+		var d Doctor
+		if err := scanDoctor(rows, &d); err != nil {
+			return nil, err
+		}
+		doctorList = append(doctorList, d)
+	}
+	return doctorList, rows.Err()
+}
+
+const userColumns = `username, salt, saltedHash, userUUID, role, name, email, disabled`
+
+func scanUser(row interface{ Scan(...interface{}) error }, u *UserAccount) error {
+	return row.Scan(&u.Username, &u.Salt, &u.SaltedHash, uuidCol{&u.UserUUID}, &u.Role, &u.Name,
+		&u.Email, &u.Disabled)
+}
+
+func (s *SQLStore) CreateUser(u UserAccount) error {
+	err := affected(s.db.Exec(`INSERT OR IGNORE INTO users (`+userColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, u.Username, u.Salt, u.SaltedHash, u.UserUUID.String(),
+		u.Role, u.Name, u.Email, u.Disabled))
+	if err == ErrNotFound {
+		return ErrExists
+	}
+	return err
+}
+
+func (s *SQLStore) GetUserByUsername(username string) (UserAccount, error) {
+	var u UserAccount
+	err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`,
+		username), &u)
+	return u, sqlNotFound(err)
+}
+
+func (s *SQLStore) GetUserByUUID(userUUID gocql.UUID) (UserAccount, error) {
+	var u UserAccount
+	err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE userUUID = ?
+		LIMIT 1`, userUUID.String()), &u)
+	return u, sqlNotFound(err)
+}
+
+func (s *SQLStore) UpdatePassword(username string, salt, saltedHash []byte) error {
+	return affected(s.db.Exec(`UPDATE users SET salt = ?, saltedHash = ? WHERE username = ?`,
+		salt, saltedHash, username))
+}
+
+func (s *SQLStore) UpdateUser(u UserAccount) error {
+	return affected(s.db.Exec(`UPDATE users SET role = ?, name = ?, email = ?, disabled = ?
+		WHERE username = ?`, u.Role, u.Name, u.Email, u.Disabled, u.Username))
+}
+
+func (s *SQLStore) ListUsers() ([]UserAccount, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userList := []UserAccount{}
+	for rows.Next() {
+		var u UserAccount
+		if err := scanUser(rows, &u); err != nil {
+			return nil, err
+		}
+		userList = append(userList, u)
+	}
+	return userList, rows.Err()
+}
+
+func (s *SQLStore) DeleteUser(username string) error {
+	return affected(s.db.Exec(`DELETE FROM users WHERE username = ?`, username))
+}
+
+func (s *SQLStore) CreatePrescription(p Prescription) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO prescriptions (patientUUID, prescriptionUUID,
+		doctorUUID, doctorName, drug, startDate, endDate, instructions)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, p.PatientUUID.String(), p.PrescriptionUUID.String(),
+		p.DoctorUUID.String(), p.DoctorName, p.Drug, p.StartDate, p.EndDate, p.Instructions)
+	return err
+}
+
+func (s *SQLStore) PrescriptionsByPatient(patientUUID gocql.UUID) (Prescriptions, error) {
+	rows, err := s.db.Query(`SELECT patientUUID, prescriptionUUID, doctorUUID, doctorName,
+		drug, startDate, endDate, instructions FROM prescriptions WHERE patientUUID = ?
+		ORDER BY endDate DESC, prescriptionUUID`, patientUUID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prescriptionList := Prescriptions{}
+	for rows.Next() {
+		var p Prescription
+		if err := rows.Scan(uuidCol{&p.PatientUUID}, uuidCol{&p.PrescriptionUUID},
+			uuidCol{&p.DoctorUUID}, &p.DoctorName, &p.Drug, &p.StartDate, &p.EndDate,
+			&p.Instructions); err != nil {
+			return nil, err
+		}
+		prescriptionList = append(prescriptionList, p)
+	}
+	return prescriptionList, rows.Err()
+}
+
+func (s *SQLStore) CreateNotification(n Notification) error {
+	notificationUUID, err := gocql.RandomUUID()
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO notifications (receiverUUID, dateCreated, notificationUUID,
+		message, senderName, senderUUID) VALUES (?, ?, ?, ?, ?, ?)`,
+		n.ReceiverUUID.String(), n.DateCreated, notificationUUID.String(), n.Messsage,
+		n.SenderName, n.SenderUUID.String())
+	return err
+}
+
+func (s *SQLStore) NotificationsByReceiver(receiverUUID gocql.UUID, limit int) (Notifications, error) {
+	rows, err := s.db.Query(`SELECT receiverUUID, dateCreated, message, senderUUID, senderName
+		FROM notifications WHERE receiverUUID = ? ORDER BY dateCreated DESC LIMIT ?`,
+		receiverUUID.String(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notiList := Notifications{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(uuidCol{&n.ReceiverUUID}, &n.DateCreated, &n.Messsage,
+			uuidCol{&n.SenderUUID}, &n.SenderName); err != nil {
+			return nil, err
+		}
+		notiList = append(notiList, n)
+	}
+	return notiList, rows.Err()
+}
+
+func (s *SQLStore) CreateDocument(d Document) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO documents (documentUUID, patientUUID, filename,
+		dateUploaded, content) VALUES (?, ?, ?, ?, ?)`, d.DocumentUUID.String(),
+		d.PatientUUID.String(), d.Filename, d.DateUploaded, []byte(d.Content))
+	return err
+}
+
+func (s *SQLStore) GetDocument(documentUUID gocql.UUID) (Document, error) {
+	var d Document
+	var content []byte
+	err := s.db.QueryRow(`SELECT documentUUID, patientUUID, filename, dateUploaded, content
+		FROM documents WHERE documentUUID = ?`, documentUUID.String()).
+		Scan(uuidCol{&d.DocumentUUID}, uuidCol{&d.PatientUUID}, &d.Filename, &d.DateUploaded,
+			&content)
+	d.Content = string(content)
+	return d, sqlNotFound(err)
+}
+
+func (s *SQLStore) DocumentsByPatient(patientUUID gocql.UUID) ([]Document, error) {
+	rows, err := s.db.Query(`SELECT documentUUID, patientUUID, filename, dateUploaded
+		FROM documents WHERE patientUUID = ? ORDER BY documentUUID`, patientUUID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docuList := []Document{}
+	for rows.Next() {
+		var d Document
+		if err := rows.Scan(uuidCol{&d.DocumentUUID}, uuidCol{&d.PatientUUID}, &d.Filename,
+			&d.DateUploaded); err != nil {
+			return nil, err
+		}
+		docuList = append(docuList, d)
+	}
+	return docuList, rows.Err()
+}
+
+// putSession inserts or replaces a row of table: sessions, refreshTokens,
+// loginChallenges, passwordResets or doctorInvites
+func (s *SQLStore) putSession(table string, session Session) error {
+	// expired rows are purged here, SQLite has no TTL
+	if _, err := s.db.Exec(`DELETE FROM `+table+` WHERE expiresAt <= ?`, time.Now().Unix()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO `+table+` (tokenHash, userUUID, role, name,
+		createdAt, expiresAt, rotated, twoFactor) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.TokenHash, session.UserUUID.String(), session.Role, session.Name,
+		session.CreatedAt.Unix(), session.ExpiresAt.Unix(), session.Rotated, session.TwoFactor)
+	return err
+}
+
+func (s *SQLStore) getSession(table, tokenHash string) (Session, error) {
+	session := Session{TokenHash: tokenHash}
+	var createdAt, expiresAt int64
+	err := s.db.QueryRow(`SELECT userUUID, role, name, createdAt, expiresAt, rotated,
+		twoFactor FROM `+table+` WHERE tokenHash = ? AND expiresAt > ?`, tokenHash,
+		time.Now().Unix()).Scan(uuidCol{&session.UserUUID}, &session.Role, &session.Name,
+		&createdAt, &expiresAt, &session.Rotated, &session.TwoFactor)
+	session.CreatedAt, session.ExpiresAt = time.Unix(createdAt, 0), time.Unix(expiresAt, 0)
+	return session, sqlNotFound(err)
+}
+
+func (s *SQLStore) deleteUserSessions(table string, userUUID gocql.UUID) error {
+	_, err := s.db.Exec(`DELETE FROM `+table+` WHERE userUUID = ?`, userUUID.String())
+	return err
+}
+
+func (s *SQLStore) CreateSession(session Session) error {
+	return s.putSession("sessions", session)
+}
+
+func (s *SQLStore) GetSession(tokenHash string) (Session, error) {
+	return s.getSession("sessions", tokenHash)
+}
+
+func (s *SQLStore) DeleteSession(tokenHash string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE tokenHash = ?`, tokenHash)
+	return err
+}
+
+func (s *SQLStore) DeleteUserSessions(userUUID gocql.UUID) error {
+	return s.deleteUserSessions("sessions", userUUID)
+}
+
+func (s *SQLStore) CreateRefreshToken(t Session) error {
+	return s.putSession("refreshTokens", t)
+}
+
+func (s *SQLStore) GetRefreshToken(tokenHash string) (Session, error) {
+	return s.getSession("refreshTokens", tokenHash)
+}
+
+func (s *SQLStore) DeleteRefreshToken(tokenHash string) error {
+	_, err := s.db.Exec(`DELETE FROM refreshTokens WHERE tokenHash = ?`, tokenHash)
+	return err
+}
+
+func (s *SQLStore) DeleteUserRefreshTokens(userUUID gocql.UUID) error {
+	return s.deleteUserSessions("refreshTokens", userUUID)
+}
+
+func (s *SQLStore) GetLoginAttempts(key string) (LoginAttempts, error) {
+	a := LoginAttempts{Key: key}
+	var lastFailure, lockedUntil, expiresAt int64
+	err := s.db.QueryRow(`SELECT failures, lastFailure, lockedUntil, expiresAt
+		FROM loginAttempts WHERE attemptKey = ? AND expiresAt > ?`, key, time.Now().Unix()).
+		Scan(&a.Failures, &lastFailure, &lockedUntil, &expiresAt)
+	a.LastFailure, a.ExpiresAt = time.Unix(lastFailure, 0), time.Unix(expiresAt, 0)
+	if lockedUntil != 0 {
+		a.LockedUntil = time.Unix(lockedUntil, 0)
+	}
+	return a, sqlNotFound(err)
+}
+
+func (s *SQLStore) PutLoginAttempts(a LoginAttempts) error {
+	// expired rows are purged here, SQLite has no TTL
+	if _, err := s.db.Exec(`DELETE FROM loginAttempts WHERE expiresAt <= ?`, time.Now().Unix()); err != nil {
+		return err
+	}
+	var lockedUntil int64
+	if !a.LockedUntil.IsZero() {
+		lockedUntil = a.LockedUntil.Unix()
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO loginAttempts (attemptKey, failures, lastFailure,
+		lockedUntil, expiresAt) VALUES (?, ?, ?, ?, ?)`, a.Key, a.Failures, a.LastFailure.Unix(),
+		lockedUntil, a.ExpiresAt.Unix())
+	return err
+}
+
+func (s *SQLStore) DeleteLoginAttempts(key string) error {
+	_, err := s.db.Exec(`DELETE FROM loginAttempts WHERE attemptKey = ?`, key)
+	return err
+}
+
+func (s *SQLStore) CreateLoginChallenge(c Session) error {
+	return s.putSession("loginChallenges", c)
+}
+
+func (s *SQLStore) GetLoginChallenge(tokenHash string) (Session, error) {
+	return s.getSession("loginChallenges", tokenHash)
+}
+
+func (s *SQLStore) DeleteLoginChallenge(tokenHash string) error {
+	_, err := s.db.Exec(`DELETE FROM loginChallenges WHERE tokenHash = ?`, tokenHash)
+	return err
+}
+
+func (s *SQLStore) CreatePasswordReset(t Session) error {
+	return s.putSession("passwordResets", t)
+}
+
+func (s *SQLStore) GetPasswordReset(tokenHash string) (Session, error) {
+	return s.getSession("passwordResets", tokenHash)
+}
+
+func (s *SQLStore) DeletePasswordReset(tokenHash string) error {
+	return affected(s.db.Exec(`DELETE FROM passwordResets WHERE tokenHash = ?`, tokenHash))
+}
+
+func (s *SQLStore) DeleteUserPasswordResets(userUUID gocql.UUID) error {
+	return s.deleteUserSessions("passwordResets", userUUID)
+}
+
+func (s *SQLStore) CreateDoctorInvite(i Session) error {
+	return s.putSession("doctorInvites", i)
+}
+
+func (s *SQLStore) GetDoctorInvite(codeHash string) (Session, error) {
+	return s.getSession("doctorInvites", codeHash)
+}
+
+func (s *SQLStore) DeleteDoctorInvite(codeHash string) error {
+	return affected(s.db.Exec(`DELETE FROM doctorInvites WHERE tokenHash = ?`, codeHash))
+}
+
+func (s *SQLStore) GetOIDCIdentity(issuer, subject string) (gocql.UUID, error) {
+	var userUUID gocql.UUID
+	err := s.db.QueryRow(`SELECT userUUID FROM oidcIdentities WHERE issuer = ? AND subject = ?`,
+		issuer, subject).Scan(uuidCol{&userUUID})
+	return userUUID, sqlNotFound(err)
+}
+
+func (s *SQLStore) PutOIDCIdentity(issuer, subject string, userUUID gocql.UUID) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO oidcIdentities (issuer, subject, userUUID)
+		VALUES (?, ?, ?)`, issuer, subject, userUUID.String())
+	return err
+}
+
+const apiKeyColumns = `keyUUID, name, scopes, secretHash, createdBy, createdAt, expiresAt,
+	lastUsedAt, revokedAt`
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }, k *APIKey) error {
+	var scopes string
+	var createdAt, expiresAt, lastUsedAt, revokedAt int64
+	if err := row.Scan(uuidCol{&k.KeyUUID}, &k.Name, &scopes, &k.SecretHash, uuidCol{&k.CreatedBy},
+		&createdAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return err
+	}
+	k.Scopes = strings.Split(scopes, ",")
+	k.CreatedAt, k.ExpiresAt = time.Unix(createdAt, 0), time.Unix(expiresAt, 0)
+	k.LastUsedAt, k.RevokedAt = sqlOptionalTime(lastUsedAt), sqlOptionalTime(revokedAt)
+	return nil
+}
+
+// sqlOptionalTime reads a time stored in Unix seconds, 0 being unset
+func sqlOptionalTime(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(unix, 0)
+	return &t
+}
+
+func (s *SQLStore) CreateAPIKey(k APIKey) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO apiKeys (keyUUID, name, scopes, secretHash,
+		createdBy, createdAt, expiresAt) VALUES (?, ?, ?, ?, ?, ?, ?)`, k.KeyUUID.String(), k.Name,
+		strings.Join(k.Scopes, ","), k.SecretHash, k.CreatedBy.String(), k.CreatedAt.Unix(),
+		k.ExpiresAt.Unix())
+	return err
+}
+
+func (s *SQLStore) GetAPIKey(keyUUID gocql.UUID) (APIKey, error) {
+	var k APIKey
+	err := scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM apiKeys WHERE keyUUID = ?`,
+		keyUUID.String()), &k)
+	return k, sqlNotFound(err)
+}
+
+func (s *SQLStore) ListAPIKeys() ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT ` + apiKeyColumns + ` FROM apiKeys ORDER BY createdAt, keyUUID`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keyList := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := scanAPIKey(rows, &k); err != nil {
+			return nil, err
+		}
+		keyList = append(keyList, k)
+	}
+	return keyList, rows.Err()
+}
+
+func (s *SQLStore) TouchAPIKey(keyUUID gocql.UUID, usedAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE apiKeys SET lastUsedAt = ? WHERE keyUUID = ?`, usedAt.Unix(),
+		keyUUID.String())
+	return err
+}
+
+func scanAuditEvent(row interface{ Scan(...interface{}) error }, e *AuditEvent) error {
+	var occurredAt int64
+	err := row.Scan(&e.Seq, &occurredAt, uuidCol{&e.ActorUUID}, &e.ActorRole, &e.Action,
+		&e.ResourceType, uuidCol{&e.ResourceUUID}, uuidCol{&e.PatientUUID}, &e.Outcome, &e.Status,
+		&e.SourceIP, &e.RequestID, &e.PrevHash, &e.Hash)
+	e.OccurredAt = time.UnixMilli(occurredAt).UTC()
+	return err
+}
+
+func (s *SQLStore) LastAuditEvent() (AuditEvent, error) {
+	var e AuditEvent
+	err := scanAuditEvent(s.db.QueryRow(`SELECT `+auditEventColumns+` FROM auditEvents
+		ORDER BY seq DESC LIMIT 1`), &e)
+	return e, sqlNotFound(err)
+}
+
+func (s *SQLStore) AppendAuditEvents(events []AuditEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, e := range events {
+		err := affected(tx.Exec(`INSERT OR IGNORE INTO auditEvents (`+auditEventColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, e.Seq, e.OccurredAt.UnixMilli(),
+			e.ActorUUID.String(), e.ActorRole, e.Action, e.ResourceType, e.ResourceUUID.String(),
+			e.PatientUUID.String(), e.Outcome, e.Status, e.SourceIP, e.RequestID, e.PrevHash, e.Hash))
+		if err == ErrNotFound {
+			return ErrExists
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) AuditEvents(q AuditQuery) ([]AuditEvent, error) {
+	where, args := []string{"1 = 1"}, []interface{}{}
+	var zero gocql.UUID
+	if q.PatientUUID != zero {
+		where, args = append(where, "patientUUID = ?"), append(args, q.PatientUUID.String())
+	}
+	if q.ActorUUID != zero {
+		where, args = append(where, "actorUUID = ?"), append(args, q.ActorUUID.String())
+	}
+	if !q.From.IsZero() {
+		where, args = append(where, "occurredAt >= ?"), append(args, q.From.UnixMilli())
+	}
+	if !q.To.IsZero() {
+		where, args = append(where, "occurredAt < ?"), append(args, q.To.UnixMilli())
+	}
+	if q.BeforeSeq != 0 {
+		where, args = append(where, "seq < ?"), append(args, q.BeforeSeq)
+	}
+	if q.StaffOnly {
+		where = append(where, "actorRole IN (?"+strings.Repeat(", ?", len(staffRoles)-1)+")")
+		for _, role := range staffRoles {
+			args = append(args, role)
+		}
+	}
+	rows, err := s.db.Query(`SELECT `+auditEventColumns+` FROM auditEvents WHERE `+
+		strings.Join(where, " AND ")+` ORDER BY seq DESC LIMIT ?`, append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		var e AuditEvent
+		if err := scanAuditEvent(rows, &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLStore) RevokeAPIKey(keyUUID gocql.UUID, revokedAt time.Time) error {
+	return affected(s.db.Exec(`UPDATE apiKeys SET revokedAt = ? WHERE keyUUID = ?`,
+		revokedAt.Unix(), keyUUID.String()))
+}
+
+func (s *SQLStore) GetTwoFactor(userUUID gocql.UUID) (TwoFactor, error) {
+	t := TwoFactor{UserUUID: userUUID, RecoveryCodes: []RecoveryCode{}}
+	err := s.db.QueryRow(`SELECT secret, enabled, lastCounter FROM twoFactor
+		WHERE userUUID = ?`, userUUID.String()).Scan(&t.Secret, &t.Enabled, &t.LastCounter)
+	if err != nil {
+		return TwoFactor{}, sqlNotFound(err)
+	}
+
+	rows, err := s.db.Query(`SELECT codeID, salt, saltedHash FROM recoveryCodes
+		WHERE userUUID = ? ORDER BY codeID`, userUUID.String())
+	if err != nil {
+		return TwoFactor{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code RecoveryCode
+		if err := rows.Scan(&code.ID, &code.Salt, &code.SaltedHash); err != nil {
+			return TwoFactor{}, err
+		}
+		t.RecoveryCodes = append(t.RecoveryCodes, code)
+	}
+	return t, rows.Err()
+}
+
+func (s *SQLStore) PutTwoFactor(t TwoFactor) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO twoFactor (userUUID, secret, enabled,
+		lastCounter) VALUES (?, ?, ?, ?)`, t.UserUUID.String(), t.Secret, t.Enabled,
+		t.LastCounter)
+	return err
+}
+
+func (s *SQLStore) UseTOTPCounter(userUUID gocql.UUID, counter int64) error {
+	err := affected(s.db.Exec(`UPDATE twoFactor SET lastCounter = ? WHERE userUUID = ?
+		AND lastCounter < ?`, counter, userUUID.String(), counter))
+	if err == ErrNotFound {
+		return ErrExists
+	}
+	return err
+}
+
+func (s *SQLStore) PutRecoveryCodes(userUUID gocql.UUID, codes []RecoveryCode) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recoveryCodes WHERE userUUID = ?`, userUUID.String()); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`INSERT INTO recoveryCodes (userUUID, codeID, salt, saltedHash)
+			VALUES (?, ?, ?, ?)`, userUUID.String(), code.ID, code.Salt, code.SaltedHash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) DeleteRecoveryCode(userUUID gocql.UUID, codeID int) error {
+	_, err := s.db.Exec(`DELETE FROM recoveryCodes WHERE userUUID = ? AND codeID = ?`,
+		userUUID.String(), codeID)
+	return err
+}
+
+func (s *SQLStore) DeleteTwoFactor(userUUID gocql.UUID) error {
+	if _, err := s.db.Exec(`DELETE FROM recoveryCodes WHERE userUUID = ?`, userUUID.String()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM twoFactor WHERE userUUID = ?`, userUUID.String())
+	return err
+}
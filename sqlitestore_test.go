@@ -0,0 +1,62 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestSQLiteStore opens a fresh database file that is removed after the test
+func newTestSQLiteStore(t *testing.T) *SQLStore {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "emr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestSQLiteStorePatientLifecycle(t *testing.T) {
+	testStorePatientLifecycle(t, newTestSQLiteStore(t))
+}
+
+func TestSQLiteStoreAppointmentsByDoctor(t *testing.T) {
+	testStoreAppointmentsByDoctor(t, newTestSQLiteStore(t))
+}
+
+func TestSQLiteStoreUserCreateAndLogin(t *testing.T) {
+	testStoreUserCreateAndLogin(t, newTestSQLiteStore(t))
+}
+
+func TestSQLiteStoreDocuments(t *testing.T) {
+	testStoreDocuments(t, newTestSQLiteStore(t))
+}
+
+func TestSQLiteStoreLoginLockout(t *testing.T) {
+	testStoreLoginLockout(t, newTestSQLiteStore(t))
+}
+
+func TestSQLiteStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emr.db")
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CreateDoctor(Doctor{Name: "Anoosh Gilliam"})
+	store.Close()
+
+	// reopening must not re-run applied migrations or lose data
+	store, err = NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var version int
+	store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if version != len(sqliteMigrations) {
+		t.Errorf("Schema version is %d, want %d", version, len(sqliteMigrations))
+	}
+	if doctors, _ := store.ListDoctors(); len(doctors) != 1 {
+		t.Errorf("Expected 1 doctor after reopening, got %d", len(doctors))
+	}
+}
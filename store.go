@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// ErrNotFound is returned by a store when the requested entry does not exist
+var ErrNotFound = errors.New("entry not found")
+
+// ErrUnavailable is returned by a store when its database cannot be reached
+var ErrUnavailable = errors.New("storage unavailable")
+
+// ErrExists is returned by a store when an insert would overwrite an entry
+var ErrExists = errors.New("entry already exists")
+
+// PatientStore reads and writes the patients table
+type PatientStore interface {
+	CreatePatient(p Patient) error
+	GetPatient(patientUUID gocql.UUID) (Patient, error)
+	GetPatientByMedicalNumber(medicalNumber string) (Patient, error)
+	ListPatients() (Patients, error)
+	// UpdatePatient returns ErrNotFound if the patient does not exist
+	UpdatePatient(p Patient) error
+}
+
+// AppointmentStore reads and writes the futureAppointments and
+// completedAppointments tables
+type AppointmentStore interface {
+	CreateFutureAppointment(a FutureAppointment) error
+	GetFutureAppointment(appointmentUUID gocql.UUID) (FutureAppointment, error)
+	// DeleteFutureAppointment returns ErrNotFound if nothing was deleted
+	DeleteFutureAppointment(appointmentUUID gocql.UUID) error
+	FutureAppointmentsByPatient(patientUUID gocql.UUID) (FutureAppointments, error)
+	FutureAppointmentsByDoctor(doctorUUID gocql.UUID) (FutureAppointments, error)
+
+	// CompleteAppointment removes the matching future appointment, if any,
+	// and creates or updates the completed appointment entry
+	CompleteAppointment(a CompletedAppointment) error
+	GetCompletedAppointment(appointmentUUID gocql.UUID) (CompletedAppointment, error)
+	CompletedAppointmentsByPatient(patientUUID gocql.UUID) (CompletedAppointments, error)
+	CompletedAppointmentsByDoctor(doctorUUID gocql.UUID) (CompletedAppointments, error)
+}
+
+// DoctorStore reads and writes the doctors table
+type DoctorStore interface {
+	CreateDoctor(d Doctor) error
+	GetDoctor(doctorUUID gocql.UUID) (Doctor, error)
+	ListDoctors() ([]Doctor, error)
+}
+
+// UserStore reads and writes the users table
+type UserStore interface {
+	// CreateUser returns ErrExists if the username is already taken
+	CreateUser(u UserAccount) error
+	GetUserByUsername(username string) (UserAccount, error)
+	GetUserByUUID(userUUID gocql.UUID) (UserAccount, error)
+	// UpdatePassword replaces the stored credentials of the user, or returns
+	// ErrNotFound
+	UpdatePassword(username string, salt, saltedHash []byte) error
+	// UpdateUser replaces the role, name, email and disabled flag of the
+	// user with the username of u, or returns ErrNotFound
+	UpdateUser(u UserAccount) error
+	// ListUsers returns every user ordered by username
+	ListUsers() ([]UserAccount, error)
+	// DeleteUser returns ErrNotFound if nothing was deleted
+	DeleteUser(username string) error
+}
+
+// PrescriptionStore reads and writes the prescriptions table
+type PrescriptionStore interface {
+	CreatePrescription(p Prescription) error
+	// PrescriptionsByPatient returns the prescriptions latest end date first
+	PrescriptionsByPatient(patientUUID gocql.UUID) (Prescriptions, error)
+}
+
+// NotificationStore reads and writes the notifications table
+type NotificationStore interface {
+	CreateNotification(n Notification) error
+	// NotificationsByReceiver returns at most limit notifications, newest first
+	NotificationsByReceiver(receiverUUID gocql.UUID, limit int) (Notifications, error)
+}
+
+// DocumentStore reads and writes the documents table
+type DocumentStore interface {
+	CreateDocument(d Document) error
+	GetDocument(documentUUID gocql.UUID) (Document, error)
+	// DocumentsByPatient returns document metadata only, without content
+	DocumentsByPatient(patientUUID gocql.UUID) ([]Document, error)
+}
+
+// SessionStore reads and writes the sessions table
+type SessionStore interface {
+	// CreateSession inserts or replaces the session with the same token hash
+	CreateSession(s Session) error
+	// GetSession returns ErrNotFound for unknown and expired sessions
+	GetSession(tokenHash string) (Session, error)
+	DeleteSession(tokenHash string) error
+	// DeleteUserSessions revokes every session of the user
+	DeleteUserSessions(userUUID gocql.UUID) error
+}
+
+// RefreshTokenStore reads and writes the refreshTokens table. Refresh tokens
+// are stored like sessions, Rotated marking a token that has been used.
+type RefreshTokenStore interface {
+	// CreateRefreshToken inserts or replaces the token with the same hash
+	CreateRefreshToken(t Session) error
+	// GetRefreshToken returns ErrNotFound for unknown and expired tokens
+	GetRefreshToken(tokenHash string) (Session, error)
+	DeleteRefreshToken(tokenHash string) error
+	// DeleteUserRefreshTokens revokes every refresh token of the user
+	DeleteUserRefreshTokens(userUUID gocql.UUID) error
+}
+
+// LoginChallengeStore reads and writes the loginChallenges table, logins
+// waiting for their second factor, which are stored like sessions
+type LoginChallengeStore interface {
+	// CreateLoginChallenge inserts or replaces the challenge with the same hash
+	CreateLoginChallenge(c Session) error
+	// GetLoginChallenge returns ErrNotFound for unknown and expired challenges
+	GetLoginChallenge(tokenHash string) (Session, error)
+	DeleteLoginChallenge(tokenHash string) error
+}
+
+// PasswordResetStore reads and writes the passwordResets table, the emailed
+// password reset tokens, which are stored like sessions
+type PasswordResetStore interface {
+	// CreatePasswordReset inserts or replaces the reset with the same hash
+	CreatePasswordReset(t Session) error
+	// GetPasswordReset returns ErrNotFound for unknown and expired tokens
+	GetPasswordReset(tokenHash string) (Session, error)
+	// DeletePasswordReset returns ErrNotFound if the reset was deleted
+	// already, so that only one caller consumes it
+	DeletePasswordReset(tokenHash string) error
+	// DeleteUserPasswordResets removes every reset token of the user
+	DeleteUserPasswordResets(userUUID gocql.UUID) error
+}
+
+// DoctorInviteStore reads and writes the doctorInvites table, the invitation
+// codes of doctors, which are stored like sessions with the DoctorUUID as
+// UserUUID
+type DoctorInviteStore interface {
+	// CreateDoctorInvite inserts or replaces the invite with the same hash
+	CreateDoctorInvite(i Session) error
+	// GetDoctorInvite returns ErrNotFound for unknown and expired codes
+	GetDoctorInvite(codeHash string) (Session, error)
+	// DeleteDoctorInvite returns ErrNotFound if the invite was deleted
+	// already, so that only one caller redeems it
+	DeleteDoctorInvite(codeHash string) error
+}
+
+// AuditStore appends to and reads the auditEvents table. Events cannot be
+// changed or removed.
+type AuditStore interface {
+	// LastAuditEvent returns the newest event, or ErrNotFound when there is
+	// none yet
+	LastAuditEvent() (AuditEvent, error)
+	// AppendAuditEvents appends events of consecutive Seq, chained after the
+	// newest event, all or none. It returns ErrExists if an event with the
+	// Seq of the first was appended already.
+	AppendAuditEvents(events []AuditEvent) error
+	// AuditEvents returns up to q.Limit events selected by q, newest first
+	AuditEvents(q AuditQuery) ([]AuditEvent, error)
+}
+
+// OIDCIdentityStore reads and writes the oidcIdentities table, which links
+// the subjects of OpenID Connect providers to local users
+type OIDCIdentityStore interface {
+	// GetOIDCIdentity returns the user linked to the subject, or ErrNotFound
+	GetOIDCIdentity(issuer, subject string) (gocql.UUID, error)
+	// PutOIDCIdentity links the subject to the user, replacing any link
+	PutOIDCIdentity(issuer, subject string, userUUID gocql.UUID) error
+}
+
+// APIKeyStore reads and writes the apiKeys table. Revoked and expired keys
+// are kept, to be listed.
+type APIKeyStore interface {
+	CreateAPIKey(k APIKey) error
+	GetAPIKey(keyUUID gocql.UUID) (APIKey, error)
+	// ListAPIKeys returns every key, oldest first
+	ListAPIKeys() ([]APIKey, error)
+	// TouchAPIKey records the last use of the key
+	TouchAPIKey(keyUUID gocql.UUID, usedAt time.Time) error
+	// RevokeAPIKey marks the key revoked, or returns ErrNotFound
+	RevokeAPIKey(keyUUID gocql.UUID, revokedAt time.Time) error
+}
+
+// TwoFactorStore reads and writes the twoFactor and recoveryCodes tables
+type TwoFactorStore interface {
+	// GetTwoFactor returns the TOTP enrollment of the user with its recovery
+	// codes, or ErrNotFound
+	GetTwoFactor(userUUID gocql.UUID) (TwoFactor, error)
+	// PutTwoFactor inserts or replaces the enrollment, leaving its recovery
+	// codes untouched
+	PutTwoFactor(t TwoFactor) error
+	// UseTOTPCounter sets the last used time step of the user to counter if
+	// it is lower, and returns ErrExists otherwise
+	UseTOTPCounter(userUUID gocql.UUID, counter int64) error
+	// PutRecoveryCodes replaces every recovery code of the user
+	PutRecoveryCodes(userUUID gocql.UUID, codes []RecoveryCode) error
+	DeleteRecoveryCode(userUUID gocql.UUID, codeID int) error
+	// DeleteTwoFactor removes the enrollment and recovery codes of the user
+	DeleteTwoFactor(userUUID gocql.UUID) error
+}
+
+// LoginAttemptStore reads and writes the loginAttempts table
+type LoginAttemptStore interface {
+	// GetLoginAttempts returns ErrNotFound for keys without recent failures
+	GetLoginAttempts(key string) (LoginAttempts, error)
+	// PutLoginAttempts inserts or replaces the entry with the same key
+	PutLoginAttempts(a LoginAttempts) error
+	DeleteLoginAttempts(key string) error
+}
+
+// HealthStore reports whether the database can serve requests
+type HealthStore interface {
+	// SchemaVersion returns the latest migration applied to the database and
+	// the latest one this build knows of
+	SchemaVersion() (applied, expected int, err error)
+	// CheckWritable records a health check for instance in the healthChecks
+	// table, failing if the database cannot be written
+	CheckWritable(instance string) error
+}
+
+// Store is a complete storage backend for the service
+type Store interface {
+	PatientStore
+	AppointmentStore
+	DoctorStore
+	UserStore
+	PrescriptionStore
+	NotificationStore
+	DocumentStore
+	SessionStore
+	RefreshTokenStore
+	LoginAttemptStore
+	LoginChallengeStore
+	TwoFactorStore
+	PasswordResetStore
+	DoctorInviteStore
+	OIDCIdentityStore
+	APIKeyStore
+	AuditStore
+	HealthStore
+	Close()
+}
+
+// OpenStore connects to the storage backend selected by cfg
+func OpenStore(cfg Config) (Store, error) {
+	switch cfg.Storage {
+	case "cassandra":
+		store, err := NewCassandraStore(cfg.Cassandra)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		store, err := NewSQLiteStore(cfg.SQLitePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open SQLite database %s: %v", cfg.SQLitePath, err)
+		}
+		return store, nil
+	case "memory":
+		log.Printf("Using in-memory storage, data will not be persisted")
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage)
+}
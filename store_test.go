@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+// testUser is the doctor sending the requests of serveStore, testAdmin is
+// an administrator
+var (
+	testUser  = UserAccount{UserUUID: gocql.TimeUUID(), Role: RoleDoctor, Name: "Anoosh Gilliam"}
+	testAdmin = UserAccount{UserUUID: gocql.TimeUUID(), Role: RoleAdmin, Name: "Site Admin"}
+)
+
+// serveStore sends req through the full router backed by store
+func serveStore(store Store, req *http.Request) *httptest.ResponseRecorder {
+	return serveServer(NewServer(store), testUser, req)
+}
+
+// serveServer sends req through the router of s, logged in as user unless
+// req already carries a session cookie
+func serveServer(s *Server, user UserAccount, req *http.Request) *httptest.ResponseRecorder {
+	if _, err := req.Cookie(sessionCookie); err != nil {
+		_, token, err := s.newSession(user, false)
+		if err != nil {
+			panic(err)
+		}
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	}
+	rec := httptest.NewRecorder()
+	NewRouter(s).ServeHTTP(rec, req)
+	return rec
+}
+
+func testStorePatientLifecycle(t *testing.T, store Store) {
+
+	rec := serveStore(store, httptest.NewRequest("POST", "/patients", strings.NewReader(`{
+		"gender": "F", "name": "Kelly Lai", "medicalNumber": "1234567890",
+		"phoneNumber": "483-555-5123", "dateOfBirth": 191289600}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusCreated)
+	}
+
+	patient, err := store.GetPatientByMedicalNumber("1234567890")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serveStore(store, httptest.NewRequest("GET", "/patients/patientuuid/"+patient.PatientUUID.String(), nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusOK)
+	}
+	if !strings.Contains(rec.Body.String(), `"name":"Kelly Lai"`) {
+		t.Errorf("The response message did not contain the patient name. \n The returned message is: \n %v", rec.Body.String())
+	}
+
+	// changing the medical number must move the secondary index entry
+	rec = serveStore(store, httptest.NewRequest("PUT", "/patients", strings.NewReader(`{
+		"patientUUID": "`+patient.PatientUUID.String()+`", "gender": "F",
+		"name": "Kelly Lai", "medicalNumber": "999"}`)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusOK)
+	}
+	if _, err := store.GetPatientByMedicalNumber("1234567890"); err != ErrNotFound {
+		t.Errorf("Old medical number still indexed: %v", err)
+	}
+	if p, err := store.GetPatientByMedicalNumber("999"); err != nil || p.PatientUUID != patient.PatientUUID {
+		t.Errorf("New medical number not indexed: %v", err)
+	}
+
+	missing, _ := gocql.RandomUUID()
+	rec = serveStore(store, httptest.NewRequest("PUT", "/patients", strings.NewReader(`{
+		"patientUUID": "`+missing.String()+`", "name": "Nobody"}`)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func testStoreAppointmentsByDoctor(t *testing.T, store Store) {
+	patientUUID, _ := gocql.RandomUUID()
+	doctorUUID := testUser.UserUUID
+	otherDoctorUUID, _ := gocql.RandomUUID()
+	store.CreatePatient(Patient{PatientUUID: patientUUID, Name: "Joey Kapow"})
+
+	for _, d := range []gocql.UUID{doctorUUID, doctorUUID, otherDoctorUUID} {
+		rec := serveStore(store, httptest.NewRequest("POST", "/futureappointments", strings.NewReader(`{
+			"patientUUID": "`+patientUUID.String()+`", "doctorUUID": "`+d.String()+`",
+			"dateScheduled": 1479463552, "notes": "check blood pressure"}`)))
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusCreated)
+		}
+	}
+
+	future, _ := store.FutureAppointmentsByDoctor(doctorUUID)
+	if len(future) != 2 {
+		t.Fatalf("Expected 2 appointments for doctor, got %d", len(future))
+	}
+
+	// completing an appointment moves it out of the future appointments
+	rec := serveStore(store, httptest.NewRequest("POST", "/completedappointments", strings.NewReader(`{
+		"appointmentUUID": "`+future[0].AppointmentUUID.String()+`",
+		"patientUUID": "`+patientUUID.String()+`", "doctorUUID": "`+doctorUUID.String()+`",
+		"dateVisited": 1479463552, "heartRate": 97}`)))
+	if rec.Code != http.StatusCreated {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusCreated)
+	}
+
+	rec = serveStore(store, httptest.NewRequest("GET", "/appointments/doctoruuid/"+doctorUUID.String(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusOK)
+	}
+	var appointments []GenericAppointment
+	if err := json.Unmarshal(rec.Body.Bytes(), &appointments); err != nil {
+		t.Fatal(err)
+	}
+	if len(appointments) != 2 {
+		t.Fatalf("Expected 2 appointments in response, got %d", len(appointments))
+	}
+	if appointments[0].DateScheduled == 0 || appointments[1].DateVisited == 0 {
+		t.Errorf("Expected one scheduled then one completed appointment, got %+v", appointments)
+	}
+	if appointments[0].PatientName != "Joey Kapow" {
+		t.Errorf("Patient name not resolved, got %q", appointments[0].PatientName)
+	}
+
+	rec = serveStore(store, httptest.NewRequest("DELETE",
+		"/futureappointments/appointmentuuid/"+future[0].AppointmentUUID.String(), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusNotFound)
+	}
+}
+
+func testStoreUserCreateAndLogin(t *testing.T, store Store) {
+	patientUUID, _ := gocql.RandomUUID()
+	store.CreatePatient(Patient{PatientUUID: patientUUID, Name: "Kelly Lai", MedicalNumber: "42"})
+
+	body := `{"username": "kelly", "password": "correct horse", "role": "Patient", "verificationKey": "42"}`
+	rec := serveStore(store, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusCreated)
+	}
+	if !strings.Contains(rec.Body.String(), patientUUID.String()) {
+		t.Errorf("Patient user not linked to patient entry: %v", rec.Body.String())
+	}
+
+	rec = serveStore(store, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Duplicate username accepted: got %v, want %v", rec.Code, http.StatusUnauthorized)
+	}
+
+	// in this order, as a failed login delays the next one
+	for _, login := range []struct {
+		password string
+		want     int
+	}{{"correct horse", http.StatusOK}, {"wrong", http.StatusUnauthorized}} {
+		req := httptest.NewRequest("POST", "/login",
+			strings.NewReader(url.Values{"username": {"kelly"}, "password": {login.password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if rec := serveStore(store, req); rec.Code != login.want {
+			t.Errorf("Login with %q: got %v, want %v", login.password, rec.Code, login.want)
+		}
+	}
+}
+
+func testStoreDocuments(t *testing.T, store Store) {
+	patientUUID, _ := gocql.RandomUUID()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("patientUUID", patientUUID.String())
+	form.WriteField("filename", "test.txt")
+	part, _ := form.CreateFormFile("file", "test.txt")
+	part.Write([]byte("blood panel results"))
+	form.Close()
+
+	req := httptest.NewRequest("POST", "/documents", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := serveStore(store, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Handler returned wrong status code: got %v, want %v", rec.Code, http.StatusCreated)
+	}
+	var created map[string]gocql.UUID
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serveStore(store, httptest.NewRequest("GET", "/documents/patientuuid/"+patientUUID.String(), nil))
+	if strings.Contains(rec.Body.String(), "blood panel") || !strings.Contains(rec.Body.String(), "test.txt") {
+		t.Errorf("Document list should hold metadata only: %v", rec.Body.String())
+	}
+
+	rec = serveStore(store, httptest.NewRequest("GET", "/documents/documentuuid/"+created["documentuuid"].String(), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "blood panel results" {
+		t.Errorf("Document download returned %v: %q", rec.Code, rec.Body.String())
+	}
+}
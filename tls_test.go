@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// devCAPool returns a pool trusting the development CA in dir
+func devCAPool(t *testing.T, dir string) *x509.CertPool {
+	pemCerts, err := ioutil.ReadFile(filepath.Join(dir, devCAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		t.Fatal("no CA certificate in", devCAFile)
+	}
+	return pool
+}
+
+func loadLeaf(t *testing.T, certFile, keyFile string) *x509.Certificate {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestGenerateDevCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, err := GenerateDevCertificates(dir, []string{"localhost", "emr.test", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf := loadLeaf(t, certFile, keyFile)
+	for _, host := range []string{"localhost", "emr.test", "127.0.0.1"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: devCAPool(t, dir)}); err != nil {
+			t.Errorf("certificate not valid for %s: %v", host, err)
+		}
+	}
+	if leaf.IsCA {
+		t.Error("server certificate must not be a CA")
+	}
+
+	// the CA is kept so that it only has to be trusted once
+	caBefore, _ := ioutil.ReadFile(filepath.Join(dir, devCAFile))
+	if _, _, err := GenerateDevCertificates(dir, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	caAfter, _ := ioutil.ReadFile(filepath.Join(dir, devCAFile))
+	if string(caBefore) != string(caAfter) {
+		t.Error("development CA was regenerated")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, err := GenerateDevCertificates(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := newCertReloader(certFile, keyFile, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := reloader.GetCertificate(nil)
+
+	// an unreadable certificate keeps the current one in use
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if cert, _ := reloader.GetCertificate(nil); cert != first {
+		t.Error("broken certificate file replaced the served certificate")
+	}
+
+	if _, _, err := GenerateDevCertificates(dir, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	if cert, _ := reloader.GetCertificate(nil); cert == first {
+		t.Error("renewed certificate was not reloaded")
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig().TLS
+	cfg.Dev, cfg.DevDir = true, dir
+	cfg.ClientCAFile = filepath.Join(dir, devCAFile)
+	cfg.ClientAuth = "require"
+	// the CA must exist before it can be named as the client CA
+	if _, _, err := GenerateDevCertificates(dir, cfg.DevHosts); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(Index))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: devCAPool(t, dir)}}}
+	if resp, err := client.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Error("expected the handshake to fail without a client certificate")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		method, url, httpsAddr string
+		code                   int
+		location               string
+	}{
+		{"GET", "http://emr.example.com/patients?x=1", ":443", http.StatusMovedPermanently,
+			"https://emr.example.com/patients?x=1"},
+		{"POST", "http://emr.example.com:8080/login", ":8443", http.StatusPermanentRedirect,
+			"https://emr.example.com:8443/login"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		RedirectToHTTPS(test.httpsAddr).ServeHTTP(rec, httptest.NewRequest(test.method, test.url, nil))
+		if rec.Code != test.code || rec.Header().Get("Location") != test.location {
+			t.Errorf("%s %s: got %d %s, want %d %s", test.method, test.url,
+				rec.Code, rec.Header().Get("Location"), test.code, test.location)
+		}
+	}
+}
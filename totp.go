@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpStep is the RFC 6238 time step in seconds
+const totpStep = 30
+
+// recoveryCodeCount is the number of recovery codes handed out at a time
+const recoveryCodeCount = 10
+
+// totpOptions are those of the codes shown by common authenticator apps
+var totpOptions = totp.ValidateOpts{Period: totpStep, Digits: otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1}
+
+// TwoFactor is the TOTP enrollment of a user
+type TwoFactor struct {
+	UserUUID gocql.UUID
+	// Secret is the base32 secret shared with the authenticator app
+	Secret string
+	// Enabled is set once the user entered a first code
+	Enabled bool
+	// LastCounter is the time step of the last code accepted, codes of that
+	// step or earlier cannot be used again
+	LastCounter int64
+	// RecoveryCodes are the unused single-use codes replacing a TOTP code
+	RecoveryCodes []RecoveryCode
+}
+
+// RecoveryCode is stored like a password, as a salt and the bcrypt hash of
+// salt+code
+type RecoveryCode struct {
+	ID         int
+	Salt       []byte
+	SaltedHash []byte
+}
+
+// TwoFactorChallenge is returned by /login to users with two-factor
+// authentication, who send the token to /login/totp with their code
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	TwoFactorToken    string `json:"twoFactorToken"`
+	// ExpiresIn is the time left to send the code in seconds
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// TOTPEnrollment is the secret to add to an authenticator app, as text, as
+// an otpauth:// URI and as a PNG data URI of its QR code
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningURI"`
+	QRCode          string `json:"qrCode"`
+}
+
+// RecoveryCodes are shown once, when two-factor authentication is enabled
+// or the codes are replaced
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// requiresTwoFactor reports whether users of role must enable two-factor
+// authentication
+func (s *Server) requiresTwoFactor(role string) bool {
+	for _, required := range s.TOTP.RequiredRoles {
+		if role == required {
+			return true
+		}
+	}
+	return false
+}
+
+// totpCounter returns the time step code is valid for, allowing a step of
+// clock drift either way, or 0 if it is not valid
+func totpCounter(secret, code string, now time.Time) int64 {
+	counter := now.Unix() / totpStep
+	for _, c := range []int64{counter, counter - 1, counter + 1} {
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(c*totpStep, 0), totpOptions)
+		if err == nil && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return c
+		}
+	}
+	return 0
+}
+
+// normalizeRecoveryCode lets users type recovery codes without the dash and
+// in any case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes returns recoveryCodeCount random codes and their hashes
+func newRecoveryCodes(cfg PasswordConfig) ([]string, []RecoveryCode, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashed := make([]RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw)[:10])
+		salt, saltedHash, err := hashPassword(cfg, code)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashed[i] = RecoveryCode{ID: i + 1, Salt: salt, SaltedHash: saltedHash}
+	}
+	return codes, hashed, nil
+}
+
+// checkSecondFactor reports whether code is a TOTP code of tf newer than
+// the last one used, or recoveryCode an unused recovery code, and consumes it
+func (s *Server) checkSecondFactor(tf *TwoFactor, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		counter := totpCounter(tf.Secret, code, time.Now())
+		if counter == 0 || counter <= tf.LastCounter {
+			return false, nil
+		}
+		// compared again by the store, so that requests racing with the
+		// same code cannot both use it
+		err := s.TwoFactor.UseTOTPCounter(tf.UserUUID, counter)
+		if err == ErrExists {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		tf.LastCounter = counter
+		return true, nil
+	}
+	if recoveryCode != "" && tf.Enabled {
+		recoveryCode = normalizeRecoveryCode(recoveryCode)
+		for _, stored := range tf.RecoveryCodes {
+			if checkSaltedHash(stored.Salt, stored.SaltedHash, recoveryCode) == nil {
+				return true, s.TwoFactor.DeleteRecoveryCode(tf.UserUUID, stored.ID)
+			}
+		}
+	}
+	return false, nil
+}
+
+// verifySecondFactor checks the code or recoveryCode form value of r
+// against tf, throttled and counted like passwords, and answers the caller
+// when it fails
+func (s *Server) verifySecondFactor(w http.ResponseWriter, r *http.Request, username string, tf *TwoFactor) bool {
+	if wait, err := s.loginWait(r, username); err != nil {
+		s.internalError(w, r, err)
+		return false
+	} else if wait > 0 {
+		s.tooManyLogins(w, r, wait)
+		return false
+	}
+
+	ok, err := s.checkSecondFactor(tf, r.Form.Get("code"), r.Form.Get("recoveryCode"))
+	if err != nil {
+		s.internalError(w, r, err)
+		return false
+	}
+	if !ok {
+		if err := s.loginFailed(r, username); err != nil {
+			s.internalError(w, r, err)
+			return false
+		}
+		requestLogger(r).Info("Incorrect second factor code")
+		s.writeStatus(w, r, http.StatusUnauthorized, "Incorrect code")
+		return false
+	}
+	return true
+}
+
+// writeSecretJSON sends v with the given status, marked never to be cached
+// as it holds secrets
+func (s *Server) writeSecretJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	s.allowOrigin(w, r)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// startChallenge answers the first login step of user, who has two-factor
+// authentication, with the token to send with the code
+func (s *Server) startChallenge(w http.ResponseWriter, r *http.Request, user UserAccount) {
+	challenge, token, err := newToken(user, s.TOTP.ChallengeTTL)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.LoginChallenges.CreateLoginChallenge(challenge); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	s.writeSecretJSON(w, r, http.StatusAccepted, TwoFactorChallenge{TwoFactorRequired: true,
+		TwoFactorToken: token, ExpiresIn: int(s.TOTP.ChallengeTTL.Seconds())})
+}
+
+/*
+Completes the login of a user with two-factor authentication, from the
+twoFactorToken returned by /login and a TOTP code or a recovery code
+Method: POST
+Endpoint: /login/totp
+*/
+func (s *Server) UserAuthenticateTOTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	token := r.Form.Get("twoFactorToken")
+	if token == "" || (r.Form.Get("code") == "" && r.Form.Get("recoveryCode") == "") {
+		s.badRequest(w, r, "Missing twoFactorToken, code or recoveryCode")
+		return
+	}
+
+	challenge, err := s.LoginChallenges.GetLoginChallenge(hashToken(token))
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusUnauthorized, "Login expired, log in again")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	setRequestUser(r, challenge.UserUUID.String())
+	user, err := s.Users.GetUserByUUID(challenge.UserUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	tf, err := s.TwoFactor.GetTwoFactor(user.UserUUID)
+	if err == ErrNotFound {
+		// reset by an admin since the first step
+		s.writeStatus(w, r, http.StatusUnauthorized, "Login expired, log in again")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	if !s.verifySecondFactor(w, r, user.Username, &tf) {
+		return
+	}
+	if err := s.LoginChallenges.DeleteLoginChallenge(challenge.TokenHash); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	s.completeLogin(w, r, user, true)
+}
+
+/*
+Starts the TOTP enrollment of the caller, returning the secret to add to an
+authenticator app. It is enabled once confirmed with a first code.
+Method: POST
+Endpoint: /2fa/totp
+*/
+func (s *Server) TOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFrom(r.Context())
+	user, err := s.Users.GetUserByUUID(principal.UserUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if tf, err := s.TwoFactor.GetTwoFactor(user.UserUUID); err == nil && tf.Enabled {
+		s.writeStatus(w, r, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	} else if err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: s.TOTP.Issuer, AccountName: user.Username,
+		Period: totpStep, Digits: totpOptions.Digits, Algorithm: totpOptions.Algorithm})
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	qrCode, err := key.Image(256, 256)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	var qrPNG bytes.Buffer
+	if err := png.Encode(&qrPNG, qrCode); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.TwoFactor.PutTwoFactor(TwoFactor{UserUUID: user.UserUUID,
+		Secret: key.Secret()}); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	requestLogger(r).Info("Started TOTP enrollment", "userID", user.UserUUID)
+	s.writeSecretJSON(w, r, http.StatusCreated, TOTPEnrollment{
+		Secret:          key.Secret(),
+		ProvisioningURI: key.URL(),
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrPNG.Bytes()),
+	})
+}
+
+/*
+Enables two-factor authentication for the caller once they send a first
+TOTP code, returning their recovery codes
+Method: POST
+Endpoint: /2fa/totp/confirm
+*/
+func (s *Server) TOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	if r.Form.Get("code") == "" {
+		s.badRequest(w, r, "Missing code")
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	user, err := s.Users.GetUserByUUID(principal.UserUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	tf, err := s.TwoFactor.GetTwoFactor(user.UserUUID)
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusNotFound, "No pending two-factor enrollment")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if tf.Enabled {
+		s.writeStatus(w, r, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	if !s.verifySecondFactor(w, r, user.Username, &tf) {
+		return
+	}
+	codes, hashed, err := newRecoveryCodes(s.Password)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.TwoFactor.PutRecoveryCodes(user.UserUUID, hashed); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	tf.Enabled = true
+	if err := s.TwoFactor.PutTwoFactor(tf); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+
+	// sessions and refresh tokens issued on the password alone are revoked
+	// but the current one, which has just proven the second factor; bearer
+	// clients log in again for tokens that carry it
+	var session Session
+	if principal.SessionTokenHash != "" {
+		session, err = s.Sessions.GetSession(principal.SessionTokenHash)
+		if err == ErrNotFound {
+			session = Session{}
+		} else if err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+	}
+	if err := s.signOutUser(user.UserUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if session.TokenHash != "" {
+		session.TwoFactor = true
+		if err := s.Sessions.CreateSession(session); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+	}
+
+	auditLog(r, "2fa.enabled", "Two-factor authentication enabled", "userID", user.UserUUID)
+	s.writeSecretJSON(w, r, http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+}
+
+/*
+Disables two-factor authentication for the caller, given a TOTP code or a
+recovery code, unless their role requires it
+Method: POST
+Endpoint: /2fa/totp/disable
+*/
+func (s *Server) TOTPDisable(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	if s.requiresTwoFactor(principal.Role) {
+		s.writeStatus(w, r, http.StatusForbidden, "Two-factor authentication is required for your role")
+		return
+	}
+	user, tf, ok := s.enabledTwoFactor(w, r, principal.UserUUID)
+	if !ok || !s.verifySecondFactor(w, r, user.Username, &tf) {
+		return
+	}
+	if err := s.TwoFactor.DeleteTwoFactor(user.UserUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	auditLog(r, "2fa.disabled", "Two-factor authentication disabled", "userID", user.UserUUID)
+	s.writeStatus(w, r, http.StatusOK, "Two-factor authentication disabled")
+}
+
+/*
+Replaces the recovery codes of the caller, given a TOTP code or a recovery
+code
+Method: POST
+Endpoint: /2fa/recovery-codes
+*/
+func (s *Server) RecoveryCodesRegenerate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.badRequest(w, r, "Malformed form body: "+err.Error())
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	user, tf, ok := s.enabledTwoFactor(w, r, principal.UserUUID)
+	if !ok || !s.verifySecondFactor(w, r, user.Username, &tf) {
+		return
+	}
+	codes, hashed, err := newRecoveryCodes(s.Password)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.TwoFactor.PutRecoveryCodes(user.UserUUID, hashed); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	auditLog(r, "2fa.recovery_codes", "Recovery codes replaced", "userID", user.UserUUID)
+	s.writeSecretJSON(w, r, http.StatusOK, RecoveryCodes{RecoveryCodes: codes})
+}
+
+// enabledTwoFactor returns the user and enabled TOTP enrollment of
+// userUUID, answering the caller when there is none
+func (s *Server) enabledTwoFactor(w http.ResponseWriter, r *http.Request, userUUID gocql.UUID) (UserAccount, TwoFactor, bool) {
+	user, err := s.Users.GetUserByUUID(userUUID)
+	if err != nil {
+		s.internalError(w, r, err)
+		return UserAccount{}, TwoFactor{}, false
+	}
+	tf, err := s.TwoFactor.GetTwoFactor(userUUID)
+	if err == ErrNotFound || (err == nil && !tf.Enabled) {
+		s.writeStatus(w, r, http.StatusNotFound, "Two-factor authentication is not enabled")
+		return UserAccount{}, TwoFactor{}, false
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return UserAccount{}, TwoFactor{}, false
+	}
+	return user, tf, true
+}
+
+/*
+Removes the two-factor authentication of a user who lost their
+authenticator and recovery codes, so that they can enroll again
+Method: DELETE
+Endpoint: /users/useruuid/{useruuid}/2fa
+*/
+func (s *Server) UserTwoFactorReset(w http.ResponseWriter, r *http.Request) {
+	userUUID, err := gocql.ParseUUID(mux.Vars(r)["useruuid"])
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return
+	}
+	if _, err := s.Users.GetUserByUUID(userUUID); err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusNotFound, "Not Found")
+		return
+	} else if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.TwoFactor.DeleteTwoFactor(userUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	auditLog(r, "2fa.reset", "Two-factor authentication reset", "userID", userUUID,
+		"resetBy", principal.UserUUID)
+	s.writeStatus(w, r, http.StatusOK, "Two-factor authentication reset")
+}
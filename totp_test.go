@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestTOTPCounter(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1 at T=59, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		now  int64
+		code string
+		want int64
+	}{
+		{59, "287082", 1},
+		{89, "287082", 1},
+		{149, "287082", 0},
+		{59, "287083", 0},
+	}
+	for _, test := range tests {
+		if got := totpCounter(secret, test.code, time.Unix(test.now, 0)); got != test.want {
+			t.Errorf("code %s at %d: got step %d, want %d", test.code, test.now, got, test.want)
+		}
+	}
+}
+
+// postForm posts values to path through the router of s with the session
+// cookie
+func postForm(s *Server, cookie *http.Cookie, path string, values url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveAs(s, cookie, req)
+}
+
+// enrollTOTP enables two-factor authentication for the user of cookie,
+// returning the TOTP secret and the recovery codes
+func enrollTOTP(t *testing.T, s *Server, cookie *http.Cookie) (string, []string) {
+	rec := postForm(s, cookie, "/2fa/totp", nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("enroll: got %d, want 201: %s", rec.Code, rec.Body)
+	}
+	var enrollment TOTPEnrollment
+	if err := json.NewDecoder(rec.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/EMR:kelly?") ||
+		!strings.HasPrefix(enrollment.QRCode, "data:image/png;base64,") {
+		t.Errorf("unexpected enrollment %+v", enrollment)
+	}
+
+	code, _ := totp.GenerateCode(enrollment.Secret, time.Now())
+	rec = postForm(s, cookie, "/2fa/totp/confirm", url.Values{"code": {code}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("confirm: got %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var codes RecoveryCodes
+	if err := json.NewDecoder(rec.Body).Decode(&codes); err != nil {
+		t.Fatal(err)
+	}
+	if len(codes.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes.RecoveryCodes), recoveryCodeCount)
+	}
+	return enrollment.Secret, codes.RecoveryCodes
+}
+
+// loginChallenge runs the first login step of kelly, returning the token to
+// send with the code
+func loginChallenge(t *testing.T, s *Server) string {
+	rec := postLogin(s, "kelly", "correct horse")
+	var challenge TwoFactorChallenge
+	if rec.Code != http.StatusAccepted || json.NewDecoder(rec.Body).Decode(&challenge) != nil ||
+		!challenge.TwoFactorRequired {
+		t.Fatalf("login with two-factor authentication: got %d, want 202 with a challenge", rec.Code)
+	}
+	return challenge.TwoFactorToken
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	secret, recoveryCodes := enrollTOTP(t, s, login(t, s))
+
+	// the code used to confirm cannot be replayed, the next one is accepted
+	token := loginChallenge(t, s)
+	next, _ := totp.GenerateCode(secret, time.Now().Add(totpStep*time.Second))
+	rec := postForm(s, nil, "/login/totp", url.Values{"twoFactorToken": {token}, "code": {next}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("second login step: got %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if len(rec.Result().Cookies()) == 0 {
+		t.Error("second login step returned no session cookie")
+	}
+	rec = postForm(s, nil, "/login/totp", url.Values{"twoFactorToken": {token}, "code": {next}})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused challenge: got %d, want 401", rec.Code)
+	}
+
+	// recovery codes are accepted once, with or without the dash
+	token = loginChallenge(t, s)
+	recoveryCode := strings.ToUpper(strings.Replace(recoveryCodes[3], "-", "", 1))
+	rec = postForm(s, nil, "/login/totp", url.Values{"twoFactorToken": {token},
+		"recoveryCode": {recoveryCode}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login with a recovery code: got %d, want 200: %s", rec.Code, rec.Body)
+	}
+	token = loginChallenge(t, s)
+	rec = postForm(s, nil, "/login/totp", url.Values{"twoFactorToken": {token},
+		"recoveryCode": {recoveryCodes[3]}})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused recovery code: got %d, want 401", rec.Code)
+	}
+
+	// a lost authenticator is reset by an admin
+	reset := httptest.NewRequest("DELETE", "/users/useruuid/"+testUser.UserUUID.String()+"/2fa", nil)
+	if rec := serveServer(s, testAdmin, reset); rec.Code != http.StatusOK {
+		t.Errorf("reset by an admin: got %d, want 200", rec.Code)
+	}
+	elapse(t, s, accountKey("kelly"), time.Minute)
+	elapse(t, s, "ip:192.0.2.1", time.Minute)
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusOK {
+		t.Errorf("login after reset: got %d, want 200", rec.Code)
+	}
+}
+
+// racedTwoFactor has the code of the next time step used by another request
+// right after each enrollment is read
+type racedTwoFactor struct{ TwoFactorStore }
+
+func (r racedTwoFactor) GetTwoFactor(userUUID gocql.UUID) (TwoFactor, error) {
+	tf, err := r.TwoFactorStore.GetTwoFactor(userUUID)
+	if err == nil {
+		err = r.TwoFactorStore.UseTOTPCounter(userUUID, time.Now().Unix()/totpStep+1)
+	}
+	return tf, err
+}
+
+func TestTwoFactorCodeRaced(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	secret, _ := enrollTOTP(t, s, login(t, s))
+	token := loginChallenge(t, s)
+
+	s.TwoFactor = racedTwoFactor{s.TwoFactor}
+	next, _ := totp.GenerateCode(secret, time.Now().Add(totpStep*time.Second))
+	rec := postForm(s, nil, "/login/totp", url.Values{"twoFactorToken": {token}, "code": {next}})
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("code used by another request: got %d, want 401", rec.Code)
+	}
+}
+
+func TestTwoFactorRequiredRole(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	s.TOTP.RequiredRoles = []string{RolePatient}
+	cookie := login(t, s)
+
+	patient := "/patients/patientuuid/" + testUser.UserUUID.String()
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", patient, nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("request before enrolling: got %d, want 403", rec.Code)
+	}
+	enrollTOTP(t, s, cookie)
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", patient, nil)); rec.Code != http.StatusOK {
+		t.Errorf("request after enrolling: got %d, want 200", rec.Code)
+	}
+	if rec := postForm(s, cookie, "/2fa/totp/disable", url.Values{"code": {"000000"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("disabling required two-factor authentication: got %d, want 403", rec.Code)
+	}
+}
+
+func TestTwoFactorEnrollSignsOut(t *testing.T) {
+	s := NewServer(NewMemoryStore())
+	cookie := login(t, s)
+	var other *http.Cookie
+	for _, c := range postLogin(s, "kelly", "correct horse").Result().Cookies() {
+		if c.Name == sessionCookie {
+			other = c
+		}
+	}
+
+	enrollTOTP(t, s, cookie)
+	patient := "/patients/patientuuid/" + testUser.UserUUID.String()
+	if rec := serveAs(s, other, httptest.NewRequest("GET", patient, nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("other session after enrolling: got %d, want 401", rec.Code)
+	}
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", patient, nil)); rec.Code != http.StatusOK {
+		t.Errorf("enrolling session after enrolling: got %d, want 200", rec.Code)
+	}
+}
@@ -9,5 +9,20 @@ type User struct {
 	Role     		string     `json:"role,omitempty"`
 	Name     		string     `json:"name,omitempty"`
 	VerificationKey	string     `json:"verificationKey,omitempty"`
+	Email    		string     `json:"email,omitempty"`
+	Disabled 		bool       `json:"disabled,omitempty"`
 }
 
+// UserAccount is a users table entry, including the stored credentials
+type UserAccount struct {
+	Username   string
+	Salt       []byte
+	SaltedHash []byte
+	UserUUID   gocql.UUID
+	Role       string
+	Name       string
+	// Email receives password reset links, it may be empty
+	Email string
+	// Disabled users cannot log in
+	Disabled bool
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// accountDisabled refuses the login of a disabled user, once their
+// credentials have been checked
+func (s *Server) accountDisabled(w http.ResponseWriter, r *http.Request, user UserAccount) {
+	requestLogger(r).Info("Login refused, account disabled", "username", user.Username)
+	s.writeStatus(w, r, http.StatusForbidden, "Account disabled")
+}
+
+// userInfo is the users table entry of u as shown to admins, without its
+// credentials
+func userInfo(u UserAccount) User {
+	return User{Username: u.Username, UserUUID: u.UserUUID, Role: u.Role, Name: u.Name,
+		Email: u.Email, Disabled: u.Disabled}
+}
+
+// matchesUser reports whether query is found, ignoring case, in the
+// username, name or email of u
+func matchesUser(u UserAccount, query string) bool {
+	query = strings.ToLower(query)
+	for _, field := range []string{u.Username, u.Name, u.Email} {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminTarget returns the user named by the useruuid route variable, which
+// must not be the calling admin when self is false. It answers the request
+// itself and returns false otherwise.
+func (s *Server) adminTarget(w http.ResponseWriter, r *http.Request, self bool) (UserAccount, bool) {
+	userUUID, err := gocql.ParseUUID(mux.Vars(r)["useruuid"])
+	if err != nil {
+		s.badRequest(w, r, "Invalid UUID in request URI")
+		return UserAccount{}, false
+	}
+	user, err := s.Users.GetUserByUUID(userUUID)
+	if err == ErrNotFound {
+		s.writeStatus(w, r, http.StatusNotFound, "Not Found")
+		return UserAccount{}, false
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return UserAccount{}, false
+	}
+	// so that admins cannot lock themselves out
+	if principal, _ := principalFrom(r.Context()); !self && principal.UserUUID == userUUID {
+		s.writeStatus(w, r, http.StatusConflict, "Admins cannot do this to their own account")
+		return UserAccount{}, false
+	}
+	return user, true
+}
+
+/*
+Returns the users ordered by username, optionally only those of a role and
+those whose username, name or email contains the q query value
+Method: GET
+Endpoint: /users?q={q}&role={role}
+*/
+func (s *Server) UserListGet(w http.ResponseWriter, r *http.Request) {
+	query, role := r.URL.Query().Get("q"), r.URL.Query().Get("role")
+	users, err := s.Users.ListUsers()
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	userList := []User{}
+	for _, u := range users {
+		if (role == "" || u.Role == role) && (query == "" || matchesUser(u, query)) {
+			userList = append(userList, userInfo(u))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(userList); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+Changes the role and display name of a user, each left as is when empty.
+A new role signs the user out everywhere, as sessions hold the role.
+Method: PATCH
+Endpoint: /users/useruuid/{useruuid}
+*/
+func (s *Server) UserUpdate(w http.ResponseWriter, r *http.Request) {
+	var a User
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		s.badRequest(w, r, "Malformed JSON body: "+err.Error())
+		return
+	}
+	defer r.Body.Close()
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Role != "" && a.Role != RolePatient && a.Role != RoleDoctor && a.Role != RoleAdmin {
+		s.badRequest(w, r, "Role must be Patient, Doctor or Admin")
+		return
+	}
+	user, ok := s.adminTarget(w, r, a.Role == "")
+	if !ok {
+		return
+	}
+
+	roleChanged := a.Role != "" && a.Role != user.Role
+	if roleChanged {
+		switch a.Role {
+		case RolePatient:
+			// patient accounts share the UUID of their patient entry
+			if _, err := s.Patients.GetPatient(user.UserUUID); err == ErrNotFound {
+				s.badRequest(w, r, "Patient accounts need a patient entry of their UUID")
+				return
+			} else if err != nil {
+				s.internalError(w, r, err)
+				return
+			}
+		case RoleDoctor:
+			// as when invited, doctors have a doctor entry of their UUID
+			_, err := s.Doctors.GetDoctor(user.UserUUID)
+			if err == ErrNotFound {
+				name := user.Name
+				if a.Name != "" {
+					name = a.Name
+				}
+				err = s.Doctors.CreateDoctor(Doctor{DoctorUUID: user.UserUUID, Name: name})
+			}
+			if err != nil {
+				s.internalError(w, r, err)
+				return
+			}
+		}
+	}
+
+	principal, _ := principalFrom(r.Context())
+	previous := user.Role
+	if a.Role != "" {
+		user.Role = a.Role
+	}
+	if a.Name != "" {
+		user.Name = a.Name
+	}
+	if err := s.Users.UpdateUser(user); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if roleChanged {
+		if err := s.signOutUser(user.UserUUID); err != nil {
+			s.internalError(w, r, err)
+			return
+		}
+		auditLog(r, "user.role_changed", "Role of a user changed", "userID", user.UserUUID,
+			"from", previous, "to", user.Role, "changedBy", principal.UserUUID)
+	}
+	requestLogger(r).Info("Updated user", "userID", user.UserUUID, "role", user.Role, "name", user.Name)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	s.allowOrigin(w, r)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(userInfo(user)); err != nil {
+		log.Println(err)
+	}
+}
+
+// setDisabled disables or re-enables the user named by the route, signing
+// them out when disabled
+func (s *Server) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	user, ok := s.adminTarget(w, r, false)
+	if !ok {
+		return
+	}
+	user.Disabled = disabled
+	if err := s.Users.UpdateUser(user); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	if !disabled {
+		auditLog(r, "user.enabled", "User enabled", "userID", user.UserUUID,
+			"username", user.Username, "enabledBy", principal.UserUUID)
+		s.writeStatus(w, r, http.StatusOK, "Account enabled")
+		return
+	}
+	if err := s.signOutUser(user.UserUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	auditLog(r, "user.disabled", "User disabled", "userID", user.UserUUID,
+		"username", user.Username, "disabledBy", principal.UserUUID)
+	s.writeStatus(w, r, http.StatusOK, "Account disabled")
+}
+
+/*
+Disables a user account: its sessions and refresh tokens are revoked and it
+cannot log in until enabled again
+Method: PUT
+Endpoint: /users/useruuid/{useruuid}/disabled
+*/
+func (s *Server) UserDisable(w http.ResponseWriter, r *http.Request) {
+	s.setDisabled(w, r, true)
+}
+
+/*
+Enables a disabled user account again
+Method: DELETE
+Endpoint: /users/useruuid/{useruuid}/disabled
+*/
+func (s *Server) UserEnable(w http.ResponseWriter, r *http.Request) {
+	s.setDisabled(w, r, false)
+}
+
+/*
+Deletes a user account with its credentials, sessions and two-factor
+authentication. The patient or doctor entry of the account and the audit
+history naming its UUID are kept.
+Method: DELETE
+Endpoint: /users/useruuid/{useruuid}
+*/
+func (s *Server) UserDelete(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminTarget(w, r, false)
+	if !ok {
+		return
+	}
+	// credentials go first, so that a failure cannot leave a usable session
+	// of a deleted account
+	if err := s.signOutUser(user.UserUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.TwoFactor.DeleteTwoFactor(user.UserUUID); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.LoginAttempts.DeleteLoginAttempts(accountKey(user.Username)); err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if err := s.Users.DeleteUser(user.Username); err != nil && err != ErrNotFound {
+		s.internalError(w, r, err)
+		return
+	}
+	principal, _ := principalFrom(r.Context())
+	auditLog(r, "user.deleted", "User deleted", "userID", user.UserUUID, "username", user.Username,
+		"role", user.Role, "name", user.Name, "deletedBy", principal.UserUUID)
+	s.writeStatus(w, r, http.StatusOK, "Account deleted")
+}
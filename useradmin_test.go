@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// listUsers returns the users listed to an admin at path
+func listUsers(t *testing.T, s *Server, path string) []User {
+	rec := serveServer(s, testAdmin, httptest.NewRequest("GET", path, nil))
+	var userList []User
+	if rec.Code != http.StatusOK || json.NewDecoder(rec.Body).Decode(&userList) != nil {
+		t.Fatalf("GET %s: got %d, want 200 with users", path, rec.Code)
+	}
+	return userList
+}
+
+func TestUserAdmin(t *testing.T) {
+	s := NewServer(newTestSQLiteStore(t))
+	cookie := login(t, s)
+	if err := s.Users.CreateUser(UserAccount{Username: "root", UserUUID: testAdmin.UserUUID,
+		Role: RoleAdmin, Name: testAdmin.Name}); err != nil {
+		t.Fatal(err)
+	}
+	kelly := "/users/useruuid/" + testUser.UserUUID.String()
+
+	if rec := serveServer(s, testUser, httptest.NewRequest("GET", "/users", nil)); rec.Code != http.StatusForbidden {
+		t.Errorf("list by a doctor: got %d, want 403", rec.Code)
+	}
+	if got := listUsers(t, s, "/users"); len(got) != 2 || got[0].Username != "kelly" || got[1].Username != "root" {
+		t.Errorf("got users %+v, want kelly and root", got)
+	}
+	if got := listUsers(t, s, "/users?q=LAI&role=Patient"); len(got) != 1 || got[0].UserUUID != testUser.UserUUID {
+		t.Errorf("search: got %+v, want kelly", got)
+	}
+	if got := listUsers(t, s, "/users?q=lai&role=Doctor"); len(got) != 0 {
+		t.Errorf("search of another role: got %+v, want none", got)
+	}
+
+	// disabled users are signed out and cannot log in until enabled again
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("PUT", kelly+"/disabled", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("disable: got %d, want 200", rec.Code)
+	}
+	if rec := serveAs(s, cookie, httptest.NewRequest("GET", "/doctors", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("session of a disabled user: got %d, want 401", rec.Code)
+	}
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusForbidden {
+		t.Errorf("login of a disabled user: got %d, want 403", rec.Code)
+	}
+	if got := listUsers(t, s, "/users?q=kelly"); len(got) != 1 || !got[0].Disabled {
+		t.Errorf("got %+v, want kelly disabled", got)
+	}
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("DELETE", kelly+"/disabled", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("enable: got %d, want 200", rec.Code)
+	}
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusOK {
+		t.Errorf("login of an enabled user: got %d, want 200", rec.Code)
+	}
+
+	tests := []struct {
+		path, body string
+		code       int
+	}{
+		{kelly, `{"role": "Owner"}`, http.StatusBadRequest},
+		{kelly, `{"name": "Kelly Lai-Chen"}`, http.StatusOK},
+		{kelly, `{"role": "Doctor"}`, http.StatusOK},
+		{"/users/useruuid/" + testAdmin.UserUUID.String(), `{"role": "Patient"}`, http.StatusConflict},
+		{"/users/useruuid/" + testAdmin.UserUUID.String(), `{"name": "Root"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		rec := serveServer(s, testAdmin, httptest.NewRequest("PATCH", test.path, strings.NewReader(test.body)))
+		if rec.Code != test.code {
+			t.Errorf("PATCH %s %s: got %d, want %d", test.path, test.body, rec.Code, test.code)
+		}
+	}
+	user, err := s.Users.GetUserByUUID(testUser.UserUUID)
+	if err != nil || user.Role != RoleDoctor || user.Name != "Kelly Lai-Chen" {
+		t.Errorf("got user %+v after the update, %v", user, err)
+	}
+	if doctor, err := s.Doctors.GetDoctor(testUser.UserUUID); err != nil || doctor.Name != "Kelly Lai-Chen" {
+		t.Errorf("got doctor entry %+v, %v", doctor, err)
+	}
+
+	// deleted accounts are gone, their records stay
+	self := "/users/useruuid/" + testAdmin.UserUUID.String()
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("DELETE", self, nil)); rec.Code != http.StatusConflict {
+		t.Errorf("delete of the own account: got %d, want 409", rec.Code)
+	}
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("DELETE", kelly, nil)); rec.Code != http.StatusOK {
+		t.Fatalf("delete: got %d, want 200", rec.Code)
+	}
+	if rec := postLogin(s, "kelly", "correct horse"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("login of a deleted user: got %d, want 401", rec.Code)
+	}
+	if rec := serveServer(s, testAdmin, httptest.NewRequest("DELETE", kelly, nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete: got %d, want 404", rec.Code)
+	}
+	if _, err := s.Patients.GetPatient(testUser.UserUUID); err != nil {
+		t.Errorf("patient entry of a deleted user: %v", err)
+	}
+}